@@ -0,0 +1,55 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage cache benchmark tool.
+// Runs the default cache workloads, prints their results as JSON and compares them with a baseline
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/foliagecp/sdk/statefun/cache/cachebench"
+)
+
+func main() {
+	workloadName := flag.String("workload", "", "run a single default workload by name")
+	baselineFile := flag.String("baseline", "", "baseline results JSON to compare with")
+	tolerance := flag.Float64("tolerance", 0.2, "allowed throughput drop relative to the baseline")
+	flag.Parse()
+
+	results := []cachebench.Result{}
+	for _, w := range cachebench.DefaultWorkloads() {
+		if len(*workloadName) > 0 && w.Name != *workloadName {
+			continue
+		}
+		result, err := cachebench.Run(w)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		results = append(results, result)
+	}
+	data, _ := json.MarshalIndent(results, "", "  ")
+	fmt.Println(string(data))
+
+	if len(*baselineFile) > 0 {
+		data, err := os.ReadFile(*baselineFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		baseline := []cachebench.Result{}
+		if err := json.Unmarshal(data, &baseline); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if regressions := cachebench.Regressions(baseline, results, *tolerance); len(regressions) > 0 {
+			for _, r := range regressions {
+				fmt.Fprintln(os.Stderr, "regression:", r)
+			}
+			os.Exit(1)
+		}
+	}
+}
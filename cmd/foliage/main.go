@@ -0,0 +1,14 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage command line tool.
+// Runs JS stateful functions locally: foliage run --typename X --js handler.js --payload file.json --context file.json
+package main
+
+import (
+	sfPluginJS "github.com/foliagecp/sdk/statefun/plugins/js"
+	"github.com/foliagecp/sdk/statefun/sandbox"
+)
+
+func main() {
+	sandbox.Main(nil, sfPluginJS.StatefunExecutorPluginJSContructor)
+}
@@ -5,15 +5,22 @@
 package common
 
 import (
+	"errors"
+
 	"github.com/foliagecp/easyjson"
 
+	sdkErrors "github.com/foliagecp/sdk/errors"
 	lg "github.com/foliagecp/sdk/statefun/logger"
 	"github.com/foliagecp/sdk/statefun/plugins"
 	sfplugins "github.com/foliagecp/sdk/statefun/plugins"
 	sfSystem "github.com/foliagecp/sdk/statefun/system"
 )
 
-const QueryResultTopic = "functions.graph.query"
+const (
+	QueryResultTopic = "functions.graph.query"
+	// Field of a failed reply with the kind of its error (sdk errors package)
+	ErrorKindField = "error_kind"
+)
 
 func GetQueryID(contextProcessor *sfplugins.StatefunContextProcessor) string {
 	var queryID string
@@ -38,3 +45,22 @@ func ReplyQueryID(queryID string, result *easyjson.JSON, contextProcessor *sfplu
 		lg.Logln(lg.WarnLevel, "replyQueryId has no target to reply")
 	}
 }
+
+// SetErrorKind sets the kind of the error to the failed reply if the error is of a kind
+func SetErrorKind(reply *easyjson.JSON, err error) {
+	if kind := sdkErrors.KindName(err); len(kind) > 0 {
+		reply.SetByPath(ErrorKindField, easyjson.NewJSON(kind))
+	}
+}
+
+// ReplyError restores the error of a failed reply with its kind, nil if the reply is not failed
+func ReplyError(reply *easyjson.JSON) error {
+	if reply.GetByPath("status").AsStringDefault("failed") != "failed" {
+		return nil
+	}
+	msg := reply.GetByPath("result").AsStringDefault("unknown error")
+	if kind, ok := reply.GetByPath(ErrorKindField).AsString(); ok {
+		return sdkErrors.FromKindName(kind, msg)
+	}
+	return errors.New(msg)
+}
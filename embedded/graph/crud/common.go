@@ -2,6 +2,8 @@ package crud
 
 import (
 	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfplugins "github.com/foliagecp/sdk/statefun/plugins"
 )
 
 const (
@@ -18,10 +20,17 @@ const (
 	OutLinkLinkNamePrefPattern = "%s.out.name."
 	// key=fmt.Sprintf(OutLinkNameGenKeyPattern, <fromVertexId>), value=counter[int64]
 	OutLinkNameGenKeyPattern = "%s.out.namegen"
-	// key=fmt.Sprintf(InLinkKeyPrefPattern+LinkKeySuff2Pattern, <toVertexId>, <fromVertexId>, <linkType>), value=nil
+	// key=fmt.Sprintf(OutLinkMetaKeyPrefPattern+LinkKeySuff2Pattern, <fromVertexId>, <linkType>, <toVertexId>), value=<linkMeta>
+	OutLinkMetaKeyPrefPattern = "%s.out.meta."
+	// key=fmt.Sprintf(InLinkKeyPrefPattern+LinkKeySuff2Pattern, <toVertexId>, <fromVertexId>, <linkType>), value=<linkMeta>
 	InLinkKeyPrefPattern = "%s.in."
 )
 
+const (
+	// Link keys are writable only through the graph API, see RegisterAllFunctionTypes
+	GraphKeysOwner = "graph"
+)
+
 const (
 	Types   = "types"
 	Objects = "objects"
@@ -37,7 +46,16 @@ var (
 	llAPILinkCUDNames   = []string{"functions.graph.api.link.create", "functions.graph.api.link.update", "functions.graph.api.link.delete"}
 )
 
+// Writes keys reserved by the graph
+func graphCache(contextProcessor *sfplugins.StatefunContextProcessor) *cache.ReservedWriter {
+	return contextProcessor.GlobalCache.Reserved(GraphKeysOwner)
+}
+
 func RegisterAllFunctionTypes(runtime *statefun.Runtime) {
+	runtime.ReserveCacheKeyPattern(GraphKeysOwner, "*.out.>")
+	runtime.ReserveCacheKeyPattern(GraphKeysOwner, "*.in.>")
+	runtime.ReserveCacheKeyPattern(GraphKeysOwner, ObjectIntentKeyPrefix+".>")
+
 	// High-Level API Registration
 	statefun.NewFunctionType(runtime, "functions.cmdb.api.type.create", CreateType, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
 	statefun.NewFunctionType(runtime, "functions.cmdb.api.type.update", UpdateType, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
@@ -55,6 +73,10 @@ func RegisterAllFunctionTypes(runtime *statefun.Runtime) {
 	statefun.NewFunctionType(runtime, "functions.cmdb.api.objects.link.update", UpdateObjectsLink, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
 	statefun.NewFunctionType(runtime, "functions.cmdb.api.objects.link.delete", DeleteObjectsLink, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
 
+	statefun.NewFunctionType(runtime, RollupUpdateFunction, RollupUpdate, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
+	statefun.NewFunctionType(runtime, ScheduleFunction, ScheduleFire, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
+	statefun.NewFunctionType(runtime, IntentRecoverFunction, IntentRecover, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
+
 	// Low-Level API Registration
 	statefun.NewFunctionType(runtime, llAPIVertexCUDNames[0], LLAPIVertexCreate, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
 	statefun.NewFunctionType(runtime, llAPIVertexCUDNames[1], LLAPIVertexUpdate, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
@@ -63,4 +85,7 @@ func RegisterAllFunctionTypes(runtime *statefun.Runtime) {
 	statefun.NewFunctionType(runtime, llAPILinkCUDNames[0], LLAPILinkCreate, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
 	statefun.NewFunctionType(runtime, llAPILinkCUDNames[1], LLAPILinkUpdate, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
 	statefun.NewFunctionType(runtime, llAPILinkCUDNames[2], LLAPILinkDelete, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
+
+	statefun.NewFunctionType(runtime, "functions.graph.api.vertex.read", LLAPIVertexRead, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
+	statefun.NewFunctionType(runtime, "functions.graph.api.link.read", LLAPILinkRead, *statefun.NewFunctionTypeConfig().SetServiceState(true).SetMaxIdHandlers(-1))
 }
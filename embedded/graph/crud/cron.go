@@ -0,0 +1,146 @@
+// Copyright 2023 NJWS Inc.
+
+package crud
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Cron specs of schedules, UTC:
+
+	"<minute> <hour> <day of month> <month> <day of week>" - fields are "*", numbers, ranges "a-b", lists "a,b"
+		and steps "a-b/n", "a/n" (from a to the maximum) or "*" with a step; days of week are 0-6 from Sunday
+		(7 is Sunday too)
+	"@hourly", "@daily", "@weekly", "@monthly", "@yearly"
+	"@every <duration>" - e.g. "@every 90s", counted from the previous fire
+
+As in cron, when both the day of month and the day of week are restricted a day matching either one fires.
+*/
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+type cronSchedule struct {
+	every                                  time.Duration
+	minutes, hours, days, months, weekdays uint64 // Bit sets of allowed values
+	daysRestricted, weekdaysRestricted     bool
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+	if strings.HasPrefix(spec, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil || every < time.Second {
+			return nil, fmt.Errorf("error: invalid cron spec %q: duration must be at least 1s", spec)
+		}
+		return &cronSchedule{every: every}, nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("error: invalid cron spec %q: 5 fields expected", spec)
+	}
+	cs := &cronSchedule{}
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := []*uint64{&cs.minutes, &cs.hours, &cs.days, &cs.months, &cs.weekdays}
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("error: invalid cron spec %q: %s", spec, err)
+		}
+		*sets[i] = set
+	}
+	if cs.weekdays&(1<<7) != 0 {
+		cs.weekdays |= 1
+	}
+	cs.daysRestricted = fields[2] != "*"
+	cs.weekdaysRestricted = fields[4] != "*"
+	return cs, nil
+}
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart = part[:i]
+		}
+		from, to := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%q is out of %d-%d", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (cs *cronSchedule) dayMatches(t time.Time) bool {
+	day := cs.days&(1<<t.Day()) != 0
+	weekday := cs.weekdays&(1<<int(t.Weekday())) != 0
+	if cs.daysRestricted && cs.weekdaysRestricted {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// Returns the first fire time after the time, zero if there is none within 5 years
+func (cs *cronSchedule) next(after time.Time) time.Time {
+	if cs.every > 0 {
+		return after.Add(cs.every)
+	}
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if cs.months&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if cs.hours&(1<<t.Hour()) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if cs.minutes&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
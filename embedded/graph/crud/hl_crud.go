@@ -31,6 +31,12 @@ func CreateType(_ sfplugins.StatefunExecutor, contextProcessor *sfplugins.Statef
 		return
 	}
 
+	if err := beginObjectIntent(contextProcessor, "type.create", []string{selfID}); err != nil {
+		replyError(contextProcessor, err)
+		return
+	}
+	defer endObjectIntent(contextProcessor)
+
 	_, err := contextProcessor.Request(sfplugins.GolangLocalRequest, "functions.graph.api.vertex.create", selfID, payload, nil)
 	if err != nil {
 		replyError(contextProcessor, err)
@@ -107,6 +113,12 @@ func CreateObject(_ sfplugins.StatefunExecutor, contextProcessor *sfplugins.Stat
 		return
 	}
 
+	if err := beginObjectIntent(contextProcessor, "object.create", []string{selfID}); err != nil {
+		replyError(contextProcessor, err)
+		return
+	}
+	defer endObjectIntent(contextProcessor)
+
 	options := easyjson.NewJSONObjectWithKeyValue("return_op_stack", easyjson.NewJSON(true))
 	result, err := contextProcessor.Request(sfplugins.GolangLocalRequest, "functions.graph.api.vertex.create", selfID, payload, &options)
 	if err := checkRequestError(result, err); err != nil {
@@ -183,16 +195,15 @@ func DeleteObject(_ sfplugins.StatefunExecutor, contextProcessor *sfplugins.Stat
 	payload := contextProcessor.Payload
 
 	mode := payload.GetByPath("mode").AsStringDefault("vertex")
+	vertices := []string{selfID}
 	switch mode {
 	case "cascade":
+		// All the descendants are found before deleting, so an interrupted deletion can be completed
 		visited := map[string]struct{}{
 			selfID: {},
 		}
-		queue := []string{selfID}
-
-		for len(queue) > 0 {
-			elem := queue[0]
-			pattern := fmt.Sprintf(OutLinkBodyKeyPrefPattern+LinkKeySuff1Pattern, elem, ">")
+		for i := 0; i < len(vertices); i++ {
+			pattern := fmt.Sprintf(OutLinkBodyKeyPrefPattern+LinkKeySuff1Pattern, vertices[i], ">")
 			children := contextProcessor.GlobalCache.GetKeysByPattern(pattern)
 
 			for _, v := range children {
@@ -208,30 +219,25 @@ func DeleteObject(_ sfplugins.StatefunExecutor, contextProcessor *sfplugins.Stat
 				}
 
 				visited[id] = struct{}{}
-				queue = append(queue, id)
-			}
-
-			queue = queue[1:]
-			if len(queue) == 0 {
-				break
-			}
-
-			empty := easyjson.NewJSONObject()
-			options := easyjson.NewJSONObjectWithKeyValue("return_op_stack", easyjson.NewJSON(true))
-			result, err := contextProcessor.Request(sfplugins.GolangLocalRequest, "functions.graph.api.vertex.delete", elem, &empty, &options)
-			if err := checkRequestError(result, err); err != nil {
-				replyError(contextProcessor, err)
-				return
-			}
-
-			if result.PathExists("op_stack") {
-				executeTriggersFromLLOpStack(contextProcessor, result.GetByPath("op_stack").GetPtr())
+				vertices = append(vertices, id)
 			}
 		}
 	case "vertex":
+	default:
+		replyOk(contextProcessor)
+		return
+	}
+
+	if err := beginObjectIntent(contextProcessor, "object.delete", vertices); err != nil {
+		replyError(contextProcessor, err)
+		return
+	}
+	defer endObjectIntent(contextProcessor)
+
+	for _, elem := range vertices {
 		empty := easyjson.NewJSONObject()
 		options := easyjson.NewJSONObjectWithKeyValue("return_op_stack", easyjson.NewJSON(true))
-		result, err := contextProcessor.Request(sfplugins.GolangLocalRequest, "functions.graph.api.vertex.delete", selfID, &empty, &options)
+		result, err := contextProcessor.Request(sfplugins.GolangLocalRequest, "functions.graph.api.vertex.delete", elem, &empty, &options)
 		if err := checkRequestError(result, err); err != nil {
 			replyError(contextProcessor, err)
 			return
@@ -381,7 +387,8 @@ func DeleteTypesLink(_ sfplugins.StatefunExecutor, contextProcessor *sfplugins.S
 /*
 	{
 		"to": string,
-		"body": json
+		"body": json,
+		"order": number, optional
 	}
 
 create object -> object link
@@ -412,6 +419,9 @@ func CreateObjectsLink(_ sfplugins.StatefunExecutor, contextProcessor *sfplugins
 	objectLink.SetByPath("descendant_uuid", easyjson.NewJSON(objectToID))
 	objectLink.SetByPath("link_type", easyjson.NewJSON(linkType))
 	objectLink.SetByPath("link_body", payload.GetByPath("body"))
+	if payload.PathExists("order") {
+		objectLink.SetByPath("link_order", payload.GetByPath("order"))
+	}
 
 	options := easyjson.NewJSONObjectWithKeyValue("return_op_stack", easyjson.NewJSON(true))
 	result, err := contextProcessor.Request(sfplugins.GolangLocalRequest, "functions.graph.api.link.create", selfID, &objectLink, &options)
@@ -430,7 +440,8 @@ func CreateObjectsLink(_ sfplugins.StatefunExecutor, contextProcessor *sfplugins
 /*
 	{
 		"to": string,
-		"body": json
+		"body": json,
+		"order": number, optional
 	}
 */
 func UpdateObjectsLink(_ sfplugins.StatefunExecutor, contextProcessor *sfplugins.StatefunContextProcessor) {
@@ -452,6 +463,9 @@ func UpdateObjectsLink(_ sfplugins.StatefunExecutor, contextProcessor *sfplugins
 	objectLink.SetByPath("descendant_uuid", easyjson.NewJSON(objectToID))
 	objectLink.SetByPath("link_type", easyjson.NewJSON(linkType))
 	objectLink.SetByPath("link_body", payload.GetByPath("body"))
+	if payload.PathExists("order") {
+		objectLink.SetByPath("link_order", payload.GetByPath("order"))
+	}
 
 	options := easyjson.NewJSONObjectWithKeyValue("return_op_stack", easyjson.NewJSON(true))
 	result, err := contextProcessor.Request(sfplugins.GolangLocalRequest, "functions.graph.api.link.update", selfID, &objectLink, &options)
@@ -522,6 +536,8 @@ func getReferenceLinkTypeBetweenTwoObjects(ctx *sfplugins.StatefunContextProcess
 }
 
 func executeTriggersFromLLOpStack(ctx *sfplugins.StatefunContextProcessor, opStack *easyjson.JSON) {
+	executeRollupsFromLLOpStack(ctx, opStack)
+	executeSchedulesFromLLOpStack(ctx, opStack)
 	if opStack != nil && opStack.IsArray() {
 		for i := 0; i < opStack.ArraySize(); i++ {
 			opData := opStack.ArrayElement(i)
@@ -691,7 +707,12 @@ func replyOk(ctx *sfplugins.StatefunContextProcessor, msg ...string) {
 }
 
 func replyError(ctx *sfplugins.StatefunContextProcessor, err error) {
-	reply(ctx, "failed", err.Error())
+	qid := common.GetQueryID(ctx)
+	reply := easyjson.NewJSONObject()
+	reply.SetByPath("status", easyjson.NewJSON("failed"))
+	reply.SetByPath("result", easyjson.NewJSON(err.Error()))
+	common.SetErrorKind(&reply, err)
+	common.ReplyQueryID(qid, easyjson.NewJSONObjectWithKeyValue("payload", reply).GetPtr(), ctx)
 }
 
 func reply(ctx *sfplugins.StatefunContextProcessor, status string, data any) {
@@ -707,9 +728,5 @@ func checkRequestError(result *easyjson.JSON, err error) error {
 		return err
 	}
 
-	if result.GetByPath("status").AsStringDefault("failed") == "failed" {
-		return errors.New(result.GetByPath("result").AsStringDefault("unknown error"))
-	}
-
-	return nil
+	return common.ReplyError(result)
 }
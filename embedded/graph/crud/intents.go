@@ -0,0 +1,111 @@
+// Copyright 2023 NJWS Inc.
+
+package crud
+
+import (
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/foliagecp/sdk/statefun"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfplugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Object intents keep multi-step object mutations (type and object creation, object deletion) from leaving related
+vertices half-modified when a runtime dies in the middle. Before its first step a mutation locks the object
+(StatefunContextProcessor.ObjectMutexLock) and durably writes a write-ahead intent record:
+
+	__graph_intents.<object id hash> = {"op": string, "id": string, "vertices": [string, ...], "started_at": <ns>}
+
+where vertices are the ones to be deleted if the mutation is interrupted: the new vertex of a creation (rolled back)
+or all the vertices of a deletion (completed). The record is removed right before the lock is released.
+A runtime dying in between leaves both the record and the lock, the lock expires after KVMutexLifetimeSec and the
+record is recovered by whoever locks the object next: the next mutation of the object or IntentRecoverFunction,
+signalled by a timer the mutation arms for the time its lock expires, so an untouched object is recovered too.
+*/
+
+const (
+	ObjectIntentKeyPrefix = "__graph_intents"
+	IntentRecoverFunction = "functions.cmdb.intent.recover"
+
+	intentRecoveryTimerID = "intent"
+)
+
+func objectIntentKey(objectID string) string {
+	return ObjectIntentKeyPrefix + "." + system.GetHashStr(objectID)
+}
+
+// Locks the object, recovers an intent left by a dead runtime and records the new one
+func beginObjectIntent(ctx *sfplugins.StatefunContextProcessor, op string, vertices []string) error {
+	if err := ctx.ObjectMutexLock(false); err != nil {
+		return err
+	}
+	recoverObjectIntent(ctx)
+
+	record := easyjson.NewJSONObjectWithKeyValue("op", easyjson.NewJSON(op))
+	record.SetByPath("id", easyjson.NewJSON(ctx.Self.ID))
+	record.SetByPath("vertices", easyjson.JSONFromArray(vertices))
+	record.SetByPath("started_at", easyjson.NewJSON(system.GetCurrentTimeNs()))
+	if err := graphCache(ctx).SetValueDurable(objectIntentKey(ctx.Self.ID), record.ToBytes()); err != nil {
+		system.MsgOnErrorReturn(ctx.ObjectMutexUnlock())
+		return err
+	}
+
+	empty := easyjson.NewJSONObject()
+	system.MsgOnErrorReturn(ctx.ScheduleSignalAfter(intentRecoveryTimerID, 2*statefun.KVMutexLifetimeSec*time.Second, sfplugins.JetstreamGlobalSignal, IntentRecoverFunction, ctx.Self.ID, &empty, nil))
+	return nil
+}
+
+// Removes the intent of the finished mutation, releases the object
+func endObjectIntent(ctx *sfplugins.StatefunContextProcessor) {
+	ctx.CancelTimer(intentRecoveryTimerID)
+	graphCache(ctx).DeleteValue(objectIntentKey(ctx.Self.ID), true, -1, "")
+	system.MsgOnErrorReturn(ctx.ObjectMutexUnlock())
+}
+
+// Deletes the vertices of the intent left on the locked object, if any
+func recoverObjectIntent(ctx *sfplugins.StatefunContextProcessor) {
+	key := objectIntentKey(ctx.Self.ID)
+	record, err := ctx.GlobalCache.GetValueAsJSON(key)
+	if err != nil {
+		return
+	}
+	vertices, _ := record.GetByPath("vertices").AsArrayString()
+	lg.Log(lg.WarnLevel, "Recovering interrupted object mutation", "op", record.GetByPath("op").AsStringDefault(""), "id", ctx.Self.ID, "vertices", len(vertices))
+	for _, vertexID := range vertices {
+		if _, err := ctx.GlobalCache.GetValue(vertexID); err != nil {
+			continue // Already deleted or never created
+		}
+		empty := easyjson.NewJSONObject()
+		result, err := ctx.Request(sfplugins.GolangLocalRequest, "functions.graph.api.vertex.delete", vertexID, &empty, nil)
+		if err := checkRequestError(result, err); err != nil {
+			lg.Log(lg.ErrorLevel, "Cannot delete vertex of interrupted object mutation", "id", ctx.Self.ID, "vertex", vertexID, "error", err)
+			return // Intent is kept to be recovered again
+		}
+	}
+	graphCache(ctx).DeleteValue(key, true, -1, "")
+}
+
+/*
+Recovers an intent of an interrupted mutation of the object with an id the function being called with, signalled by
+the timer of the mutation. Waits for the object's lock, so the intent of a mutation still running is not touched.
+
+Request:
+
+	payload: json - optional, ignored
+*/
+func IntentRecover(_ sfplugins.StatefunExecutor, contextProcessor *sfplugins.StatefunContextProcessor) {
+	if _, err := contextProcessor.GlobalCache.GetValue(objectIntentKey(contextProcessor.Self.ID)); err != nil {
+		replyOk(contextProcessor)
+		return
+	}
+	if err := contextProcessor.ObjectMutexLock(false); err != nil {
+		replyError(contextProcessor, err)
+		return
+	}
+	recoverObjectIntent(contextProcessor)
+	system.MsgOnErrorReturn(contextProcessor.ObjectMutexUnlock())
+	replyOk(contextProcessor)
+}
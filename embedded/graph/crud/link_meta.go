@@ -0,0 +1,109 @@
+// Copyright 2023 NJWS Inc.
+
+package crud
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfplugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+// LinkMeta is link's provenance and position among the out links of its vertex, stored separately from link's body
+type LinkMeta struct {
+	FromID          string
+	LinkType        string
+	ToID            string
+	CreatedAt       int64 // ns
+	UpdatedAt       int64 // ns
+	CreatorTypename string
+	CreatorID       string
+	Order           float64
+	Ordered         bool // Order was explicitly set
+}
+
+func newLinkMetaJSON(contextProcessor *sfplugins.StatefunContextProcessor, payload *easyjson.JSON) *easyjson.JSON {
+	now := system.GetCurrentTimeNs()
+	meta := easyjson.NewJSONObject()
+	meta.SetByPath("created_at", easyjson.NewJSON(now))
+	meta.SetByPath("updated_at", easyjson.NewJSON(now))
+	meta.SetByPath("creator_typename", easyjson.NewJSON(contextProcessor.Caller.Typename))
+	meta.SetByPath("creator_id", easyjson.NewJSON(contextProcessor.Caller.ID))
+	if order, ok := payload.GetByPath("link_order").AsNumeric(); ok {
+		meta.SetByPath("order", easyjson.NewJSON(order))
+	}
+	return &meta
+}
+
+// Applies "link_order" from payload to the stored meta, returns true if meta was changed
+func updateLinkMetaOrder(cacheStore *cache.Store, fromID string, linkType string, toID string, payload *easyjson.JSON) bool {
+	order, ok := payload.GetByPath("link_order").AsNumeric()
+	if !ok {
+		return false
+	}
+	key := fmt.Sprintf(OutLinkMetaKeyPrefPattern+LinkKeySuff2Pattern, fromID, linkType, toID)
+	meta, err := cacheStore.GetValueAsJSON(key)
+	if err != nil {
+		meta = easyjson.NewJSONObject().GetPtr()
+	}
+	meta.SetByPath("order", easyjson.NewJSON(order))
+	meta.SetByPath("updated_at", easyjson.NewJSON(system.GetCurrentTimeNs()))
+	cacheStore.Reserved(GraphKeysOwner).SetValue(key, meta.ToBytes(), true, -1, "")
+	return true
+}
+
+func linkMetaFromJSON(fromID string, linkType string, toID string, meta *easyjson.JSON) LinkMeta {
+	lm := LinkMeta{FromID: fromID, LinkType: linkType, ToID: toID}
+	if meta == nil {
+		return lm
+	}
+	lm.CreatedAt = int64(meta.GetByPath("created_at").AsNumericDefault(0))
+	lm.UpdatedAt = int64(meta.GetByPath("updated_at").AsNumericDefault(0))
+	lm.CreatorTypename = meta.GetByPath("creator_typename").AsStringDefault("")
+	lm.CreatorID = meta.GetByPath("creator_id").AsStringDefault("")
+	lm.Order, lm.Ordered = meta.GetByPath("order").AsNumeric()
+	return lm
+}
+
+// GetLinkMeta returns meta of the out link, links created before meta was introduced have zero values
+func GetLinkMeta(cacheStore *cache.Store, fromID string, linkType string, toID string) LinkMeta {
+	meta, _ := cacheStore.GetValueAsJSON(fmt.Sprintf(OutLinkMetaKeyPrefPattern+LinkKeySuff2Pattern, fromID, linkType, toID))
+	return linkMetaFromJSON(fromID, linkType, toID, meta)
+}
+
+// GetOrderedOutLinks returns out links of the vertex ("*" or empty linkType - of all types) in a stable order:
+// explicitly ordered links first by ascending order, then the rest by creation time
+func GetOrderedOutLinks(cacheStore *cache.Store, fromID string, linkType string) []LinkMeta {
+	pattern := fmt.Sprintf(OutLinkBodyKeyPrefPattern+LinkKeySuff1Pattern, fromID, ">")
+	if len(linkType) > 0 && linkType != "*" {
+		pattern = fmt.Sprintf(OutLinkBodyKeyPrefPattern+LinkKeySuff2Pattern, fromID, linkType, ">")
+	}
+
+	links := []LinkMeta{}
+	for _, key := range cacheStore.GetKeysByPattern(pattern) {
+		tokens := strings.Split(key, ".")
+		if len(tokens) < 2 {
+			continue
+		}
+		links = append(links, GetLinkMeta(cacheStore, fromID, tokens[len(tokens)-2], tokens[len(tokens)-1]))
+	}
+
+	sort.SliceStable(links, func(i, j int) bool {
+		a, b := links[i], links[j]
+		if a.Ordered != b.Ordered {
+			return a.Ordered
+		}
+		if a.Ordered && a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		if a.CreatedAt != b.CreatedAt {
+			return a.CreatedAt < b.CreatedAt
+		}
+		return a.LinkType+"."+a.ToID < b.LinkType+"."+b.ToID
+	})
+	return links
+}
@@ -130,7 +130,7 @@ func LLAPIVertexCreate(executor sfplugins.StatefunExecutor, contextProcessor *sf
 		// --------------------------------------------------------------------
 	}
 
-	contextProcessor.GlobalCache.SetValue(contextProcessor.Self.ID, objectBody.ToBytes(), true, -1, "")
+	graphCache(contextProcessor).SetValue(contextProcessor.Self.ID, objectBody.ToBytes(), true, -1, "")
 	addVertexOpToOpStack(opStack, contextProcessor.Self.Typename, contextProcessor.Self.ID, nil, &objectBody)
 
 	result.SetByPath("status", easyjson.NewJSON("ok"))
@@ -276,14 +276,14 @@ func LLAPIVertexDelete(executor sfplugins.StatefunExecutor, contextProcessor *sf
 	// ----------------------------------------------------
 
 	// Delete link name generator -------------------------
-	contextProcessor.GlobalCache.DeleteValue(fmt.Sprintf(OutLinkNameGenKeyPattern, contextProcessor.Self.ID), true, -1, "")
+	graphCache(contextProcessor).DeleteValue(fmt.Sprintf(OutLinkNameGenKeyPattern, contextProcessor.Self.ID), true, -1, "")
 	// ----------------------------------------------------
 
 	var oldBody *easyjson.JSON = nil
 	if opStack != nil {
 		oldBody = contextProcessor.GetObjectContext()
 	}
-	contextProcessor.GlobalCache.DeleteValue(contextProcessor.Self.ID, true, -1, "") // Delete object's body
+	graphCache(contextProcessor).DeleteValue(contextProcessor.Self.ID, true, -1, "") // Delete object's body
 	addVertexOpToOpStack(opStack, contextProcessor.Self.Typename, contextProcessor.Self.ID, oldBody, nil)
 
 	result.SetByPath("status", easyjson.NewJSON("ok"))
@@ -311,10 +311,12 @@ Request:
 			name: string - optional // Defines link's name which is unique among all object's output links. Will be generated automatically if not defined or if same named out link already exists.
 			tags: []string - optional // Defines link tags.
 			<key>: <type> - optional // Any additional key and value to be stored in link's body.
+		link_order: number - optional // Position among object's output links, see GetOrderedOutLinks. Link meta also stores creation time and creator typename.
 
 		// Self-requests to descendants (GolangCallSync): // ID can be composite: <object_id>===create_in_link - for non-blocking execution on the same object
 			query_id: string - required // ID for this query.
 			in_link_type: string - required // Type of input link to create
+			link_meta: json - optional // Meta of the link to be stored with the input link
 
 	options: json - optional
 		return_op_stack: bool - optional
@@ -341,7 +343,11 @@ func LLAPILinkCreate(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 		// TODO: This vertex might not exist at all, what to do about that?
 		if inLinkType, ok := payload.GetByPath("in_link_type").AsString(); ok && len(inLinkType) > 0 {
 			if linkFromObjectUUID := contextProcessor.Caller.ID; len(linkFromObjectUUID) > 0 {
-				contextProcessor.GlobalCache.SetValue(fmt.Sprintf(InLinkKeyPrefPattern+LinkKeySuff2Pattern, selfID, linkFromObjectUUID, inLinkType), nil, true, -1, "")
+				var linkMeta []byte = nil
+				if payload.GetByPath("link_meta").IsObject() {
+					linkMeta = payload.GetByPath("link_meta").ToBytes()
+				}
+				graphCache(contextProcessor).SetValue(fmt.Sprintf(InLinkKeyPrefPattern+LinkKeySuff2Pattern, selfID, linkFromObjectUUID, inLinkType), linkMeta, true, -1, "")
 				result.SetByPath("status", easyjson.NewJSON("ok"))
 			}
 		} else {
@@ -406,24 +412,28 @@ func LLAPILinkCreate(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 				}
 				linkName = fmt.Sprintf("name%d", namegen)
 				namegen++
-				contextProcessor.GlobalCache.SetValue(fmt.Sprintf(OutLinkNameGenKeyPattern, contextProcessor.Self.ID), system.Int64ToBytes(namegen), true, -1, "")
+				graphCache(contextProcessor).SetValue(fmt.Sprintf(OutLinkNameGenKeyPattern, contextProcessor.Self.ID), system.Int64ToBytes(namegen), true, -1, "")
 				linkBody.SetByPath("name", easyjson.NewJSON(linkName))
 			}
 			// ----------------------------------
 			// Create link name -----------------
-			contextProcessor.GlobalCache.SetValue(fmt.Sprintf(OutLinkLinkNamePrefPattern+LinkKeySuff1Pattern, contextProcessor.Self.ID, linkName), nil, true, -1, "")
+			graphCache(contextProcessor).SetValue(fmt.Sprintf(OutLinkLinkNamePrefPattern+LinkKeySuff1Pattern, contextProcessor.Self.ID, linkName), nil, true, -1, "")
 			// ----------------------------------
 			// Index link name ------------------
-			contextProcessor.GlobalCache.SetValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "name", linkName), nil, true, -1, "")
+			graphCache(contextProcessor).SetValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "name", linkName), nil, true, -1, "")
 			// ----------------------------------
 			// Set link body --------------------
-			contextProcessor.GlobalCache.SetValue(fmt.Sprintf(OutLinkBodyKeyPrefPattern+LinkKeySuff2Pattern, contextProcessor.Self.ID, linkType, descendantUUID), linkBody.ToBytes(), true, -1, "") // Store link body in KV
+			graphCache(contextProcessor).SetValue(fmt.Sprintf(OutLinkBodyKeyPrefPattern+LinkKeySuff2Pattern, contextProcessor.Self.ID, linkType, descendantUUID), linkBody.ToBytes(), true, -1, "") // Store link body in KV
+			// ----------------------------------
+			// Set link meta --------------------
+			linkMeta := newLinkMetaJSON(contextProcessor, payload)
+			graphCache(contextProcessor).SetValue(fmt.Sprintf(OutLinkMetaKeyPrefPattern+LinkKeySuff2Pattern, contextProcessor.Self.ID, linkType, descendantUUID), linkMeta.ToBytes(), true, -1, "")
 			// ----------------------------------
 			// Store tags -----------------------
 			if linkBody.GetByPath("tags").IsNonEmptyArray() {
 				if linkTags, ok := linkBody.GetByPath("tags").AsArrayString(); ok {
 					for _, linkTag := range linkTags {
-						contextProcessor.GlobalCache.SetValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "tag", linkTag), nil, true, -1, "")
+						graphCache(contextProcessor).SetValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "tag", linkTag), nil, true, -1, "")
 					}
 				}
 			}
@@ -434,6 +444,7 @@ func LLAPILinkCreate(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 			nextCallPayload := easyjson.NewJSONObject()
 			nextCallPayload.SetByPath("query_id", easyjson.NewJSON(queryID))
 			nextCallPayload.SetByPath("in_link_type", easyjson.NewJSON(linkType))
+			nextCallPayload.SetByPath("link_meta", *linkMeta)
 			if descendantUUID == contextProcessor.Self.ID {
 				system.MsgOnErrorReturn(contextProcessor.Request(sfplugins.GolangLocalRequest, contextProcessor.Self.Typename, descendantUUID+"===create_in_link", &nextCallPayload, nil))
 			} else {
@@ -471,6 +482,7 @@ Request:
 			tags: []string - optional // Defines link tags.
 			<key>: <type> - optional // Any additional key and value to be stored in link's body.
 		mode: string - optional // "merge" (default) - deep merge old and new bodies, "replace" - replace old body with the new one, <other> is interpreted as "merge" without any notification
+		link_order: number - optional // Moves the link to a new position among object's output links
 
 	options: json - optional
 		return_op_stack: bool - optional
@@ -516,15 +528,15 @@ func LLAPILinkUpdate(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 			// Delete old indices -----------------------------------------
 			// Link name ------------------------
 			if linkName, ok := fixedOldLinkBody.GetByPath("name").AsString(); ok {
-				contextProcessor.GlobalCache.DeleteValue(fmt.Sprintf(OutLinkLinkNamePrefPattern+LinkKeySuff1Pattern, contextProcessor.Self.ID, linkName), true, -1, "")
-				contextProcessor.GlobalCache.DeleteValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "name", linkName), true, -1, "")
+				graphCache(contextProcessor).DeleteValue(fmt.Sprintf(OutLinkLinkNamePrefPattern+LinkKeySuff1Pattern, contextProcessor.Self.ID, linkName), true, -1, "")
+				graphCache(contextProcessor).DeleteValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "name", linkName), true, -1, "")
 			}
 			// ----------------------------------
 			// Link tags ------------------------
 			if fixedOldLinkBody.GetByPath("tags").IsNonEmptyArray() {
 				if linkTags, ok := fixedOldLinkBody.GetByPath("tags").AsArrayString(); ok {
 					for _, linkTag := range linkTags {
-						contextProcessor.GlobalCache.DeleteValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "tag", linkTag), true, -1, "")
+						graphCache(contextProcessor).DeleteValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "tag", linkTag), true, -1, "")
 					}
 				}
 			}
@@ -561,28 +573,31 @@ func LLAPILinkUpdate(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 				}
 				linkName = fmt.Sprintf("name%d", namegen)
 				namegen++
-				contextProcessor.GlobalCache.SetValue(fmt.Sprintf(OutLinkNameGenKeyPattern, contextProcessor.Self.ID), system.Int64ToBytes(namegen), true, -1, "")
+				graphCache(contextProcessor).SetValue(fmt.Sprintf(OutLinkNameGenKeyPattern, contextProcessor.Self.ID), system.Int64ToBytes(namegen), true, -1, "")
 				newBody.SetByPath("name", easyjson.NewJSON(linkName))
 			}
 			// ------------------------------------------------------------
 			// Create link name -------------------------------------------
-			contextProcessor.GlobalCache.SetValue(fmt.Sprintf(OutLinkLinkNamePrefPattern+LinkKeySuff1Pattern, contextProcessor.Self.ID, linkName), nil, true, -1, "")
+			graphCache(contextProcessor).SetValue(fmt.Sprintf(OutLinkLinkNamePrefPattern+LinkKeySuff1Pattern, contextProcessor.Self.ID, linkName), nil, true, -1, "")
 			// ------------------------------------------------------------
 			// Index link name --------------------------------------------
-			contextProcessor.GlobalCache.SetValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "name", linkName), nil, true, -1, "")
+			graphCache(contextProcessor).SetValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "name", linkName), nil, true, -1, "")
 			// ------------------------------------------------------------
 			// Update link body -------------------------------------------
-			contextProcessor.GlobalCache.SetValue(fmt.Sprintf(OutLinkBodyKeyPrefPattern+LinkKeySuff2Pattern, contextProcessor.Self.ID, linkType, descendantUUID), newBody.ToBytes(), true, -1, "") // Store link body in KV
+			graphCache(contextProcessor).SetValue(fmt.Sprintf(OutLinkBodyKeyPrefPattern+LinkKeySuff2Pattern, contextProcessor.Self.ID, linkType, descendantUUID), newBody.ToBytes(), true, -1, "") // Store link body in KV
 			// ------------------------------------------------------------
 			// Create new indices -----------------------------------------
 			if newBody.GetByPath("tags").IsNonEmptyArray() {
 				if linkTags, ok := newBody.GetByPath("tags").AsArrayString(); ok {
 					for _, linkTag := range linkTags {
-						contextProcessor.GlobalCache.SetValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "tag", linkTag), nil, true, -1, "")
+						graphCache(contextProcessor).SetValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "tag", linkTag), nil, true, -1, "")
 					}
 				}
 			}
 			// ------------------------------------------------------------
+			// Reorder link -----------------------------------------------
+			updateLinkMetaOrder(contextProcessor.GlobalCache, contextProcessor.Self.ID, linkType, descendantUUID, payload)
+			// ------------------------------------------------------------
 			addLinkOpToOpStack(opStack, contextProcessor.Self.Typename, contextProcessor.Self.ID, descendantUUID, linkType, fixedOldLinkBody, newBody)
 		} else {
 			// Create link if does not exist
@@ -591,6 +606,9 @@ func LLAPILinkUpdate(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 			createLinkPayload.SetByPath("descendant_uuid", easyjson.NewJSON(descendantUUID))
 			createLinkPayload.SetByPath("link_type", easyjson.NewJSON(linkType))
 			createLinkPayload.SetByPath("link_body", linkBody)
+			if payload.PathExists("link_order") {
+				createLinkPayload.SetByPath("link_order", payload.GetByPath("link_order"))
+			}
 			res, err := contextProcessor.Request(sfplugins.GolangLocalRequest, "functions.graph.api.link.create", contextProcessor.Self.ID, &createLinkPayload, contextProcessor.Options)
 			system.MsgOnErrorReturn(err)
 			if res != nil {
@@ -650,7 +668,7 @@ func LLAPILinkDelete(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 		selfID := strings.Split(contextProcessor.Self.ID, "===")[0]
 		if inLinkType, ok := payload.GetByPath("in_link_type").AsString(); ok && len(inLinkType) > 0 {
 			if linkFromObjectUUID := contextProcessor.Caller.ID; len(linkFromObjectUUID) > 0 {
-				contextProcessor.GlobalCache.DeleteValue(fmt.Sprintf(InLinkKeyPrefPattern+LinkKeySuff2Pattern, selfID, linkFromObjectUUID, inLinkType), true, -1, "")
+				graphCache(contextProcessor).DeleteValue(fmt.Sprintf(InLinkKeyPrefPattern+LinkKeySuff2Pattern, selfID, linkFromObjectUUID, inLinkType), true, -1, "")
 				result.SetByPath("status", easyjson.NewJSON("ok"))
 			}
 		} else {
@@ -682,20 +700,21 @@ func LLAPILinkDelete(executor sfplugins.StatefunExecutor, contextProcessor *sfpl
 			} else {
 				lbk := fmt.Sprintf(OutLinkBodyKeyPrefPattern+LinkKeySuff2Pattern, contextProcessor.Self.ID, linkType, descendantUUID)
 				linkBody, _ := contextProcessor.GlobalCache.GetValueAsJSON(lbk)
-				contextProcessor.GlobalCache.DeleteValue(lbk, true, -1, "")
+				graphCache(contextProcessor).DeleteValue(lbk, true, -1, "")
+				graphCache(contextProcessor).DeleteValue(fmt.Sprintf(OutLinkMetaKeyPrefPattern+LinkKeySuff2Pattern, contextProcessor.Self.ID, linkType, descendantUUID), true, -1, "")
 
 				if linkBody != nil {
 					// Delete link name -------------------
 					if linkName, ok := linkBody.GetByPath("name").AsString(); ok {
-						contextProcessor.GlobalCache.DeleteValue(fmt.Sprintf(OutLinkLinkNamePrefPattern+LinkKeySuff1Pattern, contextProcessor.Self.ID, linkName), true, -1, "")
-						contextProcessor.GlobalCache.DeleteValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "name", linkName), true, -1, "")
+						graphCache(contextProcessor).DeleteValue(fmt.Sprintf(OutLinkLinkNamePrefPattern+LinkKeySuff1Pattern, contextProcessor.Self.ID, linkName), true, -1, "")
+						graphCache(contextProcessor).DeleteValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "name", linkName), true, -1, "")
 					}
 					// -----------------------------------
 					// Delete tags -----------------------
 					if linkBody.GetByPath("tags").IsNonEmptyArray() {
 						if linkTags, ok := linkBody.GetByPath("tags").AsArrayString(); ok {
 							for _, linkTag := range linkTags {
-								contextProcessor.GlobalCache.DeleteValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "tag", linkTag), true, -1, "")
+								graphCache(contextProcessor).DeleteValue(fmt.Sprintf(OutLinkIndexPrefPattern+LinkKeySuff4Pattern, contextProcessor.Self.ID, linkType, descendantUUID, "tag", linkTag), true, -1, "")
 							}
 						}
 					}
@@ -0,0 +1,131 @@
+// Copyright 2023 NJWS Inc.
+
+package crud
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/embedded/graph/common"
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfplugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func replyReadResult(queryID string, contextProcessor *sfplugins.StatefunContextProcessor, data *easyjson.JSON, err error) {
+	result := easyjson.NewJSONObject().GetPtr()
+	if err != nil {
+		result.SetByPath("status", easyjson.NewJSON("failed"))
+		result.SetByPath("result", easyjson.NewJSON(err.Error()))
+		common.SetErrorKind(result, err)
+	} else {
+		result.SetByPath("status", easyjson.NewJSON("ok"))
+		result.SetByPath("result", *data)
+	}
+	common.ReplyQueryID(queryID, result, contextProcessor)
+}
+
+/*
+Reads an object of the graph with an id the function being called with.
+If caller is not empty returns result to the caller else returns result to the nats topic.
+
+Request:
+
+	payload: json - optional
+		// Initial request from caller:
+		query_id: string - optional // ID for this query.
+		consistency: string - optional // "cached" (default) - fast, may be stale; "kv-verified" - cached value is checked against KV; "linearizable" - read through KV with fencing
+		links: bool - optional // Also read the object's out links, the links' set comes from the cache, their bodies are read with the consistency level
+
+Reply:
+
+	payload: json
+		status: string
+		result: json
+			body: json
+			links: json array - optional
+				[{"type": string, "to": string, "body": json}, ...]
+*/
+func LLAPIVertexRead(executor sfplugins.StatefunExecutor, contextProcessor *sfplugins.StatefunContextProcessor) {
+	payload := contextProcessor.Payload
+	queryID := common.GetQueryID(contextProcessor)
+	selfID := contextProcessor.Self.ID
+
+	level, err := cache.ParseReadConsistency(payload.GetByPath("consistency").AsStringDefault(""))
+	if err != nil {
+		replyReadResult(queryID, contextProcessor, nil, err)
+		return
+	}
+	body, err := contextProcessor.GlobalCache.GetValueAsJSONConsistent(selfID, level)
+	if err != nil {
+		replyReadResult(queryID, contextProcessor, nil, err)
+		return
+	}
+	data := easyjson.NewJSONObjectWithKeyValue("body", *body)
+
+	if payload.GetByPath("links").AsBoolDefault(false) {
+		links := easyjson.NewJSONArray()
+		prefix := fmt.Sprintf(OutLinkBodyKeyPrefPattern, selfID)
+		for _, key := range contextProcessor.GlobalCache.GetKeysByPattern(prefix + ">") {
+			split := strings.Split(strings.TrimPrefix(key, prefix), ".")
+			if len(split) != 2 {
+				continue
+			}
+			linkBody, err := contextProcessor.GlobalCache.GetValueAsJSONConsistent(key, level)
+			if err != nil {
+				continue // Deleted meanwhile or found deleted in KV
+			}
+			link := easyjson.NewJSONObjectWithKeyValue("type", easyjson.NewJSON(split[0]))
+			link.SetByPath("to", easyjson.NewJSON(split[1]))
+			link.SetByPath("body", *linkBody)
+			links.AddToArray(link)
+		}
+		data.SetByPath("links", links)
+	}
+
+	replyReadResult(queryID, contextProcessor, &data, nil)
+}
+
+/*
+Reads a link of the graph going from an object with an id the function being called with.
+If caller is not empty returns result to the caller else returns result to the nats topic.
+
+Request:
+
+	payload: json - required
+		// Initial request from caller:
+		query_id: string - optional // ID for this query.
+		link_type: string - required
+		descendant_uuid: string - required
+		consistency: string - optional // See functions.graph.api.vertex.read
+
+Reply:
+
+	payload: json
+		status: string
+		result: json - link's body
+*/
+func LLAPILinkRead(executor sfplugins.StatefunExecutor, contextProcessor *sfplugins.StatefunContextProcessor) {
+	payload := contextProcessor.Payload
+	queryID := common.GetQueryID(contextProcessor)
+
+	linkType, ok := payload.GetByPath("link_type").AsString()
+	if !ok {
+		replyReadResult(queryID, contextProcessor, nil, fmt.Errorf("ERROR LLAPILinkRead %s: link_type:string is missing", contextProcessor.Self.ID))
+		return
+	}
+	descendantUUID, ok := payload.GetByPath("descendant_uuid").AsString()
+	if !ok {
+		replyReadResult(queryID, contextProcessor, nil, fmt.Errorf("ERROR LLAPILinkRead %s: descendant_uuid:string is missing", contextProcessor.Self.ID))
+		return
+	}
+	level, err := cache.ParseReadConsistency(payload.GetByPath("consistency").AsStringDefault(""))
+	if err != nil {
+		replyReadResult(queryID, contextProcessor, nil, err)
+		return
+	}
+
+	body, err := contextProcessor.GlobalCache.GetValueAsJSONConsistent(fmt.Sprintf(OutLinkBodyKeyPrefPattern+LinkKeySuff2Pattern, contextProcessor.Self.ID, linkType, descendantUUID), level)
+	replyReadResult(queryID, contextProcessor, body, err)
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 NJWS Inc.
+
+package crud
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/foliagecp/easyjson"
+	sfplugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Rollups keep aggregates of object's children in object's body. They are declared in the body of object's type:
+
+	"rollups": {
+		"<name>": {
+			"child_type": string,      // Children are objects of the type linked from the object
+			"link_type": string,       // optional, links of any type if absent
+			"sum": [<body path>, ...]  // optional, numeric fields of children's bodies to sum up
+		}
+	}
+
+and kept in object's body as
+
+	"rollups": {
+		"<name>": {"count": <number of children>, "sum": {<body path>: <sum>, ...}}
+	}
+
+Changes of vertices and links made through the cmdb API signal RollupUpdateFunction for every object with rollups
+the changed vertex or link goes from, it recomputes the rollups and updates the object through the cmdb API as well.
+So a rollup over another rollup ("sum": ["rollups.<name>.sum.<body path>"]) aggregates the whole subtree.
+*/
+
+const (
+	RollupUpdateFunction = "functions.cmdb.rollup.update"
+)
+
+// Signals rollup updates of objects the vertices and links changed by the operations go from
+func executeRollupsFromLLOpStack(ctx *sfplugins.StatefunContextProcessor, opStack *easyjson.JSON) {
+	if opStack == nil || !opStack.IsArray() {
+		return
+	}
+	parents := map[string]struct{}{}
+	for i := 0; i < opStack.ArraySize(); i++ {
+		opData := opStack.ArrayElement(i)
+		if fromVId := opData.GetByPath("from_id").AsStringDefault(""); len(fromVId) > 0 {
+			parents[fromVId] = struct{}{}
+			continue
+		}
+		vId := opData.GetByPath("id").AsStringDefault("")
+		if len(vId) == 0 {
+			continue
+		}
+		for _, key := range ctx.GlobalCache.GetKeysByPattern(fmt.Sprintf(InLinkKeyPrefPattern+LinkKeySuff1Pattern, vId, ">")) {
+			tokens := strings.Split(key, ".")
+			if len(tokens) >= 2 {
+				parents[tokens[len(tokens)-2]] = struct{}{}
+			}
+		}
+	}
+
+	for parentID := range parents {
+		if rollups := getObjectTypeRollups(ctx, parentID); rollups.IsNonEmptyObject() {
+			empty := easyjson.NewJSONObject()
+			system.MsgOnErrorReturn(ctx.Signal(sfplugins.JetstreamGlobalSignal, RollupUpdateFunction, parentID, &empty, nil))
+		}
+	}
+}
+
+func getObjectTypeRollups(ctx *sfplugins.StatefunContextProcessor, objectID string) easyjson.JSON {
+	typeName := findObjectType(ctx, objectID)
+	if len(typeName) == 0 {
+		return easyjson.NewJSONObject()
+	}
+	typeBody, err := ctx.GlobalCache.GetValueAsJSON(typeName)
+	if err != nil || !typeBody.GetByPath("rollups").IsObject() {
+		return easyjson.NewJSONObject()
+	}
+	return typeBody.GetByPath("rollups")
+}
+
+/*
+Recomputes rollups of the object with an id the function being called with, updates the changed ones.
+
+Request:
+
+	payload: json - optional, ignored
+*/
+func RollupUpdate(_ sfplugins.StatefunExecutor, contextProcessor *sfplugins.StatefunContextProcessor) {
+	selfID := contextProcessor.Self.ID
+	body, err := contextProcessor.GlobalCache.GetValueAsJSON(selfID)
+	if err != nil { // Object was deleted
+		replyOk(contextProcessor)
+		return
+	}
+
+	rollups := getObjectTypeRollups(contextProcessor, selfID)
+	changed := easyjson.NewJSONObject()
+	for _, name := range rollups.ObjectKeys() {
+		rollup := computeRollup(contextProcessor, selfID, rollups.GetByPath(name))
+		if body.GetByPath("rollups."+name).ToString() != rollup.ToString() {
+			changed.SetByPath(name, rollup)
+		}
+	}
+	if len(changed.ObjectKeys()) == 0 {
+		replyOk(contextProcessor)
+		return
+	}
+
+	update := easyjson.NewJSONObjectWithKeyValue("body", easyjson.NewJSONObjectWithKeyValue("rollups", changed))
+	update.SetByPath("mode", easyjson.NewJSON("merge"))
+	result, err := contextProcessor.Request(sfplugins.GolangLocalRequest, "functions.cmdb.api.object.update", selfID, &update, nil)
+	if err == nil {
+		result = result.GetByPath("payload").GetPtr()
+	}
+	if err := checkRequestError(result, err); err != nil {
+		replyError(contextProcessor, err)
+		return
+	}
+	replyOk(contextProcessor)
+}
+
+func computeRollup(ctx *sfplugins.StatefunContextProcessor, objectID string, rollup easyjson.JSON) easyjson.JSON {
+	childType := rollup.GetByPath("child_type").AsStringDefault("")
+	pattern := fmt.Sprintf(OutLinkBodyKeyPrefPattern+LinkKeySuff1Pattern, objectID, ">")
+	if linkType, ok := rollup.GetByPath("link_type").AsString(); ok {
+		pattern = fmt.Sprintf(OutLinkBodyKeyPrefPattern+LinkKeySuff2Pattern, objectID, linkType, ">")
+	}
+	sumPaths, _ := rollup.GetByPath("sum").AsArrayString()
+
+	children := map[string]struct{}{}
+	sums := make([]float64, len(sumPaths))
+	for _, key := range ctx.GlobalCache.GetKeysByPattern(pattern) {
+		tokens := strings.Split(key, ".")
+		childID := tokens[len(tokens)-1]
+		if _, ok := children[childID]; ok || findObjectType(ctx, childID) != childType {
+			continue
+		}
+		children[childID] = struct{}{}
+		childBody, err := ctx.GlobalCache.GetValueAsJSON(childID)
+		if err != nil {
+			continue
+		}
+		for i, path := range sumPaths {
+			sums[i] += childBody.GetByPath(path).AsNumericDefault(0)
+		}
+	}
+
+	result := easyjson.NewJSONObjectWithKeyValue("count", easyjson.NewJSON(len(children)))
+	sum := easyjson.NewJSONObject()
+	for i, path := range sumPaths {
+		sum.SetByPath(path, easyjson.NewJSON(sums[i]))
+	}
+	result.SetByPath("sum", sum)
+	return result
+}
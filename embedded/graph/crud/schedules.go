@@ -0,0 +1,151 @@
+// Copyright 2023 NJWS Inc.
+
+package crud
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	sfplugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Schedules are objects of ScheduleType created, updated and deleted through the cmdb API like any other object,
+so automations are data: each one signals its target on a cron spec (see cron.go). The type is created once:
+
+	functions.cmdb.api.type.create "schedule"
+
+and a schedule's body is
+
+	{
+		"cron": string,             // e.g. "0 9 * * 1-5", "@daily", "@every 30s"
+		"typename": string,         // Typename to signal
+		"id": string,               // optional, the schedule's id if absent
+		"payload": json,            // optional, template of the signal's payload
+		"enabled": bool             // optional, true if absent
+	}
+
+String values of the payload template may contain "{{schedule_id}}" and "{{fire_time}}" (RFC3339), both are
+replaced on each fire. Changes of schedules made through the cmdb API signal ScheduleFunction for the schedule,
+it arms a runtime timer for the next fire time (replacing the previous one), a fired timer signals the target and
+arms the next one. Timers are persisted and delivered at least once, so a fire may repeat after a crash but is not
+lost; a fire missed while no runtime was running happens on the next start. A deleted or disabled schedule, or one
+with an invalid spec, is disarmed.
+*/
+
+const (
+	ScheduleType     = "schedule"
+	ScheduleFunction = "functions.cmdb.schedule"
+
+	scheduleTimerID = "schedule"
+)
+
+// Signals ScheduleFunction for schedules the operations create, change or delete
+func executeSchedulesFromLLOpStack(ctx *sfplugins.StatefunContextProcessor, opStack *easyjson.JSON) {
+	if opStack == nil || !opStack.IsArray() {
+		return
+	}
+	schedules := map[string]struct{}{}
+	for i := 0; i < opStack.ArraySize(); i++ {
+		opData := opStack.ArrayElement(i)
+		if fromVId := opData.GetByPath("from_id").AsStringDefault(""); len(fromVId) > 0 {
+			// Object's link to its type is made on creation and removed on deletion
+			if opData.GetByPath("type").AsStringDefault("") == TypeLink && opData.GetByPath("to_id").AsStringDefault("") == ScheduleType {
+				schedules[fromVId] = struct{}{}
+			}
+			continue
+		}
+		if vId := opData.GetByPath("id").AsStringDefault(""); len(vId) > 0 && findObjectType(ctx, vId) == ScheduleType {
+			schedules[vId] = struct{}{}
+		}
+	}
+	for scheduleID := range schedules {
+		empty := easyjson.NewJSONObject()
+		system.MsgOnErrorReturn(ctx.Signal(sfplugins.JetstreamGlobalSignal, ScheduleFunction, scheduleID, &empty, nil))
+	}
+}
+
+/*
+Arms the timer of the schedule with an id the function being called with, fires the schedule if called by its timer.
+
+Request:
+
+	payload: json - optional
+		fire_at: number - optional, fire time in ns, set by the schedule's timer
+*/
+func ScheduleFire(_ sfplugins.StatefunExecutor, contextProcessor *sfplugins.StatefunContextProcessor) {
+	selfID := contextProcessor.Self.ID
+	body, err := contextProcessor.GlobalCache.GetValueAsJSON(selfID)
+	if err != nil || findObjectType(contextProcessor, selfID) != ScheduleType || !body.GetByPath("enabled").AsBoolDefault(true) {
+		contextProcessor.CancelTimer(scheduleTimerID)
+		replyOk(contextProcessor)
+		return
+	}
+	cron, err := parseCron(body.GetByPath("cron").AsStringDefault(""))
+	if err != nil {
+		contextProcessor.CancelTimer(scheduleTimerID)
+		replyError(contextProcessor, err)
+		return
+	}
+	typename, ok := body.GetByPath("typename").AsString()
+	if !ok || len(typename) == 0 {
+		contextProcessor.CancelTimer(scheduleTimerID)
+		replyError(contextProcessor, fmt.Errorf("error: schedule %s has no typename", selfID))
+		return
+	}
+
+	after := contextProcessor.Now()
+	if fireAt, ok := contextProcessor.Payload.GetByPath("fire_at").AsNumeric(); ok {
+		fireTime := time.Unix(0, int64(fireAt)).UTC()
+		targetID := body.GetByPath("id").AsStringDefault(selfID)
+		payload := renderScheduleTemplate(body.GetByPath("payload"), strings.NewReplacer("{{schedule_id}}", selfID, "{{fire_time}}", fireTime.Format(time.RFC3339)))
+		if !payload.IsObject() {
+			payload = easyjson.NewJSONObject()
+		}
+		if err := contextProcessor.Signal(sfplugins.JetstreamGlobalSignal, typename, targetID, &payload, nil); err != nil {
+			replyError(contextProcessor, err)
+			return
+		}
+		after = fireTime // Missed fires are not repeated, "@every" keeps its period
+	}
+
+	next := cron.next(after)
+	if next.IsZero() {
+		contextProcessor.CancelTimer(scheduleTimerID)
+		replyOk(contextProcessor)
+		return
+	}
+	if now := contextProcessor.Now(); next.Before(now) {
+		next = cron.next(now)
+	}
+	timerPayload := easyjson.NewJSONObjectWithKeyValue("fire_at", easyjson.NewJSON(next.UnixNano()))
+	if err := contextProcessor.ScheduleSignal(scheduleTimerID, next, sfplugins.JetstreamGlobalSignal, ScheduleFunction, selfID, &timerPayload, nil); err != nil {
+		replyError(contextProcessor, err)
+		return
+	}
+	replyOk(contextProcessor)
+}
+
+func renderScheduleTemplate(template easyjson.JSON, replacer *strings.Replacer) easyjson.JSON {
+	switch {
+	case template.IsString():
+		return easyjson.NewJSON(replacer.Replace(template.AsStringDefault("")))
+	case template.IsObject():
+		result := easyjson.NewJSONObject()
+		for _, key := range template.ObjectKeys() {
+			result.SetByPath(key, renderScheduleTemplate(template.GetByPath(key), replacer))
+		}
+		return result
+	case template.IsArray():
+		result := easyjson.NewJSONArray()
+		for i := 0; i < template.ArraySize(); i++ {
+			result.AddToArray(renderScheduleTemplate(template.ArrayElement(i), replacer))
+		}
+		return result
+	default:
+		return template
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/foliagecp/easyjson"
 
 	"github.com/foliagecp/sdk/embedded/graph/common"
+	sdkErrors "github.com/foliagecp/sdk/errors"
 	"github.com/foliagecp/sdk/statefun"
 	"github.com/foliagecp/sdk/statefun/cache"
 	"github.com/foliagecp/sdk/statefun/plugins"
@@ -247,7 +248,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 				}
 				return nil
 			}
-			return fmt.Errorf("ERROR replyCallerLoopPrevent: callerAggregationID does not exist for object_id=%s", thisObjectID)
+			return sdkErrors.Newf(sdkErrors.ErrKeyNotFound, "ERROR replyCallerLoopPrevent: callerAggregationID does not exist for object_id=%s", thisObjectID)
 		}
 
 		state, err := getState()
@@ -269,7 +270,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 			//lg.Logln(processID + ":0:: " + "(" + thisObjectID + ") " + "2")
 			callerAggregationID, ok := context.GetByPath(thisFunctionAggregationID + "_caller_aggregation_id").AsString()
 			if !ok {
-				lg.Logf(lg.ErrorLevel, "LLAPIQueryJPGQLCallTreeResultAggregation: no valid caller_aggregation_id on state=0 for object_id=%s\n", thisObjectID)
+				lg.Log(lg.ErrorLevel, "LLAPIQueryJPGQLCallTreeResultAggregation: no valid caller_aggregation_id", "state", 0, "id", thisObjectID)
 				return
 			}
 			//lg.Logln(processID + ":0:: " + "(" + thisObjectID + ") " + "3")
@@ -357,7 +358,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 			}
 			callbacksFloat, ok := context.GetByPath(thisFunctionAggregationID + "_callbacks").AsNumeric()
 			if !ok || callbacksFloat < 0 {
-				lg.Logf(lg.ErrorLevel, "LLAPIQueryJPGQLCallTreeResultAggregation: no valid callbacks counter for result aggregation for object_id=%s\n", thisObjectID)
+				lg.Log(lg.ErrorLevel, "LLAPIQueryJPGQLCallTreeResultAggregation: no valid callbacks counter for result aggregation", "id", thisObjectID)
 				return
 			}
 			callbacks := int(callbacksFloat)
@@ -375,7 +376,7 @@ func LLAPIQueryJPGQLCallTreeResultAggregation(executor sfPlugins.StatefunExecuto
 				//lg.Logln(processID+"::: 1:0 "+thisObjectID+" | Context:", context.ToString())
 				callerAggregationID, ok := context.GetByPath(thisFunctionAggregationID + "_caller_aggregation_id").AsString()
 				if !ok {
-					lg.Logf(lg.ErrorLevel, "LLAPIQueryJPGQLCallTreeResultAggregation: no valid caller_aggregation_id on state=1 for object_id=%s\n", thisObjectID)
+					lg.Log(lg.ErrorLevel, "LLAPIQueryJPGQLCallTreeResultAggregation: no valid caller_aggregation_id", "state", 1, "id", thisObjectID)
 					return
 				}
 
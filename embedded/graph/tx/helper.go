@@ -1,7 +1,6 @@
 package tx
 
 import (
-	"errors"
 	"fmt"
 	"strings"
 
@@ -157,7 +156,12 @@ func replyOk(ctx *sfplugins.StatefunContextProcessor, msg ...string) {
 }
 
 func replyError(ctx *sfplugins.StatefunContextProcessor, err error) {
-	reply(ctx, "failed", err.Error())
+	qid := common.GetQueryID(ctx)
+	reply := easyjson.NewJSONObject()
+	reply.SetByPath("status", easyjson.NewJSON("failed"))
+	reply.SetByPath("result", easyjson.NewJSON(err.Error()))
+	common.SetErrorKind(&reply, err)
+	common.ReplyQueryID(qid, easyjson.NewJSONObjectWithKeyValue("payload", reply).GetPtr(), ctx)
 }
 
 func reply(ctx *sfplugins.StatefunContextProcessor, status string, data any) {
@@ -188,11 +192,7 @@ func checkRequestError(result *easyjson.JSON, err error) error {
 		return err
 	}
 
-	if result.GetByPath("payload.status").AsStringDefault("failed") == "failed" {
-		return errors.New(result.GetByPath("payload.result").AsStringDefault("unknown error"))
-	}
-
-	return nil
+	return common.ReplyError(result.GetByPath("payload").GetPtr())
 }
 
 func findTypeObjects(ctx *sfplugins.StatefunContextProcessor, typeID string) []string {
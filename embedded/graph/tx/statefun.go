@@ -14,7 +14,6 @@ import (
 	"github.com/foliagecp/sdk/statefun/logger"
 	sfplugins "github.com/foliagecp/sdk/statefun/plugins"
 	"github.com/foliagecp/sdk/statefun/system"
-	"github.com/prometheus/client_golang/prometheus"
 )
 
 const _TX_MASTER = "txmaster"
@@ -39,6 +38,8 @@ var (
 )
 
 func RegisterAllFunctionTypes(runtime *statefun.Runtime) {
+	runtime.RegisterCapability("transactions")
+
 	statefun.NewFunctionType(runtime, "functions.cmdb.tx.begin", Begin, *statefun.NewFunctionTypeConfig().SetServiceState(true))
 
 	statefun.NewFunctionType(runtime, "functions.cmdb.tx.type.create", CreateType, *statefun.NewFunctionTypeConfig().SetServiceState(true))
@@ -67,7 +68,7 @@ func RegisterAllFunctionTypes(runtime *statefun.Runtime) {
 
 func replyTxError(ctx *sfplugins.StatefunContextProcessor, err error) {
 	system.MsgOnErrorReturn(ctx.ObjectMutexUnlock())
-	reply(ctx, "failed", err.Error())
+	replyError(ctx, err)
 }
 
 /*
@@ -125,9 +126,7 @@ func Begin(_ sfplugins.StatefunExecutor, contextProcessor *sfplugins.StatefunCon
 
 	// Measure cloning duration ---------------------------
 	measureName := fmt.Sprintf("%sclone_execution_time", strings.ReplaceAll(contextProcessor.Self.Typename, ".", ""))
-	if gaugeVec, err := system.GlobalPrometrics.EnsureGaugeVecSimple(measureName, "", []string{"type"}); err == nil {
-		gaugeVec.With(prometheus.Labels{"type": cloneMod}).Set(float64(time.Since(cloneStart).Microseconds()))
-	}
+	system.Metrics().SetGauge(measureName, "", map[string]string{"type": cloneMod}, float64(time.Since(cloneStart).Microseconds()))
 	// ----------------------------------------------------
 
 	qid := common.GetQueryID(contextProcessor)
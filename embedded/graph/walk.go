@@ -0,0 +1,163 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage graph store package.
+// Provides Go-level helpers for reading the graph stored in the cache
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/embedded/graph/crud"
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/cache"
+)
+
+var (
+	// Returned by a visit function to not follow links of the visited vertex
+	SkipLinks = errors.New("skip links of this vertex")
+	// Returned by a visit function to stop the walk without an error
+	StopWalk = errors.New("stop walk")
+)
+
+type WalkOptions struct {
+	MaxDepth    int      // < 0 - no limit, 0 - visit the start vertex only
+	LinkTypes   []string // Link types to follow, empty - all
+	Inbound     bool     // Follow in links (to parents) instead of out links
+	Concurrency int      // Vertices of the same depth visited at once, <= 1 - sequentially
+}
+
+func NewWalkOptions() *WalkOptions {
+	return &WalkOptions{MaxDepth: -1, Concurrency: 1}
+}
+
+// WalkStep describes a visited vertex and the link it was reached by, FromID and LinkType are empty for the start vertex
+type WalkStep struct {
+	ID       string
+	Depth    int
+	FromID   string
+	LinkType string
+	LinkBody *easyjson.JSON // Out link's body, nil for the start vertex and in links
+}
+
+// With Concurrency > 1 visit is called from multiple routines at once
+type WalkVisitFunc func(step WalkStep) error
+
+// Walk visits vertices reachable from startID breadth first, every vertex is visited once so cycles are safe
+func Walk(runtime *statefun.Runtime, startID string, options *WalkOptions, visit WalkVisitFunc) error {
+	return WalkCache(runtime.GetCacheStore(), startID, options, visit)
+}
+
+// WalkCache is Walk over a cache store, e.g. StatefunContextProcessor.GlobalCache inside a function
+func WalkCache(cacheStore *cache.Store, startID string, options *WalkOptions, visit WalkVisitFunc) error {
+	if options == nil {
+		options = NewWalkOptions()
+	}
+	linkTypes := map[string]struct{}{}
+	for _, lt := range options.LinkTypes {
+		linkTypes[lt] = struct{}{}
+	}
+
+	visited := map[string]struct{}{startID: {}}
+	level := []WalkStep{{ID: startID}}
+
+	for depth := 0; len(level) > 0; depth++ {
+		next := []WalkStep{}
+		var nextMutex sync.Mutex
+		var firstErr error
+		var errOnce sync.Once
+
+		visitOne := func(step WalkStep) {
+			err := visit(step)
+			if err == SkipLinks {
+				return
+			}
+			if err != nil {
+				errOnce.Do(func() { firstErr = err })
+				return
+			}
+			if options.MaxDepth >= 0 && depth >= options.MaxDepth {
+				return
+			}
+			children := walkLinks(cacheStore, step.ID, options.Inbound)
+			nextMutex.Lock()
+			for _, child := range children {
+				if len(linkTypes) > 0 {
+					if _, ok := linkTypes[child.LinkType]; !ok {
+						continue
+					}
+				}
+				if _, ok := visited[child.ID]; ok {
+					continue
+				}
+				visited[child.ID] = struct{}{}
+				child.Depth = depth + 1
+				next = append(next, child)
+			}
+			nextMutex.Unlock()
+		}
+
+		if options.Concurrency <= 1 {
+			for _, step := range level {
+				visitOne(step)
+				if firstErr != nil {
+					break
+				}
+			}
+		} else {
+			semaphore := make(chan struct{}, options.Concurrency)
+			var wg sync.WaitGroup
+			for _, step := range level {
+				semaphore <- struct{}{}
+				wg.Add(1)
+				go func(step WalkStep) {
+					defer wg.Done()
+					defer func() { <-semaphore }()
+					visitOne(step)
+				}(step)
+			}
+			wg.Wait()
+		}
+
+		if firstErr == StopWalk {
+			return nil
+		}
+		if firstErr != nil {
+			return firstErr
+		}
+		level = next
+	}
+	return nil
+}
+
+func walkLinks(cacheStore *cache.Store, id string, inbound bool) []WalkStep {
+	steps := []WalkStep{}
+	if inbound {
+		// <id>.in.<from_id>.<link_type>
+		for _, key := range cacheStore.GetKeysByPattern(fmt.Sprintf(crud.InLinkKeyPrefPattern+crud.LinkKeySuff1Pattern, id, ">")) {
+			tokens := strings.Split(key, ".")
+			if len(tokens) < 2 {
+				continue
+			}
+			steps = append(steps, WalkStep{ID: tokens[len(tokens)-2], FromID: id, LinkType: tokens[len(tokens)-1]})
+		}
+		return steps
+	}
+	// <id>.out.body.<link_type>.<to_id>
+	for _, key := range cacheStore.GetKeysByPattern(fmt.Sprintf(crud.OutLinkBodyKeyPrefPattern+crud.LinkKeySuff1Pattern, id, ">")) {
+		tokens := strings.Split(key, ".")
+		if len(tokens) < 2 {
+			continue
+		}
+		step := WalkStep{ID: tokens[len(tokens)-1], FromID: id, LinkType: tokens[len(tokens)-2]}
+		if body, err := cacheStore.GetValueAsJSON(key); err == nil {
+			step.LinkBody = body
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
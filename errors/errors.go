@@ -0,0 +1,104 @@
+// Copyright 2023 NJWS Inc.
+
+package errors
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+Errors of the SDK's modules (cache, runtime, CRUD, jpgql) are of the kinds below, so callers check them with errors.Is
+instead of matching their messages:
+
+	if _, err := cacheStore.GetValue(key); errors.Is(err, sdkErrors.ErrKeyNotFound) {
+		...
+	}
+
+	ErrKeyNotFound  - a key, an object or a link does not exist
+	ErrConflict     - a concurrent update won: a revision mismatch, a locked mutex, a changing subtree
+	ErrThrottled    - refused by a limit or a full buffer, worth retrying later
+	ErrTimeout      - not done in time
+	ErrUnauthorized - not permitted for the caller: a reserved key or subject, a not approved stream
+
+An error of a kind keeps its own message and its cause (errors.Is(err, nats.ErrKeyNotFound) still holds for a key
+not found in KV), the modules' own sentinels (e.g. RequestTimeoutError) are errors of kinds too and match both.
+CRUD replies carry the kind's name by an "error_kind" field, so errors restored from replies by FromKindName match
+the kind on the requesting side as well.
+*/
+
+var (
+	ErrKeyNotFound  = errors.New("error: not found")
+	ErrConflict     = errors.New("error: conflict")
+	ErrThrottled    = errors.New("error: throttled")
+	ErrTimeout      = errors.New("error: timeout")
+	ErrUnauthorized = errors.New("error: unauthorized")
+)
+
+var kindNames = []struct {
+	kind error
+	name string
+}{
+	{ErrKeyNotFound, "key_not_found"},
+	{ErrConflict, "conflict"},
+	{ErrThrottled, "throttled"},
+	{ErrTimeout, "timeout"},
+	{ErrUnauthorized, "unauthorized"},
+}
+
+// Error is an error of a kind with its own message and an optional cause
+type Error struct {
+	Kind error
+	Msg  string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New returns an error of the kind with the message
+func New(kind error, msg string) error {
+	return &Error{Kind: kind, Msg: msg}
+}
+
+// Newf returns an error of the kind with the formatted message
+func Newf(kind error, format string, args ...any) error {
+	return &Error{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Wrap returns an error of the kind with the cause's message, nil if the cause is nil
+func Wrap(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Msg: err.Error(), Err: err}
+}
+
+// KindName returns the name of the error's kind, empty if the error is of none
+func KindName(err error) string {
+	for _, k := range kindNames {
+		if errors.Is(err, k.kind) {
+			return k.name
+		}
+	}
+	return ""
+}
+
+// FromKindName returns an error of the named kind with the message, a plain error if the name is unknown
+func FromKindName(name string, msg string) error {
+	for _, k := range kindNames {
+		if k.name == name {
+			return New(k.kind, msg)
+		}
+	}
+	return errors.New(msg)
+}
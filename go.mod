@@ -6,19 +6,23 @@ require (
 	github.com/PaesslerAG/gval v1.2.2
 	github.com/foliagecp/easyjson v0.1.0
 	github.com/goccy/go-graphviz v0.1.1
+	github.com/klauspost/compress v1.16.7
 	github.com/nats-io/nats.go v1.28.0
 	github.com/prometheus/client_golang v1.17.0
 	github.com/sirupsen/logrus v1.9.3
+	github.com/tetratelabs/wazero v1.5.0
+	google.golang.org/grpc v1.58.3
+	google.golang.org/protobuf v1.31.0
 	rogchap.com/v8go v0.9.0
 )
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fogleman/gg v1.3.0 // indirect
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
-	github.com/klauspost/compress v1.16.7 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
 	github.com/nats-io/nats-server/v2 v2.9.22 // indirect
 	github.com/nats-io/nkeys v0.4.4 // indirect
@@ -30,6 +34,8 @@ require (
 	github.com/shopspring/decimal v1.3.1 // indirect
 	golang.org/x/crypto v0.12.0 // indirect
 	golang.org/x/image v0.6.0 // indirect
+	golang.org/x/net v0.12.0 // indirect
 	golang.org/x/sys v0.11.0 // indirect
-	google.golang.org/protobuf v1.31.0 // indirect
+	golang.org/x/text v0.12.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
 )
@@ -0,0 +1,215 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Admin UI is a single embedded page served by the runtime (RuntimeConfig.SetAdminUI) showing registered typenames
+with their throughput, cache stats, recent errors (panics, refused payloads, SLO breaches) and a request console
+with a JPGQL preset. The page polls the JSON API:
+
+	GET  /api/overview - runtime, typenames and cache stats
+	GET  /api/errors   - recent errors, newest first
+	POST /api/request  - {"typename": ..., "id": ..., "payload": {...}}, replies with the function's reply
+	GET  /api/lock-contention?n=20 - cache keys with the highest sampled lock wait (cache.Config.SetLockStats)
+
+With a token set every API call must carry "Authorization: Bearer <token>".
+*/
+
+const (
+	RecentErrorsSize = 100
+
+	adminUIShutdownTimeout = 5 * time.Second
+)
+
+//go:embed admin/index.html
+var adminUIPage []byte
+
+type recentError struct {
+	Time     int64  `json:"time"`
+	Typename string `json:"typename"`
+	ID       string `json:"id"`
+	Kind     string `json:"kind"`
+	Message  string `json:"message"`
+}
+
+type recentErrors struct {
+	mutex  sync.Mutex
+	errors []recentError
+	next   int
+}
+
+func (r *Runtime) recordError(typename string, id string, kind string, message string) {
+	e := recentError{Time: system.GetCurrentTimeNs(), Typename: typename, ID: id, Kind: kind, Message: message}
+	r.recentErrors.mutex.Lock()
+	defer r.recentErrors.mutex.Unlock()
+	if len(r.recentErrors.errors) < RecentErrorsSize {
+		r.recentErrors.errors = append(r.recentErrors.errors, e)
+	} else {
+		r.recentErrors.errors[r.recentErrors.next] = e
+	}
+	r.recentErrors.next = (r.recentErrors.next + 1) % RecentErrorsSize
+}
+
+// Newest first
+func (r *Runtime) getRecentErrors() []recentError {
+	r.recentErrors.mutex.Lock()
+	defer r.recentErrors.mutex.Unlock()
+	errors := append([]recentError{}, r.recentErrors.errors...)
+	sort.Slice(errors, func(i, j int) bool { return errors[i].Time > errors[j].Time })
+	return errors
+}
+
+func (r *Runtime) startAdminUI() {
+	if len(r.config.adminUIAddress) == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(adminUIPage)
+	})
+	mux.HandleFunc("/api/overview", r.adminAPI(http.MethodGet, r.adminOverview))
+	mux.HandleFunc("/api/errors", r.adminAPI(http.MethodGet, func(req *http.Request) (interface{}, error) {
+		return r.getRecentErrors(), nil
+	}))
+	mux.HandleFunc("/api/request", r.adminAPI(http.MethodPost, r.adminRequest))
+	mux.HandleFunc("/api/lock-contention", r.adminAPI(http.MethodGet, r.adminLockContention))
+
+	r.adminServer = &http.Server{Addr: r.config.adminUIAddress, Handler: mux}
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("runtime-adminUI")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime-adminUI")
+		if err := r.adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			lg.Logf(lg.ErrorLevel, "Admin UI server on %s failed: %s\n", r.config.adminUIAddress, err)
+		}
+	}()
+}
+
+func (r *Runtime) stopAdminUI() {
+	if r.adminServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), adminUIShutdownTimeout)
+	defer cancel()
+	system.MsgOnErrorReturn(r.adminServer.Shutdown(ctx))
+}
+
+func (r *Runtime) adminAPI(method string, handler func(req *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if len(r.config.adminUIToken) > 0 && req.Header.Get("Authorization") != "Bearer "+r.config.adminUIToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if req.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result, err := handler(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		system.MsgOnErrorReturn(json.NewEncoder(w).Encode(result))
+	}
+}
+
+func (r *Runtime) adminOverview(req *http.Request) (interface{}, error) {
+	type typenameOverview struct {
+		Name          string `json:"name"`
+		Served        bool   `json:"served"`
+		ServiceActive bool   `json:"service_active"`
+		Handled       uint64 `json:"handled"`
+		Failed        uint64 `json:"failed"`
+		IDHandlers    int    `json:"id_handlers"`
+	}
+	typenames := []typenameOverview{}
+	for _, ft := range r.registeredFunctionTypes {
+		idHandlers := 0
+		ft.idHandlersChannel.Range(func(_, _ interface{}) bool {
+			idHandlers++
+			return true
+		})
+		typenames = append(typenames, typenameOverview{
+			Name:          ft.name,
+			Served:        r.servesFunctionType(ft),
+			ServiceActive: ft.config.serviceActive,
+			Handled:       ft.handledCount.Load(),
+			Failed:        ft.failedCount.Load(),
+			IDHandlers:    idHandlers,
+		})
+	}
+	sort.Slice(typenames, func(i, j int) bool { return typenames[i].Name < typenames[j].Name })
+
+	overview := map[string]interface{}{
+		"time":          system.GetCurrentTimeNs(),
+		"role":          r.config.role,
+		"handlers_busy": r.handlersBusy.Load(),
+		"goroutines":    runtime.NumGoroutine(),
+		"typenames":     typenames,
+	}
+	if r.cacheStore != nil {
+		overview["cache"] = r.cacheStore.Stats()
+		overview["lru"] = r.cacheStore.LRUTuning()
+	}
+	return overview, nil
+}
+
+func (r *Runtime) adminLockContention(req *http.Request) (interface{}, error) {
+	n := 20
+	if s := req.URL.Query().Get("n"); len(s) > 0 {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil {
+			return nil, err
+		}
+	}
+	if r.cacheStore == nil {
+		return []cache.KeyLockContention{}, nil
+	}
+	return r.cacheStore.LockContentionTop(n), nil
+}
+
+func (r *Runtime) adminRequest(req *http.Request) (interface{}, error) {
+	var body struct {
+		Typename string          `json:"typename"`
+		ID       string          `json:"id"`
+		Payload  json.RawMessage `json:"payload"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	payload := easyjson.NewJSONObject()
+	if len(body.Payload) > 0 {
+		if j, ok := easyjson.JSONFromBytes(body.Payload); ok {
+			payload = j
+		}
+	}
+	reply, err := r.request(sfPlugins.NatsCoreGlobalRequest, "admin", "ui", body.Typename, body.ID, &payload, nil)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(reply.ToBytes()), nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+
+	"github.com/foliagecp/easyjson"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Broadcast sends one signal to many ids of a typename, e.g. to all children of a graph vertex:
+
+	contextProcessor.Broadcast(sfPlugins.JetstreamGlobalSignal, "functions.app.refresh", childIDs, &payload, nil)
+	contextProcessor.BroadcastByPattern(sfPlugins.JetstreamGlobalSignal, "functions.app.refresh", vertexID+".out.body.>", &payload, nil)
+
+The message data is built (and end-to-end encrypted) once per target typename, all messages are published by a
+single routine and flushed at once instead of one routine per signal. Duplicate ids get a single signal.
+*/
+
+func (r *Runtime) broadcast(signalProvider sfPlugins.SignalProvider, callerTypename string, callerID string, targetTypename string, targetIDs []string, payload *easyjson.JSON, options *easyjson.JSON) error {
+	if signalProvider != sfPlugins.JetstreamGlobalSignal {
+		return fmt.Errorf("unknown signal provider: %d", signalProvider)
+	}
+
+	type natsMsg struct {
+		subject string
+		data    []byte
+	}
+	targetTypename = r.resolveAlias(targetTypename)
+	msgs := make([]natsMsg, 0, len(targetIDs))
+	dataByTypename := map[string][]byte{} // Versions of the typename may be routed to
+	sent := map[string]struct{}{}
+	for _, id := range targetIDs {
+		if _, ok := sent[id]; ok {
+			continue
+		}
+		sent[id] = struct{}{}
+		typename := r.routeVersion(targetTypename, id)
+		data, ok := dataByTypename[typename]
+		if !ok {
+			e2ePayload, err := r.e2eSend(callerTypename, typename, payload)
+			if err != nil {
+				return err
+			}
+			data = buildNatsData(callerTypename, callerID, e2ePayload, options, false)
+			dataByTypename[typename] = data
+		}
+		msgs = append(msgs, natsMsg{subject: r.prioritySignalSubject(typename, id, options), data: data})
+	}
+
+	if r.signalBuffer != nil {
+		for _, msg := range msgs {
+			if err := r.signalBuffer.enqueue(msg.subject, msg.data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("ingress-broadcast-gofunc")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("ingress-broadcast-gofunc")
+		nc, _ := r.messaging()
+		for _, msg := range msgs {
+			system.MsgOnErrorReturn(nc.Publish(msg.subject, msg.data))
+		}
+		system.MsgOnErrorReturn(nc.Flush())
+	}()
+	return nil
+}
+
+// Broadcast signals every id of the typename with the same payload and options
+func (r *Runtime) Broadcast(signalProvider sfPlugins.SignalProvider, typename string, ids []string, payload *easyjson.JSON, options *easyjson.JSON) error {
+	return r.broadcast(signalProvider, "ingress", "nats", typename, ids, payload, options)
+}
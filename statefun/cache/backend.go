@@ -0,0 +1,139 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"errors"
+
+	customNatsKv "github.com/foliagecp/sdk/embedded/nats/kv"
+	sdkErrors "github.com/foliagecp/sdk/errors"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	KVBackendCASNotSupportedError = errors.New("error: kv backend does not support conditional writes")
+	KVRevisionMismatchError       = sdkErrors.New(sdkErrors.ErrConflict, "error: kv key's revision does not match")
+)
+
+// KVBackendEntry is a single record stored in a KVBackend
+type KVBackendEntry interface {
+	Key() string
+	Value() []byte
+	Revision() uint64
+}
+
+// KVBackendWatcher delivers all values matching a watched pattern, then a nil entry
+// marking the end of initial values, then live updates until stopped
+type KVBackendWatcher interface {
+	Updates() <-chan KVBackendEntry
+	Stop() error
+}
+
+// KVBackend is a persistent key/value store the cache lives on top of
+type KVBackend interface {
+	Get(key string) (KVBackendEntry, error)
+	Put(key string, value []byte) (uint64, error)
+	// Delete removes the key's value completely, no delete marker is delivered to watchers
+	Delete(key string) error
+	// Watch watches keys by a NATS-like pattern ("*" - single token, ">" - all tokens to the end) ignoring deletes
+	Watch(keyPattern string) (KVBackendWatcher, error)
+}
+
+// KVBackendCAS is implemented by backends able to write depending on the key's latest revision
+type KVBackendCAS interface {
+	// Create puts the value only if the key does not exist
+	Create(key string, value []byte) (uint64, error)
+	// Update puts the value only if the key's latest revision is the given one
+	Update(key string, value []byte, revision uint64) (uint64, error)
+	// DeleteRevision deletes the key completely only if its latest revision is the given one
+	DeleteRevision(key string, revision uint64) error
+}
+
+// True if a conditional write failed because the key's revision did not match, other errors are not retried
+func isKVRevisionMismatch(err error) bool {
+	var apiErr *nats.APIError
+	return errors.Is(err, KVRevisionMismatchError) || err == nats.ErrKeyExists ||
+		(errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence)
+}
+
+// NATS key/value backend -------------------------------------------------------------------------
+
+type natsKVBackend struct {
+	js nats.JetStreamContext
+	kv nats.KeyValue
+}
+
+type natsKVBackendWatcher struct {
+	w       nats.KeyWatcher
+	updates chan KVBackendEntry
+}
+
+func NewNatsKVBackend(js nats.JetStreamContext, kv nats.KeyValue) KVBackend {
+	return &natsKVBackend{js: js, kv: kv}
+}
+
+func (b *natsKVBackend) Get(key string) (KVBackendEntry, error) {
+	entry, err := b.kv.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (b *natsKVBackend) Put(key string, value []byte) (uint64, error) {
+	return b.kv.Put(key, value)
+}
+
+func (b *natsKVBackend) Delete(key string) error {
+	return customNatsKv.DeleteKeyValueValue(b.js, b.kv, key)
+}
+
+func (b *natsKVBackend) Watch(keyPattern string) (KVBackendWatcher, error) {
+	w, err := b.kv.Watch(keyPattern, nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	nw := &natsKVBackendWatcher{w: w, updates: make(chan KVBackendEntry)}
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("cache.natsKVBackendWatcher")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("cache.natsKVBackendWatcher")
+		defer close(nw.updates)
+		for entry := range w.Updates() {
+			if entry == nil {
+				nw.updates <- nil
+			} else {
+				nw.updates <- entry
+			}
+		}
+	}()
+	return nw, nil
+}
+
+func (nw *natsKVBackendWatcher) Updates() <-chan KVBackendEntry {
+	return nw.updates
+}
+
+func (nw *natsKVBackendWatcher) Stop() error {
+	err := nw.w.Stop()
+	// Drain forwarded entries so the forwarding routine can exit when the source channel closes
+	go func() {
+		for range nw.updates {
+		}
+	}()
+	return err
+}
+
+func (b *natsKVBackend) Create(key string, value []byte) (uint64, error) {
+	return b.kv.Create(key, value)
+}
+
+func (b *natsKVBackend) Update(key string, value []byte, revision uint64) (uint64, error) {
+	return b.kv.Update(key, value, revision)
+}
+
+func (b *natsKVBackend) DeleteRevision(key string, revision uint64) error {
+	return b.kv.Purge(key, nats.LastRevision(revision))
+}
+
+// ------------------------------------------------------------------------------------------------
@@ -0,0 +1,89 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"errors"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+Compression wraps a KV backend so record values longer than the threshold are compressed before Put and decompressed
+after Get, Watch and scans. The codec is marked by the record's flag byte (see kvRecordBytes):
+
+	1 - plain value, 0 - delete, 2 - zstd compressed value, 3 - snappy compressed value, 4 - content reference
+	(see backend_dedup.go), 5 - delta (see backend_delta.go)
+
+Values which do not get shorter are written plain. Readers decompress records of any codec whatever is configured,
+so the codec and the threshold can be changed on a running bucket as long as compression stays enabled.
+*/
+
+type CompressionCodec byte
+
+const (
+	CompressionZstd   CompressionCodec = 2
+	CompressionSnappy CompressionCodec = 3
+)
+
+var (
+	UnknownCompressionCodecError = errors.New("error: unknown cache compression codec")
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+type recordCompressor struct {
+	codec     CompressionCodec
+	threshold int
+}
+
+// NewCompressedKVBackend returns the backend compressing record values longer than threshold bytes with the codec
+func NewCompressedKVBackend(backend KVBackend, codec CompressionCodec, threshold int, onError func(key string, err error)) KVBackend {
+	c := &recordCompressor{codec: codec, threshold: threshold}
+	return newTransformingKVBackend(backend, c.compress, c.decompress, onError)
+}
+
+func (c *recordCompressor) compress(key string, record []byte) ([]byte, error) {
+	if len(record) < 9 || record[8] != 1 || len(record)-9 <= c.threshold {
+		return record, nil
+	}
+	compressed := make([]byte, 9, len(record))
+	copy(compressed, record[:9])
+	switch c.codec {
+	case CompressionZstd:
+		compressed = zstdEncoder.EncodeAll(record[9:], compressed)
+	case CompressionSnappy:
+		compressed = append(compressed, s2.EncodeSnappy(nil, record[9:])...)
+	default:
+		return nil, UnknownCompressionCodecError
+	}
+	if len(compressed) >= len(record) {
+		return record, nil
+	}
+	compressed[8] = byte(c.codec)
+	return compressed, nil
+}
+
+func (c *recordCompressor) decompress(key string, record []byte) ([]byte, error) {
+	if len(record) < 9 || (CompressionCodec(record[8]) != CompressionZstd && CompressionCodec(record[8]) != CompressionSnappy) {
+		return record, nil
+	}
+	plain := make([]byte, 9, 9+2*len(record))
+	copy(plain, record[:9])
+	plain[8] = 1
+	switch CompressionCodec(record[8]) {
+	case CompressionZstd:
+		return zstdDecoder.DecodeAll(record[9:], plain)
+	case CompressionSnappy:
+		value, err := s2.Decode(nil, record[9:])
+		if err != nil {
+			return nil, err
+		}
+		return append(plain, value...), nil
+	}
+	return nil, UnknownCompressionCodecError
+}
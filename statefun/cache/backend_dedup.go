@@ -0,0 +1,356 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+/*
+Content deduplication wraps a KV backend so identical values longer than the threshold (e.g. vertex bodies made from
+one template) are stored once. The value goes to a content record named by its sha256 hash, the key's record keeps
+a reference: the time, flag 4, the hash and the content generation. Content keys live next to the store's keys
+(<prefix>_content.<hash>.<generation>), so the store's watches never see them:
+
+	<prefix>_content_refs.<hash> - references count and the generation of the content
+	<prefix>_content.<hash>.<generation> - the value
+
+References are counted with conditional writes (KVBackendCAS), so any number of runtimes may share a bucket.
+The backend is a KVBackendCAS itself: key records are written depending on their revision the same way.
+The content is deleted with its last reference; a value stored again after that gets a new generation, so deleting
+the old content never races with the new one. A runtime failing between the steps leaves an unreferenced content
+record at worst, never a reference without content.
+Readers resolve references whatever the threshold is, so it can be changed on a running bucket as long as
+deduplication stays enabled. Resolved values are cached, content records never change.
+*/
+
+const (
+	contentRefFlag     = 4
+	dedupCASAttempts   = 32
+	dedupContentsCache = 1024
+)
+
+var (
+	MalformedContentRefError = errors.New("error: malformed cache content reference")
+)
+
+type contentRef struct {
+	hash       [sha256.Size]byte
+	generation uint64
+}
+
+type dedupKVBackend struct {
+	b         KVBackend
+	cas       KVBackendCAS
+	prefix    string
+	threshold int
+	onError   func(key string, err error)
+
+	contentsMutex sync.Mutex
+	contents      map[contentRef][]byte
+}
+
+// NewDedupKVBackend returns the backend storing identical values longer than threshold bytes once,
+// contentPrefix must be outside of the watched keys
+func NewDedupKVBackend(backend KVBackend, contentPrefix string, threshold int, onError func(key string, err error)) (KVBackend, error) {
+	cas, ok := backend.(KVBackendCAS)
+	if !ok {
+		return nil, KVBackendCASNotSupportedError
+	}
+	d := &dedupKVBackend{b: backend, cas: cas, prefix: contentPrefix, threshold: threshold, onError: onError, contents: map[contentRef][]byte{}}
+	onDecodeError := func(key string, err error) {
+		// Watched references outdated meanwhile may point to the content already deleted, newer records follow them
+		if err != nats.ErrKeyNotFound && onError != nil {
+			onError(key, err)
+		}
+	}
+	return wrapTransformingKVBackend(&transformingKVBackend{b: backend, decode: d.resolve, onError: onDecodeError, put: d.put, delete: d.delete, conditional: dedupKVBackendCAS{d}}), nil
+}
+
+func (d *dedupKVBackend) refsKey(hash [sha256.Size]byte) string {
+	return d.prefix + "_refs." + hex.EncodeToString(hash[:])
+}
+
+func (d *dedupKVBackend) contentKey(ref contentRef) string {
+	return d.prefix + "." + hex.EncodeToString(ref.hash[:]) + "." + hex.EncodeToString(binary.BigEndian.AppendUint64(nil, ref.generation))
+}
+
+func contentRefRecord(record []byte, ref contentRef) []byte {
+	refRecord := make([]byte, 9, 9+sha256.Size+8)
+	copy(refRecord, record[:8])
+	refRecord[8] = contentRefFlag
+	refRecord = append(refRecord, ref.hash[:]...)
+	return binary.BigEndian.AppendUint64(refRecord, ref.generation)
+}
+
+func parseContentRef(record []byte) (contentRef, bool) {
+	ref := contentRef{}
+	if len(record) != 9+sha256.Size+8 || record[8] != contentRefFlag {
+		return ref, false
+	}
+	copy(ref.hash[:], record[9:9+sha256.Size])
+	ref.generation = binary.BigEndian.Uint64(record[9+sha256.Size:])
+	return ref, true
+}
+
+// Refs record is a regular record so the wrapped backends treat it as any other: references count, generation
+func refsRecord(count uint64, generation uint64) []byte {
+	value := binary.BigEndian.AppendUint64(nil, count)
+	return kvRecordBytes(0, binary.BigEndian.AppendUint64(value, generation), true)
+}
+
+func parseRefsRecord(record []byte) (count uint64, generation uint64, err error) {
+	if len(record) != 9+16 || record[8] != 1 {
+		return 0, 0, MalformedContentRefError
+	}
+	return binary.BigEndian.Uint64(record[9:17]), binary.BigEndian.Uint64(record[17:]), nil
+}
+
+func (d *dedupKVBackend) put(key string, record []byte) (uint64, error) {
+	var err error
+	for attempt := 0; attempt < dedupCASAttempts; attempt++ {
+		previous, e := d.b.Get(key)
+		if e != nil && e != nats.ErrKeyNotFound {
+			return 0, e
+		}
+		var revision uint64
+		if revision, err = d.write(key, record, previous); err == nil || !isKVRevisionMismatch(err) {
+			return revision, err
+		}
+		// Written concurrently
+	}
+	return 0, err
+}
+
+// Writes the record over the previous one (nil - the key must not exist) if it is still the key's latest one
+func (d *dedupKVBackend) write(key string, record []byte, previous KVBackendEntry) (uint64, error) {
+	previousRef, previousIsRef := contentRef{}, false
+	if previous != nil {
+		previousRef, previousIsRef = parseContentRef(previous.Value())
+	}
+
+	toWrite, ref, acquired := record, previousRef, false
+	deduplicated := len(record) >= 9 && record[8] == 1 && len(record)-9 > d.threshold
+	if deduplicated {
+		if hash := sha256.Sum256(record[9:]); !previousIsRef || previousRef.hash != hash {
+			var err error
+			if ref, err = d.acquire(hash, record[9:]); err != nil {
+				return 0, err
+			}
+			acquired = true
+		}
+		toWrite = contentRefRecord(record, ref)
+	}
+
+	var revision uint64
+	var err error
+	if previous == nil {
+		revision, err = d.cas.Create(key, toWrite)
+	} else {
+		revision, err = d.cas.Update(key, toWrite, previous.Revision())
+	}
+	if err != nil {
+		if acquired {
+			d.release(ref)
+		}
+		return 0, err
+	}
+	if previousIsRef && (!deduplicated || previousRef != ref) {
+		d.release(previousRef)
+	}
+	return revision, nil
+}
+
+func (d *dedupKVBackend) delete(key string) error {
+	var err error
+	for attempt := 0; attempt < dedupCASAttempts; attempt++ {
+		previous, e := d.b.Get(key)
+		if e != nil {
+			return e
+		}
+		if err = d.cas.DeleteRevision(key, previous.Revision()); err != nil {
+			if isKVRevisionMismatch(err) {
+				continue
+			}
+			return err
+		}
+		if ref, ok := parseContentRef(previous.Value()); ok {
+			d.release(ref)
+		}
+		return nil
+	}
+	return err
+}
+
+// Conditional writes of key records
+type dedupKVBackendCAS struct {
+	d *dedupKVBackend
+}
+
+func (c dedupKVBackendCAS) Create(key string, value []byte) (uint64, error) {
+	if _, err := c.d.b.Get(key); err == nil {
+		return 0, KVRevisionMismatchError
+	} else if err != nats.ErrKeyNotFound {
+		return 0, err
+	}
+	return c.d.write(key, value, nil)
+}
+
+func (c dedupKVBackendCAS) Update(key string, value []byte, revision uint64) (uint64, error) {
+	previous, err := c.d.b.Get(key)
+	if err == nats.ErrKeyNotFound || (err == nil && previous.Revision() != revision) {
+		return 0, KVRevisionMismatchError
+	} else if err != nil {
+		return 0, err
+	}
+	return c.d.write(key, value, previous)
+}
+
+func (c dedupKVBackendCAS) DeleteRevision(key string, revision uint64) error {
+	previous, err := c.d.b.Get(key)
+	if err == nats.ErrKeyNotFound || (err == nil && previous.Revision() != revision) {
+		return KVRevisionMismatchError
+	} else if err != nil {
+		return err
+	}
+	if err := c.d.cas.DeleteRevision(key, revision); err != nil {
+		return err
+	}
+	if ref, ok := parseContentRef(previous.Value()); ok {
+		c.d.release(ref)
+	}
+	return nil
+}
+
+// Adds a reference to the content, stores the content if it is the first one
+func (d *dedupKVBackend) acquire(hash [sha256.Size]byte, value []byte) (contentRef, error) {
+	refsKey := d.refsKey(hash)
+	var err error
+	for attempt := 0; attempt < dedupCASAttempts; attempt++ {
+		refs, e := d.b.Get(refsKey)
+		if e == nats.ErrKeyNotFound {
+			ref := contentRef{hash: hash}
+			generationBytes := make([]byte, 8)
+			if _, err = rand.Read(generationBytes); err != nil {
+				return ref, err
+			}
+			ref.generation = binary.BigEndian.Uint64(generationBytes)
+			// Content first: a reference must never exist without it
+			if _, err = d.b.Put(d.contentKey(ref), kvRecordBytes(0, value, true)); err != nil {
+				return ref, err
+			}
+			if _, err = d.cas.Create(refsKey, refsRecord(1, ref.generation)); err == nil {
+				return ref, nil
+			}
+			_ = d.b.Delete(d.contentKey(ref))
+			if isKVRevisionMismatch(err) {
+				continue // Stored concurrently
+			}
+			return contentRef{}, err
+		}
+		if e != nil {
+			return contentRef{}, e
+		}
+		count, generation, e := parseRefsRecord(refs.Value())
+		if e != nil {
+			return contentRef{}, e
+		}
+		if _, err = d.cas.Update(refsKey, refsRecord(count+1, generation), refs.Revision()); err == nil {
+			return contentRef{hash: hash, generation: generation}, nil
+		} else if !isKVRevisionMismatch(err) {
+			return contentRef{}, err
+		}
+	}
+	return contentRef{}, err
+}
+
+// Removes a reference to the content, deletes the content with the last one
+func (d *dedupKVBackend) release(ref contentRef) {
+	refsKey := d.refsKey(ref.hash)
+	var err error
+	for attempt := 0; attempt < dedupCASAttempts; attempt++ {
+		refs, e := d.b.Get(refsKey)
+		if e == nats.ErrKeyNotFound {
+			return
+		}
+		if e != nil {
+			err = e
+			break
+		}
+		count, generation, e := parseRefsRecord(refs.Value())
+		if e != nil {
+			err = e
+			break
+		}
+		if generation != ref.generation {
+			return // Already released
+		}
+		if count > 1 {
+			if _, err = d.cas.Update(refsKey, refsRecord(count-1, generation), refs.Revision()); err == nil {
+				return
+			} else if !isKVRevisionMismatch(err) {
+				break
+			}
+			continue
+		}
+		if err = d.cas.DeleteRevision(refsKey, refs.Revision()); err == nil {
+			if err = d.b.Delete(d.contentKey(ref)); err == nil || err == nats.ErrKeyNotFound {
+				d.contentsMutex.Lock()
+				delete(d.contents, ref)
+				d.contentsMutex.Unlock()
+				return
+			}
+			break
+		} else if !isKVRevisionMismatch(err) {
+			break
+		}
+	}
+	if err != nil && d.onError != nil {
+		d.onError(refsKey, err)
+	}
+}
+
+// Replaces a content reference with the referenced value
+func (d *dedupKVBackend) resolve(key string, record []byte) ([]byte, error) {
+	ref, ok := parseContentRef(record)
+	if !ok {
+		return record, nil
+	}
+	d.contentsMutex.Lock()
+	value, cached := d.contents[ref]
+	d.contentsMutex.Unlock()
+
+	if !cached {
+		content, err := d.b.Get(d.contentKey(ref))
+		if err != nil {
+			return nil, err
+		}
+		if len(content.Value()) < 9 {
+			return nil, MalformedContentRefError
+		}
+		value = content.Value()[9:]
+		d.contentsMutex.Lock()
+		if len(d.contents) >= dedupContentsCache {
+			for r := range d.contents {
+				delete(d.contents, r)
+				break
+			}
+		}
+		d.contents[ref] = value
+		d.contentsMutex.Unlock()
+	}
+
+	resolved := make([]byte, 9, 9+len(value))
+	copy(resolved, record[:8])
+	resolved[8] = 1
+	return append(resolved, value...), nil
+}
+
+// ------------------------------------------------------------------------------------------------
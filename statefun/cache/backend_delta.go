@@ -0,0 +1,402 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+/*
+Delta encoding wraps a KV backend so big values changed by a few fields at a time (e.g. JSON contexts) are written
+as binary diffs against a full snapshot of the value instead of the whole value every time. The snapshot (base)
+is a separate record, the key's record keeps the time, flag 5, the base generation and the diff:
+
+	<prefix>_delta.<key>.<generation> - the base value
+
+A new base is written every snapshotEvery writes of the key or when the diff is not much shorter than the value,
+the previous one is deleted right after the key's record stops referencing it. Key records are written with
+conditional writes (KVBackendCAS): a write from another runtime makes the writer reload the record, so a base
+is never deleted while the latest record of its key references it. The backend is a KVBackendCAS itself.
+Diff: ops "copy" (base offset, length) and "insert" (length, bytes), numbers are uvarints. Readers resolve deltas
+whatever the threshold is, so it can be changed on a running bucket as long as delta encoding stays enabled.
+*/
+
+const (
+	deltaFlag         = 5
+	deltaOpCopy       = 0
+	deltaOpInsert     = 1
+	deltaBlockSize    = 16
+	deltaCASAttempts  = 32
+	deltaStatesCache  = 1024
+	deltaReadAttempts = 3
+)
+
+var (
+	MalformedDeltaError = errors.New("error: malformed cache delta record")
+	DeltaWithDedupError = errors.New("error: cache delta encoding is not used together with deduplication")
+)
+
+// Last record of a key written or read by this backend
+type deltaKeyState struct {
+	revision   uint64
+	generation uint64 // 0 - the record is not a delta
+	base       []byte
+	deltas     int
+}
+
+type deltaKVBackend struct {
+	b             KVBackend
+	cas           KVBackendCAS
+	keysPrefix    string
+	basePrefix    string
+	threshold     int
+	snapshotEvery int
+
+	statesMutex sync.Mutex
+	states      map[string]*deltaKeyState
+}
+
+// NewDeltaKVBackend returns the backend writing values of keys under keysPrefix longer than threshold bytes
+// as diffs against a base rewritten every snapshotEvery writes, basePrefix must be outside of the watched keys
+func NewDeltaKVBackend(backend KVBackend, keysPrefix string, basePrefix string, threshold int, snapshotEvery int, onError func(key string, err error)) (KVBackend, error) {
+	cas, ok := backend.(KVBackendCAS)
+	if !ok {
+		return nil, KVBackendCASNotSupportedError
+	}
+	d := &deltaKVBackend{b: backend, cas: cas, keysPrefix: keysPrefix + ".", basePrefix: basePrefix, threshold: threshold, snapshotEvery: snapshotEvery, states: map[string]*deltaKeyState{}}
+	onDecodeError := func(key string, err error) {
+		// Watched deltas outdated meanwhile may point to the base already deleted, newer records follow them
+		if err != nats.ErrKeyNotFound && onError != nil {
+			onError(key, err)
+		}
+	}
+	return wrapTransformingKVBackend(&transformingKVBackend{b: backend, decode: d.resolve, onError: onDecodeError, put: d.put, delete: d.delete, conditional: deltaKVBackendCAS{d}}), nil
+}
+
+func (d *deltaKVBackend) baseKey(key string, generation uint64) string {
+	return d.basePrefix + "." + key + "." + hex.EncodeToString(binary.BigEndian.AppendUint64(nil, generation))
+}
+
+func deltaRecord(record []byte, generation uint64, diff []byte) []byte {
+	delta := make([]byte, 9, 17+len(diff))
+	copy(delta, record[:8])
+	delta[8] = deltaFlag
+	delta = binary.BigEndian.AppendUint64(delta, generation)
+	return append(delta, diff...)
+}
+
+func parseDeltaRecord(record []byte) (generation uint64, diff []byte, ok bool) {
+	if len(record) < 17 || record[8] != deltaFlag {
+		return 0, nil, false
+	}
+	return binary.BigEndian.Uint64(record[9:17]), record[17:], true
+}
+
+func (d *deltaKVBackend) getState(key string) *deltaKeyState {
+	d.statesMutex.Lock()
+	defer d.statesMutex.Unlock()
+	return d.states[key]
+}
+
+func (d *deltaKVBackend) setState(key string, state *deltaKeyState) {
+	d.statesMutex.Lock()
+	defer d.statesMutex.Unlock()
+	if state == nil {
+		delete(d.states, key)
+		return
+	}
+	if _, ok := d.states[key]; !ok && len(d.states) >= deltaStatesCache {
+		for k := range d.states {
+			delete(d.states, k)
+			break
+		}
+	}
+	d.states[key] = state
+}
+
+// Reads the latest record of the key, nil state if there is none
+func (d *deltaKVBackend) loadState(key string) (*deltaKeyState, error) {
+	entry, err := d.b.Get(key)
+	if err == nats.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &deltaKeyState{revision: entry.Revision()}
+	if generation, _, ok := parseDeltaRecord(entry.Value()); ok {
+		base, err := d.b.Get(d.baseKey(key, generation))
+		if err == nats.ErrKeyNotFound {
+			return state, nil // Unreadable record, is overwritten with a new base
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(base.Value()) < 9 {
+			return nil, MalformedDeltaError
+		}
+		state.generation, state.base = generation, base.Value()[9:]
+	}
+	return state, nil
+}
+
+func (d *deltaKVBackend) put(key string, record []byte) (uint64, error) {
+	var err error
+	for attempt := 0; attempt < deltaCASAttempts; attempt++ {
+		state := d.getState(key)
+		if state == nil {
+			if state, err = d.loadState(key); err != nil {
+				return 0, err
+			}
+		}
+		var revision uint64
+		if revision, err = d.write(key, record, state); err == nil || !isKVRevisionMismatch(err) {
+			return revision, err
+		}
+		// Written concurrently, reloading
+	}
+	return 0, err
+}
+
+// Writes the record over the key's latest one of the state (nil - the key must not exist) if it is still the latest
+func (d *deltaKVBackend) write(key string, record []byte, state *deltaKeyState) (uint64, error) {
+	encodable := strings.HasPrefix(key, d.keysPrefix) && len(record) >= 9 && record[8] == 1 && len(record)-9 > d.threshold
+
+	var err error
+	toWrite, next := record, &deltaKeyState{}
+	newBase := false
+	if encodable {
+		value := record[9:]
+		next.base = value
+		if state != nil && state.generation != 0 && state.deltas < d.snapshotEvery {
+			if diff := deltaDiff(state.base, value); len(diff) <= len(value)/2 {
+				next.generation, next.base, next.deltas = state.generation, state.base, state.deltas+1
+				toWrite = deltaRecord(record, state.generation, diff)
+			}
+		}
+		if next.generation == 0 {
+			if next.generation, err = randomDeltaGeneration(); err != nil {
+				return 0, err
+			}
+			if _, err = d.b.Put(d.baseKey(key, next.generation), kvRecordBytes(0, value, true)); err != nil {
+				return 0, err
+			}
+			newBase = true
+			toWrite = deltaRecord(record, next.generation, nil)
+		}
+	}
+
+	if state == nil {
+		next.revision, err = d.cas.Create(key, toWrite)
+	} else {
+		next.revision, err = d.cas.Update(key, toWrite, state.revision)
+	}
+	if err != nil {
+		if newBase {
+			_ = d.b.Delete(d.baseKey(key, next.generation))
+		}
+		d.setState(key, nil)
+		return 0, err
+	}
+	if state != nil && state.generation != 0 && state.generation != next.generation {
+		_ = d.b.Delete(d.baseKey(key, state.generation))
+	}
+	if next.generation == 0 {
+		next.base = nil
+	}
+	d.setState(key, next)
+	return next.revision, nil
+}
+
+func (d *deltaKVBackend) delete(key string) error {
+	var err error
+	for attempt := 0; attempt < deltaCASAttempts; attempt++ {
+		entry, e := d.b.Get(key)
+		if e != nil {
+			return e
+		}
+		if err = d.cas.DeleteRevision(key, entry.Revision()); err != nil {
+			if isKVRevisionMismatch(err) {
+				continue
+			}
+			return err
+		}
+		if generation, _, ok := parseDeltaRecord(entry.Value()); ok {
+			_ = d.b.Delete(d.baseKey(key, generation))
+		}
+		d.setState(key, nil)
+		return nil
+	}
+	return err
+}
+
+// Conditional writes of key records
+type deltaKVBackendCAS struct {
+	d *deltaKVBackend
+}
+
+func (c deltaKVBackendCAS) Create(key string, value []byte) (uint64, error) {
+	return c.d.write(key, value, nil)
+}
+
+func (c deltaKVBackendCAS) Update(key string, value []byte, revision uint64) (uint64, error) {
+	state := c.d.getState(key)
+	if state == nil || state.revision != revision {
+		var err error
+		if state, err = c.d.loadState(key); err != nil {
+			return 0, err
+		}
+	}
+	if state == nil || state.revision != revision {
+		return 0, KVRevisionMismatchError
+	}
+	return c.d.write(key, value, state)
+}
+
+func (c deltaKVBackendCAS) DeleteRevision(key string, revision uint64) error {
+	entry, err := c.d.b.Get(key)
+	if err == nats.ErrKeyNotFound || (err == nil && entry.Revision() != revision) {
+		return KVRevisionMismatchError
+	} else if err != nil {
+		return err
+	}
+	if err := c.d.cas.DeleteRevision(key, revision); err != nil {
+		return err
+	}
+	if generation, _, ok := parseDeltaRecord(entry.Value()); ok {
+		_ = c.d.b.Delete(c.d.baseKey(key, generation))
+	}
+	c.d.setState(key, nil)
+	return nil
+}
+
+// Replaces a delta with the value it encodes
+func (d *deltaKVBackend) resolve(key string, record []byte) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		generation, diff, ok := parseDeltaRecord(record)
+		if !ok {
+			return record, nil
+		}
+		var base []byte
+		if state := d.getState(key); state != nil && state.generation == generation {
+			base = state.base
+		} else {
+			entry, err := d.b.Get(d.baseKey(key, generation))
+			if err == nats.ErrKeyNotFound && attempt < deltaReadAttempts {
+				// The key may have been written right after its record was read, reading the latest one
+				if entry, err = d.b.Get(key); err != nil {
+					return nil, err
+				}
+				record = entry.Value()
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(entry.Value()) < 9 {
+				return nil, MalformedDeltaError
+			}
+			base = entry.Value()[9:]
+		}
+
+		resolved := make([]byte, 9, 9+len(base))
+		copy(resolved, record[:8])
+		resolved[8] = 1
+		return deltaApply(resolved, base, diff)
+	}
+}
+
+func randomDeltaGeneration() (uint64, error) {
+	generationBytes := make([]byte, 8)
+	if _, err := rand.Read(generationBytes); err != nil {
+		return 0, err
+	}
+	if generation := binary.BigEndian.Uint64(generationBytes); generation != 0 {
+		return generation, nil
+	}
+	return 1, nil
+}
+
+// Encodes target as copies of base ranges found by blocks of deltaBlockSize and inserted bytes between them
+func deltaDiff(base []byte, target []byte) []byte {
+	blocks := make(map[string]int, len(base)/deltaBlockSize)
+	for i := 0; i+deltaBlockSize <= len(base); i += deltaBlockSize {
+		if _, ok := blocks[string(base[i:i+deltaBlockSize])]; !ok {
+			blocks[string(base[i:i+deltaBlockSize])] = i
+		}
+	}
+
+	diff := []byte{}
+	inserted := 0
+	for i := 0; i+deltaBlockSize <= len(target); {
+		offset, ok := blocks[string(target[i:i+deltaBlockSize])]
+		if !ok {
+			i++
+			continue
+		}
+		start, baseStart := i, offset
+		for start > inserted && baseStart > 0 && target[start-1] == base[baseStart-1] {
+			start--
+			baseStart--
+		}
+		end, baseEnd := i+deltaBlockSize, offset+deltaBlockSize
+		for end < len(target) && baseEnd < len(base) && target[end] == base[baseEnd] {
+			end++
+			baseEnd++
+		}
+		diff = appendDeltaInsert(diff, target[inserted:start])
+		diff = append(diff, deltaOpCopy)
+		diff = binary.AppendUvarint(diff, uint64(baseStart))
+		diff = binary.AppendUvarint(diff, uint64(end-start))
+		inserted, i = end, end
+	}
+	return appendDeltaInsert(diff, target[inserted:])
+}
+
+func appendDeltaInsert(diff []byte, data []byte) []byte {
+	if len(data) == 0 {
+		return diff
+	}
+	diff = append(diff, deltaOpInsert)
+	diff = binary.AppendUvarint(diff, uint64(len(data)))
+	return append(diff, data...)
+}
+
+// Appends the target encoded by the diff against base to dst
+func deltaApply(dst []byte, base []byte, diff []byte) ([]byte, error) {
+	r := bytes.NewReader(diff)
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		a, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, MalformedDeltaError
+		}
+		switch op {
+		case deltaOpCopy:
+			length, err := binary.ReadUvarint(r)
+			if err != nil || a+length > uint64(len(base)) {
+				return nil, MalformedDeltaError
+			}
+			dst = append(dst, base[a:a+length]...)
+		case deltaOpInsert:
+			if a > uint64(r.Len()) {
+				return nil, MalformedDeltaError
+			}
+			start := len(diff) - r.Len()
+			dst = append(dst, diff[start:start+int(a)]...)
+			_, _ = r.Seek(int64(a), io.SeekCurrent)
+		default:
+			return nil, MalformedDeltaError
+		}
+	}
+	return dst, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Encryption at rest wraps a KV backend so every record is sealed with AES-GCM before Put and opened after Get, Watch
+and scans, the key name is authenticated along with the record. The key (16, 24 or 32 bytes) comes from
+Config.SetEncryptionKey or base64 encoded from the CACHE_ENCRYPTION_KEY environment variable.
+
+Sealed record: encryptedRecordMarker, nonce, ciphertext of the whole record (time, flag and value). Plain records
+never start with the marker (it would be a time centuries ahead), so records written before the encryption was
+enabled stay readable and are sealed on their next write.
+*/
+
+const (
+	CacheEncryptionKeyEnv = "CACHE_ENCRYPTION_KEY"
+
+	encryptedRecordMarker = 0xE1
+)
+
+var (
+	EncryptionKeyError            = errors.New("error: cache encryption key must be 16, 24 or 32 bytes long")
+	MalformedEncryptedRecordError = errors.New("error: malformed encrypted KV record")
+)
+
+type recordCipher struct {
+	gcm    cipher.AEAD
+	keyErr error // Set if the key is unusable: nothing is written then instead of writing plaintext
+}
+
+// NewEncryptedKVBackend returns the backend sealing records with the key, resuming and polling stay available if the
+// backend supports them. With an invalid key all writes fail with EncryptionKeyError
+func NewEncryptedKVBackend(backend KVBackend, key []byte, onError func(key string, err error)) KVBackend {
+	c := &recordCipher{}
+	if block, err := aes.NewCipher(key); err != nil {
+		c.keyErr = EncryptionKeyError
+	} else if c.gcm, err = cipher.NewGCM(block); err != nil {
+		c.keyErr = err
+	}
+	return newTransformingKVBackend(backend, c.seal, c.open, onError)
+}
+
+// Returns the encryption key from the config or the environment, nil if encryption is off
+func encryptionKeyFromConfig(cacheConfig *Config) ([]byte, error) {
+	if len(cacheConfig.encryptionKey) > 0 {
+		return cacheConfig.encryptionKey, nil
+	}
+	if encoded := system.GetEnvMustProceed(CacheEncryptionKeyEnv, ""); len(encoded) > 0 {
+		return base64.StdEncoding.DecodeString(encoded)
+	}
+	return nil, nil
+}
+
+func (e *recordCipher) seal(key string, record []byte) ([]byte, error) {
+	if e.keyErr != nil {
+		return nil, e.keyErr
+	}
+	nonce := make([]byte, 1+e.gcm.NonceSize(), 1+e.gcm.NonceSize()+len(record)+e.gcm.Overhead())
+	nonce[0] = encryptedRecordMarker
+	if _, err := rand.Read(nonce[1:]); err != nil {
+		return nil, err
+	}
+	return e.gcm.Seal(nonce, nonce[1:], record, []byte(key)), nil
+}
+
+func (e *recordCipher) open(key string, sealed []byte) ([]byte, error) {
+	if len(sealed) == 0 || sealed[0] != encryptedRecordMarker {
+		return sealed, nil // Plain record or a complete delete
+	}
+	if e.keyErr != nil {
+		return nil, e.keyErr
+	}
+	if len(sealed) < 1+e.gcm.NonceSize() {
+		return nil, MalformedEncryptedRecordError
+	}
+	return e.gcm.Open(nil, sealed[1:1+e.gcm.NonceSize()], sealed[1+e.gcm.NonceSize():], []byte(key))
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// In-memory key/value backend ---------------------------------------------------------------------
+// Keeps everything in process memory, intended for unit tests and local development without NATS
+
+type memoryKVBackendEntry struct {
+	key      string
+	value    []byte
+	revision uint64
+}
+
+func (e *memoryKVBackendEntry) Key() string      { return e.key }
+func (e *memoryKVBackendEntry) Value() []byte    { return e.value }
+func (e *memoryKVBackendEntry) Revision() uint64 { return e.revision }
+
+type memoryKVBackendWatcher struct {
+	backend    *MemoryKVBackend
+	keyPattern string
+	updates    chan KVBackendEntry
+	// Entries waiting for delivery: Put never blocks on a slow consumer, which may itself be waiting for the putter
+	queueMutex sync.Mutex
+	queue      []KVBackendEntry
+	queued     chan struct{}
+	stopOnce   sync.Once
+	done       chan struct{}
+}
+
+type MemoryKVBackend struct {
+	mutex    sync.Mutex
+	revision uint64
+	entries  map[string]*memoryKVBackendEntry
+	watchers map[*memoryKVBackendWatcher]struct{}
+}
+
+func NewMemoryKVBackend() *MemoryKVBackend {
+	return &MemoryKVBackend{
+		entries:  map[string]*memoryKVBackendEntry{},
+		watchers: map[*memoryKVBackendWatcher]struct{}{},
+	}
+}
+
+func (b *MemoryKVBackend) Get(key string) (KVBackendEntry, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if e, ok := b.entries[key]; ok {
+		return e, nil
+	}
+	return nil, nats.ErrKeyNotFound // Same error as the NATS backend returns
+}
+
+func (b *MemoryKVBackend) Put(key string, value []byte) (uint64, error) {
+	return b.put(key, value, nil)
+}
+
+// Create puts the value only if the key does not exist
+func (b *MemoryKVBackend) Create(key string, value []byte) (uint64, error) {
+	return b.put(key, value, func(e *memoryKVBackendEntry) error {
+		if e != nil {
+			return nats.ErrKeyExists
+		}
+		return nil
+	})
+}
+
+// Update puts the value only if the key's latest revision is the given one
+func (b *MemoryKVBackend) Update(key string, value []byte, revision uint64) (uint64, error) {
+	return b.put(key, value, func(e *memoryKVBackendEntry) error {
+		if e == nil || e.revision != revision {
+			return KVRevisionMismatchError
+		}
+		return nil
+	})
+}
+
+// DeleteRevision deletes the key only if its latest revision is the given one
+func (b *MemoryKVBackend) DeleteRevision(key string, revision uint64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if e, ok := b.entries[key]; !ok || e.revision != revision {
+		return KVRevisionMismatchError
+	}
+	delete(b.entries, key)
+	return nil
+}
+
+// Puts the value if check passes for the existing entry (nil if there is none)
+func (b *MemoryKVBackend) put(key string, value []byte, check func(e *memoryKVBackendEntry) error) (uint64, error) {
+	b.mutex.Lock()
+	if check != nil {
+		if err := check(b.entries[key]); err != nil {
+			b.mutex.Unlock()
+			return 0, err
+		}
+	}
+	b.revision++
+	valueCopy := append([]byte{}, value...)
+	e := &memoryKVBackendEntry{key: key, value: valueCopy, revision: b.revision}
+	b.entries[key] = e
+	watchers := []*memoryKVBackendWatcher{}
+	for w := range b.watchers {
+		if KeyMatchesPattern(key, w.keyPattern) {
+			watchers = append(watchers, w)
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, w := range watchers {
+		w.deliver(e)
+	}
+	return e.revision, nil
+}
+
+func (b *MemoryKVBackend) Delete(key string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.entries[key]; !ok {
+		return nats.ErrKeyNotFound
+	}
+	delete(b.entries, key)
+	return nil
+}
+
+func (b *MemoryKVBackend) Watch(keyPattern string) (KVBackendWatcher, error) {
+	return b.watch(keyPattern, 0)
+}
+
+// Only the latest value of each key is kept, so keys updated after the revision are delivered with their latest values
+func (b *MemoryKVBackend) WatchFromRevision(keyPattern string, revision uint64) (KVBackendWatcher, error) {
+	return b.watch(keyPattern, revision)
+}
+
+func (b *MemoryKVBackend) watch(keyPattern string, fromRevision uint64) (KVBackendWatcher, error) {
+	w := &memoryKVBackendWatcher{backend: b, keyPattern: keyPattern, updates: make(chan KVBackendEntry, 64), queued: make(chan struct{}, 1), done: make(chan struct{})}
+
+	b.mutex.Lock()
+	for key, e := range b.entries {
+		if KeyMatchesPattern(key, keyPattern) && e.revision > fromRevision {
+			w.queue = append(w.queue, e)
+		}
+	}
+	w.queue = append(w.queue, nil)
+	b.watchers[w] = struct{}{}
+	b.mutex.Unlock()
+
+	go w.pump()
+	w.queued <- struct{}{}
+	return w, nil
+}
+
+func (w *memoryKVBackendWatcher) deliver(e KVBackendEntry) {
+	w.queueMutex.Lock()
+	w.queue = append(w.queue, e)
+	w.queueMutex.Unlock()
+	select {
+	case w.queued <- struct{}{}:
+	default:
+	}
+}
+
+// Sends queued entries in order until stopped
+func (w *memoryKVBackendWatcher) pump() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.queued:
+		}
+		w.queueMutex.Lock()
+		entries := w.queue
+		w.queue = nil
+		w.queueMutex.Unlock()
+		for _, e := range entries {
+			select {
+			case w.updates <- e:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+func (w *memoryKVBackendWatcher) Updates() <-chan KVBackendEntry {
+	return w.updates
+}
+
+func (w *memoryKVBackendWatcher) Stop() error {
+	w.stopOnce.Do(func() {
+		w.backend.mutex.Lock()
+		delete(w.backend.watchers, w)
+		w.backend.mutex.Unlock()
+		close(w.done)
+	})
+	return nil
+}
+
+// ------------------------------------------------------------------------------------------------
+
+// KeyMatchesPattern checks a dot-separated key against a NATS-like pattern: "*" matches exactly one token,
+// ">" matches one or more tokens till the end, or till the rest of the pattern if it is not the last token
+func KeyMatchesPattern(key string, pattern string) bool {
+	return keyTokensMatchPattern(strings.Split(key, "."), strings.Split(pattern, "."))
+}
@@ -0,0 +1,210 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+/*
+Routing backend keeps keys of different domains (object contexts, function contexts, graph links) in different
+backends, e.g. NATS KV buckets with their own history, TTL and replicas. A key goes to the first route whose pattern
+it matches, to the default backend otherwise. Watches are merged from all backends, so resuming and polling
+are not available: revisions of different buckets are not comparable. Conditional writes go to the key's backend.
+*/
+
+// KVBackendRoute routes store keys matching Pattern (tokens, "*" and ">") to Backend
+type KVBackendRoute struct {
+	Pattern string
+	Backend KVBackend
+}
+
+// KVBucketConfig describes a NATS KV bucket for the keys routed to it, the bucket is created if does not exist
+type KVBucketConfig struct {
+	Bucket   string
+	History  uint8
+	TTL      time.Duration
+	Replicas int
+}
+
+type routingKVBackendRoute struct {
+	tokens  []string
+	backend KVBackend
+}
+
+type routingKVBackend struct {
+	defaultBackend KVBackend
+	routes         []routingKVBackendRoute
+}
+
+func NewRoutingKVBackend(defaultBackend KVBackend, routes []KVBackendRoute) KVBackend {
+	b := &routingKVBackend{defaultBackend: defaultBackend}
+	for _, route := range routes {
+		b.routes = append(b.routes, routingKVBackendRoute{tokens: strings.Split(route.Pattern, "."), backend: route.Backend})
+	}
+	return b
+}
+
+// Returns NATS KV backends for the cache config's bucket routes, their patterns prefixed with the store prefix
+func natsKVBackendRoutes(js nats.JetStreamContext, cacheConfig *Config) ([]KVBackendRoute, error) {
+	routes := []KVBackendRoute{}
+	for _, route := range cacheConfig.kvBucketRoutes {
+		kv, err := js.KeyValue(route.bucket.Bucket)
+		if err == nats.ErrBucketNotFound {
+			kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+				Bucket:   route.bucket.Bucket,
+				History:  route.bucket.History,
+				TTL:      route.bucket.TTL,
+				Replicas: route.bucket.Replicas,
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, KVBackendRoute{Pattern: cacheConfig.kvStorePrefix + "." + route.keyPattern, Backend: NewNatsKVBackend(js, kv)})
+	}
+	return routes, nil
+}
+
+func (b *routingKVBackend) route(key string) KVBackend {
+	keyTokens := strings.Split(key, ".")
+	for _, r := range b.routes {
+		if keyTokensMatchPattern(keyTokens, r.tokens) {
+			return r.backend
+		}
+	}
+	return b.defaultBackend
+}
+
+func (b *routingKVBackend) Get(key string) (KVBackendEntry, error) {
+	return b.route(key).Get(key)
+}
+
+func (b *routingKVBackend) Put(key string, value []byte) (uint64, error) {
+	return b.route(key).Put(key, value)
+}
+
+func (b *routingKVBackend) Delete(key string) error {
+	return b.route(key).Delete(key)
+}
+
+func (b *routingKVBackend) Create(key string, value []byte) (uint64, error) {
+	if cb, ok := b.route(key).(KVBackendCAS); ok {
+		return cb.Create(key, value)
+	}
+	return 0, KVBackendCASNotSupportedError
+}
+
+func (b *routingKVBackend) Update(key string, value []byte, revision uint64) (uint64, error) {
+	if cb, ok := b.route(key).(KVBackendCAS); ok {
+		return cb.Update(key, value, revision)
+	}
+	return 0, KVBackendCASNotSupportedError
+}
+
+func (b *routingKVBackend) DeleteRevision(key string, revision uint64) error {
+	if cb, ok := b.route(key).(KVBackendCAS); ok {
+		return cb.DeleteRevision(key, revision)
+	}
+	return KVBackendCASNotSupportedError
+}
+
+type routingKVBackendWatcher struct {
+	watchers []KVBackendWatcher
+	updates  chan KVBackendEntry
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Watch merges watches of all backends, the nil entry is delivered once all of them delivered their initial values.
+// Updates are closed as soon as any of the watches closes so the watcher is restarted
+func (b *routingKVBackend) Watch(keyPattern string) (KVBackendWatcher, error) {
+	rw := &routingKVBackendWatcher{updates: make(chan KVBackendEntry), done: make(chan struct{})}
+	for _, backend := range append([]KVBackend{b.defaultBackend}, b.routeBackends()...) {
+		w, err := backend.Watch(keyPattern)
+		if err != nil {
+			system.MsgOnErrorReturn(rw.Stop())
+			return nil, err
+		}
+		rw.watchers = append(rw.watchers, w)
+	}
+
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("cache.routingKVBackendWatcher")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("cache.routingKVBackendWatcher")
+		defer close(rw.updates)
+
+		merged := make(chan KVBackendEntry)
+		closed := make(chan struct{}, len(rw.watchers))
+		for _, w := range rw.watchers {
+			go func(w KVBackendWatcher) {
+				for entry := range w.Updates() {
+					select {
+					case merged <- entry:
+					case <-rw.done:
+						return
+					}
+				}
+				closed <- struct{}{}
+			}(w)
+		}
+
+		initialsLeft := len(rw.watchers)
+		for {
+			select {
+			case entry := <-merged:
+				if entry == nil {
+					if initialsLeft--; initialsLeft > 0 {
+						continue
+					}
+				}
+				select {
+				case rw.updates <- entry:
+				case <-rw.done:
+					return
+				}
+			case <-closed:
+				return
+			case <-rw.done:
+				return
+			}
+		}
+	}()
+	return rw, nil
+}
+
+// Distinct backends of the routes
+func (b *routingKVBackend) routeBackends() []KVBackend {
+	backends := []KVBackend{}
+	for _, r := range b.routes {
+		known := r.backend == b.defaultBackend
+		for _, backend := range backends {
+			known = known || backend == r.backend
+		}
+		if !known {
+			backends = append(backends, r.backend)
+		}
+	}
+	return backends
+}
+
+func (rw *routingKVBackendWatcher) Updates() <-chan KVBackendEntry {
+	return rw.updates
+}
+
+func (rw *routingKVBackendWatcher) Stop() (err error) {
+	rw.stopOnce.Do(func() {
+		close(rw.done)
+		for _, w := range rw.watchers {
+			if e := w.Stop(); e != nil {
+				err = e
+			}
+		}
+	})
+	return
+}
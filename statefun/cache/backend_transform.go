@@ -0,0 +1,242 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+// Transforming backend ---------------------------------------------------------------------------
+// Wraps a backend encoding records before Put and decoding them after Get, Watch and scans,
+// resuming and polling stay available if the wrapped backend supports them
+
+type recordTransform func(key string, record []byte) ([]byte, error)
+
+type transformingKVBackend struct {
+	b       KVBackend
+	encode  recordTransform
+	decode  recordTransform
+	onError func(key string, err error) // Called for watched and scanned records which cannot be decoded
+	// Replace encoding Put and Delete if set, conditional writes are available then only if conditional is set too
+	put         func(key string, value []byte) (uint64, error)
+	delete      func(key string) error
+	conditional KVBackendCAS
+}
+
+type transformedKVBackendEntry struct {
+	KVBackendEntry
+	value []byte
+}
+
+func (e *transformedKVBackendEntry) Value() []byte { return e.value }
+
+func newTransformingKVBackend(backend KVBackend, encode recordTransform, decode recordTransform, onError func(key string, err error)) KVBackend {
+	return wrapTransformingKVBackend(&transformingKVBackend{b: backend, encode: encode, decode: decode, onError: onError})
+}
+
+// Returns the transforming backend with the optional interfaces of the wrapped one
+func wrapTransformingKVBackend(t *transformingKVBackend) KVBackend {
+	_, resumable := t.b.(KVBackendResumable)
+	_, scannable := t.b.(KVBackendScannable)
+	_, cas := t.b.(KVBackendCAS)
+	cas = (cas && t.put == nil && t.delete == nil) || t.conditional != nil
+	r, s, c := transformingKVBackendResumable{t}, transformingKVBackendScannable{t}, transformingKVBackendCAS{t}
+	switch {
+	case resumable && scannable && cas:
+		return &struct {
+			*transformingKVBackend
+			transformingKVBackendResumable
+			transformingKVBackendScannable
+			transformingKVBackendCAS
+		}{t, r, s, c}
+	case resumable && scannable:
+		return &struct {
+			*transformingKVBackend
+			transformingKVBackendResumable
+			transformingKVBackendScannable
+		}{t, r, s}
+	case resumable && cas:
+		return &struct {
+			*transformingKVBackend
+			transformingKVBackendResumable
+			transformingKVBackendCAS
+		}{t, r, c}
+	case scannable && cas:
+		return &struct {
+			*transformingKVBackend
+			transformingKVBackendScannable
+			transformingKVBackendCAS
+		}{t, s, c}
+	case resumable:
+		return &struct {
+			*transformingKVBackend
+			transformingKVBackendResumable
+		}{t, r}
+	case scannable:
+		return &struct {
+			*transformingKVBackend
+			transformingKVBackendScannable
+		}{t, s}
+	case cas:
+		return &struct {
+			*transformingKVBackend
+			transformingKVBackendCAS
+		}{t, c}
+	}
+	return t
+}
+
+// Decodes the entry, nil if it cannot be decoded
+func (t *transformingKVBackend) decodeEntry(entry KVBackendEntry) KVBackendEntry {
+	value, err := t.decode(entry.Key(), entry.Value())
+	if err != nil {
+		if t.onError != nil {
+			t.onError(entry.Key(), err)
+		}
+		return nil
+	}
+	return &transformedKVBackendEntry{KVBackendEntry: entry, value: value}
+}
+
+func (t *transformingKVBackend) Get(key string) (KVBackendEntry, error) {
+	entry, err := t.b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := t.decode(key, entry.Value())
+	if err != nil {
+		return nil, err
+	}
+	return &transformedKVBackendEntry{KVBackendEntry: entry, value: value}, nil
+}
+
+func (t *transformingKVBackend) Put(key string, value []byte) (uint64, error) {
+	if t.put != nil {
+		return t.put(key, value)
+	}
+	encoded, err := t.encode(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return t.b.Put(key, encoded)
+}
+
+func (t *transformingKVBackend) Delete(key string) error {
+	if t.delete != nil {
+		return t.delete(key)
+	}
+	return t.b.Delete(key)
+}
+
+func (t *transformingKVBackend) Watch(keyPattern string) (KVBackendWatcher, error) {
+	w, err := t.b.Watch(keyPattern)
+	if err != nil {
+		return nil, err
+	}
+	return t.decodingWatcher(w), nil
+}
+
+type transformingKVBackendWatcher struct {
+	w       KVBackendWatcher
+	updates chan KVBackendEntry
+}
+
+// Forwards entries of the watcher decoded, entries which cannot be decoded are dropped
+func (t *transformingKVBackend) decodingWatcher(w KVBackendWatcher) KVBackendWatcher {
+	tw := &transformingKVBackendWatcher{w: w, updates: make(chan KVBackendEntry)}
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("cache.transformingKVBackendWatcher")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("cache.transformingKVBackendWatcher")
+		defer close(tw.updates)
+		for entry := range w.Updates() {
+			if entry == nil {
+				tw.updates <- nil
+			} else if decoded := t.decodeEntry(entry); decoded != nil {
+				tw.updates <- decoded
+			}
+		}
+	}()
+	return tw
+}
+
+func (tw *transformingKVBackendWatcher) Updates() <-chan KVBackendEntry {
+	return tw.updates
+}
+
+func (tw *transformingKVBackendWatcher) Stop() error {
+	err := tw.w.Stop()
+	go func() {
+		for range tw.updates {
+		}
+	}()
+	return err
+}
+
+type transformingKVBackendResumable struct {
+	t *transformingKVBackend
+}
+
+func (r transformingKVBackendResumable) WatchFromRevision(keyPattern string, revision uint64) (KVBackendWatcher, error) {
+	w, err := r.t.b.(KVBackendResumable).WatchFromRevision(keyPattern, revision)
+	if err != nil {
+		return nil, err
+	}
+	return r.t.decodingWatcher(w), nil
+}
+
+type transformingKVBackendScannable struct {
+	t *transformingKVBackend
+}
+
+func (s transformingKVBackendScannable) ScanFromRevision(keyPattern string, revision uint64, limit int) ([]KVBackendEntry, uint64, error) {
+	entries, nextRevision, err := s.t.b.(KVBackendScannable).ScanFromRevision(keyPattern, revision, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	decoded := make([]KVBackendEntry, 0, len(entries))
+	for _, entry := range entries {
+		if d := s.t.decodeEntry(entry); d != nil {
+			decoded = append(decoded, d)
+		}
+	}
+	return decoded, nextRevision, nil
+}
+
+func (s transformingKVBackendScannable) LastRevision() (uint64, error) {
+	return s.t.b.(KVBackendScannable).LastRevision()
+}
+
+type transformingKVBackendCAS struct {
+	t *transformingKVBackend
+}
+
+func (c transformingKVBackendCAS) Create(key string, value []byte) (uint64, error) {
+	if c.t.conditional != nil {
+		return c.t.conditional.Create(key, value)
+	}
+	encoded, err := c.t.encode(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return c.t.b.(KVBackendCAS).Create(key, encoded)
+}
+
+func (c transformingKVBackendCAS) Update(key string, value []byte, revision uint64) (uint64, error) {
+	if c.t.conditional != nil {
+		return c.t.conditional.Update(key, value, revision)
+	}
+	encoded, err := c.t.encode(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return c.t.b.(KVBackendCAS).Update(key, encoded, revision)
+}
+
+func (c transformingKVBackendCAS) DeleteRevision(key string, revision uint64) error {
+	if c.t.conditional != nil {
+		return c.t.conditional.DeleteRevision(key, revision)
+	}
+	return c.t.b.(KVBackendCAS).DeleteRevision(key, revision)
+}
+
+// ------------------------------------------------------------------------------------------------
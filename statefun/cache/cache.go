@@ -10,17 +10,15 @@ import (
 	"fmt"
 	"regexp"
 	"sort"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	lg "github.com/foliagecp/sdk/statefun/logger"
-	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/foliagecp/easyjson"
 
-	customNatsKv "github.com/foliagecp/sdk/embedded/nats/kv"
+	sdkErrors "github.com/foliagecp/sdk/errors"
 	"github.com/foliagecp/sdk/statefun/system"
 	"github.com/nats-io/nats.go"
 )
@@ -47,16 +45,50 @@ type StoreValue struct {
 	valueUpdateTime                int64
 	storeMutex                     sync.Mutex
 	notifyUpdates                  sync.Map
+	notifySubtreeUpdates           sync.Map // ">" subscribers, notified about updates at any depth below
 	syncNeeded                     bool
 	syncedWithKV                   bool
+	kvRevision                     uint64     // KV revision of the last record confirmed for the value, 0 - unknown
+	version                        uint64     // Local version incremented on every update and delete
+	lockStats                      *lockStats // Store's lock statistics, nil if disabled
 }
 
 func notifySubscriber(c chan KeyValue, key interface{}, value interface{}) {
 	c <- KeyValue{Key: key, Value: value}
 }
 
+// Level keys are tokens of the tree, notified as keys (see KeyToken)
+func keyTokenOf(key interface{}) interface{} {
+	if token, ok := key.(string); ok {
+		return KeyToken(token)
+	}
+	return key
+}
+
+// Notifies ">" subscribers of level and all its parents, Key is the dot-separated path relative to the subscribed level
+func notifySubtreeSubscribers(level *StoreValue, key interface{}, value interface{}) {
+	relativeKey, _ := key.(string)
+	relativeKey = KeyToken(relativeKey)
+	for level != nil {
+		level.notifySubtreeUpdates.Range(func(_, v interface{}) bool {
+			notifySubscriber(v.(chan KeyValue), relativeKey, value)
+			return true
+		})
+		if levelKey, ok := level.keyInParent.(string); ok && level.parent != nil {
+			relativeKey = KeyToken(levelKey) + "." + relativeKey
+		}
+		level = level.parent
+	}
+}
+
 func (csv *StoreValue) Lock(caller string) {
 	//lg.Logf("------- Locking '%s' by '%s'\n", csv.keyInParent, caller)
+	if ls := csv.lockStats; ls != nil && ls.sampled() {
+		start := time.Now()
+		csv.storeMutex.Lock()
+		ls.account(csv, caller, time.Since(start))
+		return
+	}
 	csv.storeMutex.Lock()
 	//lg.Logf(">>>>>>> Locked '%s' by '%s'\n", csv.keyInParent, caller)
 }
@@ -72,13 +104,13 @@ func (csv *StoreValue) GetFullKeyString() string {
 		if keyStr, ok := csv.keyInParent.(string); ok {
 			prefix := csv.parent.GetFullKeyString()
 			if len(prefix) > 0 {
-				return csv.parent.GetFullKeyString() + "." + keyStr
+				return prefix + "." + KeyToken(keyStr)
 			}
-			return keyStr
+			return KeyToken(keyStr)
 		}
 	} else {
 		if keyStr, ok := csv.keyInParent.(string); ok {
-			return keyStr
+			return KeyToken(keyStr)
 		}
 	}
 	return ""
@@ -114,6 +146,7 @@ func (csv *StoreValue) StoreChild(key interface{}, child *StoreValue, safe bool)
 
 	child.parent = csv
 	child.keyInParent = key
+	child.lockStats = csv.lockStats
 
 	if safe {
 		csv.Lock("StoreChild")
@@ -123,13 +156,20 @@ func (csv *StoreValue) StoreChild(key interface{}, child *StoreValue, safe bool)
 		csv.Unlock("StoreChild")
 	}
 	csv.notifyUpdates.Range(func(_, v interface{}) bool {
-		notifySubscriber(v.(chan KeyValue), key, child.value)
+		notifySubscriber(v.(chan KeyValue), keyTokenOf(key), child.value)
 		return true
 	})
+	notifySubtreeSubscribers(csv, key, child.value)
 }
 
 func (csv *StoreValue) Put(value interface{}, updateInKV bool, customPutTime int64) {
 	csv.Lock("Put")
+	csv.putLocked(value, updateInKV, customPutTime)
+	csv.Unlock("Put")
+}
+
+// Put with the value locked
+func (csv *StoreValue) putLocked(value interface{}, updateInKV bool, customPutTime int64) {
 	key := csv.keyInParent
 
 	csv.value = value
@@ -139,17 +179,17 @@ func (csv *StoreValue) Put(value interface{}, updateInKV bool, customPutTime int
 		customPutTime = system.GetCurrentTimeNs()
 	}
 	csv.valueUpdateTime = customPutTime
+	csv.version++
 	csv.syncNeeded = updateInKV
 	csv.syncedWithKV = !updateInKV
 
 	if csv.parent != nil {
 		csv.parent.notifyUpdates.Range(func(_, v interface{}) bool {
-			notifySubscriber(v.(chan KeyValue), key, value)
+			notifySubscriber(v.(chan KeyValue), keyTokenOf(key), value)
 			return true
 		})
+		notifySubtreeSubscribers(csv.parent, key, value)
 	}
-
-	csv.Unlock("Put")
 }
 
 func (csv *StoreValue) collectGarbage() {
@@ -170,6 +210,10 @@ func (csv *StoreValue) collectGarbage() {
 		noNotifySubscribers = false
 		return false
 	})
+	csv.notifySubtreeUpdates.Range(func(_, _ interface{}) bool {
+		noNotifySubscribers = false
+		return false
+	})
 	canBeDeletedFromParent = csv.purgeState == 2 && len(csv.store) == 0 && !csv.syncNeeded && csv.syncedWithKV && noNotifySubscribers
 	csv.Unlock("collectGarbage")
 
@@ -217,6 +261,7 @@ func (csv *StoreValue) Delete(updateInKV bool, customDeleteTime int64) {
 		customDeleteTime = system.GetCurrentTimeNs()
 	}
 	csv.valueUpdateTime = customDeleteTime
+	csv.version++
 	if updateInKV {
 		csv.purgeState = 1
 		csv.syncNeeded = true
@@ -230,9 +275,10 @@ func (csv *StoreValue) Delete(updateInKV bool, customDeleteTime int64) {
 
 	if csv.parent != nil {
 		csv.parent.notifyUpdates.Range(func(_, v interface{}) bool {
-			notifySubscriber(v.(chan KeyValue), key, nil)
+			notifySubscriber(v.(chan KeyValue), keyTokenOf(key), nil)
 			return true
 		})
+		notifySubtreeSubscribers(csv.parent, key, nil)
 	}
 }
 
@@ -246,6 +292,18 @@ func (csv *StoreValue) Range(f func(key, value interface{}) bool) {
 	}
 }
 
+func (csv *StoreValue) valueSize() int {
+	if bv, ok := csv.value.([]byte); ok {
+		return len(bv)
+	}
+	return 0
+}
+
+type lruEntry struct {
+	updateTime int64
+	size       int
+}
+
 type TransactionOperator struct {
 	operatorType int // 0 - set, 1 - delete
 	key          string
@@ -262,14 +320,24 @@ type Transaction struct {
 
 type Store struct {
 	cacheConfig *Config
-	js          nats.JetStreamContext
-	kv          nats.KeyValue
+	backend     KVBackend
 	ctx         context.Context
 	cancel      context.CancelFunc
 
 	rootValue       *StoreValue
 	lruTresholdTime int64
 	valuesInCache   int
+	bytesInCache    int
+	stats           storeStats
+	lazyWriterSync  lazyWriterSync
+	archiveBackend  ArchiveBackend
+	accessStats     accessStats
+	keyPolicy       keyPolicy
+	evictionChurn   evictionChurn
+	epoch           atomic.Uint64
+	lastKVRevision  atomic.Uint64
+	instanceID      string // Distinguishes own invalidations from the other replicas' ones
+	archiveLocks    archiveLocks
 
 	transactions                sync.Map
 	transactionsMutex           *sync.Mutex
@@ -277,12 +345,31 @@ type Store struct {
 }
 
 func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamContext, kv nats.KeyValue) *Store {
+	if cacheConfig.archiveIdleDays > 0 && cacheConfig.archiveBackend == nil && len(cacheConfig.archiveObjectStoreBucket) > 0 {
+		if archiveBackend, err := NewNatsObjectStoreArchiveBackend(js, cacheConfig.archiveObjectStoreBucket); err == nil {
+			config := *cacheConfig // The caller's config is left as is
+			cacheConfig = config.SetArchiveBackend(archiveBackend)
+		} else {
+			lg.Logf(lg.ErrorLevel, "Cache archive object store %s is not available: %s\n", cacheConfig.archiveObjectStoreBucket, err)
+		}
+	}
+	backend := NewNatsKVBackend(js, kv)
+	if len(cacheConfig.kvBucketRoutes) > 0 {
+		if routes, err := natsKVBackendRoutes(js, cacheConfig); err == nil {
+			backend = NewRoutingKVBackend(backend, routes)
+		} else {
+			lg.Logf(lg.ErrorLevel, "Cache KV buckets for key routes are not available: %s\n", err)
+		}
+	}
+	return NewCacheStoreWithBackend(ctx, cacheConfig, backend)
+}
+
+func NewCacheStoreWithBackend(ctx context.Context, cacheConfig *Config, backend KVBackend) *Store {
 	var inited atomic.Bool
 	initChan := make(chan bool)
 	cs := Store{
 		cacheConfig: cacheConfig,
-		js:          js,
-		kv:          kv,
+		backend:     backend,
 		rootValue: &StoreValue{
 			parent:                         nil,
 			value:                          nil,
@@ -293,76 +380,105 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 			syncNeeded:                     false,
 			syncedWithKV:                   true,
 			valueUpdateTime:                -1,
+			lockStats:                      newLockStats(cacheConfig),
 		},
 		lruTresholdTime:             0,
 		valuesInCache:               0,
+		lazyWriterSync:              newLazyWriterSync(),
+		archiveBackend:              cacheConfig.archiveBackend,
 		transactionsMutex:           &sync.Mutex{},
 		getKeysByPatternFromKVMutex: &sync.Mutex{},
 	}
 
 	cs.ctx, cs.cancel = context.WithCancel(ctx)
+	cs.ReserveKeyPattern(CacheKeysOwner, CacheEpochKey)
+	if encryptionKey, err := encryptionKeyFromConfig(cacheConfig); err != nil || len(encryptionKey) > 0 {
+		if err != nil {
+			cs.reportError("kv_encryption", CacheEncryptionKeyEnv, err)
+		}
+		cs.backend = NewEncryptedKVBackend(cs.backend, encryptionKey, func(key string, err error) {
+			cs.reportError("kv_decrypt", key, err)
+		})
+	}
+	if cacheConfig.compressionThreshold > 0 {
+		cs.backend = NewCompressedKVBackend(cs.backend, cacheConfig.compressionCodec, cacheConfig.compressionThreshold, func(key string, err error) {
+			cs.reportError("kv_decompress", key, err)
+		})
+	}
+	if cacheConfig.deltaThreshold > 0 && cacheConfig.dedupThreshold <= 0 {
+		deltaBackend, err := NewDeltaKVBackend(cs.backend, cacheConfig.kvStorePrefix, cacheConfig.kvStorePrefix+"_delta", cacheConfig.deltaThreshold, cacheConfig.deltaSnapshotEvery, func(key string, err error) {
+			cs.reportError("kv_delta", key, err)
+		})
+		if err == nil {
+			cs.backend = deltaBackend
+		} else {
+			cs.reportError("kv_delta", cacheConfig.kvStorePrefix, err)
+		}
+	} else if cacheConfig.deltaThreshold > 0 {
+		cs.reportError("kv_delta", cacheConfig.kvStorePrefix, DeltaWithDedupError)
+	}
+	if cacheConfig.dedupThreshold > 0 {
+		dedupBackend, err := NewDedupKVBackend(cs.backend, cacheConfig.kvStorePrefix+"_content", cacheConfig.dedupThreshold, func(key string, err error) {
+			cs.reportError("kv_dedup", key, err)
+		})
+		if err == nil {
+			cs.backend = dedupBackend
+		} else {
+			cs.reportError("kv_dedup", cacheConfig.kvStorePrefix, err)
+		}
+	}
+	if _, ok := cs.backend.(KVBackendCAS); !ok {
+		cs.logger().Logf(lg.WarnLevel, "Cache KV backend does not support conditional writes, writes of %s are not fenced\n", cacheConfig.kvStorePrefix)
+	}
 
 	storeUpdatesHandler := func(cs *Store) {
 		system.GlobalPrometrics.GetRoutinesCounter().Started("cache.storeUpdatesHandler")
 		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("cache.storeUpdatesHandler")
-		if w, err := kv.Watch(cacheConfig.kvStorePrefix+".>", nats.IgnoreDeletes()); err == nil {
+		for cs.ctx.Err() == nil {
+			w, resumed, err := cs.watchKVUpdates()
+			if err != nil {
+				cs.reportError("kv_watch", cacheConfig.kvStorePrefix+".>", err)
+				select {
+				case <-cs.ctx.Done():
+				case <-time.After(time.Duration(cs.cacheConfig.watchRestartIntervalMs) * time.Millisecond):
+				}
+				continue
+			}
+
+			// Full re-watch after a watcher loss: keys not delivered initially were deleted from KV meanwhile
+			var reconciliationKeys map[string]struct{}
+			if !resumed && inited.Load() {
+				reconciliationKeys = map[string]struct{}{}
+			}
+
 			activeKVSync := true
 			for activeKVSync {
 				select {
 				case <-cs.ctx.Done():
 					activeKVSync = false
-				case entry := <-w.Updates():
-					if entry != nil {
-						key := cs.fromStoreKey(entry.Key())
-						valueBytes := entry.Value()
-						if len(valueBytes) >= 9 { // Update or delete signal from KV store
-							appendFlag := valueBytes[8]
-							kvRecordTime := int64(binary.BigEndian.Uint64(valueBytes[:8]))
-
-							cacheRecordTime := cs.GetValueUpdateTime(key)
-							if kvRecordTime > cacheRecordTime {
-								if appendFlag == 1 {
-									//lg.Logf("---CACHE_KV TF UPDATE: %s, %d, %d\n", key, kvRecordTime, appendFlag)
-									cs.SetValue(key, valueBytes[9:], false, kvRecordTime, "")
-								} else { // Someone else (other module) deleted a key from the cache
-									//lg.Logf("---CACHE_KV TF DELETE: %s, %d, %d\n", key, kvRecordTime, appendFlag)
-
-									//system.MsgOnErrorReturn(kv.Delete(entry.Key()))
-									system.MsgOnErrorReturn(customNatsKv.DeleteKeyValueValue(cs.js, cs.kv, entry.Key()))
-
-									//cs.rootValue.purgeReady
-									//if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
-									//	csv.Purge(true)
-									//}
-								}
-							} else if kvRecordTime == cacheRecordTime { // KV confirmes update
-								if appendFlag == 0 {
-									//system.MsgOnErrorReturn(kv.Delete(entry.Key()))
-									system.MsgOnErrorReturn(customNatsKv.DeleteKeyValueValue(cs.js, cs.kv, entry.Key()))
-								}
-								if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
-									csv.Lock("storeUpdatesHandler")
-									csv.syncedWithKV = true
-									csv.TryPurgeConfirm(false)
-									csv.Unlock("storeUpdatesHandler")
-								}
-								//lg.Logf("---CACHE_KV TF TOO OLD: %s, %d, %d\n", key, kvRecordTime, appendFlag)
+				case entry, ok := <-w.Updates():
+					if !ok { // Watcher is lost (e.g. NATS connection dropped), restarting it
+						cs.logger().Logf(lg.WarnLevel, "Cache KV watcher stopped after revision %d, restarting\n", cs.lastKVRevision.Load())
+						activeKVSync = false
+					} else if entry != nil {
+						if entry.Revision() <= cs.lastKVRevision.Load() && inited.Load() {
+							if reconciliationKeys != nil {
+								reconciliationKeys[cs.fromStoreKey(entry.Key())] = struct{}{}
 							}
-						} else if len(valueBytes) == 0 { // Complete delete signal from KV store
-							if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
-								csv.Lock("storeUpdatesHandler complete_delete")
-								csv.syncedWithKV = true
-								csv.TryPurgeReady(false)
-								csv.TryPurgeConfirm(false)
-								csv.Unlock("storeUpdatesHandler complete_delete")
-							}
-							//lg.Logf("---CACHE_KV EMPTY: %s\n", key)
-							// Deletion notify - omitting cause value must already be deleted from the cache
-						} else {
-							//lg.Logf("---CACHE_KV !T!F: %s\n", key)
-							lg.Logf(lg.ErrorLevel, "storeUpdatesHandler: received value without time and append flag!\n")
+							continue // Already seen before the restart
 						}
+						if entry.Revision() > cs.lastKVRevision.Load() { // Initial values may come unordered
+							cs.lastKVRevision.Store(entry.Revision())
+						}
+						if reconciliationKeys != nil {
+							reconciliationKeys[cs.fromStoreKey(entry.Key())] = struct{}{}
+						}
+						cs.applyKVEntry(entry, inited.Load())
 					} else {
+						if reconciliationKeys != nil {
+							cs.reconcileWithKV(reconciliationKeys)
+							reconciliationKeys = nil
+						}
 						if inited.CompareAndSwap(false, true) {
 							close(initChan)
 						}
@@ -370,22 +486,28 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 				}
 			}
 			system.MsgOnErrorReturn(w.Stop())
-		} else {
-			lg.Logf(lg.ErrorLevel, "storeUpdatesHandler kv.Watch error %s\n", err)
 		}
 	}
 	kvLazyWriter := func(cs *Store) {
 		system.GlobalPrometrics.GetRoutinesCounter().Started("cache.kvLazyWriter")
 		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("cache.kvLazyWriter")
+		var lastLRUScan time.Time
 		for {
 			select {
 			case <-cs.ctx.Done():
+				return
 			default:
 				cacheStoreValueStack := []*StoreValue{cs.rootValue}
 				suffixPathsStack := []string{""}
 				depthsStack := []int{0}
 
-				lruTimes := []int64{}
+				lruEntries := []lruEntry{}
+				loopStart := time.Now()
+				var pendingKVSyncs int64 = 0
+
+				evicted := []KeyValue{} // Reported after the pass not to call back under the tree locks
+				lruScan := time.Since(lastLRUScan) >= time.Duration(cs.cacheConfig.lruScanIntervalMs)*time.Millisecond
+				writesLeft := cs.cacheConfig.lazyWriterWriteBudget
 
 				for len(cacheStoreValueStack) > 0 {
 					lastID := len(cacheStoreValueStack) - 1
@@ -393,7 +515,7 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 					currentStoreValue := cacheStoreValueStack[lastID]
 
 					currentStoreValue.Lock("kvLazyWriter")
-					lruTimes = append(lruTimes, currentStoreValue.valueUpdateTime)
+					lruEntries = append(lruEntries, lruEntry{updateTime: currentStoreValue.valueUpdateTime, size: currentStoreValue.valueSize()})
 					currentStoreValue.Unlock("kvLazyWriter")
 
 					currentSuffix := suffixPathsStack[lastID]
@@ -409,50 +531,55 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 
 						var newSuffix string
 						if currentDepth == 0 {
-							newSuffix = currentSuffix + key.(string)
+							newSuffix = currentSuffix + KeyToken(key.(string))
 						} else {
-							newSuffix = currentSuffix + "." + key.(string)
+							newSuffix = currentSuffix + "." + KeyToken(key.(string))
 						}
 
 						var finalBytes []byte = nil
 
 						csvChild := value.(*StoreValue)
 						var valueUpdateTime int64 = 0
+						var valueKVRevision uint64 = 0
 						csvChild.Lock("kvLazyWriter")
 						if csvChild.syncNeeded {
 							valueUpdateTime = csvChild.valueUpdateTime
-							timeBytes := make([]byte, 8)
-							binary.BigEndian.PutUint64(timeBytes, uint64(csvChild.valueUpdateTime))
+							valueKVRevision = csvChild.kvRevision
 							if csvChild.valueExists {
-								header := append(timeBytes, 1) // Add append flag "1"
-								finalBytes = append(header, csvChild.value.([]byte)...)
+								finalBytes = kvRecordBytes(csvChild.valueUpdateTime, csvChild.value.([]byte), true)
 							} else {
-								finalBytes = append(timeBytes, 0) // Add delete flag "0"
+								finalBytes = kvRecordBytes(csvChild.valueUpdateTime, nil, false)
 							}
-						} else {
+						} else if lruScan {
 							if csvChild.valueUpdateTime > 0 && csvChild.valueUpdateTime <= cs.lruTresholdTime && csvChild.purgeState == 0 { // Older than or equal to specific time
 								// currentStoreValue locked by range no locking/unlocking needed
 								currentStoreValue.ConsistencyLoss(system.GetCurrentTimeNs())
 								//lg.Logf("Consistency lost for key=\"%s\" store\n", currentStoreValue.GetFullKeyString())
 								//lg.Logln("Purging: " + newSuffix)
 								csvChild.TryPurgeReady(false)
-								csvChild.TryPurgeConfirm(false)
+								if csvChild.TryPurgeConfirm(false) {
+									cs.stats.evictions.Add(1)
+									cs.accountEviction(newSuffix)
+									if cs.cacheConfig.onEvict != nil && csvChild.valueExists {
+										evicted = append(evicted, KeyValue{Key: newSuffix, Value: csvChild.value})
+									}
+								}
 							}
 						}
 						csvChild.Unlock("kvLazyWriter")
 
 						// Putting value into KV store ------------------
-						if csvChild.syncNeeded {
+						if csvChild.syncNeeded && cs.cacheConfig.lazyWriterWriteBudget > 0 && writesLeft <= 0 {
+							pendingKVSyncs++ // Write budget of the pass is exhausted
+						} else if csvChild.syncNeeded {
+							writesLeft--
 							keyStr := key.(string)
-							_, putErr := kv.Put(cs.toStoreKey(newSuffix), finalBytes)
+							revision, newerEntry, putErr := cs.putFenced(cs.toStoreKey(newSuffix), finalBytes, valueKVRevision, valueUpdateTime)
 							if putErr == nil {
-								csvChild.Lock("kvLazyWriter")
-								if valueUpdateTime == csvChild.valueUpdateTime {
-									csvChild.syncNeeded = false
-								}
-								csvChild.Unlock("kvLazyWriter")
+								cs.confirmFencedPut(csvChild, newSuffix, valueUpdateTime, revision, newerEntry)
 							} else {
-								lg.Logf(lg.ErrorLevel, "Store kvLazyWriter cannot update key=%s\n: %s", keyStr, putErr)
+								pendingKVSyncs++
+								cs.reportError("kv_put", keyStr, putErr)
 							}
 						}
 						// ----------------------------------------------
@@ -468,11 +595,15 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 					}
 				}
 
-				sort.Slice(lruTimes, func(i, j int) bool { return lruTimes[i] > lruTimes[j] })
-				if len(lruTimes) > cacheConfig.lruSize {
-					cs.lruTresholdTime = lruTimes[cacheConfig.lruSize-1]
-				} else {
-					cs.lruTresholdTime = lruTimes[len(lruTimes)-1]
+				for _, kv := range evicted {
+					value, _ := kv.Value.([]byte)
+					cs.cacheConfig.onEvict(kv.Key.(string), value)
+				}
+
+				if lruScan {
+					sort.Slice(lruEntries, func(i, j int) bool { return lruEntries[i].updateTime > lruEntries[j].updateTime })
+					cs.lruTresholdTime = cs.calcLRUTresholdTime(lruEntries)
+					lastLRUScan = time.Now()
 				}
 
 				/*// Debug info -----------------------------------------------------
@@ -485,31 +616,146 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 				}
 				// ----------------------------------------------------------------*/
 
-				cs.valuesInCache = len(lruTimes)
-
-				if gaugeVec, err := system.GlobalPrometrics.EnsureGaugeVecSimple("cache_values", "", []string{"id"}); err == nil {
-					gaugeVec.With(prometheus.Labels{"id": cs.cacheConfig.id}).Set(float64(cs.valuesInCache))
+				cs.valuesInCache = len(lruEntries)
+				cs.bytesInCache = 0
+				for _, e := range lruEntries {
+					cs.bytesInCache += e.size
 				}
 
-				time.Sleep(100 * time.Millisecond) // Prevents too many locks and prevents too much processor time consumption
+				cs.stats.values.Store(int64(cs.valuesInCache))
+				cs.stats.bytes.Store(int64(cs.bytesInCache))
+				cs.stats.pendingKVSyncs.Store(pendingKVSyncs)
+				cs.stats.lazyWriterLoopDuration.Store(int64(time.Since(loopStart)))
+
+				system.Metrics().SetGauge("cache_values", "", map[string]string{"id": cs.cacheConfig.id}, float64(cs.valuesInCache))
+				system.Metrics().SetGauge("cache_values_bytes", "", map[string]string{"id": cs.cacheConfig.id}, float64(cs.bytesInCache))
+
+				cs.lazyWriterPassCompleted(pendingKVSyncs)
+
+				// Prevents too many locks and prevents too much processor time consumption, Flush can wake the writer up earlier
+				select {
+				case <-cs.lazyWriterSync.wakeup:
+				case <-time.After(time.Duration(cs.cacheConfig.lazyWriterSyncIntervalMs) * time.Millisecond):
+				}
 			}
 		}
 	}
 	go storeUpdatesHandler(&cs)
 	go kvLazyWriter(&cs)
 	<-initChan
+	cs.startInvalidation()
+	if cs.archiveBackend != nil && cacheConfig.archiveIdleDays > 0 {
+		if _, ok := cs.backend.(KVBackendCAS); ok {
+			go cs.runArchiver()
+		} else { // Archived values are still rehydrated
+			cs.reportError("archive", cacheConfig.kvStorePrefix, KVBackendCASNotSupportedError)
+		}
+	}
 	return &cs
 }
 
+// Applies a single update received from the KV watcher to the cache
+func (cs *Store) applyKVEntry(entry KVBackendEntry, inited bool) {
+	key := cs.fromStoreKey(entry.Key())
+	valueBytes := entry.Value()
+	if key == CacheEpochKey {
+		cs.handleEpochRecord(valueBytes, inited)
+	} else if len(valueBytes) >= 9 { // Update or delete signal from KV store
+		appendFlag := valueBytes[8]
+		kvRecordTime := int64(binary.BigEndian.Uint64(valueBytes[:8]))
+
+		if cs.resolveKVConflict(key, ConflictVersion{Value: valueBytes[9:], Exists: appendFlag == 1, Time: kvRecordTime}) {
+			return
+		}
+		cacheRecordTime := cs.GetValueUpdateTime(key)
+		if kvRecordTime > cacheRecordTime {
+			if appendFlag == 1 {
+				//lg.Logf("---CACHE_KV TF UPDATE: %s, %d, %d\n", key, kvRecordTime, appendFlag)
+				cs.setValue(key, valueBytes[9:], false, kvRecordTime, "")
+				cs.setKVRevision(key, kvRecordTime, entry.Revision())
+			} else { // Someone else (other module) deleted a key from the cache
+				//lg.Logf("---CACHE_KV TF DELETE: %s, %d, %d\n", key, kvRecordTime, appendFlag)
+
+				//system.MsgOnErrorReturn(kv.Delete(entry.Key()))
+				system.MsgOnErrorReturn(cs.backend.Delete(entry.Key()))
+
+				//cs.rootValue.purgeReady
+				//if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
+				//	csv.Purge(true)
+				//}
+			}
+		} else if kvRecordTime == cacheRecordTime { // KV confirmes update
+			if appendFlag == 0 {
+				//system.MsgOnErrorReturn(kv.Delete(entry.Key()))
+				system.MsgOnErrorReturn(cs.backend.Delete(entry.Key()))
+			}
+			if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
+				csv.Lock("storeUpdatesHandler")
+				csv.syncedWithKV = true
+				csv.kvRevision = entry.Revision()
+				csv.TryPurgeConfirm(false)
+				csv.Unlock("storeUpdatesHandler")
+			}
+			//lg.Logf("---CACHE_KV TF TOO OLD: %s, %d, %d\n", key, kvRecordTime, appendFlag)
+		}
+	} else if len(valueBytes) == 0 { // Complete delete signal from KV store
+		if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
+			csv.Lock("storeUpdatesHandler complete_delete")
+			csv.syncedWithKV = true
+			csv.TryPurgeReady(false)
+			csv.TryPurgeConfirm(false)
+			csv.Unlock("storeUpdatesHandler complete_delete")
+		}
+		//lg.Logf("---CACHE_KV EMPTY: %s\n", key)
+		// Deletion notify - omitting cause value must already be deleted from the cache
+	} else {
+		//lg.Logf("---CACHE_KV !T!F: %s\n", key)
+		cs.reportError("kv_watch", key, MalformedKVRecordError)
+	}
+}
+
+// lruEntries must be sorted from the most recently updated to the least one
+// Values updated before or at the returned time are purged from the cache
+func (cs *Store) calcLRUTresholdTime(lruEntries []lruEntry) int64 {
+	var tresholdTime int64
+	if len(lruEntries) > cs.cacheConfig.lruSize {
+		tresholdTime = lruEntries[cs.cacheConfig.lruSize-1].updateTime
+	} else {
+		tresholdTime = lruEntries[len(lruEntries)-1].updateTime
+	}
+
+	if cs.cacheConfig.lruMaxBytes > 0 {
+		totalBytes := 0
+		for _, e := range lruEntries {
+			totalBytes += e.size
+			if totalBytes > cs.cacheConfig.lruMaxBytes {
+				if e.updateTime > tresholdTime {
+					tresholdTime = e.updateTime
+				}
+				break
+			}
+		}
+	}
+
+	return tresholdTime
+}
+
 // key - level callback key, for e.g. "a.b.c.*"
 // callbackID - unique id for this subscription
+// SubscribeLevelCallback notifies about updates of direct children of the key's level ("a.b.*"),
+// a key ending with ">" ("a.b.>") subscribes to updates of the whole subtree with keys relative to the level.
+// Notified keys are escaped as keys are (see KeyToken)
 func (cs *Store) SubscribeLevelCallback(key string, callbackID string) chan KeyValue {
-	if _, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, true); parentCacheStoreValue != nil {
+	if keyLastToken, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, true); parentCacheStoreValue != nil {
 		onBufferOverflow := func() {
-			lg.Logf(lg.WarnLevel, "SubscribeLevelCallback SubscriptionNotificationsBuffer overflow for key=%s!\n", key)
+			cs.logger().Logf(lg.WarnLevel, "SubscribeLevelCallback SubscriptionNotificationsBuffer overflow for key=%s!\n", key)
 		}
 		callbackChannelIn, callbackChannelOut := system.CreateDimSizeChannel[KeyValue](cs.cacheConfig.levelSubscriptionNotificationsBufferMaxSize, onBufferOverflow)
-		parentCacheStoreValue.notifyUpdates.Store(callbackID, callbackChannelIn)
+		if keyLastToken == ">" {
+			parentCacheStoreValue.notifySubtreeUpdates.Store(callbackID, callbackChannelIn)
+		} else {
+			parentCacheStoreValue.notifyUpdates.Store(callbackID, callbackChannelIn)
+		}
 
 		return callbackChannelOut
 	}
@@ -517,13 +763,17 @@ func (cs *Store) SubscribeLevelCallback(key string, callbackID string) chan KeyV
 }
 
 func (cs *Store) UnsubscribeLevelCallback(key string, callbackID string) {
-	if _, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, false); parentCacheStoreValue != nil {
-		if v, ok := parentCacheStoreValue.notifyUpdates.Load(callbackID); ok {
+	if keyLastToken, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, false); parentCacheStoreValue != nil {
+		subscribers := &parentCacheStoreValue.notifyUpdates
+		if keyLastToken == ">" {
+			subscribers = &parentCacheStoreValue.notifySubtreeUpdates
+		}
+		if v, ok := subscribers.Load(callbackID); ok {
 			if callbackChannelIn, ok := v.(chan KeyValue); ok {
 				close(callbackChannelIn)
 			}
 		}
-		parentCacheStoreValue.notifyUpdates.Delete(callbackID)
+		subscribers.Delete(callbackID)
 	}
 }
 
@@ -547,6 +797,7 @@ func (cs *Store) GetValue(key string) ([]byte, error) {
 	var resultError error = nil
 
 	cacheMiss := true
+	cs.accountAccess(key, false)
 
 	if keyLastToken, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, false); len(keyLastToken) > 0 && parentCacheStoreValue != nil {
 		if csv, ok := parentCacheStoreValue.LoadChild(keyLastToken, true); ok {
@@ -556,16 +807,25 @@ func (cs *Store) GetValue(key string) ([]byte, error) {
 				if bv, ok := csv.value.([]byte); ok {
 					result = bv
 				}
+			} else if csv.valueUpdateTime < 0 { // Local state was dropped on epoch change, value is unknown
+				cacheMiss = true
 			} else { // Value was intenionally deleted and was marked so, no cache miss policy can be applied here
-				resultError = fmt.Errorf("Value for for key=%s does not exist", key)
+				resultError = sdkErrors.Newf(sdkErrors.ErrKeyNotFound, "Value for for key=%s does not exist", key)
 			}
 			csv.Unlock("GetValue")
 		}
 	}
 
+	if cacheMiss {
+		cs.stats.misses.Add(1)
+		cs.accountMiss(key)
+	} else {
+		cs.stats.hits.Add(1)
+	}
+
 	// Cache miss -----------------------------------------
 	if cacheMiss {
-		if entry, err := cs.kv.Get(cs.toStoreKey(key)); err == nil {
+		if entry, err := cs.backend.Get(cs.toStoreKey(key)); err == nil {
 			key := cs.fromStoreKey(entry.Key())
 			valueBytes := entry.Value()
 			result = valueBytes[9:]
@@ -574,16 +834,24 @@ func (cs *Store) GetValue(key string) ([]byte, error) {
 				appendFlag := valueBytes[8]
 				kvRecordTime := int64(binary.BigEndian.Uint64(valueBytes[:8]))
 				if appendFlag == 1 { // Valid value exists in KV store
-					cs.SetValue(key, result, false, kvRecordTime, "")
+					cs.setValue(key, result, false, kvRecordTime, "")
+					cs.setKVRevision(key, kvRecordTime, entry.Revision())
 					resultError = nil
 				}
 			}
+		} else if err == nats.ErrKeyNotFound {
+			resultError = sdkErrors.Wrap(sdkErrors.ErrKeyNotFound, err)
 		} else {
 			resultError = err
 		}
 	}
 	// ----------------------------------------------------
 
+	// Archived root key is transparently restored from the archive
+	if resultError == nil && cs.archiveBackend != nil && isArchiveStub(result) && keyDotIndex(key, false) < 0 {
+		result, resultError = cs.rehydrate(key)
+	}
+
 	return result, resultError
 }
 
@@ -609,26 +877,102 @@ func (cs *Store) TransactionBegin(transactionID string) {
 	}
 }
 
-func (cs *Store) TransactionEnd(transactionID string) {
-	if v, ok := cs.transactions.Load(transactionID); ok {
+// TransactionEnd commits the transaction when its outermost begin is ended: operators going to KV are written
+// synchronously all-or-nothing (already written ones are rolled back on a failure), then applied to the cache
+func (cs *Store) TransactionEnd(transactionID string) error {
+	v, ok := cs.transactions.Load(transactionID)
+	if !ok {
+		return nil
+	}
+	transaction := v.(*Transaction)
+	transaction.mutex.Lock()
+	defer transaction.mutex.Unlock()
+
+	transaction.beginCounter--
+	if transaction.beginCounter > 0 {
+		return nil
+	}
+	cs.transactions.Delete(transactionID)
+
+	cs.transactionsMutex.Lock()
+	defer cs.transactionsMutex.Unlock()
+
+	if err := cs.commitTransactionToKV(transaction.operators); err != nil {
+		return err
+	}
+	for _, op := range transaction.operators {
+		// updateInKV is kept so the lazy writer rewrites values it might have overwritten with stale ones while committing
+		switch op.operatorType {
+		case 0:
+			cs.setValue(op.key, op.value, op.updateInKV, op.customTime, "")
+		case 1:
+			cs.deleteValue(op.key, op.updateInKV, op.customTime, "")
+		}
+	}
+	return nil
+}
+
+// TransactionAbort discards all buffered operators of the transaction regardless of nested begins
+func (cs *Store) TransactionAbort(transactionID string) {
+	if v, ok := cs.transactions.LoadAndDelete(transactionID); ok {
 		transaction := v.(*Transaction)
 		transaction.mutex.Lock()
-		transaction.beginCounter--
-		if transaction.beginCounter == 0 {
-			cs.transactionsMutex.Lock()
-			for _, op := range transaction.operators {
-				switch op.operatorType {
-				case 0:
-					cs.SetValue(op.key, op.value, op.updateInKV, op.customTime, "")
-				case 1:
-					cs.DeleteValue(op.key, op.updateInKV, op.customTime, "")
-				}
+		transaction.operators = nil
+		transaction.beginCounter = 0
+		transaction.mutex.Unlock()
+	}
+}
+
+func (cs *Store) commitTransactionToKV(operators []*TransactionOperator) error {
+	type kvRollback struct {
+		storeKey string
+		record   []byte // nil - key did not exist in KV
+	}
+	rollbacks := []kvRollback{}
+
+	rollback := func() {
+		now := system.GetCurrentTimeNs() // Newer than committed records so the rollback wins everywhere
+		for i := len(rollbacks) - 1; i >= 0; i-- {
+			record := kvRecordBytes(now, nil, false)
+			if rollbacks[i].record != nil && len(rollbacks[i].record) >= 9 && rollbacks[i].record[8] == 1 {
+				record = kvRecordBytes(now, rollbacks[i].record[9:], true)
+			}
+			if _, err := cs.backend.Put(rollbacks[i].storeKey, record); err != nil {
+				cs.reportError("transaction_rollback", rollbacks[i].storeKey, err)
 			}
-			cs.transactionsMutex.Unlock()
-			cs.transactions.Delete(transactionID)
 		}
-		transaction.mutex.Unlock()
 	}
+
+	for _, op := range operators {
+		if !op.updateInKV {
+			continue
+		}
+		if op.operatorType == 0 && !cs.validKey(op.key) {
+			continue // Same as SetValue does
+		}
+		storeKey := cs.toStoreKey(op.key)
+
+		var previous []byte
+		if entry, err := cs.backend.Get(storeKey); err == nil {
+			previous = entry.Value()
+		} else if err != nats.ErrKeyNotFound {
+			rollback()
+			return err
+		}
+		rollbacks = append(rollbacks, kvRollback{storeKey: storeKey, record: previous})
+
+		var record []byte
+		if op.operatorType == 0 {
+			record = kvRecordBytes(op.customTime, op.value, true)
+		} else {
+			record = kvRecordBytes(op.customTime, nil, false)
+		}
+		if _, err := cs.backend.Put(storeKey, record); err != nil {
+			rollback()
+			return err
+		}
+	}
+	return nil
 }
 
 /*func (cs *Store) SetValueIfEquals(key string, newValue []byte, updateInKV bool, customSetTime int64, compareValue []byte) bool {
@@ -647,7 +991,7 @@ func (cs *Store) TransactionEnd(transactionID string) {
 			}
 			return false
 		} else {
-			csvUpdate = &StoreValue{value: newValue, storeMutex: &sync.Mutex{}, store: make(map[interface{}]*StoreValue), storeConsistencyWithKVLossTime: 0, valueExists: true, purgeState: 0, syncNeeded: updateInKV, syncedWithKV: !updateInKV, valueUpdateTime: customSetTime}
+			csvUpdate = &StoreValue{value: newValue, storeMutex: &sync.Mutex{}, store: make(map[interface{}]*StoreValue), storeConsistencyWithKVLossTime: 0, valueExists: true, purgeState: 0, syncNeeded: updateInKV, syncedWithKV: !updateInKV, valueUpdateTime: customSetTime, version: 1}
 			parentCacheStoreValue.StoreChild(keyLastToken, csvUpdate)
 			return true
 		}
@@ -656,7 +1000,15 @@ func (cs *Store) TransactionEnd(transactionID string) {
 }*/
 
 func (cs *Store) SetValueIfDoesNotExist(key string, newValue []byte, updateInKV bool, customSetTime int64) bool {
-	if !keyValidationRegexp.MatchString(key) {
+	if err := cs.checkKeyWrite("", key); err != nil {
+		cs.reportError("key_policy", key, err)
+		return false
+	}
+	return cs.setValueIfDoesNotExist(key, newValue, updateInKV, customSetTime)
+}
+
+func (cs *Store) setValueIfDoesNotExist(key string, newValue []byte, updateInKV bool, customSetTime int64) bool {
+	if !cs.validKey(key) {
 		return false
 	}
 
@@ -674,7 +1026,7 @@ func (cs *Store) SetValueIfDoesNotExist(key string, newValue []byte, updateInKV
 				return true
 			}
 		} else {
-			csvUpdate = &StoreValue{value: newValue, store: make(map[interface{}]*StoreValue), storeConsistencyWithKVLossTime: 0, valueExists: true, purgeState: 0, syncNeeded: updateInKV, syncedWithKV: !updateInKV, valueUpdateTime: customSetTime}
+			csvUpdate = &StoreValue{value: newValue, store: make(map[interface{}]*StoreValue), storeConsistencyWithKVLossTime: 0, valueExists: true, purgeState: 0, syncNeeded: updateInKV, syncedWithKV: !updateInKV, valueUpdateTime: customSetTime, version: 1}
 			parentCacheStoreValue.StoreChild(keyLastToken, csvUpdate, false)
 			return true
 		}
@@ -683,13 +1035,22 @@ func (cs *Store) SetValueIfDoesNotExist(key string, newValue []byte, updateInKV
 }
 
 func (cs *Store) SetValue(key string, value []byte, updateInKV bool, customSetTime int64, transactionID string) bool {
-	if !keyValidationRegexp.MatchString(key) {
+	err := cs.setValueChecked(key, value, updateInKV, customSetTime, transactionID)
+	if err != nil {
+		cs.reportWriteError(key, transactionID, err)
+	}
+	return err == nil || err == TransactionNotFoundError // A missing transaction never failed SetValue
+}
+
+func (cs *Store) setValue(key string, value []byte, updateInKV bool, customSetTime int64, transactionID string) bool {
+	if !cs.validKey(key) {
 		return false
 	}
 
 	if customSetTime < 0 {
 		customSetTime = system.GetCurrentTimeNs()
 	}
+	cs.accountAccess(key, true)
 	if len(transactionID) == 0 {
 		//lg.Logln(">>1 " + key)
 		if keyLastToken, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, true); len(keyLastToken) > 0 && parentCacheStoreValue != nil {
@@ -700,7 +1061,7 @@ func (cs *Store) SetValue(key string, value []byte, updateInKV bool, customSetTi
 				csv.Put(value, updateInKV, customSetTime)
 			} else {
 				//lg.Logln(">>4 " + key)
-				csvUpdate = &StoreValue{value: value, store: make(map[interface{}]*StoreValue), storeConsistencyWithKVLossTime: 0, valueExists: true, purgeState: 0, syncNeeded: updateInKV, syncedWithKV: !updateInKV, valueUpdateTime: customSetTime}
+				csvUpdate = &StoreValue{value: value, store: make(map[interface{}]*StoreValue), storeConsistencyWithKVLossTime: 0, valueExists: true, purgeState: 0, syncNeeded: updateInKV, syncedWithKV: !updateInKV, valueUpdateTime: customSetTime, version: 1}
 				//lg.Logln(">>5 " + key)
 				parentCacheStoreValue.StoreChild(keyLastToken, csvUpdate, true)
 				//lg.Logln(">>6 " + key)
@@ -713,20 +1074,48 @@ func (cs *Store) SetValue(key string, value []byte, updateInKV bool, customSetTi
 			transaction.operators = append(transaction.operators, &TransactionOperator{operatorType: 0, key: key, value: value, updateInKV: updateInKV, customTime: customSetTime})
 			transaction.mutex.Unlock()
 		} else {
-			lg.Logf(lg.ErrorLevel, "SetValue: transaction with id=%s doesn't exist\n", transactionID)
+			cs.reportError("transaction", transactionID, TransactionNotFoundError)
 		}
 	}
 	return true
 }
 
+// SetValueDurable sets the value and writes it to the KV store before returning instead of leaving it to the lazy writer
+func (cs *Store) SetValueDurable(key string, value []byte) error {
+	if err := cs.checkKeyWrite("", key); err != nil {
+		return err
+	}
+	return cs.setValueDurable(key, value)
+}
+
+func (cs *Store) setValueDurable(key string, value []byte) error {
+	if !cs.validKey(key) {
+		return fmt.Errorf("invalid key=%s", key)
+	}
+	setTime := system.GetCurrentTimeNs()
+	cs.setValue(key, value, false, setTime, "")
+	revision, err := cs.backend.Put(cs.toStoreKey(key), kvRecordBytes(setTime, value, true))
+	if err == nil {
+		cs.setKVRevision(key, setTime, revision)
+	}
+	return err
+}
+
 func (cs *Store) Destroy() {
 	cs.cancel()
 }
 
 func (cs *Store) DeleteValue(key string, updateInKV bool, customDeleteTime int64, transactionID string) {
+	if err := cs.deleteValueChecked(key, updateInKV, customDeleteTime, transactionID); err != nil {
+		cs.reportWriteError(key, transactionID, err)
+	}
+}
+
+func (cs *Store) deleteValue(key string, updateInKV bool, customDeleteTime int64, transactionID string) {
 	if customDeleteTime < 0 {
 		customDeleteTime = system.GetCurrentTimeNs()
 	}
+	cs.accountAccess(key, true)
 	if len(transactionID) == 0 {
 		if keyLastToken, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, false); len(keyLastToken) > 0 && parentCacheStoreValue != nil {
 			if csv, ok := parentCacheStoreValue.LoadChild(keyLastToken, true); ok {
@@ -735,6 +1124,9 @@ func (cs *Store) DeleteValue(key string, updateInKV bool, customDeleteTime int64
 				}
 			}
 		}
+		if !updateInKV { // Never reaches other replicas via KV
+			cs.Invalidate(key)
+		}
 	} else {
 		if v, ok := cs.transactions.Load(transactionID); ok {
 			transaction := v.(*Transaction)
@@ -742,7 +1134,7 @@ func (cs *Store) DeleteValue(key string, updateInKV bool, customDeleteTime int64
 			transaction.operators = append(transaction.operators, &TransactionOperator{operatorType: 1, key: key, value: nil, updateInKV: updateInKV, customTime: customDeleteTime})
 			transaction.mutex.Unlock()
 		} else {
-			lg.Logf(lg.ErrorLevel, "DeleteValue: transaction with id=%s doesn't exist\n", transactionID)
+			cs.reportError("transaction", transactionID, TransactionNotFoundError)
 		}
 	}
 }
@@ -750,12 +1142,23 @@ func (cs *Store) DeleteValue(key string, updateInKV bool, customDeleteTime int64
 func (cs *Store) GetKeysByPattern(pattern string) []string {
 	start := time.Now()
 
+	cs.rehydratePatternRoot(pattern, true)
 	keys := map[string]bool{}
 
+	if hasMidPatternWildcard(pattern) {
+		cs.getKeysByMidWildcardPattern(pattern, keys)
+		keysSlice := make([]string, 0, len(keys))
+		for k := range keys {
+			keysSlice = append(keysSlice, k)
+		}
+		return keysSlice
+	}
+
 	appendKeysFromKV := func() {
+		cs.rehydratePatternRoot(pattern, false)
 		cs.getKeysByPatternFromKVMutex.Lock()
 		//lg.Logln("!!! GetKeysByPattern started appendKeysFromKV")
-		if w, err := cs.kv.Watch(cs.toStoreKey(pattern), nats.IgnoreDeletes()); err == nil {
+		if w, err := cs.backend.Watch(cs.toStoreKey(pattern)); err == nil {
 			for entry := range w.Updates() {
 				if entry != nil && len(entry.Value()) >= 9 {
 					keys[cs.fromStoreKey(entry.Key())] = true
@@ -763,8 +1166,9 @@ func (cs *Store) GetKeysByPattern(pattern string) []string {
 					break
 				}
 			}
+			system.MsgOnErrorReturn(w.Stop())
 		} else {
-			lg.Logf(lg.ErrorLevel, "GetKeysByPattern kv.Watch error %s\n", err)
+			cs.reportError("kv_watch", pattern, err)
 		}
 		//lg.Logln("!!! GetKeysByPattern ended appendKeysFromKV")
 		cs.getKeysByPatternFromKVMutex.Unlock()
@@ -784,7 +1188,7 @@ func (cs *Store) GetKeysByPattern(pattern string) []string {
 					childrenStoresAreConsistentWithKV = false
 				}
 				if childCSV.ValueExists() {
-					keys[keyWithoutLastToken+key.(string)] = true
+					keys[keyWithoutLastToken+KeyToken(key.(string))] = true
 				}
 				return true
 			})
@@ -833,9 +1237,9 @@ func (cs *Store) GetKeysByPattern(pattern string) []string {
 				currentStoreValue.Range(func(key, value interface{}) bool {
 					var newSuffix string
 					if currentDepth == 0 {
-						newSuffix = currentSuffix + key.(string)
+						newSuffix = currentSuffix + KeyToken(key.(string))
 					} else {
-						newSuffix = currentSuffix + "." + key.(string)
+						newSuffix = currentSuffix + "." + KeyToken(key.(string))
 					}
 					if value.(*StoreValue).ValueExists() {
 						keys[newSuffix] = true
@@ -887,7 +1291,7 @@ func (cs *Store) GetKeysByPattern(pattern string) []string {
 				// Cannot restore consistency here
 			}
 		} else {
-			lg.Logf(lg.ErrorLevel, "GetKeysByPattern: getLastExistingCacheStoreValueByKey returns nil\n")
+			cs.logger().Logf(lg.ErrorLevel, "GetKeysByPattern: getLastExistingCacheStoreValueByKey returns nil\n")
 		}
 	}
 
@@ -898,16 +1302,14 @@ func (cs *Store) GetKeysByPattern(pattern string) []string {
 		i++
 	}
 
-	if gaugeVec, err := system.GlobalPrometrics.EnsureGaugeVecSimple("cache_get_keys_by_pattern", "", []string{"id"}); err == nil {
-		gaugeVec.With(prometheus.Labels{"id": cs.cacheConfig.id}).Set(float64(time.Since(start).Microseconds()))
-	}
+	system.Metrics().SetGauge("cache_get_keys_by_pattern", "", map[string]string{"id": cs.cacheConfig.id}, float64(time.Since(start).Microseconds()))
 
 	return keysSlice
 }
 
 // createIfNotexistsOption - 0 // Do not create, 1 // Create non parent StoreValue thread safe, 2 // Create parent StoreValue thread safe
 func (cs *Store) getLastKeyTokenAndItsParentCacheStoreValue(key string, createIfNotexists bool) (string, *StoreValue) {
-	tokens := strings.Split(key, ".")
+	tokens := splitKey(key)
 	currentTokenID := 0
 	currentStoreLevel := cs.rootValue
 	for currentTokenID < len(tokens)-1 {
@@ -937,7 +1339,7 @@ func (cs *Store) getLastKeyTokenAndItsParentCacheStoreValue(key string, createIf
 }
 
 func (cs *Store) getLastExistingCacheStoreValueByKey(key string) *StoreValue {
-	tokens := strings.Split(key, ".")
+	tokens := splitKey(key)
 	currentTokenID := 0
 	currentStoreLevel := cs.rootValue
 
@@ -954,7 +1356,7 @@ func (cs *Store) getLastExistingCacheStoreValueByKey(key string) *StoreValue {
 }
 
 func (cs *Store) getLastKeyCacheStoreValue(key string) *StoreValue {
-	tokens := strings.Split(key, ".")
+	tokens := splitKey(key)
 	currentTokenID := 0
 	currentStoreLevel := cs.rootValue
 	for currentTokenID < len(tokens) {
@@ -968,10 +1370,15 @@ func (cs *Store) getLastKeyCacheStoreValue(key string) *StoreValue {
 	return currentStoreLevel
 }
 
-func (cs *Store) toStoreKey(key string) string {
-	return cs.cacheConfig.kvStorePrefix + "." + key
-}
-
-func (cs *Store) fromStoreKey(key string) string {
-	return strings.Replace(key, cs.cacheConfig.kvStorePrefix+".", "", 1)
+// KV record: 8 bytes of big endian update time, append flag "1" or delete flag "0", value.
+// Flags above "1" mark compressed values, content references and deltas, they never reach the store
+// (see backend_compressed.go, backend_dedup.go, backend_delta.go)
+func kvRecordBytes(updateTime int64, value []byte, exists bool) []byte {
+	record := make([]byte, 8, 9+len(value))
+	binary.BigEndian.PutUint64(record, uint64(updateTime))
+	if exists {
+		record = append(record, 1)
+		return append(record, value...)
+	}
+	return append(record, 0)
 }
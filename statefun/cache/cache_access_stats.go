@@ -0,0 +1,116 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Access statistics count sampled reads and writes per key prefix (the first key token, e.g. a graph vertex id).
+Counters decay exponentially with the configured half-life so they reflect recent usage only.
+*/
+
+const (
+	accessStatsNegligibleScore = 0.01
+)
+
+// KeyAccessStats are decayed read and write counts of a key prefix
+type KeyAccessStats struct {
+	Prefix string
+	Reads  float64
+	Writes float64
+}
+
+type accessCounter struct {
+	mutex      sync.Mutex
+	reads      float64
+	writes     float64
+	decayedAt  int64
+	halfLifeNs float64
+}
+
+func (c *accessCounter) decay(now int64) {
+	if now > c.decayedAt {
+		factor := math.Exp2(-float64(now-c.decayedAt) / c.halfLifeNs)
+		c.reads *= factor
+		c.writes *= factor
+		c.decayedAt = now
+	}
+}
+
+type accessStats struct {
+	counters sync.Map // prefix -> *accessCounter
+	samples  atomic.Uint64
+}
+
+func (cs *Store) accountAccess(key string, write bool) {
+	sampleRate := cs.cacheConfig.accessStatsSampleRate
+	if sampleRate <= 0 {
+		return
+	}
+	if sampleRate > 1 && cs.accessStats.samples.Add(1)%uint64(sampleRate) != 0 {
+		return
+	}
+
+	prefix := keyRoot(key)
+	now := system.GetCurrentTimeNs()
+	v, ok := cs.accessStats.counters.Load(prefix)
+	if !ok {
+		v, _ = cs.accessStats.counters.LoadOrStore(prefix, &accessCounter{decayedAt: now, halfLifeNs: float64(cs.cacheConfig.accessStatsHalfLifeSec) * 1e9})
+	}
+	c := v.(*accessCounter)
+	c.mutex.Lock()
+	c.decay(now)
+	if write {
+		c.writes += float64(sampleRate)
+	} else {
+		c.reads += float64(sampleRate)
+	}
+	c.mutex.Unlock()
+}
+
+// AccessStats returns decayed access counts of the key's prefix
+func (cs *Store) AccessStats(key string) KeyAccessStats {
+	prefix := keyRoot(key)
+	result := KeyAccessStats{Prefix: prefix}
+	if v, ok := cs.accessStats.counters.Load(prefix); ok {
+		c := v.(*accessCounter)
+		c.mutex.Lock()
+		c.decay(system.GetCurrentTimeNs())
+		result.Reads, result.Writes = c.reads, c.writes
+		c.mutex.Unlock()
+	}
+	return result
+}
+
+// AccessStatsTop returns n most accessed key prefixes ordered by reads+writes, negligible counters are dropped on the way
+func (cs *Store) AccessStatsTop(n int) []KeyAccessStats {
+	now := system.GetCurrentTimeNs()
+	all := []KeyAccessStats{}
+	cs.accessStats.counters.Range(func(key, value any) bool {
+		c := value.(*accessCounter)
+		c.mutex.Lock()
+		c.decay(now)
+		reads, writes := c.reads, c.writes
+		c.mutex.Unlock()
+		if reads+writes < accessStatsNegligibleScore {
+			cs.accessStats.counters.Delete(key)
+			return true
+		}
+		all = append(all, KeyAccessStats{Prefix: key.(string), Reads: reads, Writes: writes})
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Reads+all[i].Writes > all[j].Reads+all[j].Writes
+	})
+	if n >= 0 && len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
@@ -0,0 +1,457 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	sdkErrors "github.com/foliagecp/sdk/errors"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+/*
+Archival tier moves cold root keys (e.g. graph vertices: "<id>" body with all "<id>.>" links) which were not updated
+for a configured period into gzip compressed archives in an object store. The root key keeps a small stub pointing
+to the archive, all subkeys are removed from KV. Stubbed keys are rehydrated back into KV when their value is read
+or their subkeys are looked up by pattern.
+
+Archiving never loses a concurrent write: the stub replaces the root only if the root's KV revision is still the
+archived one and subkeys are deleted only if their revisions are still the archived ones (a KVBackendCAS is required,
+the archiver is not started without it).
+If the root or any subkey was written meanwhile, locally unsynced writes included, the archive is aborted and
+the deleted subkeys and the root are restored. Archiving and rehydration are serialized per root key.
+*/
+
+var (
+	archiveBackendNotSetError = errors.New("error: archive backend is not set")
+	archiveRootChangedError   = sdkErrors.New(sdkErrors.ErrConflict, "error: root key or its subkeys changed while archiving")
+	archiveStubPrefix         = []byte(`{"__archived_to":`)
+)
+
+// ArchiveBackend is a blob store cold values are moved to
+type ArchiveBackend interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	Delete(name string) error
+}
+
+type archiveStub struct {
+	Object     string `json:"__archived_to"`
+	ArchivedAt int64  `json:"archived_at"`
+}
+
+type archive struct {
+	Root       string            `json:"root"`
+	ArchivedAt int64             `json:"archived_at"`
+	Records    map[string][]byte `json:"records"` // key -> value
+}
+
+// Per root key locks, dropped when not held
+type archiveLocks struct {
+	mutex sync.Mutex
+	roots map[string]*archiveRootLock
+}
+
+type archiveRootLock struct {
+	sync.Mutex
+	holders int
+}
+
+// NATS object store archive backend ----------------------------------------------------------------
+
+type natsObjectStoreArchiveBackend struct {
+	os nats.ObjectStore
+}
+
+// NewNatsObjectStoreArchiveBackend binds to the object store bucket, creates it if it does not exist
+func NewNatsObjectStoreArchiveBackend(js nats.JetStreamContext, bucket string) (ArchiveBackend, error) {
+	os, err := js.ObjectStore(bucket)
+	if err == nats.ErrStreamNotFound || err == nats.ErrBucketNotFound {
+		os, err = js.CreateObjectStore(&nats.ObjectStoreConfig{Bucket: bucket})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &natsObjectStoreArchiveBackend{os: os}, nil
+}
+
+func (b *natsObjectStoreArchiveBackend) Put(name string, data []byte) error {
+	_, err := b.os.PutBytes(name, data)
+	return err
+}
+
+func (b *natsObjectStoreArchiveBackend) Get(name string) ([]byte, error) {
+	return b.os.GetBytes(name)
+}
+
+func (b *natsObjectStoreArchiveBackend) Delete(name string) error {
+	return b.os.Delete(name)
+}
+
+// In-memory archive backend -------------------------------------------------------------------------
+
+type MemoryArchiveBackend struct {
+	objects sync.Map
+}
+
+func NewMemoryArchiveBackend() *MemoryArchiveBackend {
+	return &MemoryArchiveBackend{}
+}
+
+func (b *MemoryArchiveBackend) Put(name string, data []byte) error {
+	b.objects.Store(name, append([]byte(nil), data...))
+	return nil
+}
+
+func (b *MemoryArchiveBackend) Get(name string) ([]byte, error) {
+	if data, ok := b.objects.Load(name); ok {
+		return data.([]byte), nil
+	}
+	return nil, nats.ErrObjectNotFound
+}
+
+func (b *MemoryArchiveBackend) Delete(name string) error {
+	b.objects.Delete(name)
+	return nil
+}
+
+// ------------------------------------------------------------------------------------------------
+
+func isArchiveStub(value []byte) bool {
+	return bytes.HasPrefix(value, archiveStubPrefix)
+}
+
+// Locks archiving and rehydration of the root key, returns the unlock function
+func (cs *Store) lockArchiveRoot(root string) func() {
+	locks := &cs.archiveLocks
+	locks.mutex.Lock()
+	if locks.roots == nil {
+		locks.roots = map[string]*archiveRootLock{}
+	}
+	l, ok := locks.roots[root]
+	if !ok {
+		l = &archiveRootLock{}
+		locks.roots[root] = l
+	}
+	l.holders++
+	locks.mutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		locks.mutex.Lock()
+		if l.holders--; l.holders == 0 {
+			delete(locks.roots, root)
+		}
+		locks.mutex.Unlock()
+	}
+}
+
+// True if the cached value or any cached subkey value below has a local update not yet written to KV
+func (csv *StoreValue) syncPending() bool {
+	csv.Lock("syncPending")
+	defer csv.Unlock("syncPending")
+	if csv.syncNeeded {
+		return true
+	}
+	for _, child := range csv.store {
+		if child.syncPending() {
+			return true
+		}
+	}
+	return false
+}
+
+func (cs *Store) subtreeSyncPending(root string) bool {
+	csv := cs.getLastKeyCacheStoreValue(root)
+	return csv != nil && csv.syncPending()
+}
+
+func (cs *Store) runArchiver() {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("cache.archiver")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("cache.archiver")
+
+	idle := time.Duration(cs.cacheConfig.archiveIdleDays) * 24 * time.Hour
+	for {
+		select {
+		case <-cs.ctx.Done():
+			return
+		case <-time.After(time.Duration(cs.cacheConfig.archiveScanIntervalSec) * time.Second):
+			archived, err := cs.ArchiveCold(idle)
+			if err != nil {
+				cs.reportError("archive", "", err)
+			} else if archived > 0 {
+				cs.logger().Logf(lg.InfoLevel, "Cache archiver moved %d cold keys to the archive\n", archived)
+			}
+		}
+	}
+}
+
+// ArchiveCold archives every root key holding a JSON object whose value and subkeys were not updated for idle duration
+// and which are not being read according to access statistics (if enabled).
+// Scans the whole KV store, meant to be run rarely. Returns the number of archived root keys
+func (cs *Store) ArchiveCold(idle time.Duration) (int, error) {
+	if cs.archiveBackend == nil {
+		return 0, archiveBackendNotSetError
+	}
+
+	lastUpdates := map[string]int64{}
+	archivable := map[string]bool{}
+
+	w, err := cs.backend.Watch(cs.toStoreKey(">"))
+	if err != nil {
+		return 0, err
+	}
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		record := entry.Value()
+		if len(record) < 9 {
+			continue
+		}
+		key := cs.fromStoreKey(entry.Key())
+		root := keyRoot(key)
+		if recordTime := int64(binary.BigEndian.Uint64(record[:8])); recordTime > lastUpdates[root] {
+			lastUpdates[root] = recordTime
+		}
+		if key == root {
+			value := record[9:]
+			archivable[root] = record[8] == 1 && bytes.HasPrefix(value, []byte("{")) && json.Valid(value) && !isArchiveStub(value)
+		}
+	}
+	system.MsgOnErrorReturn(w.Stop())
+
+	threshold := system.GetCurrentTimeNs() - idle.Nanoseconds()
+	archived := 0
+	for root, ok := range archivable {
+		if !ok || lastUpdates[root] > threshold {
+			continue
+		}
+		if stats := cs.AccessStats(root); stats.Reads >= 1 { // Still being read
+			continue
+		}
+		if err := cs.archiveRoot(root); err != nil {
+			cs.reportError("archive", root, err)
+			continue
+		}
+		archived++
+	}
+	return archived, nil
+}
+
+func (cs *Store) archiveRoot(root string) error {
+	unlock := cs.lockArchiveRoot(root)
+	defer unlock()
+
+	cas, ok := cs.backend.(KVBackendCAS)
+	if !ok {
+		return KVBackendCASNotSupportedError
+	}
+	rootKey := cs.toStoreKey(root)
+	rootEntry, err := cs.backend.Get(rootKey)
+	if err != nil {
+		return err
+	}
+	rootRecord := rootEntry.Value()
+	if len(rootRecord) < 9 || rootRecord[8] != 1 || isArchiveStub(rootRecord[9:]) {
+		return nil
+	}
+	if cs.subtreeSyncPending(root) {
+		return archiveRootChangedError
+	}
+
+	a := archive{Root: root, ArchivedAt: system.GetCurrentTimeNs(), Records: map[string][]byte{root: rootRecord[9:]}}
+	subEntries := map[string]KVBackendEntry{}
+	w, err := cs.backend.Watch(cs.toStoreKey(root + ".>"))
+	if err != nil {
+		return err
+	}
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		key := cs.fromStoreKey(entry.Key())
+		subEntries[key] = entry
+		if record := entry.Value(); len(record) >= 9 && record[8] == 1 {
+			a.Records[key] = record[9:]
+		}
+	}
+	system.MsgOnErrorReturn(w.Stop())
+
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(data); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	objectName := system.GetHashStr(root)
+	if err := cs.archiveBackend.Put(objectName, compressed.Bytes()); err != nil {
+		return err
+	}
+	stub, err := json.Marshal(archiveStub{Object: objectName, ArchivedAt: a.ArchivedAt})
+	if err != nil {
+		return err
+	}
+	stubTime := system.GetCurrentTimeNs()
+	stubRevision, err := cas.Update(rootKey, kvRecordBytes(stubTime, stub, true), rootEntry.Revision())
+	if err != nil {
+		system.MsgOnErrorReturn(cs.archiveBackend.Delete(objectName))
+		if isKVRevisionMismatch(err) {
+			return archiveRootChangedError
+		}
+		return err
+	}
+
+	deleted := []string{}
+	changed := false
+	for key, entry := range subEntries {
+		if err := cas.DeleteRevision(cs.toStoreKey(key), entry.Revision()); err != nil {
+			if !isKVRevisionMismatch(err) {
+				cs.reportError("archive", key, err)
+			}
+			changed = true // Kept in KV
+			continue
+		}
+		deleted = append(deleted, key)
+	}
+	if changed || cs.subtreeSyncPending(root) {
+		return cs.abortArchive(cas, root, rootEntry, stubRevision, subEntries, deleted, objectName)
+	}
+
+	cs.setValue(root, stub, false, stubTime, "")
+	cs.setKVRevision(root, stubTime, stubRevision)
+	for _, key := range deleted {
+		if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
+			var recordTime int64 = -1
+			if record := subEntries[key].Value(); len(record) >= 9 {
+				recordTime = int64(binary.BigEndian.Uint64(record[:8]))
+			}
+			csv.Lock("archiveRoot")
+			if !csv.syncNeeded && (!csv.valueExists || csv.valueUpdateTime == recordTime) { // Not updated meanwhile
+				csv.forget()
+			}
+			csv.Unlock("archiveRoot")
+		}
+	}
+	return nil
+}
+
+// Restores the deleted subkeys and the root unless they were written meanwhile, the archive is dropped once the stub is
+// replaced
+func (cs *Store) abortArchive(cas KVBackendCAS, root string, rootEntry KVBackendEntry, stubRevision uint64, subEntries map[string]KVBackendEntry, deleted []string, objectName string) error {
+	for _, key := range deleted {
+		if record := subEntries[key].Value(); len(record) >= 9 && record[8] == 1 {
+			if _, err := cas.Create(cs.toStoreKey(key), record); err != nil && !isKVRevisionMismatch(err) {
+				return err
+			}
+		}
+	}
+	if _, err := cas.Update(cs.toStoreKey(root), rootEntry.Value(), stubRevision); err != nil && !isKVRevisionMismatch(err) {
+		return err // The stub still points to the archive
+	}
+	system.MsgOnErrorReturn(cs.archiveBackend.Delete(objectName))
+	return archiveRootChangedError
+}
+
+// Rehydrates the root key of the pattern if it is archived so the pattern lookup sees all its subkeys.
+// cachedOnly - checks only the root value kept in memory, otherwise reads it from KV on a cache miss
+func (cs *Store) rehydratePatternRoot(pattern string, cachedOnly bool) {
+	if cs.archiveBackend == nil {
+		return
+	}
+	root := keyRoot(pattern)
+	if root == "*" || root == ">" || root == pattern {
+		return
+	}
+	if cachedOnly {
+		csv, ok := cs.rootValue.LoadChild(splitKey(root)[0], true)
+		if !ok {
+			return
+		}
+		csv.Lock("rehydratePatternRoot")
+		value, _ := csv.value.([]byte)
+		stubbed := csv.valueExists && isArchiveStub(value)
+		csv.Unlock("rehydratePatternRoot")
+		if !stubbed {
+			return
+		}
+	}
+	cs.GetValue(root)
+}
+
+// Restores all archived values of the root key into KV, returns the original root value
+func (cs *Store) rehydrate(root string) ([]byte, error) {
+	unlock := cs.lockArchiveRoot(root)
+	defer unlock()
+
+	rootEntry, err := cs.backend.Get(cs.toStoreKey(root))
+	if err != nil {
+		return nil, err
+	}
+	rootRecord := rootEntry.Value()
+	if len(rootRecord) < 9 || rootRecord[8] != 1 {
+		return nil, sdkErrors.Wrap(sdkErrors.ErrKeyNotFound, nats.ErrKeyNotFound)
+	}
+	if !isArchiveStub(rootRecord[9:]) { // Already rehydrated
+		return rootRecord[9:], nil
+	}
+
+	var stub archiveStub
+	if err := json.Unmarshal(rootRecord[9:], &stub); err != nil {
+		return nil, err
+	}
+	compressed, err := cs.archiveBackend.Get(stub.Object)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+	var a archive
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, err
+	}
+
+	now := system.GetCurrentTimeNs()
+	for key, value := range a.Records {
+		if key != root {
+			cs.setValue(key, value, true, now, "")
+		}
+	}
+	// Subkeys must reach KV before the stub is replaced, otherwise a crash would lose them
+	ctx, cancel := context.WithTimeout(cs.ctx, 30*time.Second)
+	defer cancel()
+	if err := cs.Flush(ctx); err != nil {
+		return nil, err
+	}
+	if err := cs.setValueDurable(root, a.Records[root]); err != nil {
+		return nil, err
+	}
+	system.MsgOnErrorReturn(cs.archiveBackend.Delete(stub.Object))
+
+	cs.logger().Logf(lg.TraceLevel, "Rehydrated archived key=%s with %d values\n", root, len(a.Records))
+	return a.Records[root], nil
+}
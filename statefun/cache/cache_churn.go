@@ -0,0 +1,119 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"sync"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Eviction churn shows how well lruSize fits the working set. Keys evicted by LRU are remembered (without values)
+for the churn window (SetEvictionChurnWindowSec, disabled by default), a cache miss on such a key is a refault:
+the read would have been a hit with a larger LRU.
+Refaults per eviction over the last complete window is the churn ratio, about 0 - the LRU is large enough,
+close to 1 - almost every evicted key is needed again soon and lruSize should grow. Every refaulted key would have
+stayed in memory with lruSize larger by one, so the suggested size is lruSize plus refaults of the window.
+With LRUMaxBytes set it is the bytes limit evicting, the suggestion is to be applied to it proportionally.
+*/
+
+// LRUTuning describes LRU effectiveness over the last complete churn window (the current one before the first ends)
+type LRUTuning struct {
+	Evictions        uint64
+	Refaults         uint64
+	ChurnRatio       float64
+	LRUSize          int
+	SuggestedLRUSize int
+}
+
+type evictionChurn struct {
+	mutex           sync.Mutex
+	ghosts          map[string]int64 // Evicted key -> eviction time
+	windowStart     int64
+	windowEvictions uint64
+	windowRefaults  uint64
+	lastEvictions   uint64
+	lastRefaults    uint64
+	lastComplete    bool
+}
+
+func (cs *Store) churnWindowNs() int64 {
+	return int64(cs.cacheConfig.evictionChurnWindowSec) * 1e9
+}
+
+// Must be called with locked mutex
+func (c *evictionChurn) rollWindow(now int64, windowNs int64) {
+	if c.windowStart == 0 {
+		c.windowStart = now
+	}
+	if now-c.windowStart < windowNs {
+		return
+	}
+	c.lastEvictions, c.lastRefaults, c.lastComplete = c.windowEvictions, c.windowRefaults, true
+	c.windowEvictions, c.windowRefaults = 0, 0
+	c.windowStart = now
+	for key, evictedAt := range c.ghosts {
+		if now-evictedAt > windowNs {
+			delete(c.ghosts, key)
+		}
+	}
+}
+
+func (cs *Store) accountEviction(key string) {
+	windowNs := cs.churnWindowNs()
+	if windowNs <= 0 {
+		return
+	}
+	now := system.GetCurrentTimeNs()
+	c := &cs.evictionChurn
+	c.mutex.Lock()
+	c.rollWindow(now, windowNs)
+	c.windowEvictions++
+	if c.ghosts == nil {
+		c.ghosts = map[string]int64{}
+	}
+	if len(c.ghosts) < cs.cacheConfig.evictionGhostsMaxSize {
+		c.ghosts[key] = now
+	}
+	c.mutex.Unlock()
+}
+
+func (cs *Store) accountMiss(key string) {
+	windowNs := cs.churnWindowNs()
+	if windowNs <= 0 {
+		return
+	}
+	now := system.GetCurrentTimeNs()
+	c := &cs.evictionChurn
+	c.mutex.Lock()
+	c.rollWindow(now, windowNs)
+	if evictedAt, ok := c.ghosts[key]; ok {
+		delete(c.ghosts, key)
+		if now-evictedAt <= windowNs {
+			c.windowRefaults++
+			cs.stats.refaults.Add(1)
+		}
+	}
+	c.mutex.Unlock()
+}
+
+// LRUTuning returns eviction churn of the last window and the lruSize suggested by it
+func (cs *Store) LRUTuning() LRUTuning {
+	c := &cs.evictionChurn
+	c.mutex.Lock()
+	if windowNs := cs.churnWindowNs(); windowNs > 0 {
+		c.rollWindow(system.GetCurrentTimeNs(), windowNs)
+	}
+	t := LRUTuning{Evictions: c.windowEvictions, Refaults: c.windowRefaults, LRUSize: cs.cacheConfig.lruSize}
+	if c.lastComplete {
+		t.Evictions, t.Refaults = c.lastEvictions, c.lastRefaults
+	}
+	c.mutex.Unlock()
+
+	if t.Evictions > 0 {
+		t.ChurnRatio = float64(t.Refaults) / float64(t.Evictions)
+	}
+	t.SuggestedLRUSize = t.LRUSize + int(t.Refaults)
+	return t
+}
@@ -5,6 +5,21 @@ package cache
 const (
 	KVStorePrefix                               = "store"
 	LRUSize                                     = 1000000
+	LRUMaxBytes                                 = 0 // 0 - values' total size is not limited
+	ArchiveScanIntervalSec                      = 3600
+	AccessStatsSampleRate                       = 0 // 0 - access statistics are disabled
+	AccessStatsHalfLifeSec                      = 3600
+	LockStatsSampleRate                         = 0 // 0 - lock statistics are disabled
+	LazyWriterSyncIntervalMs                    = 100
+	LRUScanIntervalMs                           = 100
+	LazyWriterWriteBudget                       = 0 // 0 - all unsynced values are written to KV in a single pass
+	WatchRestartIntervalMs                      = 1000
+	CompressionThreshold                        = 0 // 0 - values are not compressed
+	DedupThreshold                              = 0 // 0 - values are not deduplicated
+	DeltaThreshold                              = 0 // 0 - values are written whole
+	DeltaSnapshotEvery                          = 16
+	EvictionChurnWindowSec                      = 0 // 0 - eviction churn is not tracked
+	EvictionGhostsMaxSize                       = 100000
 	LevelSubscriptionNotificationsBufferMaxSize = 30000 // ~16Mb: elemenets := 16 * 1024 * 1024 / (64 + 512), where 512 - avg value size, 64 - avg key size
 )
 
@@ -12,7 +27,41 @@ type Config struct {
 	id                                          string
 	kvStorePrefix                               string
 	lruSize                                     int
+	lruMaxBytes                                 int
 	levelSubscriptionNotificationsBufferMaxSize int
+	archiveIdleDays                             int // 0 - archival is disabled
+	archiveObjectStoreBucket                    string
+	archiveBackend                              ArchiveBackend
+	archiveScanIntervalSec                      int
+	accessStatsSampleRate                       int
+	accessStatsHalfLifeSec                      int
+	logger                                      Logger
+	errorHandler                                ErrorHandler
+	invalidationBus                             InvalidationBus
+	lazyWriterSyncIntervalMs                    int
+	lruScanIntervalMs                           int
+	lazyWriterWriteBudget                       int
+	watchRestartIntervalMs                      int
+	kvPollingIntervalMs                         int // 0 - KV is watched
+	keyCodec                                    KeyCodec
+	onEvict                                     func(key string, value []byte)
+	keyNamePolicy                               func(key string) error
+	encryptionKey                               []byte
+	compressionThreshold                        int
+	compressionCodec                            CompressionCodec
+	dedupThreshold                              int
+	deltaThreshold                              int
+	deltaSnapshotEvery                          int
+	kvBucketRoutes                              []kvBucketRoute
+	conflictResolvers                           []conflictResolverRoute
+	evictionChurnWindowSec                      int
+	evictionGhostsMaxSize                       int
+	lockStatsSampleRate                         int
+}
+
+type kvBucketRoute struct {
+	keyPattern string
+	bucket     KVBucketConfig
 }
 
 func NewCacheConfig(id string) *Config {
@@ -20,8 +69,36 @@ func NewCacheConfig(id string) *Config {
 		id:            id,
 		kvStorePrefix: KVStorePrefix,
 		lruSize:       LRUSize,
+		lruMaxBytes:   LRUMaxBytes,
 		levelSubscriptionNotificationsBufferMaxSize: LevelSubscriptionNotificationsBufferMaxSize,
+		archiveScanIntervalSec:                      ArchiveScanIntervalSec,
+		accessStatsSampleRate:                       AccessStatsSampleRate,
+		lockStatsSampleRate:                         LockStatsSampleRate,
+		accessStatsHalfLifeSec:                      AccessStatsHalfLifeSec,
+		lazyWriterSyncIntervalMs:                    LazyWriterSyncIntervalMs,
+		lruScanIntervalMs:                           LRUScanIntervalMs,
+		lazyWriterWriteBudget:                       LazyWriterWriteBudget,
+		watchRestartIntervalMs:                      WatchRestartIntervalMs,
+		compressionThreshold:                        CompressionThreshold,
+		compressionCodec:                            CompressionZstd,
+		dedupThreshold:                              DedupThreshold,
+		deltaThreshold:                              DeltaThreshold,
+		deltaSnapshotEvery:                          DeltaSnapshotEvery,
+		evictionChurnWindowSec:                      EvictionChurnWindowSec,
+		evictionGhostsMaxSize:                       EvictionGhostsMaxSize,
+	}
+}
+
+// Namespaced returns a copy of the config with "<namespace>_" prepended to the id and kvStorePrefix, the config itself
+// if namespace is empty
+func (ro *Config) Namespaced(namespace string) *Config {
+	if len(namespace) == 0 {
+		return ro
 	}
+	namespaced := *ro
+	namespaced.id = namespace + "_" + ro.id
+	namespaced.kvStorePrefix = namespace + "_" + ro.kvStorePrefix
+	return &namespaced
 }
 
 func (ro *Config) SetKVStorePrefix(kvStorePrefix string) *Config {
@@ -34,7 +111,170 @@ func (ro *Config) SetLRUSize(lruSize int) *Config {
 	return ro
 }
 
+// Limits total size of values kept in memory, least recently updated ones are evicted first
+func (ro *Config) SetLRUMaxBytes(lruMaxBytes int) *Config {
+	ro.lruMaxBytes = lruMaxBytes
+	return ro
+}
+
 func (ro *Config) SetLevelSubscriptionNotificationsBufferMaxSize(levelSubscriptionNotificationsBufferMaxSize int) *Config {
 	ro.levelSubscriptionNotificationsBufferMaxSize = levelSubscriptionNotificationsBufferMaxSize
 	return ro
 }
+
+// Moves root keys (with all their subkeys) not updated for idleDays into the NATS object store bucket, 0 - disabled
+func (ro *Config) SetArchivePolicy(idleDays int, objectStoreBucket string) *Config {
+	ro.archiveIdleDays = idleDays
+	ro.archiveObjectStoreBucket = objectStoreBucket
+	return ro
+}
+
+// Sets a custom archive backend used instead of the NATS object store
+func (ro *Config) SetArchiveBackend(archiveBackend ArchiveBackend) *Config {
+	ro.archiveBackend = archiveBackend
+	return ro
+}
+
+func (ro *Config) SetArchiveScanIntervalSec(archiveScanIntervalSec int) *Config {
+	ro.archiveScanIntervalSec = archiveScanIntervalSec
+	return ro
+}
+
+// Counts every sampleRate-th read and write per key prefix, counters are halved every halfLifeSec. 0 sampleRate - disabled
+func (ro *Config) SetAccessStats(sampleRate int, halfLifeSec int) *Config {
+	ro.accessStatsSampleRate = sampleRate
+	ro.accessStatsHalfLifeSec = halfLifeSec
+	return ro
+}
+
+// Measures every sampleRate-th value lock wait for the lock wait histogram and contention report
+// (see cache_lock_stats.go). 0 sampleRate - disabled
+func (ro *Config) SetLockStats(sampleRate int) *Config {
+	ro.lockStatsSampleRate = sampleRate
+	return ro
+}
+
+// Replaces the default statefun logger for all cache store messages
+func (ro *Config) SetLogger(logger Logger) *Config {
+	ro.logger = logger
+	return ro
+}
+
+// Lets the application react to persistence failures (KV watch and put errors, missing transactions, etc.)
+func (ro *Config) SetErrorHandler(errorHandler ErrorHandler) *Config {
+	ro.errorHandler = errorHandler
+	return ro
+}
+
+// Shares local deletes and Invalidate calls with other replicas on the same KV prefix, nil - disabled
+func (ro *Config) SetInvalidationBus(invalidationBus InvalidationBus) *Config {
+	ro.invalidationBus = invalidationBus
+	return ro
+}
+
+// Pause between KV lazy writer passes, longer ones save CPU and lock contention but delay writes to KV
+func (ro *Config) SetLazyWriterSyncIntervalMs(lazyWriterSyncIntervalMs int) *Config {
+	ro.lazyWriterSyncIntervalMs = lazyWriterSyncIntervalMs
+	return ro
+}
+
+// How often the lazy writer recalculates the LRU threshold and evicts values, never more often than its passes
+func (ro *Config) SetLRUScanIntervalMs(lruScanIntervalMs int) *Config {
+	ro.lruScanIntervalMs = lruScanIntervalMs
+	return ro
+}
+
+// Maximum of values written to KV per lazy writer pass, the rest waits for the next passes. 0 - not limited
+func (ro *Config) SetLazyWriterWriteBudget(lazyWriterWriteBudget int) *Config {
+	ro.lazyWriterWriteBudget = lazyWriterWriteBudget
+	return ro
+}
+
+// Pause before restarting a failed KV watcher
+func (ro *Config) SetWatchRestartIntervalMs(watchRestartIntervalMs int) *Config {
+	ro.watchRestartIntervalMs = watchRestartIntervalMs
+	return ro
+}
+
+// Scans KV for updates every kvPollingIntervalMs instead of watching it, for NATS setups not allowing watches. 0 - disabled
+func (ro *Config) SetKVPollingIntervalMs(kvPollingIntervalMs int) *Config {
+	ro.kvPollingIntervalMs = kvPollingIntervalMs
+	return ro
+}
+
+// Codec of key tokens on the way to KV and back for tokens with arbitrary characters, nil - IdentityKeyCodec.
+// With a codec set runtime context keys hold ids as single tokens, contexts of ids with dots stored before are moved
+func (ro *Config) SetKeyCodec(keyCodec KeyCodec) *Config {
+	ro.keyCodec = keyCodec
+	return ro
+}
+
+// Called with every value the LRU evicts from memory (the value stays in KV), from the lazy writer after its pass
+func (ro *Config) SetOnEvict(onEvict func(key string, value []byte)) *Config {
+	ro.onEvict = onEvict
+	return ro
+}
+
+// Checks every key written by the application (not through Store.Reserved), a non-nil error refuses the write
+func (ro *Config) SetKeyNamePolicy(keyNamePolicy func(key string) error) *Config {
+	ro.keyNamePolicy = keyNamePolicy
+	return ro
+}
+
+// AES key (16, 24 or 32 bytes) KV records are encrypted with, overrides CACHE_ENCRYPTION_KEY environment variable
+func (ro *Config) SetEncryptionKey(encryptionKey []byte) *Config {
+	ro.encryptionKey = encryptionKey
+	return ro
+}
+
+// Values longer than the threshold (bytes) are compressed in KV, 0 - compression is disabled
+func (ro *Config) SetCompressionThreshold(compressionThreshold int) *Config {
+	ro.compressionThreshold = compressionThreshold
+	return ro
+}
+
+// Codec values are compressed with: CompressionZstd (default) or CompressionSnappy
+func (ro *Config) SetCompressionCodec(compressionCodec CompressionCodec) *Config {
+	ro.compressionCodec = compressionCodec
+	return ro
+}
+
+// Identical values longer than the threshold (bytes) are stored in KV once, 0 - deduplication is disabled
+func (ro *Config) SetDedupThreshold(dedupThreshold int) *Config {
+	ro.dedupThreshold = dedupThreshold
+	return ro
+}
+
+// Values longer than the threshold (bytes) are written to KV as diffs against a full snapshot rewritten every
+// snapshotEvery writes, 0 - delta encoding is disabled. Is not used together with deduplication
+func (ro *Config) SetDeltaEncoding(threshold int, snapshotEvery int) *Config {
+	ro.deltaThreshold = threshold
+	ro.deltaSnapshotEvery = snapshotEvery
+	return ro
+}
+
+// Keeps keys matching the pattern (e.g. "*.out.>") in their own KV bucket instead of the runtime's one,
+// routes are matched in the order they were added
+func (ro *Config) SetKVBucketForKeys(keyPattern string, bucket KVBucketConfig) *Config {
+	ro.kvBucketRoutes = append(ro.kvBucketRoutes, kvBucketRoute{keyPattern: keyPattern, bucket: bucket})
+	return ro
+}
+
+// Resolves concurrent updates of keys matching the pattern instead of the latest write winning,
+// resolvers are matched in the order they were added
+func (ro *Config) SetConflictResolver(keyPattern string, resolver ConflictResolver) *Config {
+	ro.conflictResolvers = append(ro.conflictResolvers, conflictResolverRoute{tokens: splitKey(keyPattern), resolver: resolver})
+	return ro
+}
+
+// Evicted keys read again within the window are counted as refaults, see LRUTuning. 0 - disabled
+func (ro *Config) SetEvictionChurnWindowSec(evictionChurnWindowSec int) *Config {
+	ro.evictionChurnWindowSec = evictionChurnWindowSec
+	return ro
+}
+
+// Max evicted keys remembered for refault detection
+func (ro *Config) SetEvictionGhostsMaxSize(evictionGhostsMaxSize int) *Config {
+	ro.evictionGhostsMaxSize = evictionGhostsMaxSize
+	return ro
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+/*
+Conflict resolvers replace "the latest write wins" for keys changed concurrently: a KV update newer than a local value
+not yet confirmed in KV. The resolver registered for the first matching key pattern (Config.SetConflictResolver)
+decides the result, a result other than the remote version is written back to KV as a version newer than both,
+so all the replicas converge on it. Updates older than the local value are still ignored, this also keeps echoes
+of the resolved writes from triggering another resolution.
+*/
+
+// ConflictVersion is one side of a conflict
+type ConflictVersion struct {
+	Value  []byte
+	Exists bool // false - the value is deleted
+	Time   int64
+}
+
+// ConflictResolution is the result of a conflict
+type ConflictResolution struct {
+	Remote bool // Take the remote version as is, Value and Delete are ignored
+	Value  []byte
+	Delete bool
+}
+
+// ConflictResolver is called from the KV watcher routine, must not block
+type ConflictResolver func(key string, local ConflictVersion, remote ConflictVersion) ConflictResolution
+
+type conflictResolverRoute struct {
+	tokens   []string
+	resolver ConflictResolver
+}
+
+// PreferRemoteResolver takes the remote version, the same as the default policy
+func PreferRemoteResolver(key string, local ConflictVersion, remote ConflictVersion) ConflictResolution {
+	return ConflictResolution{Remote: true}
+}
+
+// PreferLocalResolver keeps the local version overwriting concurrent updates made elsewhere
+func PreferLocalResolver(key string, local ConflictVersion, remote ConflictVersion) ConflictResolution {
+	return ConflictResolution{Value: local.Value, Delete: !local.Exists}
+}
+
+// NewMergeResolver returns the resolver writing the merged value, a deleted side comes as nil
+func NewMergeResolver(merge func(key string, local []byte, remote []byte) []byte) ConflictResolver {
+	return func(key string, local ConflictVersion, remote ConflictVersion) ConflictResolution {
+		var localValue, remoteValue []byte
+		if local.Exists {
+			localValue = local.Value
+		}
+		if remote.Exists {
+			remoteValue = remote.Value
+		}
+		return ConflictResolution{Value: merge(key, localValue, remoteValue)}
+	}
+}
+
+func (cs *Store) conflictResolver(key string) ConflictResolver {
+	if len(cs.cacheConfig.conflictResolvers) == 0 {
+		return nil
+	}
+	keyTokens := splitKey(key)
+	for _, r := range cs.cacheConfig.conflictResolvers {
+		if keyTokensMatchPattern(keyTokens, r.tokens) {
+			return r.resolver
+		}
+	}
+	return nil
+}
+
+// Resolves the KV update conflicting with the local value, returns false if the update is to be applied as usual
+func (cs *Store) resolveKVConflict(key string, remote ConflictVersion) bool {
+	resolver := cs.conflictResolver(key)
+	if resolver == nil {
+		return false
+	}
+	csv := cs.getLastKeyCacheStoreValue(key)
+	if csv == nil {
+		return false
+	}
+	csv.Lock("resolveKVConflict")
+	if csv.syncedWithKV || csv.valueUpdateTime < 0 || remote.Time <= csv.valueUpdateTime {
+		csv.Unlock("resolveKVConflict")
+		return false
+	}
+	local := ConflictVersion{Exists: csv.valueExists, Time: csv.valueUpdateTime}
+	if bv, ok := csv.value.([]byte); ok {
+		local.Value = bv
+	}
+	csv.Unlock("resolveKVConflict")
+
+	resolution := resolver(key, local, remote)
+	if resolution.Remote {
+		return false
+	}
+	cs.stats.conflictsResolved.Add(1)
+	if resolution.Delete {
+		cs.deleteValue(key, true, remote.Time+1, "")
+	} else {
+		cs.setValue(key, resolution.Value, true, remote.Time+1, "")
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+)
+
+/*
+Read consistency levels let a reader trade latency for freshness explicitly:
+
+	ReadCached       - the cached value as GetValue returns it, may be stale by the KV watcher's lag
+	ReadKVVerified   - the cached value's KV revision is checked against KV, a newer KV version is loaded;
+	                   values written locally and not synced yet are returned as is, they are newer than KV
+	ReadLinearizable - fences the store first (a newer cache epoch in KV drops the local state, see cache_epoch.go),
+	                   waits until the key's local writes are confirmed in KV, then reads through KV as ReadKVVerified;
+	                   sees every write completed before the read on any node
+
+ReadKVVerified and ReadLinearizable cost a KV round trip per key.
+*/
+
+type ReadConsistency string
+
+const (
+	ReadCached       ReadConsistency = "cached"
+	ReadKVVerified   ReadConsistency = "kv-verified"
+	ReadLinearizable ReadConsistency = "linearizable"
+
+	LinearizableReadSyncTimeout = 5 * time.Second
+)
+
+// ParseReadConsistency parses a level's name, empty name is ReadCached
+func ParseReadConsistency(level string) (ReadConsistency, error) {
+	switch ReadConsistency(level) {
+	case "", ReadCached:
+		return ReadCached, nil
+	case ReadKVVerified, ReadLinearizable:
+		return ReadConsistency(level), nil
+	}
+	return "", fmt.Errorf("error: unknown read consistency level %q", level)
+}
+
+// GetValueConsistent is GetValue with the consistency level
+func (cs *Store) GetValueConsistent(key string, level ReadConsistency) ([]byte, error) {
+	switch level {
+	case ReadKVVerified:
+		cs.verifyWithKV(key)
+	case ReadLinearizable:
+		if entry, err := cs.backend.Get(cs.toStoreKey(CacheEpochKey)); err == nil {
+			cs.handleEpochRecord(entry.Value(), true)
+		}
+		if err := cs.WaitSynced(key, LinearizableReadSyncTimeout); err != nil {
+			return nil, err
+		}
+		cs.verifyWithKV(key)
+	}
+	return cs.GetValue(key)
+}
+
+// GetValueAsJSONConsistent is GetValueAsJSON with the consistency level
+func (cs *Store) GetValueAsJSONConsistent(key string, level ReadConsistency) (*easyjson.JSON, error) {
+	value, err := cs.GetValueConsistent(key, level)
+	if err == nil {
+		if j, ok := easyjson.JSONFromBytes(value); ok {
+			return &j, nil
+		}
+		return nil, fmt.Errorf("Value for key=%s is not a JSON", key)
+	}
+	return nil, err
+}
+
+// Loads the key's KV version if it is newer than the cached one
+func (cs *Store) verifyWithKV(key string) {
+	var localRevision uint64
+	localTime := int64(-1)
+	synced := true
+	if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
+		csv.Lock("verifyWithKV")
+		localRevision = csv.kvRevision
+		localTime = csv.valueUpdateTime // Deleted values keep their delete time, dropped ones have -1
+		synced = !csv.syncNeeded
+		csv.Unlock("verifyWithKV")
+	}
+	if !synced {
+		return // Local write is newer than KV
+	}
+
+	entry, err := cs.backend.Get(cs.toStoreKey(key))
+	if err != nil {
+		return // Not in KV, the cached value decides
+	}
+	if localRevision != 0 && localRevision == entry.Revision() {
+		return
+	}
+	record := entry.Value()
+	if len(record) < 9 {
+		return
+	}
+	recordTime := int64(binary.BigEndian.Uint64(record[:8]))
+	if recordTime <= localTime {
+		return
+	}
+	cs.stats.staleReads.Add(1)
+	if record[8] == 1 {
+		cs.setValue(key, record[9:], false, recordTime, "")
+		cs.setKVRevision(key, recordTime, entry.Revision())
+	} else {
+		cs.deleteValue(key, false, recordTime, "")
+	}
+}
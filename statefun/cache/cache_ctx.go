@@ -0,0 +1,63 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"context"
+
+	"github.com/foliagecp/easyjson"
+)
+
+/*
+Context-aware variants of the Store reads. A cache miss goes to KV which may block for long, the call
+returns ctx.Err() as soon as ctx is done. The abandoned KV read still completes in background
+and its value gets cached as usual.
+*/
+
+func runWithContext[T any](ctx context.Context, f func() (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		value, err := f()
+		resultChan <- result{value: value, err: err}
+	}()
+
+	select {
+	case r := <-resultChan:
+		return r.value, r.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+func (cs *Store) GetValueCtx(ctx context.Context, key string) ([]byte, error) {
+	return runWithContext(ctx, func() ([]byte, error) {
+		return cs.GetValue(key)
+	})
+}
+
+func (cs *Store) GetValueAsJSONCtx(ctx context.Context, key string) (*easyjson.JSON, error) {
+	return runWithContext(ctx, func() (*easyjson.JSON, error) {
+		return cs.GetValueAsJSON(key)
+	})
+}
+
+func (cs *Store) GetKeysByPatternCtx(ctx context.Context, pattern string) ([]string, error) {
+	return runWithContext(ctx, func() ([]string, error) {
+		return cs.GetKeysByPattern(pattern), nil
+	})
+}
+
+func GetCtx[T any](ctx context.Context, cs *Store, key string) (T, error) {
+	return runWithContext(ctx, func() (T, error) {
+		return Get[T](cs, key)
+	})
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"sort"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Digest subscriptions are level subscriptions for consumers needing eventual awareness only (e.g. UI re-render):
+instead of a message per update they receive the set of full keys changed since the previous digest every interval.
+A consumer not keeping up gets keys of the missed intervals merged into the next digest, nothing is dropped.
+*/
+
+// SubscribeLevelDigest is SubscribeLevelCallback delivering sorted changed keys at most once per intervalMs,
+// the channel is closed after UnsubscribeLevelDigest
+func (cs *Store) SubscribeLevelDigest(key string, callbackID string, intervalMs int) chan []string {
+	updates := cs.SubscribeLevelCallback(key, callbackID)
+	if updates == nil {
+		return nil
+	}
+	levelPrefix := ""
+	if i := keyDotIndex(key, true); i >= 0 {
+		levelPrefix = key[:i+1]
+	}
+
+	digests := make(chan []string, 1)
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("cache.levelDigest")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("cache.levelDigest")
+		defer close(digests)
+
+		ticker := time.NewTicker(time.Duration(intervalMs) * time.Millisecond)
+		defer ticker.Stop()
+		changed := map[string]struct{}{}
+		for {
+			select {
+			case kv, ok := <-updates:
+				if !ok {
+					return
+				}
+				if k, ok := kv.Key.(string); ok {
+					changed[levelPrefix+k] = struct{}{}
+				}
+			case <-ticker.C:
+				if len(changed) == 0 {
+					continue
+				}
+				digest := make([]string, 0, len(changed))
+				for k := range changed {
+					digest = append(digest, k)
+				}
+				sort.Strings(digest)
+				select {
+				case digests <- digest:
+					changed = map[string]struct{}{}
+				default: // Previous digest is not consumed yet, keep merging
+				}
+			case <-cs.ctx.Done():
+				return
+			}
+		}
+	}()
+	return digests
+}
+
+func (cs *Store) UnsubscribeLevelDigest(key string, callbackID string) {
+	cs.UnsubscribeLevelCallback(key, callbackID)
+}
@@ -0,0 +1,215 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Cache epoch makes KV bucket restores safe. Caches of running nodes hold values newer than the restored ones
+(and remember deletes) so they would overwrite the restored state. Bumping the epoch in KV after a restore
+makes every cache drop its local state synced with KV and reload it from KV on demand, values not yet synced are
+written afterwards as usual.
+
+Writers are fenced per key rather than by the epoch: a node paused or partitioned away wakes up with unsynced values
+that may be older than the data others wrote meanwhile. The lazy writer writes a value only if the key's KV revision
+is still the one the value was based on (KVBackendCAS), on a mismatch it compares the KV record with the value: a
+newer record fences the value off, it is discarded and reloaded from KV; an older one is overwritten at its revision.
+Backends without conditional writes (custom ones, deduplication and deltas support them) are not fenced at all:
+values are written unconditionally and the store warns about it once on start.
+*/
+
+const (
+	CacheEpochKey     = "__cache_epoch"
+	fencedPutAttempts = 8
+)
+
+// Epoch returns the cache epoch this store is in
+func (cs *Store) Epoch() uint64 {
+	return cs.epoch.Load()
+}
+
+// BumpEpoch increments the epoch in KV, all caches on top of it drop their local state when they receive it
+func (cs *Store) BumpEpoch() (uint64, error) {
+	epoch := cs.Epoch()
+	if entry, err := cs.backend.Get(cs.toStoreKey(CacheEpochKey)); err == nil {
+		if e, ok := parseEpochRecord(entry.Value()); ok && e > epoch {
+			epoch = e
+		}
+	}
+	epoch++
+	_, err := cs.backend.Put(cs.toStoreKey(CacheEpochKey), kvRecordBytes(system.GetCurrentTimeNs(), []byte(strconv.FormatUint(epoch, 10)), true))
+	return epoch, err
+}
+
+func parseEpochRecord(record []byte) (uint64, bool) {
+	if len(record) < 9 || record[8] != 1 {
+		return 0, false
+	}
+	epoch, err := strconv.ParseUint(string(record[9:]), 10, 64)
+	return epoch, err == nil
+}
+
+// Applies the epoch received from KV, initial records only set the epoch cause the cache is empty yet
+func (cs *Store) handleEpochRecord(record []byte, inited bool) {
+	epoch, ok := parseEpochRecord(record)
+	if !ok {
+		return
+	}
+	for {
+		current := cs.epoch.Load()
+		if epoch <= current {
+			return
+		}
+		if cs.epoch.CompareAndSwap(current, epoch) {
+			break
+		}
+	}
+	if inited {
+		cs.logger().Logf(lg.WarnLevel, "Cache epoch changed to %d, dropping local state\n", epoch)
+		cs.dropLocalState(cs.rootValue, system.GetCurrentTimeNs())
+	}
+}
+
+// Forgets all synced values of the subtree, keeps only levels with subscribers or unsynced values marking them
+// inconsistent with KV.
+// Returns whether the level must be kept in its parent
+func (cs *Store) dropLocalState(csv *StoreValue, lossTime int64) bool {
+	csv.Lock("dropLocalState")
+	defer csv.Unlock("dropLocalState")
+
+	for key, child := range csv.store {
+		if !cs.dropLocalState(child, lossTime) {
+			delete(csv.store, key)
+		}
+	}
+	unsynced := csv.syncNeeded // Written afterwards, fenced per key if KV holds newer data
+	if csv.parent != nil && !unsynced {
+		csv.value = nil
+		csv.valueExists = false
+		csv.valueUpdateTime = -1
+		csv.purgeState = 0
+		csv.syncedWithKV = true
+	}
+	atomic.StoreInt64(&csv.storeConsistencyWithKVLossTime, lossTime)
+
+	hasSubscribers := false
+	csv.notifyUpdates.Range(func(_, _ interface{}) bool {
+		hasSubscribers = true
+		return false
+	})
+	csv.notifySubtreeUpdates.Range(func(_, _ interface{}) bool {
+		hasSubscribers = true
+		return false
+	})
+	return hasSubscribers || unsynced || len(csv.store) > 0
+}
+
+// Writes the value's record unless KV already holds a newer one. revision - the KV revision the value is based on,
+// 0 - the key is not expected in KV. Returns the record's revision; the newer KV entry instead if the value is fenced off.
+// Backends without KVBackendCAS are written unconditionally, the value is never fenced off then
+func (cs *Store) putFenced(storeKey string, record []byte, revision uint64, updateTime int64) (uint64, KVBackendEntry, error) {
+	cas, ok := cs.backend.(KVBackendCAS)
+	if !ok {
+		written, err := cs.backend.Put(storeKey, record)
+		return written, nil, err
+	}
+	for attempt := 0; attempt < fencedPutAttempts; attempt++ {
+		var written uint64
+		var err error
+		if revision == 0 {
+			written, err = cas.Create(storeKey, record)
+		} else {
+			written, err = cas.Update(storeKey, record, revision)
+		}
+		if err == nil {
+			return written, nil, nil
+		}
+		if !isKVRevisionMismatch(err) {
+			return 0, nil, err
+		}
+
+		entry, err := cs.backend.Get(storeKey)
+		if err == nats.ErrKeyNotFound {
+			revision = 0
+			continue
+		} else if err != nil {
+			return 0, nil, err
+		}
+		kvRecord := entry.Value()
+		if len(kvRecord) < 9 {
+			revision = entry.Revision()
+			continue
+		}
+		switch kvRecordTime := int64(binary.BigEndian.Uint64(kvRecord[:8])); {
+		case kvRecordTime > updateTime:
+			return 0, entry, nil
+		case kvRecordTime == updateTime: // The record is already there (e.g. written by a transaction)
+			return entry.Revision(), nil, nil
+		}
+		revision = entry.Revision()
+	}
+	return 0, nil, KVRevisionMismatchError
+}
+
+// Applies the result of putFenced of the value written with updateTime
+func (cs *Store) confirmFencedPut(csv *StoreValue, key string, updateTime int64, revision uint64, newerEntry KVBackendEntry) {
+	csv.Lock("confirmFencedPut")
+	defer csv.Unlock("confirmFencedPut")
+	if newerEntry != nil {
+		if csv.discardFenced(updateTime) {
+			cs.stats.fencedWrites.Add(1)
+			cs.logger().Logf(lg.WarnLevel, "Cache value for key=%s is fenced off by a newer KV record, discarded\n", key)
+		}
+		return
+	}
+	csv.kvRevision = revision // The key's latest revision whether the value changed meanwhile or not
+	if updateTime == csv.valueUpdateTime {
+		csv.syncNeeded = false
+	}
+}
+
+// Writes the key's local update not yet synced with KV right away the way the lazy writer does
+func (cs *Store) flushKey(key string) error {
+	csv := cs.getLastKeyCacheStoreValue(key)
+	if csv == nil {
+		return nil
+	}
+	csv.Lock("flushKey")
+	if !csv.syncNeeded {
+		csv.Unlock("flushKey")
+		return nil
+	}
+	updateTime, kvRevision := csv.valueUpdateTime, csv.kvRevision
+	var record []byte
+	if csv.valueExists {
+		record = kvRecordBytes(updateTime, csv.value.([]byte), true)
+	} else {
+		record = kvRecordBytes(updateTime, nil, false)
+	}
+	csv.Unlock("flushKey")
+
+	revision, newerEntry, err := cs.putFenced(cs.toStoreKey(key), record, kvRevision, updateTime)
+	if err != nil {
+		return err
+	}
+	cs.confirmFencedPut(csv, key, updateTime, revision, newerEntry)
+	return nil
+}
+
+// Discards the value fenced off by a newer KV record unless it was updated meanwhile, it is reloaded from KV on demand
+func (csv *StoreValue) discardFenced(updateTime int64) bool {
+	if csv.valueUpdateTime != updateTime {
+		return false
+	}
+	csv.syncNeeded = false
+	return csv.forget()
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+)
+
+var (
+	InvalidKeyError          = errors.New("error: invalid key")
+	TransactionNotFoundError = errors.New("error: transaction does not exist")
+	MalformedKVRecordError   = errors.New("error: KV record without time and append flag")
+)
+
+// Logger receives all cache store log messages
+type Logger interface {
+	Logf(level lg.LogLevel, format string, args ...interface{})
+}
+
+type defaultLogger struct{}
+
+func (defaultLogger) Logf(level lg.LogLevel, format string, args ...interface{}) {
+	lg.Logf(level, format, args...)
+}
+
+// ErrorEvent describes a failure which happened inside the cache store, mostly in its background routines
+type ErrorEvent struct {
+	Op  string // Operation failed: "kv_watch", "kv_put", "transaction", etc.
+	Key string
+	Err error
+}
+
+func (e ErrorEvent) Error() string {
+	if len(e.Key) > 0 {
+		return fmt.Sprintf("cache %s key=%s: %s", e.Op, e.Key, e.Err)
+	}
+	return fmt.Sprintf("cache %s: %s", e.Op, e.Err)
+}
+
+// ErrorHandler is called synchronously from the routine the error happened in, must not block
+type ErrorHandler func(event ErrorEvent)
+
+func (cs *Store) logger() Logger {
+	if cs.cacheConfig.logger != nil {
+		return cs.cacheConfig.logger
+	}
+	return defaultLogger{}
+}
+
+func (cs *Store) reportError(op string, key string, err error) {
+	event := ErrorEvent{Op: op, Key: key, Err: err}
+	cs.logger().Logf(lg.ErrorLevel, "%s\n", event.Error())
+	if cs.cacheConfig.errorHandler != nil {
+		cs.cacheConfig.errorHandler(event)
+	}
+}
+
+// SetValueWithError is SetValue returning the reason the value was not set
+func (cs *Store) SetValueWithError(key string, value []byte, updateInKV bool, customSetTime int64, transactionID string) error {
+	return cs.setValueChecked(key, value, updateInKV, customSetTime, transactionID)
+}
+
+// DeleteValueWithError is DeleteValue returning the reason the value was not deleted
+func (cs *Store) DeleteValueWithError(key string, updateInKV bool, customDeleteTime int64, transactionID string) error {
+	return cs.deleteValueChecked(key, updateInKV, customDeleteTime, transactionID)
+}
+
+// Sets the value after the key and write policy checks, the only place they are made for SetValue*
+func (cs *Store) setValueChecked(key string, value []byte, updateInKV bool, customSetTime int64, transactionID string) error {
+	if !cs.validKey(key) {
+		return InvalidKeyError
+	}
+	if err := cs.checkKeyWrite("", key); err != nil {
+		return err
+	}
+	if len(transactionID) > 0 {
+		if _, ok := cs.transactions.Load(transactionID); !ok {
+			return TransactionNotFoundError
+		}
+	}
+	cs.setValue(key, value, updateInKV, customSetTime, transactionID)
+	return nil
+}
+
+// Deletes the value after the write policy check, the only place it is made for DeleteValue*
+func (cs *Store) deleteValueChecked(key string, updateInKV bool, customDeleteTime int64, transactionID string) error {
+	if err := cs.checkKeyWrite("", key); err != nil {
+		return err
+	}
+	if len(transactionID) > 0 {
+		if _, ok := cs.transactions.Load(transactionID); !ok {
+			return TransactionNotFoundError
+		}
+	}
+	cs.deleteValue(key, updateInKV, customDeleteTime, transactionID)
+	return nil
+}
+
+// Reports the failure of a setter without an error result the way the store always did
+func (cs *Store) reportWriteError(key string, transactionID string, err error) {
+	switch err {
+	case InvalidKeyError:
+	case TransactionNotFoundError:
+		cs.reportError("transaction", transactionID, err)
+	default:
+		cs.reportError("key_policy", key, err)
+	}
+}
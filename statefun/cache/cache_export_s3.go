@@ -0,0 +1,420 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+)
+
+/*
+S3 export streams a snapshot (see cache_snapshot.go) to S3-compatible storage (AWS S3, MinIO) as a zstd compressed
+multipart upload, nothing is written to the local disk except the small state file. The object is a sequence of zstd
+frames, one per part, each holding whole snapshot lines, so it decompresses as a single snapshot:
+
+	Import(zstdReader(object))
+
+Values are read from KV, not from memory, so keys not loaded by the runtime are exported too and updates not synced
+with KV yet are not. Keys are collected by watching the whole store and exported in order (tokens compared one by
+one, a key goes before its children), the state file records the upload and the last key of every uploaded part.
+An export started with the state file of an unfinished one continues the same upload after the last uploaded key.
+Values updated between the attempts are exported as they were at the time their part was made. Unfinished uploads are kept by the storage until aborted or expired by the
+bucket's lifecycle rules.
+*/
+
+const (
+	S3ExportMinPartSize = 5 << 20 // S3 minimum for all parts but the last one
+)
+
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com, http://minio:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+type S3ExportOptions struct {
+	Object    string
+	PartSize  int    // Compressed size of parts, not less than S3ExportMinPartSize
+	StatePath string // File the export state is kept in to be resumed, empty - the export is not resumable
+}
+
+type s3ExportState struct {
+	Object   string         `json:"object"`
+	UploadID string         `json:"upload_id"`
+	Parts    []s3ExportPart `json:"parts"`
+}
+
+type s3ExportPart struct {
+	Number  int    `json:"number"`
+	ETag    string `json:"etag"`
+	LastKey string `json:"last_key"`
+}
+
+// ExportToS3 streams a snapshot of all values stored in KV to the S3 object, resuming the export recorded in the state
+// file if there is one
+func (cs *Store) ExportToS3(ctx context.Context, s3 S3Config, options S3ExportOptions) error {
+	if options.PartSize < S3ExportMinPartSize {
+		options.PartSize = S3ExportMinPartSize
+	}
+	client := &s3Client{config: s3, http: http.DefaultClient}
+
+	state, err := loadS3ExportState(options.StatePath)
+	if err != nil {
+		return err
+	}
+	if state != nil && state.Object != options.Object {
+		return fmt.Errorf("error: state file %s is of the export to %s", options.StatePath, state.Object)
+	}
+	if state == nil {
+		uploadID, err := client.createMultipartUpload(ctx, options.Object)
+		if err != nil {
+			return err
+		}
+		state = &s3ExportState{Object: options.Object, UploadID: uploadID}
+		if err := state.save(options.StatePath); err != nil {
+			return err
+		}
+	}
+
+	part := &s3PartWriter{ctx: ctx, client: client, state: state, statePath: options.StatePath, partSize: options.PartSize}
+	var afterKey []string
+	if len(state.Parts) > 0 {
+		afterKey = splitKey(state.Parts[len(state.Parts)-1].LastKey)
+	} else if err := part.writeLine(snapshotHeader{Version: SnapshotVersion, ID: cs.cacheConfig.id, Prefix: cs.cacheConfig.kvStorePrefix}, ""); err != nil {
+		return err
+	}
+	if err := cs.exportOrdered(afterKey, func(record snapshotRecord) error {
+		return part.writeLine(record, record.Key)
+	}); err != nil {
+		return err
+	}
+	if err := part.flush(); err != nil {
+		return err
+	}
+
+	if err := client.completeMultipartUpload(ctx, options.Object, state.UploadID, state.Parts); err != nil {
+		return err
+	}
+	if len(options.StatePath) > 0 {
+		return os.Remove(options.StatePath)
+	}
+	return nil
+}
+
+// Calls emit with values stored in KV in the key order, skipping keys not after afterKey. Only the keys are collected
+// by watching the whole store, values are read one by one as they are emitted
+func (cs *Store) exportOrdered(afterKey []string, emit func(record snapshotRecord) error) error {
+	pattern := cs.toStoreKey(">")
+	w, err := cs.backend.Watch(pattern)
+	if err != nil {
+		return err
+	}
+	exported := map[string][]string{}
+	caughtUp := false
+	for entry := range w.Updates() {
+		if entry == nil {
+			caughtUp = true
+			break
+		}
+		key := cs.fromStoreKey(entry.Key())
+		if key == CacheEpochKey {
+			continue
+		}
+		if record := entry.Value(); len(record) >= 9 && record[8] == 1 {
+			if tokens := splitKey(key); compareKeyTokens(tokens, afterKey) > 0 {
+				exported[key] = tokens
+			}
+		} else {
+			delete(exported, key)
+		}
+	}
+	system.MsgOnErrorReturn(w.Stop())
+	if !caughtUp {
+		return fmt.Errorf("error: watch of %s stopped before all keys were read", pattern)
+	}
+
+	keys := make([]string, 0, len(exported))
+	for key := range exported {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return compareKeyTokens(exported[keys[i]], exported[keys[j]]) < 0 })
+
+	for _, key := range keys {
+		entry, err := cs.backend.Get(cs.toStoreKey(key))
+		if err == nats.ErrKeyNotFound { // Deleted meanwhile
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		record := entry.Value()
+		if len(record) < 9 || record[8] != 1 {
+			continue
+		}
+		if err := emit(snapshotRecord{Key: key, Value: record[9:], UpdateTime: int64(binary.BigEndian.Uint64(record[:8]))}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compareKeyTokens(a []string, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := strings.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// Compresses lines into the current part, uploads it once it reaches the part size
+type s3PartWriter struct {
+	ctx       context.Context
+	client    *s3Client
+	state     *s3ExportState
+	statePath string
+	partSize  int
+
+	buffer  bytes.Buffer
+	encoder *zstd.Encoder
+	lastKey string
+}
+
+func (w *s3PartWriter) writeLine(line interface{}, key string) error {
+	if w.encoder == nil {
+		var err error
+		if w.encoder, err = zstd.NewWriter(&w.buffer); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	if _, err := w.encoder.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	w.lastKey = key
+	if w.buffer.Len() < w.partSize {
+		return nil
+	}
+	return w.flush()
+}
+
+// Uploads the current part with its frame closed, records it in the state
+func (w *s3PartWriter) flush() error {
+	if w.encoder == nil {
+		return nil
+	}
+	if err := w.encoder.Close(); err != nil {
+		return err
+	}
+	w.encoder = nil
+
+	number := 1
+	if len(w.state.Parts) > 0 {
+		number = w.state.Parts[len(w.state.Parts)-1].Number + 1
+	}
+	etag, err := w.client.uploadPart(w.ctx, w.state.Object, w.state.UploadID, number, w.buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	w.buffer.Reset()
+	w.state.Parts = append(w.state.Parts, s3ExportPart{Number: number, ETag: etag, LastKey: w.lastKey})
+	return w.state.save(w.statePath)
+}
+
+func loadS3ExportState(path string) (*s3ExportState, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &s3ExportState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("error: invalid export state file %s: %s", path, err)
+	}
+	return state, nil
+}
+
+func (s *s3ExportState) save(path string) error {
+	if len(path) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// --------------------------------------------------------------------------------------------------------------------
+
+// Multipart upload requests signed with AWS Signature Version 4
+type s3Client struct {
+	config S3Config
+	http   *http.Client
+}
+
+func (c *s3Client) createMultipartUpload(ctx context.Context, object string) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if _, err := c.do(ctx, http.MethodPost, object, url.Values{"uploads": {""}}, nil, &result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+func (c *s3Client) uploadPart(ctx context.Context, object string, uploadID string, number int, data []byte) (string, error) {
+	header, err := c.do(ctx, http.MethodPut, object, url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {uploadID}}, data, nil)
+	if err != nil {
+		return "", err
+	}
+	return header.Get("ETag"), nil
+}
+
+func (c *s3Client) completeMultipartUpload(ctx context.Context, object string, uploadID string, parts []s3ExportPart) error {
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	body := struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{}
+	for _, part := range parts {
+		body.Parts = append(body.Parts, completedPart{PartNumber: part.Number, ETag: part.ETag})
+	}
+	data, err := xml.Marshal(body)
+	if err != nil {
+		return err
+	}
+	// Completion may fail with 200 OK and an error document
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if _, err := c.do(ctx, http.MethodPost, object, url.Values{"uploadId": {uploadID}}, data, &result); err != nil {
+		return err
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("error: s3 complete multipart upload: %s: %s", result.Code, result.Message)
+	}
+	return nil
+}
+
+func (c *s3Client) do(ctx context.Context, method string, object string, query url.Values, body []byte, result interface{}) (http.Header, error) {
+	endpoint, err := url.Parse(c.config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	path := "/" + c.config.Bucket + "/" + strings.TrimPrefix(object, "/") // Path-style, supported by S3 and MinIO
+	canonicalPath := s3Escape(path)
+	canonicalQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint.Scheme+"://"+endpoint.Host+canonicalPath+"?"+canonicalQuery, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, canonicalPath, canonicalQuery, body, time.Now().UTC())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("error: s3 %s %s: %s: %s", method, object, resp.Status, string(data))
+	}
+	if result != nil {
+		if err := xml.Unmarshal(data, result); err != nil {
+			return nil, err
+		}
+	}
+	return resp.Header, nil
+}
+
+func (c *s3Client) sign(req *http.Request, canonicalPath string, canonicalQuery string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		canonicalQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + c.config.SecretKey)
+	for _, s := range []string{date, c.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.config.AccessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// URI encoding of SigV4 paths: everything but unreserved characters and "/" is percent-encoded
+func s3Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	sdkErrors "github.com/foliagecp/sdk/errors"
+)
+
+var (
+	waitSyncedTimeoutError = sdkErrors.New(sdkErrors.ErrTimeout, "error: timeout waiting for the value to be synced with KV")
+)
+
+// Lets callers wait for KV lazy writer passes
+type lazyWriterSync struct {
+	mutex       sync.Mutex
+	passes      uint64
+	lastPending int64
+	passDone    chan struct{} // Closed and replaced on each completed pass
+	wakeup      chan struct{}
+}
+
+func newLazyWriterSync() lazyWriterSync {
+	return lazyWriterSync{passDone: make(chan struct{}), wakeup: make(chan struct{}, 1)}
+}
+
+func (cs *Store) lazyWriterPassCompleted(pending int64) {
+	cs.lazyWriterSync.mutex.Lock()
+	cs.lazyWriterSync.passes++
+	cs.lazyWriterSync.lastPending = pending
+	close(cs.lazyWriterSync.passDone)
+	cs.lazyWriterSync.passDone = make(chan struct{})
+	cs.lazyWriterSync.mutex.Unlock()
+}
+
+// Returns the number of completed passes, pending syncs left by the last one and a channel closed on the next pass
+func (cs *Store) lazyWriterState() (uint64, int64, chan struct{}) {
+	cs.lazyWriterSync.mutex.Lock()
+	defer cs.lazyWriterSync.mutex.Unlock()
+	return cs.lazyWriterSync.passes, cs.lazyWriterSync.lastPending, cs.lazyWriterSync.passDone
+}
+
+func (cs *Store) wakeLazyWriter() {
+	select {
+	case cs.lazyWriterSync.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Flush blocks until every value set before the call is confirmed in KV or ctx is done
+func (cs *Store) Flush(ctx context.Context) error {
+	startPasses, _, _ := cs.lazyWriterState()
+	for {
+		passes, pending, passDone := cs.lazyWriterState()
+		// The pass running at the moment of the call might have already visited some of the values,
+		// only a pass started after the call is guaranteed to visit all of them
+		if passes >= startPasses+2 && pending == 0 {
+			return nil
+		}
+		cs.wakeLazyWriter()
+		select {
+		case <-passDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// WaitSynced blocks until the key's value is confirmed in KV, returns immediately if the key is not in the cache
+func (cs *Store) WaitSynced(key string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		_, _, passDone := cs.lazyWriterState()
+
+		csv := cs.getLastKeyCacheStoreValue(key)
+		if csv == nil {
+			return nil
+		}
+		csv.Lock("WaitSynced")
+		syncNeeded := csv.syncNeeded
+		csv.Unlock("WaitSynced")
+		if !syncNeeded {
+			return nil
+		}
+
+		cs.wakeLazyWriter()
+		select {
+		case <-passDone:
+		case <-deadline:
+			return waitSyncedTimeoutError
+		}
+	}
+}
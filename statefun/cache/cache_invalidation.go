@@ -0,0 +1,125 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+/*
+Distributed invalidation lets replicas sharing a KV prefix drop stale values immediately. Local deletes not going
+to KV (updateInKV=false) and explicit Invalidate calls are published to the invalidation bus, every other replica
+forgets the values (unless it has own unsynced updates of them) and reloads them from KV on the next read.
+*/
+
+// InvalidationBus delivers invalidated keys between cache stores sharing a KV prefix
+type InvalidationBus interface {
+	Publish(prefix string, sourceID string, keys []string) error
+	Subscribe(prefix string, handler func(sourceID string, keys []string)) (unsubscribe func() error, err error)
+}
+
+type invalidationMsg struct {
+	Source string   `json:"source"`
+	Keys   []string `json:"keys"`
+}
+
+// NATS invalidation bus ---------------------------------------------------------------------------
+
+type natsInvalidationBus struct {
+	nc *nats.Conn
+}
+
+// NewNatsInvalidationBus publishes invalidations to the "cache.invalidate.<kv store prefix>" NATS core subject
+func NewNatsInvalidationBus(nc *nats.Conn) InvalidationBus {
+	return &natsInvalidationBus{nc: nc}
+}
+
+func invalidationSubject(prefix string) string {
+	return fmt.Sprintf("cache.invalidate.%s", prefix)
+}
+
+func (b *natsInvalidationBus) Publish(prefix string, sourceID string, keys []string) error {
+	data, err := json.Marshal(invalidationMsg{Source: sourceID, Keys: keys})
+	if err != nil {
+		return err
+	}
+	return b.nc.Publish(invalidationSubject(prefix), data)
+}
+
+func (b *natsInvalidationBus) Subscribe(prefix string, handler func(sourceID string, keys []string)) (func() error, error) {
+	sub, err := b.nc.Subscribe(invalidationSubject(prefix), func(msg *nats.Msg) {
+		var im invalidationMsg
+		if err := json.Unmarshal(msg.Data, &im); err != nil {
+			lg.Logf(lg.ErrorLevel, "Malformed cache invalidation message: %s\n", err)
+			return
+		}
+		handler(im.Source, im.Keys)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub.Unsubscribe, nil
+}
+
+// ------------------------------------------------------------------------------------------------
+
+func (cs *Store) startInvalidation() {
+	if cs.cacheConfig.invalidationBus == nil {
+		return
+	}
+	cs.instanceID = system.GetUniqueStrID()
+	unsubscribe, err := cs.cacheConfig.invalidationBus.Subscribe(cs.cacheConfig.kvStorePrefix, cs.handleInvalidation)
+	if err != nil {
+		cs.reportError("invalidation_subscribe", cs.cacheConfig.kvStorePrefix, err)
+		return
+	}
+	go func() {
+		<-cs.ctx.Done()
+		system.MsgOnErrorReturn(unsubscribe())
+	}()
+}
+
+// Invalidate makes other replicas forget the keys' values and reload them from KV on the next read
+func (cs *Store) Invalidate(keys ...string) {
+	if cs.cacheConfig.invalidationBus == nil || len(keys) == 0 {
+		return
+	}
+	if err := cs.cacheConfig.invalidationBus.Publish(cs.cacheConfig.kvStorePrefix, cs.instanceID, keys); err != nil {
+		cs.reportError("invalidation_publish", keys[0], err)
+	}
+}
+
+func (cs *Store) handleInvalidation(sourceID string, keys []string) {
+	if sourceID == cs.instanceID {
+		return
+	}
+	for _, key := range keys {
+		if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
+			csv.Lock("handleInvalidation")
+			forgotten := csv.forget()
+			csv.Unlock("handleInvalidation")
+			if forgotten && csv.parent != nil {
+				atomic.StoreInt64(&csv.parent.storeConsistencyWithKVLossTime, system.GetCurrentTimeNs())
+			}
+		}
+	}
+}
+
+// Makes the value unknown so the next read goes to KV, keeps values with unsynced local updates. Must be called under the lock
+func (csv *StoreValue) forget() bool {
+	if csv.syncNeeded || (!csv.valueExists && csv.valueUpdateTime < 0) {
+		return false
+	}
+	csv.value = nil
+	csv.valueExists = false
+	csv.valueUpdateTime = -1
+	csv.purgeState = 0
+	csv.syncedWithKV = true
+	return true
+}
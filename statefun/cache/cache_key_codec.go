@@ -0,0 +1,263 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"encoding/base32"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+Key codec lets key tokens hold any characters, e.g. user ids with dots or spaces. The store applies it to every token
+on the way to KV (toStoreKey) and back (fromStoreKey), encoding tokens into the alphabet valid for both the cache
+keys and NATS subjects ([a-zA-Z0-9=_-]), so the tree levels keep raw tokens and map to KV keys one to one. Keys are
+validated by their encoded tokens, so with IdentityKeyCodec (the default) they are as restricted as ever.
+
+Keys stay dot-separated, a token holding a dot or a backslash escapes it with a backslash (KeyToken does that):
+
+	cfg.SetKeyCodec(cache.EscapeKeyCodec{})
+	key := "users." + cache.KeyToken("john.doe@example.com") + ".settings" // KV: <prefix>.users.john=2Edoe=40example=2Ecom.settings
+	cs.SetValue(key, value, true, -1, "")
+	tokens := cs.DecodeKey(cs.GetKeysByPattern("users.*")[0])                // [users john.doe@example.com]
+
+Tokens "*" and ">" are wildcards in patterns and never encoded, empty tokens are encoded as a single "=". The codec
+of a bucket must not be changed, keys written with another one are not decoded.
+*/
+
+// KeyCodec converts a key token to the cache key alphabet and back
+type KeyCodec interface {
+	EncodeToken(token string) string
+	DecodeToken(encoded string) (string, error)
+}
+
+// IdentityKeyCodec keeps tokens as they are, they must not contain dots and must be valid for NATS subjects
+type IdentityKeyCodec struct{}
+
+func (IdentityKeyCodec) EncodeToken(token string) string { return token }
+
+func (IdentityKeyCodec) DecodeToken(encoded string) (string, error) { return encoded, nil }
+
+// EscapeKeyCodec keeps [a-zA-Z0-9_-] characters readable, every other byte becomes "=" and its two hex digits
+type EscapeKeyCodec struct{}
+
+func isKeyTokenSafeByte(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-'
+}
+
+func (EscapeKeyCodec) EncodeToken(token string) string {
+	if len(token) == 0 {
+		return "="
+	}
+	var sb strings.Builder
+	for i := 0; i < len(token); i++ {
+		if c := token[i]; isKeyTokenSafeByte(c) {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(fmt.Sprintf("=%02X", c))
+		}
+	}
+	return sb.String()
+}
+
+func (EscapeKeyCodec) DecodeToken(encoded string) (string, error) {
+	if encoded == "=" {
+		return "", nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(encoded); i++ {
+		if encoded[i] != '=' {
+			sb.WriteByte(encoded[i])
+			continue
+		}
+		if i+3 > len(encoded) {
+			return "", fmt.Errorf("error: truncated escape in key token %s", encoded)
+		}
+		c, err := strconv.ParseUint(encoded[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("error: malformed escape in key token %s", encoded)
+		}
+		sb.WriteByte(byte(c))
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// Base32KeyCodec encodes whole tokens with the standard base32 alphabet, suits binary tokens
+type Base32KeyCodec struct{}
+
+func (Base32KeyCodec) EncodeToken(token string) string {
+	if len(token) == 0 {
+		return "="
+	}
+	return base32.StdEncoding.EncodeToString([]byte(token))
+}
+
+func (Base32KeyCodec) DecodeToken(encoded string) (string, error) {
+	if encoded == "=" {
+		return "", nil
+	}
+	decoded, err := base32.StdEncoding.DecodeString(encoded)
+	return string(decoded), err
+}
+
+func (cs *Store) keyCodec() KeyCodec {
+	if cs.cacheConfig.keyCodec != nil {
+		return cs.cacheConfig.keyCodec
+	}
+	return IdentityKeyCodec{}
+}
+
+func (cs *Store) identityKeyCodec() bool {
+	_, identity := cs.keyCodec().(IdentityKeyCodec)
+	return identity
+}
+
+// KeyToken escapes dots and backslashes of a raw token, so it stays a single token of a key
+func KeyToken(token string) string {
+	if !strings.ContainsAny(token, `.\`) {
+		return token
+	}
+	var sb strings.Builder
+	for i := 0; i < len(token); i++ {
+		if c := token[i]; c == '.' || c == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(token[i])
+	}
+	return sb.String()
+}
+
+// IDToken returns the id as a single key token (see KeyToken) if the store's codec can hold any token. With
+// IdentityKeyCodec the id is kept as is, so an id with dots spans several tokens as it always did
+func (cs *Store) IDToken(id string) string {
+	if cs.identityKeyCodec() {
+		return id
+	}
+	return KeyToken(id)
+}
+
+// EncodeKey builds a key from raw tokens, a convenience for joining KeyToken ones
+func (cs *Store) EncodeKey(tokens ...string) string {
+	return joinKey(tokens)
+}
+
+// DecodeKey splits a key into raw tokens
+func (cs *Store) DecodeKey(key string) []string {
+	return splitKey(key)
+}
+
+// Splits the key into raw tokens by its unescaped dots
+func splitKey(key string) []string {
+	if !strings.Contains(key, `\`) {
+		return strings.Split(key, ".")
+	}
+	tokens := []string{}
+	var sb strings.Builder
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; {
+		case c == '\\' && i+1 < len(key):
+			i++
+			sb.WriteByte(key[i])
+		case c == '.':
+			tokens = append(tokens, sb.String())
+			sb.Reset()
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return append(tokens, sb.String())
+}
+
+// Joins raw tokens into a key
+func joinKey(tokens []string) string {
+	escaped := make([]string, len(tokens))
+	for i, token := range tokens {
+		escaped[i] = KeyToken(token)
+	}
+	return strings.Join(escaped, ".")
+}
+
+// Appends the raw token to the key, an empty key makes the token a key
+func appendKeyToken(key string, token string) string {
+	if len(key) == 0 {
+		return KeyToken(token)
+	}
+	return key + "." + KeyToken(token)
+}
+
+// Index of the key's first or last unescaped dot, -1 if there is none
+func keyDotIndex(key string, last bool) int {
+	index := -1
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '\\':
+			i++
+		case '.':
+			if !last {
+				return i
+			}
+			index = i
+		}
+	}
+	return index
+}
+
+// The key's first token as a key
+func keyRoot(key string) string {
+	if i := keyDotIndex(key, false); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// Encoded tokens of the key as they are in KV, wildcards are kept
+func (cs *Store) encodeKeyTokens(key string) []string {
+	tokens := splitKey(key)
+	codec := cs.keyCodec()
+	for i, token := range tokens {
+		if token != "*" && token != ">" {
+			tokens[i] = codec.EncodeToken(token)
+		}
+	}
+	return tokens
+}
+
+// Checks the key is valid in KV once its tokens are encoded
+func (cs *Store) validKey(key string) bool {
+	if cs.identityKeyCodec() && !strings.Contains(key, `\`) {
+		return keyValidationRegexp.MatchString(key)
+	}
+	tokens := cs.encodeKeyTokens(key)
+	for _, token := range tokens {
+		if strings.Contains(token, ".") { // A dot the codec kept would split the token in KV
+			return false
+		}
+	}
+	return keyValidationRegexp.MatchString(strings.Join(tokens, "."))
+}
+
+func (cs *Store) toStoreKey(key string) string {
+	if cs.identityKeyCodec() && !strings.Contains(key, `\`) {
+		return cs.cacheConfig.kvStorePrefix + "." + key
+	}
+	return cs.cacheConfig.kvStorePrefix + "." + strings.Join(cs.encodeKeyTokens(key), ".")
+}
+
+func (cs *Store) fromStoreKey(storeKey string) string {
+	key := strings.Replace(storeKey, cs.cacheConfig.kvStorePrefix+".", "", 1)
+	if cs.identityKeyCodec() {
+		return key
+	}
+	codec := cs.keyCodec()
+	tokens := strings.Split(key, ".")
+	for i, token := range tokens {
+		if decoded, err := codec.DecodeToken(token); err == nil {
+			tokens[i] = decoded
+		} else {
+			cs.reportError("key_decode", storeKey, err)
+		}
+	}
+	return joinKey(tokens)
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"fmt"
+	"sync"
+
+	sdkErrors "github.com/foliagecp/sdk/errors"
+)
+
+/*
+Key policy protects keys owned by SDK subsystems (graph indices, system records) from application writes.
+A subsystem reserves key patterns (tokens, "*" and ">" as in GetKeysByPattern) under its owner name and writes
+them through Reserved(owner), plain Store writes under a reserved pattern are refused with ReservedKeyError.
+The protection is against accidents: it does not authenticate the caller of Reserved.
+
+An optional naming policy (Config.SetKeyNamePolicy) additionally checks every key written by the application,
+its refusals are KeyNamePolicyError.
+*/
+
+const (
+	CacheKeysOwner = "cache"
+)
+
+// ReservedKeyError is returned for a write under a key pattern reserved by another owner
+type ReservedKeyError struct {
+	Key     string
+	Pattern string
+	Owner   string
+}
+
+func (e *ReservedKeyError) Error() string {
+	return fmt.Sprintf("error: key=%s is reserved by %s (%s)", e.Key, e.Owner, e.Pattern)
+}
+
+func (e *ReservedKeyError) Is(target error) bool {
+	return target == sdkErrors.ErrUnauthorized
+}
+
+// KeyNamePolicyError is returned for a write refused by the key naming policy
+type KeyNamePolicyError struct {
+	Key string
+	Err error
+}
+
+func (e *KeyNamePolicyError) Error() string {
+	return fmt.Sprintf("error: key=%s violates naming policy: %s", e.Key, e.Err)
+}
+
+func (e *KeyNamePolicyError) Unwrap() error {
+	return e.Err
+}
+
+type reservedKeyPattern struct {
+	owner  string
+	tokens []string
+}
+
+type keyPolicy struct {
+	mutex    sync.RWMutex
+	reserved []reservedKeyPattern
+}
+
+// ReserveKeyPattern makes keys matching the pattern writable only through Reserved(owner)
+func (cs *Store) ReserveKeyPattern(owner string, pattern string) {
+	cs.keyPolicy.mutex.Lock()
+	defer cs.keyPolicy.mutex.Unlock()
+	cs.keyPolicy.reserved = append(cs.keyPolicy.reserved, reservedKeyPattern{owner: owner, tokens: splitKey(pattern)})
+}
+
+// Checks if the owner ("" - application) may write the key
+func (cs *Store) checkKeyWrite(owner string, key string) error {
+	keyTokens := splitKey(key)
+	cs.keyPolicy.mutex.RLock()
+	for _, r := range cs.keyPolicy.reserved {
+		if r.owner != owner && keyTokensMatchPattern(keyTokens, r.tokens) {
+			cs.keyPolicy.mutex.RUnlock()
+			return &ReservedKeyError{Key: key, Pattern: joinKey(r.tokens), Owner: r.owner}
+		}
+	}
+	cs.keyPolicy.mutex.RUnlock()
+
+	if len(owner) == 0 && cs.cacheConfig.keyNamePolicy != nil {
+		if err := cs.cacheConfig.keyNamePolicy(key); err != nil {
+			return &KeyNamePolicyError{Key: key, Err: err}
+		}
+	}
+	return nil
+}
+
+// ReservedWriter writes keys reserved by its owner along with not reserved ones
+type ReservedWriter struct {
+	cs    *Store
+	owner string
+}
+
+// Reserved returns the writer of keys reserved by the owner
+func (cs *Store) Reserved(owner string) *ReservedWriter {
+	return &ReservedWriter{cs: cs, owner: owner}
+}
+
+func (w *ReservedWriter) SetValue(key string, value []byte, updateInKV bool, customSetTime int64, transactionID string) bool {
+	if err := w.cs.checkKeyWrite(w.owner, key); err != nil {
+		w.cs.reportError("key_policy", key, err)
+		return false
+	}
+	return w.cs.setValue(key, value, updateInKV, customSetTime, transactionID)
+}
+
+func (w *ReservedWriter) SetValueIfDoesNotExist(key string, newValue []byte, updateInKV bool, customSetTime int64) bool {
+	if err := w.cs.checkKeyWrite(w.owner, key); err != nil {
+		w.cs.reportError("key_policy", key, err)
+		return false
+	}
+	return w.cs.setValueIfDoesNotExist(key, newValue, updateInKV, customSetTime)
+}
+
+func (w *ReservedWriter) SetValueDurable(key string, value []byte) error {
+	if err := w.cs.checkKeyWrite(w.owner, key); err != nil {
+		return err
+	}
+	return w.cs.setValueDurable(key, value)
+}
+
+func (w *ReservedWriter) DeleteValue(key string, updateInKV bool, customDeleteTime int64, transactionID string) {
+	if err := w.cs.checkKeyWrite(w.owner, key); err != nil {
+		w.cs.reportError("key_policy", key, err)
+		return
+	}
+	w.cs.deleteValue(key, updateInKV, customDeleteTime, transactionID)
+}
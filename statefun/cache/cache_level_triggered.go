@@ -0,0 +1,195 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Level subscriptions (SubscribeLevelCallback) are edge-triggered: a message per mutation, a consumer missing one
+misses the change. Level-triggered subscriptions are for reconcilers caring only about convergence: a key of the level
+is delivered whenever its current state differs from the state the consumer acknowledged last (Ack),
+updates coming meanwhile are coalesced into the latest state. On subscribe every existing key is delivered (nothing is
+acknowledged yet), a deleted key is delivered with Exists false. A delivered and not acknowledged change is delivered
+again with the current state every resync interval, so a consumer that dropped a change still converges.
+*/
+
+type LevelChange struct {
+	Key    string // Full key
+	Value  []byte
+	Exists bool
+
+	digest uint64
+}
+
+type LevelTriggeredSubscription struct {
+	cs         *Store
+	key        string
+	callbackID string
+	changes    chan LevelChange
+	wakeup     chan struct{}
+
+	mutex    sync.Mutex
+	acked    map[string]uint64   // Full key -> digest of the acknowledged state, absent keys are acknowledged as deleted
+	notified map[string]uint64   // Full key -> digest of the delivered and not acknowledged state
+	dirty    map[string]struct{} // Keys to be compared with the acknowledged state
+}
+
+// Digest of a deleted key's state is 0
+func levelStateDigest(value []byte, exists bool) uint64 {
+	if !exists {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(value)
+	return h.Sum64() | 1
+}
+
+// SubscribeLevelTriggered subscribes to the key's level as SubscribeLevelCallback does, delivering level-triggered
+// changes; resyncIntervalMs - redelivery interval of changes not acknowledged. Returns nil if the level cannot be subscribed
+func (cs *Store) SubscribeLevelTriggered(key string, callbackID string, resyncIntervalMs int) *LevelTriggeredSubscription {
+	updates := cs.SubscribeLevelCallback(key, callbackID)
+	if updates == nil {
+		return nil
+	}
+	levelPrefix := ""
+	if i := keyDotIndex(key, true); i >= 0 {
+		levelPrefix = key[:i+1]
+	}
+
+	s := &LevelTriggeredSubscription{
+		cs:         cs,
+		key:        key,
+		callbackID: callbackID,
+		changes:    make(chan LevelChange, cs.cacheConfig.levelSubscriptionNotificationsBufferMaxSize+1),
+		wakeup:     make(chan struct{}, 1),
+		acked:      map[string]uint64{},
+		notified:   map[string]uint64{},
+		dirty:      map[string]struct{}{},
+	}
+	s.markLevelDirty(false)
+
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("cache.levelTriggered")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("cache.levelTriggered")
+		defer close(s.changes)
+
+		ticker := time.NewTicker(time.Duration(resyncIntervalMs) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			s.deliver()
+			select {
+			case kv, ok := <-updates:
+				if !ok {
+					return
+				}
+				if k, ok := kv.Key.(string); ok {
+					s.mutex.Lock()
+					s.dirty[levelPrefix+k] = struct{}{}
+					s.mutex.Unlock()
+				}
+			case <-s.wakeup:
+			case <-ticker.C:
+				s.markLevelDirty(true)
+			case <-s.cs.ctx.Done():
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Changes returns the channel of changes, it is closed after Unsubscribe
+func (s *LevelTriggeredSubscription) Changes() <-chan LevelChange {
+	return s.changes
+}
+
+// Ack acknowledges the change's state of its key, the key is delivered again only when its state differs from it
+func (s *LevelTriggeredSubscription) Ack(change LevelChange) {
+	s.mutex.Lock()
+	if change.digest == 0 {
+		delete(s.acked, change.Key)
+	} else {
+		s.acked[change.Key] = change.digest
+	}
+	if notified, ok := s.notified[change.Key]; ok && notified == change.digest { // A newer state may be delivered already
+		delete(s.notified, change.Key)
+	}
+	s.dirty[change.Key] = struct{}{} // Might have changed since the delivery
+	s.mutex.Unlock()
+
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (s *LevelTriggeredSubscription) Unsubscribe() {
+	s.cs.UnsubscribeLevelCallback(s.key, s.callbackID)
+}
+
+// Marks all the level's keys and all the tracked ones to be compared, resync - not acknowledged changes are delivered again
+func (s *LevelTriggeredSubscription) markLevelDirty(resync bool) {
+	keys := s.cs.GetKeysByPattern(s.key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, k := range keys {
+		s.dirty[k] = struct{}{}
+	}
+	for k := range s.acked {
+		s.dirty[k] = struct{}{}
+	}
+	for k := range s.notified {
+		s.dirty[k] = struct{}{}
+	}
+	if resync {
+		s.notified = map[string]uint64{}
+	}
+}
+
+// Delivers dirty keys whose state differs from the acknowledged one, keys not fitting into the channel stay dirty
+func (s *LevelTriggeredSubscription) deliver() {
+	s.mutex.Lock()
+	dirty := make([]string, 0, len(s.dirty))
+	for k := range s.dirty {
+		dirty = append(dirty, k)
+	}
+	s.mutex.Unlock()
+
+	for _, k := range dirty {
+		value, err := s.cs.GetValue(k)
+		change := LevelChange{Key: k, Value: value, Exists: err == nil}
+		change.digest = levelStateDigest(value, change.Exists)
+
+		s.mutex.Lock()
+		if _, ok := s.dirty[k]; !ok {
+			s.mutex.Unlock()
+			continue
+		}
+		if change.digest == s.acked[k] {
+			delete(s.notified, k)
+			delete(s.dirty, k)
+			s.mutex.Unlock()
+			continue
+		}
+		if notified, ok := s.notified[k]; ok && notified == change.digest {
+			delete(s.dirty, k)
+			s.mutex.Unlock()
+			continue
+		}
+		select {
+		case s.changes <- change:
+			s.notified[k] = change.digest
+			delete(s.dirty, k)
+		default:
+			s.mutex.Unlock()
+			return
+		}
+		s.mutex.Unlock()
+	}
+}
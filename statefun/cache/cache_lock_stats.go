@@ -0,0 +1,126 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Lock statistics sample StoreValue lock acquisitions (Config.SetLockStats) to find where handlers wait:
+a sampled acquisition measures the wait for the value's mutex and reports it to the "cache_lock_wait_seconds"
+histogram, and accounts it to the locked value's full key, a key with children being a subtree. LockContentionTop
+returns the keys waited for the most with the callers (the Lock caller names) waiting the most:
+
+	for _, c := range cacheStore.LockContentionTop(10) {
+		fmt.Println(c.Key, c.Samples, c.TotalWait, c.MaxWait, c.Callers)
+	}
+
+Up to LockStatsMaxKeys keys are tracked, waits of new keys beyond it are reported to the histogram only.
+Waits under LockStatsMinWait are not accounted to keys, uncontended locks do not fill the table.
+*/
+
+const (
+	LockStatsMaxKeys = 10000
+	LockStatsMinWait = 10 * time.Microsecond
+)
+
+var lockWaitBuckets = []float64{0.00001, 0.0001, 0.001, 0.01, 0.1, 1}
+
+// KeyLockContention is the sampled lock wait on a key
+type KeyLockContention struct {
+	Key       string
+	Samples   int64
+	TotalWait time.Duration
+	MaxWait   time.Duration
+	Callers   map[string]time.Duration // Lock caller -> total wait
+}
+
+type lockStats struct {
+	storeID    string
+	sampleRate uint64
+	samples    atomic.Uint64
+
+	mutex sync.Mutex
+	keys  map[string]*KeyLockContention
+}
+
+// Nil if lock statistics are disabled
+func newLockStats(cacheConfig *Config) *lockStats {
+	if cacheConfig.lockStatsSampleRate <= 0 {
+		return nil
+	}
+	return &lockStats{
+		storeID:    cacheConfig.id,
+		sampleRate: uint64(cacheConfig.lockStatsSampleRate),
+		keys:       map[string]*KeyLockContention{},
+	}
+}
+
+func (ls *lockStats) sampled() bool {
+	return ls.sampleRate <= 1 || ls.samples.Add(1)%ls.sampleRate == 0
+}
+
+func (ls *lockStats) account(csv *StoreValue, caller string, wait time.Duration) {
+	system.Metrics().ObserveHistogram("cache_lock_wait_seconds", "Sampled cache value lock wait time", lockWaitBuckets, map[string]string{"id": ls.storeID}, wait.Seconds())
+	if wait < LockStatsMinWait {
+		return
+	}
+	key := csv.GetFullKeyString()
+
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	c, ok := ls.keys[key]
+	if !ok {
+		if len(ls.keys) >= LockStatsMaxKeys {
+			return
+		}
+		c = &KeyLockContention{Key: key, Callers: map[string]time.Duration{}}
+		ls.keys[key] = c
+	}
+	c.Samples++
+	c.TotalWait += wait
+	if wait > c.MaxWait {
+		c.MaxWait = wait
+	}
+	c.Callers[caller] += wait
+}
+
+// LockContentionTop returns n keys with the highest sampled lock wait, empty if lock statistics are disabled
+func (cs *Store) LockContentionTop(n int) []KeyLockContention {
+	ls := cs.rootValue.lockStats
+	if ls == nil {
+		return []KeyLockContention{}
+	}
+	ls.mutex.Lock()
+	all := make([]KeyLockContention, 0, len(ls.keys))
+	for _, c := range ls.keys {
+		copied := *c
+		copied.Callers = make(map[string]time.Duration, len(c.Callers))
+		for caller, wait := range c.Callers {
+			copied.Callers[caller] = wait
+		}
+		all = append(all, copied)
+	}
+	ls.mutex.Unlock()
+
+	sort.Slice(all, func(i, j int) bool { return all[i].TotalWait > all[j].TotalWait })
+	if n >= 0 && len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// ResetLockContention forgets the keys' accounted lock waits, e.g. to measure a time window
+func (cs *Store) ResetLockContention() {
+	if ls := cs.rootValue.lockStats; ls != nil {
+		ls.mutex.Lock()
+		ls.keys = map[string]*KeyLockContention{}
+		ls.mutex.Unlock()
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"errors"
+
+	"github.com/nats-io/nats.go"
+
+	sdkErrors "github.com/foliagecp/sdk/errors"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+// ValueMeta is a value together with its versioning information for conflict detection and idempotent retries
+type ValueMeta struct {
+	Value        []byte
+	UpdateTime   int64
+	KVRevision   uint64 // Revision of the KV record confirmed for the value, 0 - not yet known (e.g. not synced)
+	Version      uint64 // Local version, incremented on every update of the key in this cache store
+	SyncedWithKV bool
+}
+
+// GetValueWithMeta returns the value with its update time, revision and sync state
+func (cs *Store) GetValueWithMeta(key string) (ValueMeta, error) {
+	value, err := cs.GetValue(key)
+	if err != nil {
+		return ValueMeta{}, err
+	}
+	meta := ValueMeta{Value: value}
+	if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
+		csv.Lock("GetValueWithMeta")
+		if bv, ok := csv.value.([]byte); ok && csv.valueExists { // Same snapshot as the meta below
+			meta.Value = bv
+		}
+		meta.UpdateTime = csv.valueUpdateTime
+		meta.KVRevision = csv.kvRevision
+		meta.Version = csv.version
+		meta.SyncedWithKV = csv.syncedWithKV && !csv.syncNeeded
+		csv.Unlock("GetValueWithMeta")
+	}
+	return meta, nil
+}
+
+// Remembers the KV revision if the cached value is still the one written with recordTime
+func (cs *Store) setKVRevision(key string, recordTime int64, revision uint64) {
+	if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
+		csv.Lock("setKVRevision")
+		if csv.valueUpdateTime == recordTime {
+			csv.kvRevision = revision
+		}
+		csv.Unlock("setKVRevision")
+	}
+}
+
+// GetValueWithKVRevision returns the value with its key's KV revision for SetValueIfKVRevision, 0 - the key is not in
+// KV. A local update not yet synced with KV is written to KV first so the caller reads its own writes. Both are read
+// from KV unless the cached value is the one of the last known revision, a missing value comes with the revision of
+// its key's delete record if there is one
+func (cs *Store) GetValueWithKVRevision(key string) ([]byte, uint64, error) {
+	if _, err := cs.GetValue(key); err != nil && !errors.Is(err, sdkErrors.ErrKeyNotFound) {
+		return nil, 0, err
+	}
+	if err := cs.flushKey(key); err != nil {
+		return nil, 0, err
+	}
+	notFound := sdkErrors.Newf(sdkErrors.ErrKeyNotFound, "Value for for key=%s does not exist", key)
+	if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
+		csv.Lock("GetValueWithKVRevision")
+		value, _ := csv.value.([]byte)
+		exists, revision := csv.valueExists, csv.kvRevision
+		known := !csv.syncNeeded && csv.valueUpdateTime > 0 && revision > 0
+		csv.Unlock("GetValueWithKVRevision")
+		if known && exists {
+			return value, revision, nil
+		} else if known {
+			return nil, revision, notFound
+		}
+	}
+	entry, err := cs.backend.Get(cs.toStoreKey(key))
+	if err == nats.ErrKeyNotFound {
+		return nil, 0, notFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if record := entry.Value(); len(record) >= 9 && record[8] == 1 {
+		return record[9:], entry.Revision(), nil
+	}
+	return nil, entry.Revision(), notFound
+}
+
+// SetValueIfKVRevision writes the value to KV only if its key's KV revision is still the expected one, 0 - the key
+// must not be in KV, so writers of all the runtimes detect conflicts. Returns the key's new revision; the current one
+// with KVRevisionMismatchError (sdk errors.ErrConflict) if another writer updated the key meanwhile, other errors
+// (e.g. KVBackendCASNotSupportedError) are not conflicts and are not to be retried
+func (cs *Store) SetValueIfKVRevision(key string, value []byte, revision uint64) (uint64, error) {
+	if err := cs.checkKeyWrite("", key); err != nil {
+		return 0, err
+	}
+	if !cs.validKey(key) {
+		return 0, InvalidKeyError
+	}
+	cas, ok := cs.backend.(KVBackendCAS)
+	if !ok {
+		return 0, KVBackendCASNotSupportedError
+	}
+	cs.accountAccess(key, true)
+
+	storeKey := cs.toStoreKey(key)
+	setTime := system.GetCurrentTimeNs()
+	record := kvRecordBytes(setTime, value, true)
+	var written uint64
+	var err error
+	if revision == 0 {
+		written, err = cas.Create(storeKey, record)
+	} else {
+		written, err = cas.Update(storeKey, record, revision)
+	}
+	if err != nil {
+		if !isKVRevisionMismatch(err) {
+			return 0, err
+		}
+		var current uint64 = 0
+		if entry, getErr := cs.backend.Get(storeKey); getErr == nil {
+			current = entry.Revision()
+		}
+		if csv := cs.getLastKeyCacheStoreValue(key); csv != nil { // The next GetValueWithKVRevision reads KV
+			csv.Lock("SetValueIfKVRevision")
+			csv.kvRevision = 0
+			csv.Unlock("SetValueIfKVRevision")
+		}
+		return current, KVRevisionMismatchError
+	}
+	cs.setValue(key, value, false, setTime, "")
+	cs.setKVRevision(key, setTime, written)
+	return written, nil
+}
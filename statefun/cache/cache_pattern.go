@@ -0,0 +1,137 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"sync/atomic"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Patterns with wildcards before the last token, e.g. "a.*.c" or "a.>.meta". Mid-pattern ">" matches one or more
+tokens, the cache tree is walked level by level from the first wildcard. When a walked level is inconsistent with KV
+the keys are also looked up in KV: NATS subjects do not allow ">" in the middle, so the KV is watched by the pattern
+cut right after the first such ">" and the keys are filtered locally.
+*/
+
+func hasMidPatternWildcard(pattern string) bool {
+	tokens := splitKey(pattern)
+	for _, token := range tokens[:len(tokens)-1] {
+		if token == "*" || token == ">" {
+			return true
+		}
+	}
+	return false
+}
+
+func keyTokensMatchPattern(keyTokens []string, patternTokens []string) bool {
+	for i, pt := range patternTokens {
+		if pt == ">" {
+			if i == len(patternTokens)-1 {
+				return len(keyTokens) > i
+			}
+			for j := i + 1; j < len(keyTokens); j++ { // ">" takes tokens i..j-1
+				if keyTokensMatchPattern(keyTokens[j:], patternTokens[i+1:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if i >= len(keyTokens) {
+			return false
+		}
+		if pt != "*" && pt != keyTokens[i] {
+			return false
+		}
+	}
+	return len(keyTokens) == len(patternTokens)
+}
+
+// Returns the KV watch subject covering the pattern
+func kvSubjectForPattern(pattern string) string {
+	tokens := splitKey(pattern)
+	for i, token := range tokens {
+		if token == ">" {
+			return joinKey(tokens[:i+1])
+		}
+	}
+	return pattern
+}
+
+func (cs *Store) getKeysByMidWildcardPattern(pattern string, keys map[string]bool) {
+	patternTokens := splitKey(pattern)
+	inconsistent := false
+	cs.collectKeysByPattern(cs.rootValue, "", patternTokens, keys, &inconsistent)
+	if !inconsistent {
+		return
+	}
+
+	cs.getKeysByPatternFromKVMutex.Lock()
+	defer cs.getKeysByPatternFromKVMutex.Unlock()
+	w, err := cs.backend.Watch(cs.toStoreKey(kvSubjectForPattern(pattern)))
+	if err != nil {
+		cs.reportError("kv_watch", pattern, err)
+		return
+	}
+	for entry := range w.Updates() {
+		if entry == nil || len(entry.Value()) < 9 {
+			break
+		}
+		if key := cs.fromStoreKey(entry.Key()); keyTokensMatchPattern(splitKey(key), patternTokens) {
+			keys[key] = true
+		}
+	}
+	system.MsgOnErrorReturn(w.Stop())
+}
+
+// Walks the level's children matching the pattern tokens, inconsistent is set if any walked level lacks keys from KV
+func (cs *Store) collectKeysByPattern(level *StoreValue, prefix string, patternTokens []string, keys map[string]bool, inconsistent *bool) {
+	cs.walkPattern(level, prefix, patternTokens, func(key string, csv *StoreValue) bool {
+		if csv.ValueExists() {
+			keys[key] = true
+		}
+		return true
+	}, inconsistent)
+}
+
+// Calls visit for every node matching the pattern tokens (a node may be visited more than once for patterns with
+// several ">"), returns false if visit stopped the walk
+func (cs *Store) walkPattern(level *StoreValue, prefix string, patternTokens []string, visit func(key string, csv *StoreValue) bool, inconsistent *bool) bool {
+	if atomic.LoadInt64(&level.storeConsistencyWithKVLossTime) > 0 {
+		*inconsistent = true
+	}
+
+	children := map[string]*StoreValue{}
+	token := patternTokens[0]
+	if token == "*" || token == ">" {
+		level.Range(func(key, value interface{}) bool {
+			children[key.(string)] = value.(*StoreValue)
+			return true
+		})
+	} else if child, ok := level.LoadChild(token, true); ok {
+		children[token] = child
+	}
+
+	for key, child := range children {
+		fullKey := prefix + KeyToken(key)
+		nextTokens := [][]string{patternTokens[1:]}
+		if token == ">" && len(patternTokens) > 1 {
+			nextTokens = append(nextTokens, patternTokens) // ">" takes more tokens
+		} else if token == ">" {
+			nextTokens = [][]string{{}, patternTokens}
+		}
+		for _, next := range nextTokens {
+			if len(next) == 0 {
+				if !visit(fullKey, child) {
+					return false
+				}
+				continue
+			}
+			if !cs.walkPattern(child, fullKey+".", next, visit, inconsistent) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,194 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+/*
+Polling mode replaces the KV watcher for NATS setups where watching large buckets is not allowed. Records written
+after the last seen revision are scanned periodically instead, so updates of other nodes arrive with up to one polling
+interval delay. Nothing is loaded on start: the cache is filled on demand and key patterns are always looked up in KV.
+*/
+
+const (
+	kvPollingScanLimit = 1000
+)
+
+// KVBackendScannable is implemented by backends able to list records by revision without watching
+type KVBackendScannable interface {
+	// ScanFromRevision returns up to limit records matching the pattern with revisions greater than revision ordered by
+	// revision (complete deletes as entries with empty values) and the revision the next scan should start after
+	ScanFromRevision(keyPattern string, revision uint64, limit int) ([]KVBackendEntry, uint64, error)
+	// LastRevision returns the revision of the latest record in the backend
+	LastRevision() (uint64, error)
+}
+
+type pollingWatcher struct {
+	updates  chan KVBackendEntry
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Scans the backend every interval delivering records after the revision, the nil entry comes after the first scan.
+// Updates channel is closed on a scan error so the watcher is restarted
+func newPollingWatcher(backend KVBackendScannable, keyPattern string, revision uint64, interval time.Duration, onScanError func(err error)) *pollingWatcher {
+	pw := &pollingWatcher{updates: make(chan KVBackendEntry, 64), done: make(chan struct{})}
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("cache.pollingWatcher")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("cache.pollingWatcher")
+		defer close(pw.updates)
+		caughtUp := false
+		for {
+			for {
+				entries, nextRevision, err := backend.ScanFromRevision(keyPattern, revision, kvPollingScanLimit)
+				if err != nil {
+					onScanError(err)
+					return
+				}
+				for _, entry := range entries {
+					if !pw.send(entry) {
+						return
+					}
+				}
+				revision = nextRevision
+				if len(entries) < kvPollingScanLimit {
+					break
+				}
+			}
+			if !caughtUp {
+				caughtUp = true
+				if !pw.send(nil) {
+					return
+				}
+			}
+			select {
+			case <-pw.done:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return pw
+}
+
+func (pw *pollingWatcher) send(e KVBackendEntry) bool {
+	select {
+	case pw.updates <- e:
+		return true
+	case <-pw.done:
+		return false
+	}
+}
+
+func (pw *pollingWatcher) Updates() <-chan KVBackendEntry {
+	return pw.updates
+}
+
+func (pw *pollingWatcher) Stop() error {
+	pw.stopOnce.Do(func() {
+		close(pw.done)
+		// Drain so the polling routine can exit
+		go func() {
+			for range pw.updates {
+			}
+		}()
+	})
+	return nil
+}
+
+func (cs *Store) pollKVUpdates(sb KVBackendScannable, pattern string) (KVBackendWatcher, error) {
+	revision := cs.lastKVRevision.Load()
+	if revision == 0 {
+		lastRevision, err := sb.LastRevision()
+		if err != nil {
+			return nil, err
+		}
+		revision = lastRevision
+		cs.lastKVRevision.Store(revision)
+		if entry, err := cs.backend.Get(cs.toStoreKey(CacheEpochKey)); err == nil {
+			cs.handleEpochRecord(entry.Value(), false)
+		}
+		// Values are not loaded so the root level does not contain all keys
+		cs.rootValue.ConsistencyLoss(system.GetCurrentTimeNs())
+	}
+	interval := time.Duration(cs.cacheConfig.kvPollingIntervalMs) * time.Millisecond
+	return newPollingWatcher(sb, pattern, revision, interval, func(err error) {
+		cs.reportError("kv_poll", pattern, err)
+	}), nil
+}
+
+// NATS backend scanning -------------------------------------------------------------------------
+
+// ScanFromRevision reads the KV bucket stream with direct gets of the next messages matching the pattern
+func (b *natsKVBackend) ScanFromRevision(keyPattern string, revision uint64, limit int) ([]KVBackendEntry, uint64, error) {
+	bucket := b.kv.Bucket()
+	stream := "KV_" + bucket
+	subjectPrefix := "$KV." + bucket + "."
+
+	entries := []KVBackendEntry{}
+	for len(entries) < limit {
+		m, err := b.js.GetMsg(stream, revision+1, nats.DirectGetNext(subjectPrefix+keyPattern))
+		if err != nil {
+			if errors.Is(err, nats.ErrMsgNotFound) {
+				break
+			}
+			return entries, revision, err
+		}
+		entry := &natsResumedEntry{key: strings.TrimPrefix(m.Subject, subjectPrefix), revision: m.Sequence}
+		if op := m.Header.Get("KV-Operation"); op != "DEL" && op != "PURGE" {
+			entry.value = m.Data
+		}
+		entries = append(entries, entry)
+		revision = m.Sequence
+	}
+	return entries, revision, nil
+}
+
+func (b *natsKVBackend) LastRevision() (uint64, error) {
+	info, err := b.js.StreamInfo("KV_" + b.kv.Bucket())
+	if err != nil {
+		return 0, err
+	}
+	return info.State.LastSeq, nil
+}
+
+// Memory backend scanning ------------------------------------------------------------------------
+
+// Only the latest value of each key is kept, so keys updated after the revision are returned with their latest values
+func (b *MemoryKVBackend) ScanFromRevision(keyPattern string, revision uint64, limit int) ([]KVBackendEntry, uint64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	matched := []*memoryKVBackendEntry{}
+	for key, e := range b.entries {
+		if KeyMatchesPattern(key, keyPattern) && e.revision > revision {
+			matched = append(matched, e)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].revision < matched[j].revision })
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	entries := make([]KVBackendEntry, len(matched))
+	for i, e := range matched {
+		entries[i] = e
+		revision = e.revision
+	}
+	return entries, revision, nil
+}
+
+func (b *MemoryKVBackend) LastRevision() (uint64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.revision, nil
+}
+
+// ------------------------------------------------------------------------------------------------
@@ -0,0 +1,50 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"encoding/binary"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+// Prefetch loads values of all keys matching the pattern from KV into the cache in a single scan, so iterating
+// them afterwards doesn't cost a KV round trip per key. Values updated in the cache later than in KV are kept.
+// Returns the number of loaded values
+func (cs *Store) Prefetch(pattern string) (int, error) {
+	cs.rehydratePatternRoot(pattern, false)
+
+	cs.getKeysByPatternFromKVMutex.Lock()
+	defer cs.getKeysByPatternFromKVMutex.Unlock()
+
+	w, err := cs.backend.Watch(cs.toStoreKey(pattern))
+	if err != nil {
+		return 0, err
+	}
+	defer func() { system.MsgOnErrorReturn(w.Stop()) }()
+
+	loaded := 0
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		record := entry.Value()
+		if len(record) < 9 || record[8] != 1 {
+			continue
+		}
+		key := cs.fromStoreKey(entry.Key())
+		kvRecordTime := int64(binary.BigEndian.Uint64(record[:8]))
+		if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
+			csv.Lock("Prefetch")
+			newer := csv.valueUpdateTime >= kvRecordTime // Also keeps values deleted in the cache
+			csv.Unlock("Prefetch")
+			if newer {
+				continue
+			}
+		}
+		if cs.setValue(key, record[9:], false, kvRecordTime, "") {
+			loaded++
+		}
+	}
+	return loaded, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"encoding/binary"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+// RangeByPattern calls f with every key matching the pattern and its value until f returns false. Values kept in
+// memory go first, if the pattern covers levels inconsistent with KV the rest is streamed from a KV watch by the
+// pattern without being loaded into the cache. f must not modify the store
+func (cs *Store) RangeByPattern(pattern string, f func(key string, value []byte) bool) {
+	cs.rehydratePatternRoot(pattern, false)
+	patternTokens := splitKey(pattern)
+
+	// Update times of keys known in memory, including deleted ones, KV records not newer than them are skipped
+	known := map[string]int64{}
+	inconsistent := false
+	completed := cs.walkPattern(cs.rootValue, "", patternTokens, func(key string, csv *StoreValue) bool {
+		if _, ok := known[key]; ok {
+			return true
+		}
+		csv.Lock("RangeByPattern")
+		value, _ := csv.value.([]byte)
+		exists := csv.valueExists
+		updateTime := csv.valueUpdateTime
+		csv.Unlock("RangeByPattern")
+		if updateTime < 0 { // Unknown value, KV may have it
+			return true
+		}
+		known[key] = updateTime
+		if exists {
+			cs.accountAccess(key, false)
+			return f(key, value)
+		}
+		return true
+	}, &inconsistent)
+	if !completed || !inconsistent {
+		return
+	}
+
+	cs.getKeysByPatternFromKVMutex.Lock()
+	defer cs.getKeysByPatternFromKVMutex.Unlock()
+	w, err := cs.backend.Watch(cs.toStoreKey(kvSubjectForPattern(pattern)))
+	if err != nil {
+		cs.reportError("kv_watch", pattern, err)
+		return
+	}
+	defer func() { system.MsgOnErrorReturn(w.Stop()) }()
+	for entry := range w.Updates() {
+		if entry == nil {
+			return
+		}
+		record := entry.Value()
+		if len(record) < 9 || record[8] != 1 {
+			continue
+		}
+		key := cs.fromStoreKey(entry.Key())
+		if !keyTokensMatchPattern(splitKey(key), patternTokens) {
+			continue
+		}
+		if updateTime, ok := known[key]; ok && updateTime >= int64(binary.BigEndian.Uint64(record[:8])) {
+			continue
+		}
+		cs.stats.misses.Add(1)
+		if !f(key, record[9:]) {
+			return
+		}
+	}
+}
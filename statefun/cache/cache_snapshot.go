@@ -0,0 +1,98 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+/*
+Snapshot is a JSON lines stream: the first line is a header with the format version,
+every next line is a single value of the in-memory tree with its key and update time.
+*/
+
+const (
+	SnapshotVersion = 1
+)
+
+type snapshotHeader struct {
+	Version int    `json:"version"`
+	ID      string `json:"id"`
+	Prefix  string `json:"prefix"`
+}
+
+type snapshotRecord struct {
+	Key        string `json:"key"`
+	Value      []byte `json:"value"`
+	UpdateTime int64  `json:"update_time"`
+}
+
+// Export writes a snapshot of all values currently kept in memory
+func (cs *Store) Export(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	if err := encoder.Encode(snapshotHeader{Version: SnapshotVersion, ID: cs.cacheConfig.id, Prefix: cs.cacheConfig.kvStorePrefix}); err != nil {
+		return err
+	}
+
+	levels := []*StoreValue{cs.rootValue}
+	prefixes := []string{""}
+	for len(levels) > 0 {
+		lastID := len(levels) - 1
+		level := levels[lastID]
+		prefix := prefixes[lastID]
+		levels = levels[:lastID]
+		prefixes = prefixes[:lastID]
+
+		records := []snapshotRecord{}
+		level.Range(func(key, value interface{}) bool {
+			child := value.(*StoreValue)
+			fullKey := prefix + KeyToken(key.(string))
+			child.Lock("Export")
+			if bv, ok := child.value.([]byte); ok && child.valueExists {
+				records = append(records, snapshotRecord{Key: fullKey, Value: bv, UpdateTime: child.valueUpdateTime})
+			}
+			child.Unlock("Export")
+			levels = append(levels, child)
+			prefixes = append(prefixes, fullKey+".")
+			return true
+		})
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Import loads a snapshot made by Export and writes its values to KV keeping their update times.
+// Values updated in the cache later than in the snapshot are not overwritten
+func (cs *Store) Import(r io.Reader) error {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+
+	var header snapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return err
+	}
+	if header.Version != SnapshotVersion {
+		return fmt.Errorf("error: unsupported snapshot version %d", header.Version)
+	}
+
+	for {
+		var record snapshotRecord
+		if err := decoder.Decode(&record); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if cs.GetValueUpdateTime(record.Key) > record.UpdateTime {
+			continue
+		}
+		cs.setValue(record.Key, record.Value, true, record.UpdateTime, "")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stats is a point-in-time snapshot of the cache store counters
+type Stats struct {
+	Hits                   uint64
+	Misses                 uint64
+	Evictions              uint64
+	Values                 int64
+	Bytes                  int64
+	PendingKVSyncs         int64
+	FencedWrites           uint64
+	ConflictsResolved      uint64
+	Refaults               uint64
+	StaleReads             uint64 // Cached values found stale by consistent reads (see cache_consistency.go)
+	LazyWriterLoopDuration time.Duration
+}
+
+type storeStats struct {
+	hits                   atomic.Uint64
+	misses                 atomic.Uint64
+	evictions              atomic.Uint64
+	values                 atomic.Int64
+	bytes                  atomic.Int64
+	pendingKVSyncs         atomic.Int64
+	fencedWrites           atomic.Uint64
+	conflictsResolved      atomic.Uint64
+	refaults               atomic.Uint64
+	staleReads             atomic.Uint64
+	lazyWriterLoopDuration atomic.Int64
+}
+
+func (cs *Store) Stats() Stats {
+	return Stats{
+		Hits:                   cs.stats.hits.Load(),
+		Misses:                 cs.stats.misses.Load(),
+		Evictions:              cs.stats.evictions.Load(),
+		Values:                 cs.stats.values.Load(),
+		Bytes:                  cs.stats.bytes.Load(),
+		PendingKVSyncs:         cs.stats.pendingKVSyncs.Load(),
+		FencedWrites:           cs.stats.fencedWrites.Load(),
+		ConflictsResolved:      cs.stats.conflictsResolved.Load(),
+		Refaults:               cs.stats.refaults.Load(),
+		StaleReads:             cs.stats.staleReads.Load(),
+		LazyWriterLoopDuration: time.Duration(cs.stats.lazyWriterLoopDuration.Load()),
+	}
+}
+
+// Prometheus collector -------------------------------------------------------------------------
+
+type storeStatsCollector struct {
+	cs *Store
+
+	hits                   *prometheus.Desc
+	misses                 *prometheus.Desc
+	evictions              *prometheus.Desc
+	values                 *prometheus.Desc
+	bytes                  *prometheus.Desc
+	pendingKVSyncs         *prometheus.Desc
+	fencedWrites           *prometheus.Desc
+	conflictsResolved      *prometheus.Desc
+	refaults               *prometheus.Desc
+	staleReads             *prometheus.Desc
+	evictionChurnRatio     *prometheus.Desc
+	suggestedLRUSize       *prometheus.Desc
+	lazyWriterLoopDuration *prometheus.Desc
+}
+
+// PrometheusCollector returns a collector exporting the cache store Stats, register it in any prometheus.Registerer
+func (cs *Store) PrometheusCollector() prometheus.Collector {
+	labels := prometheus.Labels{"id": cs.cacheConfig.id}
+	return &storeStatsCollector{
+		cs:                     cs,
+		hits:                   prometheus.NewDesc("cache_hits_total", "Cache reads served from memory", nil, labels),
+		misses:                 prometheus.NewDesc("cache_misses_total", "Cache reads that went to the KV store", nil, labels),
+		evictions:              prometheus.NewDesc("cache_evictions_total", "Values purged from memory by LRU", nil, labels),
+		values:                 prometheus.NewDesc("cache_stats_values", "Values in memory", nil, labels),
+		bytes:                  prometheus.NewDesc("cache_stats_values_bytes", "Total size of values in memory", nil, labels),
+		pendingKVSyncs:         prometheus.NewDesc("cache_pending_kv_syncs", "Values waiting to be written to the KV store", nil, labels),
+		fencedWrites:           prometheus.NewDesc("cache_fenced_writes_total", "Unsynced values discarded because KV holds a newer record of the key", nil, labels),
+		conflictsResolved:      prometheus.NewDesc("cache_conflicts_resolved_total", "Concurrent KV updates resolved by a conflict resolver other than taking the remote version", nil, labels),
+		refaults:               prometheus.NewDesc("cache_refaults_total", "Cache misses on keys evicted by LRU within the churn window", nil, labels),
+		staleReads:             prometheus.NewDesc("cache_stale_reads_total", "Cached values found stale by kv-verified and linearizable reads", nil, labels),
+		evictionChurnRatio:     prometheus.NewDesc("cache_eviction_churn_ratio", "Refaults per eviction over the last churn window", nil, labels),
+		suggestedLRUSize:       prometheus.NewDesc("cache_lru_size_suggested", "LRU size the last churn window suggests", nil, labels),
+		lazyWriterLoopDuration: prometheus.NewDesc("cache_lazy_writer_loop_seconds", "Duration of the last KV lazy writer pass", nil, labels),
+	}
+}
+
+func (c *storeStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.evictions
+	ch <- c.values
+	ch <- c.bytes
+	ch <- c.pendingKVSyncs
+	ch <- c.fencedWrites
+	ch <- c.conflictsResolved
+	ch <- c.refaults
+	ch <- c.staleReads
+	ch <- c.evictionChurnRatio
+	ch <- c.suggestedLRUSize
+	ch <- c.lazyWriterLoopDuration
+}
+
+func (c *storeStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.cs.Stats()
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(s.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(s.Misses))
+	ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(s.Evictions))
+	ch <- prometheus.MustNewConstMetric(c.values, prometheus.GaugeValue, float64(s.Values))
+	ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(s.Bytes))
+	ch <- prometheus.MustNewConstMetric(c.pendingKVSyncs, prometheus.GaugeValue, float64(s.PendingKVSyncs))
+	ch <- prometheus.MustNewConstMetric(c.fencedWrites, prometheus.CounterValue, float64(s.FencedWrites))
+	ch <- prometheus.MustNewConstMetric(c.conflictsResolved, prometheus.CounterValue, float64(s.ConflictsResolved))
+	ch <- prometheus.MustNewConstMetric(c.refaults, prometheus.CounterValue, float64(s.Refaults))
+	ch <- prometheus.MustNewConstMetric(c.staleReads, prometheus.CounterValue, float64(s.StaleReads))
+	tuning := c.cs.LRUTuning()
+	ch <- prometheus.MustNewConstMetric(c.evictionChurnRatio, prometheus.GaugeValue, tuning.ChurnRatio)
+	ch <- prometheus.MustNewConstMetric(c.suggestedLRUSize, prometheus.GaugeValue, float64(tuning.SuggestedLRUSize))
+	ch <- prometheus.MustNewConstMetric(c.lazyWriterLoopDuration, prometheus.GaugeValue, s.LazyWriterLoopDuration.Seconds())
+}
+
+// ------------------------------------------------------------------------------------------------
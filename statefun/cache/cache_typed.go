@@ -0,0 +1,77 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/foliagecp/easyjson"
+)
+
+// Get reads the key's value and decodes it into T: []byte and string are taken as is, easyjson.JSON is parsed
+// with easyjson, everything else is decoded with encoding/json
+func Get[T any](cs *Store, key string) (T, error) {
+	var result T
+	data, err := cs.GetValue(key)
+	if err != nil {
+		return result, err
+	}
+	err = decodeTyped(data, &result)
+	return result, err
+}
+
+// Set encodes value the same way Get decodes it and sets it as SetValue does
+func Set[T any](cs *Store, key string, value T, updateInKV bool, customSetTime int64, transactionID string) error {
+	data, err := encodeTyped(value)
+	if err != nil {
+		return err
+	}
+	if !cs.SetValue(key, data, updateInKV, customSetTime, transactionID) {
+		return fmt.Errorf("cannot set value for key=%s", key)
+	}
+	return nil
+}
+
+func encodeTyped(value any) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case easyjson.JSON:
+		return v.ToBytes(), nil
+	case *easyjson.JSON:
+		if v == nil {
+			return nil, nil
+		}
+		return v.ToBytes(), nil
+	}
+	return json.Marshal(value)
+}
+
+func decodeTyped(data []byte, target any) error {
+	switch t := target.(type) {
+	case *[]byte:
+		*t = data
+		return nil
+	case *string:
+		*t = string(data)
+		return nil
+	case *easyjson.JSON:
+		j, ok := easyjson.JSONFromBytes(data)
+		if !ok {
+			return fmt.Errorf("value is not a JSON")
+		}
+		*t = j
+		return nil
+	case **easyjson.JSON:
+		j, ok := easyjson.JSONFromBytes(data)
+		if !ok {
+			return fmt.Errorf("value is not a JSON")
+		}
+		*t = &j
+		return nil
+	}
+	return json.Unmarshal(data, target)
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/foliagecp/easyjson"
+
+	sdkErrors "github.com/foliagecp/sdk/errors"
+)
+
+/*
+Views give a consistent point-in-time read of a subtree (a key and all keys below it), so a handler computing
+an invariant across several keys does not observe a half-applied update of them:
+
+	err := cacheStore.View(vertexID, func(view cache.ReadView) error {
+		for _, key := range view.GetKeysByPattern(vertexID + ".out.ltp_oid-bdy.>") {
+			body, _ := view.GetValueAsJSON(key)
+			...
+		}
+		return nil
+	})
+
+The snapshot is taken optimistically, writers are never blocked: the subtree's keys and values are read with their
+update times and versions, then the key set and the versions are read again. If nothing changed in between the
+snapshot equals the subtree's state at the moment between the two passes, otherwise it is retried up to
+ViewMaxAttempts times and View fails with ViewContentionError, e.g. under constant writes to the subtree.
+The view is immutable and stays valid after the function returns, reads from it never reach the cache or KV.
+*/
+
+const (
+	ViewMaxAttempts = 16
+)
+
+var (
+	// Returned by View if the subtree kept changing for all the attempts, check with errors.Is
+	ViewContentionError = sdkErrors.New(sdkErrors.ErrConflict, "error: subtree kept changing while taking a view")
+)
+
+// ReadView is an immutable snapshot of a subtree
+type ReadView interface {
+	// Root key of the subtree
+	Root() string
+	GetValue(key string) ([]byte, error)
+	GetValueAsJSON(key string) (*easyjson.JSON, error)
+	// Keys of the subtree matching the pattern, sorted
+	GetKeysByPattern(pattern string) []string
+}
+
+type viewEntry struct {
+	value      []byte
+	updateTime int64
+	version    uint64
+}
+
+type snapshotView struct {
+	root    string
+	entries map[string]viewEntry // Existing keys only
+}
+
+func (v *snapshotView) Root() string {
+	return v.root
+}
+
+func (v *snapshotView) GetValue(key string) ([]byte, error) {
+	if entry, ok := v.entries[key]; ok {
+		return entry.value, nil
+	}
+	if key != v.root && !strings.HasPrefix(key, v.root+".") {
+		return nil, fmt.Errorf("Key=%s is out of the view of %s", key, v.root)
+	}
+	return nil, sdkErrors.Newf(sdkErrors.ErrKeyNotFound, "Value for for key=%s does not exist", key)
+}
+
+func (v *snapshotView) GetValueAsJSON(key string) (*easyjson.JSON, error) {
+	value, err := v.GetValue(key)
+	if err != nil {
+		return nil, err
+	}
+	if j, ok := easyjson.JSONFromBytes(value); ok {
+		return &j, nil
+	}
+	return nil, fmt.Errorf("Value for key=%s is not a JSON", key)
+}
+
+func (v *snapshotView) GetKeysByPattern(pattern string) []string {
+	patternTokens := splitKey(pattern)
+	keys := []string{}
+	for key := range v.entries {
+		if keyTokensMatchPattern(splitKey(key), patternTokens) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Reads the subtree's existing keys with their versions
+func (cs *Store) readSubtree(root string) map[string]viewEntry {
+	entries := map[string]viewEntry{}
+	for _, key := range append(cs.GetKeysByPattern(root+".>"), root) {
+		if meta, err := cs.GetValueWithMeta(key); err == nil {
+			entries[key] = viewEntry{value: meta.Value, updateTime: meta.UpdateTime, version: meta.Version}
+		}
+	}
+	return entries
+}
+
+// Unchanged if the same keys exist with the same versions
+func (cs *Store) subtreeUnchanged(root string, entries map[string]viewEntry) bool {
+	keys := append(cs.GetKeysByPattern(root+".>"), root)
+	existing := 0
+	for _, key := range keys {
+		meta, err := cs.GetValueWithMeta(key)
+		entry, ok := entries[key]
+		if err != nil {
+			if ok {
+				return false // Deleted
+			}
+			continue
+		}
+		if !ok || meta.UpdateTime != entry.updateTime || meta.Version != entry.version {
+			return false
+		}
+		existing++
+	}
+	return existing == len(entries)
+}
+
+// View calls f with a consistent snapshot of the root key's subtree, returns f's error
+func (cs *Store) View(root string, f func(view ReadView) error) error {
+	for attempt := 0; attempt < ViewMaxAttempts; attempt++ {
+		entries := cs.readSubtree(root)
+		if cs.subtreeUnchanged(root, entries) {
+			return f(&snapshotView{root: root, entries: entries})
+		}
+	}
+	return fmt.Errorf("%w: %s", ViewContentionError, root)
+}
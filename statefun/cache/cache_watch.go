@@ -0,0 +1,164 @@
+// Copyright 2023 NJWS Inc.
+
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+/*
+The cache KV watcher survives broker restarts: the last seen KV revision is kept as a resume token. Backends
+implementing KVBackendResumable continue right after it, including deletes happened meanwhile. Others are
+re-watched fully, already seen revisions are skipped and keys which did not come back are dropped from the cache
+as deleted from KV while the watcher was down.
+*/
+
+// KVBackendResumable is implemented by backends able to continue watching right after a known revision
+type KVBackendResumable interface {
+	// WatchFromRevision delivers updates with revisions greater than revision (complete deletes as entries with empty values),
+	// then a nil entry once caught up, then live updates until stopped
+	WatchFromRevision(keyPattern string, revision uint64) (KVBackendWatcher, error)
+}
+
+// Starts watching all cache keys, resumed - the watcher continues from the last seen revision
+func (cs *Store) watchKVUpdates() (KVBackendWatcher, bool, error) {
+	pattern := cs.cacheConfig.kvStorePrefix + ".>"
+	if cs.cacheConfig.kvPollingIntervalMs > 0 {
+		if sb, ok := cs.backend.(KVBackendScannable); ok {
+			w, err := cs.pollKVUpdates(sb, pattern)
+			return w, true, err
+		}
+		cs.logger().Logf(lg.WarnLevel, "Cache KV backend cannot be polled, watching instead\n")
+	}
+	if lastRevision := cs.lastKVRevision.Load(); lastRevision > 0 {
+		if rb, ok := cs.backend.(KVBackendResumable); ok {
+			w, err := rb.WatchFromRevision(pattern, lastRevision)
+			if err == nil {
+				return w, true, nil
+			}
+			cs.logger().Logf(lg.WarnLevel, "Cache KV watcher cannot resume from revision %d: %s, watching all\n", lastRevision, err)
+		}
+	}
+	w, err := cs.backend.Watch(pattern)
+	return w, false, err
+}
+
+// Drops values synced with KV whose keys were not delivered by a full re-watch, marks the levels inconsistent with KV
+func (cs *Store) reconcileWithKV(deliveredKeys map[string]struct{}) {
+	now := system.GetCurrentTimeNs()
+	dropped := 0
+
+	levels := []*StoreValue{cs.rootValue}
+	prefixes := []string{""}
+	for len(levels) > 0 {
+		lastID := len(levels) - 1
+		level := levels[lastID]
+		prefix := prefixes[lastID]
+		levels = levels[:lastID]
+		prefixes = prefixes[:lastID]
+
+		levelDropped := false
+		level.Range(func(key, value interface{}) bool {
+			child := value.(*StoreValue)
+			fullKey := prefix + KeyToken(key.(string))
+			child.Lock("reconcileWithKV")
+			if _, delivered := deliveredKeys[fullKey]; !delivered && child.valueExists && child.syncedWithKV && child.forget() {
+				levelDropped = true
+				dropped++
+			}
+			child.Unlock("reconcileWithKV")
+			levels = append(levels, child)
+			prefixes = append(prefixes, fullKey+".")
+			return true
+		})
+		if levelDropped {
+			atomic.StoreInt64(&level.storeConsistencyWithKVLossTime, now)
+		}
+	}
+	if dropped > 0 {
+		cs.logger().Logf(lg.InfoLevel, "Cache reconciliation with KV dropped %d values deleted while the watcher was down\n", dropped)
+	}
+}
+
+// NATS resumed watcher ----------------------------------------------------------------------------
+
+type natsResumedEntry struct {
+	key      string
+	value    []byte
+	revision uint64
+}
+
+func (e *natsResumedEntry) Key() string      { return e.key }
+func (e *natsResumedEntry) Value() []byte    { return e.value }
+func (e *natsResumedEntry) Revision() uint64 { return e.revision }
+
+type natsResumedWatcher struct {
+	sub      *nats.Subscription
+	updates  chan KVBackendEntry
+	done     chan struct{}
+	caughtUp bool
+}
+
+func (rw *natsResumedWatcher) send(e KVBackendEntry) {
+	select {
+	case rw.updates <- e:
+	case <-rw.done:
+	}
+}
+
+func (rw *natsResumedWatcher) Updates() <-chan KVBackendEntry {
+	return rw.updates
+}
+
+func (rw *natsResumedWatcher) Stop() error {
+	close(rw.done)
+	return rw.sub.Unsubscribe()
+}
+
+// WatchFromRevision reads the KV bucket stream with an ordered consumer starting right after the revision
+func (b *natsKVBackend) WatchFromRevision(keyPattern string, revision uint64) (KVBackendWatcher, error) {
+	bucket := b.kv.Bucket()
+	stream := "KV_" + bucket
+	subjectPrefix := fmt.Sprintf("$KV.%s.", bucket)
+
+	info, err := b.js.StreamInfo(stream)
+	if err != nil {
+		return nil, err
+	}
+	if info.State.FirstSeq > revision+1 {
+		return nil, fmt.Errorf("revision %d is not in the stream anymore", revision)
+	}
+
+	rw := &natsResumedWatcher{updates: make(chan KVBackendEntry, 256), done: make(chan struct{})}
+	if info.State.LastSeq <= revision {
+		rw.caughtUp = true
+		rw.updates <- nil
+	}
+	rw.sub, err = b.js.Subscribe(subjectPrefix+keyPattern, func(m *nats.Msg) {
+		meta, err := m.Metadata()
+		if err != nil {
+			return
+		}
+		entry := &natsResumedEntry{key: strings.TrimPrefix(m.Subject, subjectPrefix), revision: meta.Sequence.Stream}
+		if op := m.Header.Get("KV-Operation"); op != "DEL" && op != "PURGE" {
+			entry.value = m.Data
+		}
+		rw.send(entry)
+		if !rw.caughtUp && meta.NumPending == 0 {
+			rw.caughtUp = true
+			rw.send(nil)
+		}
+	}, nats.OrderedConsumer(), nats.StartSequence(revision+1), nats.BindStream(stream))
+	if err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// ------------------------------------------------------------------------------------------------
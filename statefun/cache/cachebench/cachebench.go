@@ -0,0 +1,239 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage cache benchmark package.
+// Provides reproducible concurrent mixed workloads for the cache store on top of the in-memory backend
+package cachebench
+
+/*
+baseline.json holds results of DefaultWorkloads measured on a single CPU linux/amd64 machine with:
+
+	go run ./cmd/cachebench > statefun/cache/cachebench/baseline.json
+
+Check for regressions against it (throughput only, latencies are too machine dependent):
+
+	go run ./cmd/cachebench -baseline statefun/cache/cachebench/baseline.json -tolerance 0.2
+
+Numbers are only comparable on the same machine, regenerate the baseline on the CI runner before relying on it.
+*/
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+)
+
+const (
+	latencySampleEvery = 16
+	keysPerLevel       = 100 // Keys are spread over "bench.<level>.<key>" levels
+)
+
+type KeyDistribution string
+
+const (
+	UniformKeys KeyDistribution = "uniform"
+	ZipfKeys    KeyDistribution = "zipf" // Few hot keys take most of the accesses
+)
+
+// Workload describes concurrent readers, writers and level subscribers working on a key space
+type Workload struct {
+	Name         string
+	Readers      int
+	Writers      int
+	Subscribers  int // Each one subscribes to a single level, levels are assigned round-robin
+	Keys         int
+	Distribution KeyDistribution
+	ValueSize    int
+	Duration     time.Duration
+	Seed         int64
+}
+
+type Result struct {
+	Workload          string  `json:"workload"`
+	ReadsPerSec       float64 `json:"reads_per_sec"`
+	WritesPerSec      float64 `json:"writes_per_sec"`
+	ReadP50Us         float64 `json:"read_p50_us"`
+	ReadP99Us         float64 `json:"read_p99_us"`
+	WriteP50Us        float64 `json:"write_p50_us"`
+	WriteP99Us        float64 `json:"write_p99_us"`
+	NotificationsRecv uint64  `json:"notifications_received"`
+	LazyWriterPassUs  float64 `json:"lazy_writer_pass_us"`
+}
+
+// DefaultWorkloads are the workloads the committed baseline is measured with
+func DefaultWorkloads() []Workload {
+	return []Workload{
+		{Name: "read-heavy", Readers: 8, Writers: 1, Keys: 10000, Distribution: UniformKeys, ValueSize: 256, Duration: 3 * time.Second, Seed: 1},
+		{Name: "write-heavy", Readers: 1, Writers: 8, Keys: 10000, Distribution: UniformKeys, ValueSize: 256, Duration: 3 * time.Second, Seed: 2},
+		{Name: "mixed-subscribed", Readers: 4, Writers: 4, Subscribers: 8, Keys: 10000, Distribution: UniformKeys, ValueSize: 256, Duration: 3 * time.Second, Seed: 3},
+		{Name: "hot-keys", Readers: 4, Writers: 4, Keys: 10000, Distribution: ZipfKeys, ValueSize: 1024, Duration: 3 * time.Second, Seed: 4},
+	}
+}
+
+func benchKey(n int) string {
+	return fmt.Sprintf("bench.%d.%d", n/keysPerLevel, n)
+}
+
+func keyPicker(w Workload, seed int64) func() int {
+	r := rand.New(rand.NewSource(seed))
+	if w.Distribution == ZipfKeys {
+		zipf := rand.NewZipf(r, 1.1, 1, uint64(w.Keys-1))
+		return func() int { return int(zipf.Uint64()) }
+	}
+	return func() int { return r.Intn(w.Keys) }
+}
+
+func percentileUs(samples []time.Duration, p float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return float64(samples[int(p*float64(len(samples)-1))].Nanoseconds()) / 1000
+}
+
+type worker struct {
+	ops     uint64
+	samples []time.Duration
+}
+
+// Run executes the workload against a fresh cache store, keys are prefilled before measuring
+func Run(w Workload) (Result, error) {
+	if w.Keys <= 0 || w.Duration <= 0 {
+		return Result{}, fmt.Errorf("error: workload %s needs keys and duration", w.Name)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs := cache.NewCacheStoreWithBackend(ctx, cache.NewCacheConfig("bench-"+w.Name), cache.NewMemoryKVBackend())
+	defer cs.Destroy()
+
+	value := make([]byte, w.ValueSize)
+	rand.New(rand.NewSource(w.Seed)).Read(value)
+	for n := 0; n < w.Keys; n++ {
+		cs.SetValue(benchKey(n), value, true, -1, "")
+	}
+	if err := cs.Flush(ctx); err != nil {
+		return Result{}, err
+	}
+
+	var notifications atomic.Uint64
+	levels := (w.Keys + keysPerLevel - 1) / keysPerLevel
+	var subscribersWG sync.WaitGroup
+	for i := 0; i < w.Subscribers; i++ {
+		level := fmt.Sprintf("bench.%d.*", i%levels)
+		callbackID := fmt.Sprintf("bench-subscriber-%d", i)
+		updates := cs.SubscribeLevelCallback(level, callbackID)
+		defer cs.UnsubscribeLevelCallback(level, callbackID)
+		subscribersWG.Add(1)
+		go func() {
+			defer subscribersWG.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case _, ok := <-updates:
+					if !ok {
+						return
+					}
+					notifications.Add(1)
+				}
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	var workersWG sync.WaitGroup
+	startWorkers := func(count int, seedShift int64, op func(key string)) []*worker {
+		workers := make([]*worker, count)
+		for i := 0; i < count; i++ {
+			wk := &worker{}
+			workers[i] = wk
+			pick := keyPicker(w, w.Seed+seedShift+int64(i))
+			workersWG.Add(1)
+			go func() {
+				defer workersWG.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					key := benchKey(pick())
+					if wk.ops%latencySampleEvery == 0 {
+						start := time.Now()
+						op(key)
+						wk.samples = append(wk.samples, time.Since(start))
+					} else {
+						op(key)
+					}
+					wk.ops++
+				}
+			}()
+		}
+		return workers
+	}
+
+	start := time.Now()
+	readers := startWorkers(w.Readers, 1000, func(key string) {
+		_, _ = cs.GetValue(key)
+	})
+	writers := startWorkers(w.Writers, 2000, func(key string) {
+		cs.SetValue(key, value, true, -1, "")
+	})
+	time.Sleep(w.Duration)
+	close(stop)
+	workersWG.Wait()
+	elapsed := time.Since(start).Seconds()
+
+	collect := func(workers []*worker) (uint64, []time.Duration) {
+		var ops uint64
+		samples := []time.Duration{}
+		for _, wk := range workers {
+			ops += wk.ops
+			samples = append(samples, wk.samples...)
+		}
+		return ops, samples
+	}
+	reads, readSamples := collect(readers)
+	writes, writeSamples := collect(writers)
+	cancel()
+	subscribersWG.Wait()
+
+	return Result{
+		Workload:          w.Name,
+		ReadsPerSec:       float64(reads) / elapsed,
+		WritesPerSec:      float64(writes) / elapsed,
+		ReadP50Us:         percentileUs(readSamples, 0.5),
+		ReadP99Us:         percentileUs(readSamples, 0.99),
+		WriteP50Us:        percentileUs(writeSamples, 0.5),
+		WriteP99Us:        percentileUs(writeSamples, 0.99),
+		NotificationsRecv: notifications.Load(),
+		LazyWriterPassUs:  float64(cs.Stats().LazyWriterLoopDuration.Nanoseconds()) / 1000,
+	}, nil
+}
+
+// Regressions returns workloads whose throughput dropped below the baseline by more than tolerance (0.2 - 20%)
+func Regressions(baseline []Result, current []Result, tolerance float64) []string {
+	byName := map[string]Result{}
+	for _, r := range baseline {
+		byName[r.Workload] = r
+	}
+	regressions := []string{}
+	for _, r := range current {
+		b, ok := byName[r.Workload]
+		if !ok {
+			continue
+		}
+		if r.ReadsPerSec < b.ReadsPerSec*(1-tolerance) {
+			regressions = append(regressions, fmt.Sprintf("%s: reads %.0f/s, baseline %.0f/s", r.Workload, r.ReadsPerSec, b.ReadsPerSec))
+		}
+		if r.WritesPerSec < b.WritesPerSec*(1-tolerance) {
+			regressions = append(regressions, fmt.Sprintf("%s: writes %.0f/s, baseline %.0f/s", r.Workload, r.WritesPerSec, b.WritesPerSec))
+		}
+	}
+	return regressions
+}
@@ -0,0 +1,204 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Capabilities describe what a runtime supports, so runtimes of different SDK versions in one cluster (e.g. during a
+rolling upgrade) negotiate behavior instead of failing on unknown fields: a sender checks its peers support a feature
+or an envelope version before using it. Every runtime replies with its Capabilities as JSON on:
+
+	capabilities            - all the runtimes of the namespace reply, see Runtime.QueryCapabilities
+	capabilities.<node id>  - the node replies, see Runtime.NodeCapabilities
+
+and serves them by "GET /capabilities" of the health probes (RuntimeConfig.SetHealthProbes). Features are the SDK's
+own ones enabled in the runtime, applications and embedded modules add theirs by Runtime.RegisterCapability, e.g.
+the graph transactions register "transactions". EnvelopeVersion is the version of the message data format
+(caller_typename, caller_id, payload, options, reply_stream) the runtime sends, SupportedEnvelopeVersions the ones
+it reads.
+*/
+
+const (
+	SDKVersion          = "0.1.0"
+	EnvelopeVersion     = 1
+	CapabilitiesSubject = "capabilities"
+)
+
+var SupportedEnvelopeVersions = []int{1}
+
+// Capabilities of a runtime
+type Capabilities struct {
+	SDKVersion          string   `json:"sdk_version"`
+	NodeID              string   `json:"node_id"`
+	Namespace           string   `json:"namespace,omitempty"`
+	Role                string   `json:"role"`
+	EnvelopeVersion     int      `json:"envelope_version"`
+	EnvelopeVersions    []int    `json:"envelope_versions"`
+	Features            []string `json:"features"`
+	PayloadContentTypes []string `json:"payload_content_types"`
+	FunctionTypes       []string `json:"function_types"`
+}
+
+// HasFeature reports whether the runtime has the feature
+func (c Capabilities) HasFeature(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsEnvelope reports whether the runtime reads messages of the envelope version
+func (c Capabilities) SupportsEnvelope(version int) bool {
+	for _, v := range c.EnvelopeVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+type registeredCapabilities struct {
+	mutex    sync.Mutex
+	features map[string]struct{}
+}
+
+// RegisterCapability adds the feature to the runtime's capabilities
+func (r *Runtime) RegisterCapability(feature string) {
+	r.registeredCapabilities.mutex.Lock()
+	defer r.registeredCapabilities.mutex.Unlock()
+	if r.registeredCapabilities.features == nil {
+		r.registeredCapabilities.features = map[string]struct{}{}
+	}
+	r.registeredCapabilities.features[feature] = struct{}{}
+}
+
+// Capabilities of the runtime
+func (r *Runtime) Capabilities() Capabilities {
+	features := map[string]struct{}{
+		"streaming_replies":  {},
+		"node_requests":      {},
+		"signal_batch":       {},
+		"payload_codecs":     {},
+		"object_context_cas": {},
+	}
+	if r.config.signalBufferMaxSize > 0 {
+		features["signal_buffer"] = struct{}{}
+	}
+	if len(r.config.e2eMasterKey) > 0 {
+		features["e2e_encryption"] = struct{}{}
+	}
+	functionTypes := []string{}
+	for name, ft := range r.registeredFunctionTypes {
+		if !r.servesFunctionType(ft) {
+			continue
+		}
+		functionTypes = append(functionTypes, name)
+		if ft.config.priorityLanes {
+			features["priority_lanes"] = struct{}{}
+		}
+		if ft.config.orderedPerID {
+			features["ordered_per_id"] = struct{}{}
+		}
+		if ft.executor != nil && r.config.pluginReloadTypenames[name] {
+			features["plugin_reload"] = struct{}{}
+		}
+	}
+	r.registeredCapabilities.mutex.Lock()
+	for feature := range r.registeredCapabilities.features {
+		features[feature] = struct{}{}
+	}
+	r.registeredCapabilities.mutex.Unlock()
+
+	c := Capabilities{
+		SDKVersion:          SDKVersion,
+		NodeID:              r.config.nodeID,
+		Namespace:           r.config.namespace,
+		Role:                r.config.role.String(),
+		EnvelopeVersion:     EnvelopeVersion,
+		EnvelopeVersions:    append([]int{}, SupportedEnvelopeVersions...),
+		Features:            make([]string, 0, len(features)),
+		PayloadContentTypes: sfPlugins.PayloadContentTypes(),
+		FunctionTypes:       functionTypes,
+	}
+	for feature := range features {
+		c.Features = append(c.Features, feature)
+	}
+	sort.Strings(c.Features)
+	sort.Strings(c.FunctionTypes)
+	return c
+}
+
+// Subscribes the runtime's capability subjects on the primary connection, drained with it on shutdown
+func (r *Runtime) serveCapabilities() error {
+	reply := func(msg *nats.Msg) {
+		data, err := json.Marshal(r.Capabilities())
+		if err != nil {
+			lg.Log(lg.ErrorLevel, "Capabilities encoding failed", "error", err)
+			return
+		}
+		system.MsgOnErrorReturn(msg.Respond(data))
+	}
+	for _, subject := range []string{r.namespacedSubject(CapabilitiesSubject), r.namespacedSubject(CapabilitiesSubject + "." + r.config.nodeID)} {
+		if _, err := r.nc.Subscribe(subject, reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryCapabilities collects the capabilities of the namespace's runtimes replying within the timeout, this one too
+func (r *Runtime) QueryCapabilities(timeout time.Duration) ([]Capabilities, error) {
+	inbox := r.nc.NewRespInbox()
+	sub, err := r.nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { system.MsgOnErrorReturn(sub.Unsubscribe()) }()
+	if err := r.nc.PublishRequest(r.namespacedSubject(CapabilitiesSubject), inbox, nil); err != nil {
+		return nil, err
+	}
+
+	result := []Capabilities{}
+	deadline := time.Now().Add(timeout)
+	for {
+		msg, err := sub.NextMsg(time.Until(deadline))
+		if err != nil {
+			break // Timed out
+		}
+		var c Capabilities
+		if err := json.Unmarshal(msg.Data, &c); err != nil {
+			lg.Log(lg.WarnLevel, "Malformed capabilities reply", "error", err)
+			continue
+		}
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].NodeID < result[j].NodeID })
+	return result, nil
+}
+
+// NodeCapabilities requests the capabilities of the node, fails with RequestTimeoutError if it does not reply in time
+func (r *Runtime) NodeCapabilities(nodeID string, timeout time.Duration) (Capabilities, error) {
+	var c Capabilities
+	msg, err := r.nc.Request(r.namespacedSubject(CapabilitiesSubject+"."+nodeID), nil, timeout)
+	if err == nats.ErrTimeout || err == nats.ErrNoResponders {
+		return c, RequestTimeoutError
+	}
+	if err != nil {
+		return c, err
+	}
+	return c, json.Unmarshal(msg.Data, &c)
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/foliagecp/sdk/statefun/cache"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Checkpoints persist large derived in-memory state of a function type's id (parsed models, indices) so it can be
+restored after a restart instead of recomputed. Data goes to the object store under a name including its SHA-256
+hash, the current hash is recorded in KV after the object is written:
+
+	__checkpoints.<typename hash>.<id hash>.<checkpoint name hash> = {"hash": "<sha256 hex>", "size": <bytes>, "saved_at": <ns>}
+
+A crash in the middle of a save leaves the previous checkpoint current, saving unchanged data writes nothing,
+a loaded object is verified against the recorded hash.
+*/
+
+const (
+	CheckpointKeyPrefix = "__checkpoints"
+)
+
+var (
+	checkpointCorruptedError = errors.New("error: checkpoint data does not match its hash")
+)
+
+func checkpointKey(typename string, id string, name string) string {
+	return CheckpointKeyPrefix + "." + system.GetHashStr(typename) + "." + system.GetHashStr(id) + "." + system.GetHashStr(name)
+}
+
+func checkpointObjectName(key string, hash string) string {
+	return key + "." + hash
+}
+
+// Returns the object store checkpoints are kept in, created on the first use
+func (r *Runtime) getCheckpointBackend() (cache.ArchiveBackend, error) {
+	r.checkpointBackendMutex.Lock()
+	defer r.checkpointBackendMutex.Unlock()
+	if r.checkpointBackend == nil {
+		if r.config.checkpointBackend != nil {
+			r.checkpointBackend = r.config.checkpointBackend
+		} else {
+			backend, err := cache.NewNatsObjectStoreArchiveBackend(r.js, r.config.checkpointObjectStoreBucket)
+			if err != nil {
+				return nil, err
+			}
+			r.checkpointBackend = backend
+		}
+	}
+	return r.checkpointBackend, nil
+}
+
+func (ft *FunctionType) saveCheckpoint(id string, name string, data []byte) error {
+	key := checkpointKey(ft.name, id, name)
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	previousHash := ""
+	if record, err := ft.runtime.cacheStore.GetValueAsJSON(key); err == nil {
+		previousHash, _ = record.GetByPath("hash").AsString()
+	}
+	if previousHash == hash {
+		return nil
+	}
+
+	backend, err := ft.runtime.getCheckpointBackend()
+	if err != nil {
+		return err
+	}
+	if err := backend.Put(checkpointObjectName(key, hash), data); err != nil {
+		return err
+	}
+	record := easyjson.NewJSONObject()
+	record.SetByPath("hash", easyjson.NewJSON(hash))
+	record.SetByPath("size", easyjson.NewJSON(len(data)))
+	record.SetByPath("saved_at", easyjson.NewJSON(system.GetCurrentTimeNs()))
+	if err := ft.runtime.systemCache().SetValueDurable(key, record.ToBytes()); err != nil {
+		return err
+	}
+
+	if len(previousHash) > 0 {
+		if err := backend.Delete(checkpointObjectName(key, previousHash)); err != nil {
+			lg.Log(lg.WarnLevel, "Cannot delete previous checkpoint", "checkpoint", name, "typename", ft.name, "id", id, "error", err)
+		}
+	}
+	return nil
+}
+
+func (ft *FunctionType) loadCheckpoint(id string, name string) ([]byte, error) {
+	key := checkpointKey(ft.name, id, name)
+	record, err := ft.runtime.cacheStore.GetValueAsJSON(key)
+	if err != nil {
+		return nil, nil // No checkpoint saved
+	}
+	hash, ok := record.GetByPath("hash").AsString()
+	if !ok {
+		return nil, checkpointCorruptedError
+	}
+
+	backend, err := ft.runtime.getCheckpointBackend()
+	if err != nil {
+		return nil, err
+	}
+	data, err := backend.Get(checkpointObjectName(key, hash))
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != hash {
+		return nil, checkpointCorruptedError
+	}
+	return data, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"fmt"
+	rt "runtime"
+	"runtime/debug"
+
+	sdkErrors "github.com/foliagecp/sdk/errors"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+var (
+	childTasksLimitError = sdkErrors.New(sdkErrors.ErrThrottled, "error: child tasks limit for function type is reached")
+)
+
+// Runs task in a separate routine supervised by the runtime: task's context is cancelled when the runtime stops
+// child tasks, a panic inside the task is recovered and logged, amount of running tasks per typename is limited
+func (ft *FunctionType) goChildTask(id string, task func(ctx context.Context)) error {
+	if ft.childTasksControlChannel != nil {
+		select {
+		case ft.childTasksControlChannel <- struct{}{}:
+		default:
+			return childTasksLimitError
+		}
+	}
+
+	ft.runtime.childTasksWaitGroup.Add(1)
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("functiontype-childTask")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("functiontype-childTask")
+		defer ft.runtime.childTasksWaitGroup.Done()
+		defer func() {
+			if ft.childTasksControlChannel != nil {
+				<-ft.childTasksControlChannel
+			}
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				le := lg.GetCustomLogEntry(rt.Caller(0))
+				le.Log(lg.ErrorLevel, "Child task panicked", "typename", ft.name, "id", id, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			}
+		}()
+		task(ft.runtime.childTasksCtx)
+	}()
+	return nil
+}
+
+// Cancels contexts of all running child tasks and waits for them to finish or for ctx to be done
+func (r *Runtime) StopChildTasks(ctx context.Context) error {
+	r.childTasksCancel()
+
+	done := make(chan struct{})
+	go func() {
+		r.childTasksWaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
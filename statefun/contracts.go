@@ -0,0 +1,287 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/foliagecp/easyjson"
+)
+
+/*
+Contracts between caller and callee typenames are built from recorded calls (debug capture samples). A contract
+keeps the recorded cases and schemas (in the schema registry format) inferred from them:
+
+	{
+		"caller": "<typename>", "callee": "<typename>",
+		"payload_schema": {...}, "reply_schema": {...},
+		"cases": [{"payload": {...}, "options": {...}, "requested": true, "reply": {...}}]
+	}
+
+Callers check that the payloads they send are still accepted by the callee's registered schema (VerifyCallerContract),
+callees check that they still handle recorded payloads and reply in the recorded shape (sandbox.VerifyContract).
+*/
+
+type ContractCase struct {
+	Payload   *easyjson.JSON
+	Options   *easyjson.JSON
+	Requested bool
+	Reply     *easyjson.JSON
+}
+
+type Contract struct {
+	Caller        string
+	Callee        string
+	PayloadSchema *easyjson.JSON
+	ReplySchema   *easyjson.JSON // nil if the callee was only signaled
+	Cases         []ContractCase
+}
+
+// ReadDebugCaptures reads debug capture samples stored as JSON lines, e.g. dumped from the debug capture stream
+func ReadDebugCaptures(r io.Reader) ([]*easyjson.JSON, error) {
+	samples := []*easyjson.JSON{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		sample, ok := easyjson.JSONFromBytes(scanner.Bytes())
+		if !ok {
+			return nil, fmt.Errorf("error: malformed debug capture sample: %s", scanner.Text())
+		}
+		samples = append(samples, &sample)
+	}
+	return samples, scanner.Err()
+}
+
+// ContractsFromCaptures groups debug capture samples by caller and callee typenames, samples without caller are skipped
+func ContractsFromCaptures(samples []*easyjson.JSON) []*Contract {
+	contracts := map[string]*Contract{}
+	for _, sample := range samples {
+		caller, _ := sample.GetByPath("caller_typename").AsString()
+		callee, _ := sample.GetByPath("typename").AsString()
+		if len(caller) == 0 || len(callee) == 0 {
+			continue
+		}
+		contract, ok := contracts[caller+">"+callee]
+		if !ok {
+			contract = &Contract{Caller: caller, Callee: callee}
+			contracts[caller+">"+callee] = contract
+		}
+		c := ContractCase{
+			Payload:   sample.GetByPath("payload").GetPtr(),
+			Options:   sample.GetByPath("options").GetPtr(),
+			Requested: sample.GetByPath("requested").AsBoolDefault(false),
+		}
+		if c.Requested && sample.PathExists("reply") {
+			c.Reply = sample.GetByPath("reply").GetPtr()
+		}
+		contract.Cases = append(contract.Cases, c)
+
+		contract.PayloadSchema = mergeInferredSchemas(contract.PayloadSchema, InferPayloadSchema(c.Payload))
+		if c.Reply != nil {
+			contract.ReplySchema = mergeInferredSchemas(contract.ReplySchema, InferPayloadSchema(c.Reply))
+		}
+	}
+
+	result := make([]*Contract, 0, len(contracts))
+	for _, contract := range contracts {
+		result = append(result, contract)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Caller+">"+result[i].Callee < result[j].Caller+">"+result[j].Callee
+	})
+	return result
+}
+
+// InferPayloadSchema returns the strictest schema the value matches: all present properties are required
+func InferPayloadSchema(value *easyjson.JSON) *easyjson.JSON {
+	schema := easyjson.NewJSONObject()
+	schema.SetByPath("type", easyjson.NewJSON(jsonTypeName(value)))
+	if value.IsObject() {
+		properties := easyjson.NewJSONObject()
+		required := []string{}
+		for _, name := range value.ObjectKeys() {
+			property := value.GetByPath(name)
+			properties.SetByPath(name, *InferPayloadSchema(&property))
+			required = append(required, name)
+		}
+		sort.Strings(required)
+		schema.SetByPath("properties", properties)
+		schema.SetByPath("required", easyjson.JSONFromArray(required))
+	}
+	if value.IsArray() {
+		var items *easyjson.JSON = nil
+		for i := 0; i < value.ArraySize(); i++ {
+			element := value.ArrayElement(i)
+			items = mergeInferredSchemas(items, InferPayloadSchema(&element))
+		}
+		if items != nil {
+			schema.SetByPath("items", *items)
+		}
+	}
+	return &schema
+}
+
+// Returns the schema matching values of both: properties are united, required ones intersected, differing types dropped
+func mergeInferredSchemas(a *easyjson.JSON, b *easyjson.JSON) *easyjson.JSON {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	merged := easyjson.NewJSONObject()
+	aType, _ := a.GetByPath("type").AsString()
+	bType, _ := b.GetByPath("type").AsString()
+	if aType != bType {
+		return &merged // Any value
+	}
+	merged.SetByPath("type", easyjson.NewJSON(aType))
+
+	if a.PathExists("properties") || b.PathExists("properties") {
+		aProperties := a.GetByPath("properties")
+		bProperties := b.GetByPath("properties")
+		properties := easyjson.NewJSONObject()
+		for _, name := range aProperties.ObjectKeys() {
+			ap := aProperties.GetByPath(name)
+			if bProperties.PathExists(name) {
+				bp := bProperties.GetByPath(name)
+				properties.SetByPath(name, *mergeInferredSchemas(&ap, &bp))
+			} else {
+				properties.SetByPath(name, ap)
+			}
+		}
+		for _, name := range bProperties.ObjectKeys() {
+			if !aProperties.PathExists(name) {
+				properties.SetByPath(name, bProperties.GetByPath(name))
+			}
+		}
+		merged.SetByPath("properties", properties)
+
+		bRequired := map[string]bool{}
+		if required, ok := b.GetByPath("required").AsArrayString(); ok {
+			for _, name := range required {
+				bRequired[name] = true
+			}
+		}
+		required := []string{}
+		if aRequired, ok := a.GetByPath("required").AsArrayString(); ok {
+			for _, name := range aRequired {
+				if bRequired[name] {
+					required = append(required, name)
+				}
+			}
+		}
+		merged.SetByPath("required", easyjson.JSONFromArray(required))
+	}
+
+	if a.PathExists("items") && b.PathExists("items") {
+		ai := a.GetByPath("items")
+		bi := b.GetByPath("items")
+		merged.SetByPath("items", *mergeInferredSchemas(&ai, &bi))
+	} else if a.PathExists("items") {
+		merged.SetByPath("items", a.GetByPath("items"))
+	} else if b.PathExists("items") {
+		merged.SetByPath("items", b.GetByPath("items"))
+	}
+	return &merged
+}
+
+// VerifyCallerContract checks that every recorded payload is accepted by the callee's payload schema
+func VerifyCallerContract(contract *Contract, calleePayloadSchema *easyjson.JSON) error {
+	for i, c := range contract.Cases {
+		if err := ValidatePayload(calleePayloadSchema, c.Payload); err != nil {
+			return fmt.Errorf("error: %s > %s case %d payload is not accepted anymore: %s", contract.Caller, contract.Callee, i, err)
+		}
+	}
+	return nil
+}
+
+// VerifyCallerContractByRegistry checks the contract against the latest payload schema registered for the callee
+func (r *Runtime) VerifyCallerContractByRegistry(contract *Contract) error {
+	schema, _, err := r.GetPayloadSchema(contract.Callee, -1)
+	if err != nil {
+		return err
+	}
+	return VerifyCallerContract(contract, schema)
+}
+
+// ---- serialization ----
+
+func (c *Contract) ToJSON() *easyjson.JSON {
+	j := easyjson.NewJSONObject()
+	j.SetByPath("caller", easyjson.NewJSON(c.Caller))
+	j.SetByPath("callee", easyjson.NewJSON(c.Callee))
+	if c.PayloadSchema != nil {
+		j.SetByPath("payload_schema", *c.PayloadSchema)
+	}
+	if c.ReplySchema != nil {
+		j.SetByPath("reply_schema", *c.ReplySchema)
+	}
+	cases := easyjson.NewJSONArray()
+	for _, cc := range c.Cases {
+		jc := easyjson.NewJSONObject()
+		jc.SetByPath("payload", *cc.Payload)
+		if cc.Options != nil {
+			jc.SetByPath("options", *cc.Options)
+		}
+		jc.SetByPath("requested", easyjson.NewJSON(cc.Requested))
+		if cc.Reply != nil {
+			jc.SetByPath("reply", *cc.Reply)
+		}
+		cases.AddToArray(jc)
+	}
+	j.SetByPath("cases", cases)
+	return &j
+}
+
+func ContractFromJSON(j *easyjson.JSON) (*Contract, error) {
+	c := &Contract{}
+	var ok1, ok2 bool
+	c.Caller, ok1 = j.GetByPath("caller").AsString()
+	c.Callee, ok2 = j.GetByPath("callee").AsString()
+	if !ok1 || !ok2 || !j.GetByPath("cases").IsArray() {
+		return nil, fmt.Errorf("error: malformed contract")
+	}
+	if j.PathExists("payload_schema") {
+		c.PayloadSchema = j.GetByPath("payload_schema").GetPtr()
+	}
+	if j.PathExists("reply_schema") {
+		c.ReplySchema = j.GetByPath("reply_schema").GetPtr()
+	}
+	cases := j.GetByPath("cases")
+	for i := 0; i < cases.ArraySize(); i++ {
+		jc := cases.ArrayElement(i)
+		cc := ContractCase{Payload: jc.GetByPath("payload").GetPtr(), Requested: jc.GetByPath("requested").AsBoolDefault(false)}
+		if jc.PathExists("options") {
+			cc.Options = jc.GetByPath("options").GetPtr()
+		}
+		if jc.PathExists("reply") {
+			cc.Reply = jc.GetByPath("reply").GetPtr()
+		}
+		c.Cases = append(c.Cases, cc)
+	}
+	return c, nil
+}
+
+func ReadContractFile(fileName string) (*Contract, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	j, ok := easyjson.JSONFromBytes(data)
+	if !ok {
+		return nil, fmt.Errorf("error: %s is not a valid JSON", fileName)
+	}
+	return ContractFromJSON(&j)
+}
+
+func WriteContractFile(fileName string, contract *Contract) error {
+	return os.WriteFile(fileName, []byte(contract.ToJSON().ToString()), 0644)
+}
@@ -0,0 +1,199 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+A panic in a function handler is recovered and the handler is called again up to the typename's retries
+(FunctionTypeConfig.SetPanicRecovery). A message still panicking after that is poison: it is dropped or published
+to the dead letter stream with the error, then acked, a request gets the "failed" reply. Every panic is reported
+to the runtime's panic hook (RuntimeConfig.SetPanicHook). A signal redelivered more than the typename's max
+deliveries (FunctionTypeConfig.SetMaxDeliveries), e.g. one nacked or not acked in time again and again, is dead
+lettered instead of being handled once more. Dead letters go to subjects dead.letter.<typename>.<id>:
+
+	{"time": ..., "typename": ..., "id": ..., "caller_typename": ..., "caller_id": ..., "payload": {...},
+	 "options": {...}, "reason": "panic" | "max_deliveries", "error": ..., "stack": ..., "attempts": ...}
+
+and are inspected, replayed and purged by the runtime (see dead_letter_inspection.go).
+*/
+
+const (
+	DeadLetterSubjectPrefix = "dead.letter"
+
+	DeadLetterReasonPanic         = "panic"
+	DeadLetterReasonMaxDeliveries = "max_deliveries"
+)
+
+type PoisonMessagePolicy int
+
+const (
+	// Poison messages are acked without handling, the panic hook is the only trace of them
+	PoisonMessageDrop PoisonMessagePolicy = iota
+	// Poison messages are published to the dead letter stream
+	PoisonMessageDeadLetter
+)
+
+type PanicAction int
+
+const (
+	PanicActionRetry PanicAction = iota
+	PanicActionDrop
+	PanicActionDeadLetter
+)
+
+// PanicEvent describes a panic recovered in a function handler
+type PanicEvent struct {
+	Typename string
+	ID       string
+	Caller   sfPlugins.StatefunAddress
+	Payload  *easyjson.JSON
+	Error    string
+	Stack    string
+	Attempt  int // Starting from 1
+	Action   PanicAction
+}
+
+type PanicHook func(event PanicEvent)
+
+// Returns the recovered panic as an error, nil if the handler did not panic
+func (ft *FunctionType) callHandlerRecovered(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) (stack string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			stack = string(debug.Stack())
+		}
+	}()
+	ft.callHandler(executor, contextProcessor)
+	return "", nil
+}
+
+// Calls the handler retrying on panics, returns the last panic's error if the message is poison
+func (ft *FunctionType) callHandlerWithPanicRecovery(id string, executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) error {
+	for attempt := 1; ; attempt++ {
+		stack, err := ft.callHandlerRecovered(executor, contextProcessor)
+		if err == nil {
+			return nil
+		}
+		event := PanicEvent{
+			Typename: ft.name,
+			ID:       id,
+			Caller:   contextProcessor.Caller,
+			Payload:  contextProcessor.Payload,
+			Error:    err.Error(),
+			Stack:    stack,
+			Attempt:  attempt,
+			Action:   PanicActionRetry,
+		}
+		if attempt <= ft.config.panicRetries {
+			lg.Log(lg.WarnLevel, "Handler panicked, retrying", "typename", ft.name, "id", id, "attempt", attempt, "error", err)
+			ft.runtime.reportPanic(event)
+			continue
+		}
+
+		if ft.config.poisonMessagePolicy == PoisonMessageDeadLetter {
+			event.Action = PanicActionDeadLetter
+			lg.Log(lg.ErrorLevel, "Handler panicked, message is dead lettered", "typename", ft.name, "id", id, "attempt", attempt, "error", err)
+			system.MsgOnErrorReturn(ft.publishDeadLetter(event, DeadLetterReasonPanic, contextProcessor.Options))
+		} else {
+			event.Action = PanicActionDrop
+			lg.Log(lg.ErrorLevel, "Handler panicked, message is dropped", "typename", ft.name, "id", id, "attempt", attempt, "error", err)
+		}
+		ft.runtime.reportPanic(event)
+		return err
+	}
+}
+
+func (r *Runtime) reportPanic(event PanicEvent) {
+	r.recordError(event.Typename, event.ID, "panic", event.Error)
+	if r.config.panicHook != nil {
+		r.config.panicHook(event)
+	}
+}
+
+// Dead letters the signal instead of handling it if it was delivered more than the max deliveries
+func (ft *FunctionType) deadLetterIfUndeliverable(msg *nats.Msg, id string, functionMsg FunctionTypeMsg) bool {
+	if ft.config.maxDeliveries <= 0 {
+		return false
+	}
+	meta, err := msg.Metadata()
+	if err != nil || meta.NumDelivered <= uint64(ft.config.maxDeliveries) {
+		return false
+	}
+	lg.Log(lg.ErrorLevel, "Signal exceeded max deliveries, message is dead lettered", "typename", ft.name, "id", id, "deliveries", meta.NumDelivered)
+	event := PanicEvent{
+		Typename: ft.name,
+		ID:       id,
+		Payload:  functionMsg.Payload,
+		Error:    fmt.Sprintf("error: delivered %d times, max deliveries is %d", meta.NumDelivered, ft.config.maxDeliveries),
+		Attempt:  int(meta.NumDelivered),
+		Action:   PanicActionDeadLetter,
+	}
+	if functionMsg.Caller != nil {
+		event.Caller = *functionMsg.Caller
+	}
+	system.MsgOnErrorReturn(ft.publishDeadLetter(event, DeadLetterReasonMaxDeliveries, functionMsg.Options))
+	ft.runtime.recordError(ft.name, id, DeadLetterReasonMaxDeliveries, event.Error)
+	return true
+}
+
+func (ft *FunctionType) publishDeadLetter(event PanicEvent, reason string, options *easyjson.JSON) error {
+	data := easyjson.NewJSONObject()
+	data.SetByPath("time", easyjson.NewJSON(system.GetCurrentTimeNs()))
+	data.SetByPath("typename", easyjson.NewJSON(event.Typename))
+	data.SetByPath("id", easyjson.NewJSON(event.ID))
+	data.SetByPath("caller_typename", easyjson.NewJSON(event.Caller.Typename))
+	data.SetByPath("caller_id", easyjson.NewJSON(event.Caller.ID))
+	if event.Payload != nil {
+		data.SetByPath("payload", *event.Payload)
+	}
+	if options != nil {
+		data.SetByPath("options", *options)
+	}
+	data.SetByPath("reason", easyjson.NewJSON(reason))
+	data.SetByPath("error", easyjson.NewJSON(event.Error))
+	data.SetByPath("stack", easyjson.NewJSON(event.Stack))
+	data.SetByPath("attempts", easyjson.NewJSON(event.Attempt))
+
+	_, js := ft.runtime.messaging()
+	_, err := js.Publish(fmt.Sprintf("%s.%s.%s", ft.runtime.namespacedSubject(DeadLetterSubjectPrefix), ft.name, event.ID), data.ToBytes())
+	return err
+}
+
+func (r *Runtime) createDeadLetterStreamIfNeeded(js nats.JetStreamContext, existingStreams []string) error {
+	deadLetterNeeded := false
+	for _, ft := range r.registeredFunctionTypes {
+		if ft.config.poisonMessagePolicy == PoisonMessageDeadLetter || ft.config.maxDeliveries > 0 {
+			deadLetterNeeded = true
+			break
+		}
+	}
+	if !deadLetterNeeded {
+		return nil
+	}
+
+	streamConfig := &nats.StreamConfig{
+		Name:     r.config.deadLetterStreamName,
+		Subjects: []string{r.namespacedSubject(DeadLetterSubjectPrefix) + ".>"},
+		MaxAge:   time.Duration(r.config.deadLetterTTLSec) * time.Second,
+	}
+	for _, name := range existingStreams {
+		if name == streamConfig.Name {
+			_, err := js.UpdateStream(streamConfig)
+			return err
+		}
+	}
+	_, err := js.AddStream(streamConfig)
+	return err
+}
@@ -0,0 +1,268 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Dead letters are inspected and recovered by the runtime, e.g. after a transient handler bug is fixed:
+
+	letters, err := runtime.ListDeadLetters(statefun.DeadLetterFilter{Typename: "functions.app.order", Limit: 100})
+	replayed, err := runtime.ReplayDeadLetters(statefun.DeadLetterFilter{Typename: "functions.app.order"})
+	err = runtime.PurgeDeadLetters(statefun.DeadLetterFilter{Typename: "functions.app.order", ID: orderID})
+
+Replay signals a dead letter's message to its typename and id again, from its original caller, and deletes the
+dead letter once the signal is sent. A filter selects dead letters of a typename (all if empty), of an id of it,
+starting from a dead letter stream sequence; Limit bounds listing and replay, 0 - no limit.
+
+The same operations are served to operators by the DeadLettersTypename function type (RegisterDeadLettersFunctionType)
+on any id:
+
+	{"op": "list" | "replay" | "purge", "typename": ..., "id": ..., "from_sequence": ..., "limit": ...}
+
+replying {"status": "ok", "result": [dead letters] | replayed count | null} or {"status": "failed", "result": error}.
+*/
+
+const (
+	DeadLettersTypename   = "functions.statefun.deadletters"
+	DeadLetterReadTimeout = 2 * time.Second
+)
+
+// DeadLetter is a message published to the dead letter stream
+type DeadLetter struct {
+	Sequence       uint64         `json:"sequence"` // In the dead letter stream
+	Time           int64          `json:"time"`
+	Typename       string         `json:"typename"`
+	ID             string         `json:"id"`
+	CallerTypename string         `json:"caller_typename"`
+	CallerID       string         `json:"caller_id"`
+	Payload        *easyjson.JSON `json:"-"`
+	Options        *easyjson.JSON `json:"-"`
+	Reason         string         `json:"reason"`
+	Error          string         `json:"error"`
+	Stack          string         `json:"stack"`
+	Attempts       int            `json:"attempts"`
+}
+
+// DeadLetterFilter selects dead letters, empty one selects all
+type DeadLetterFilter struct {
+	Typename     string
+	ID           string // Of the typename
+	FromSequence uint64
+	Limit        int
+}
+
+func (dl DeadLetter) toJSON() easyjson.JSON {
+	j := easyjson.NewJSONObject()
+	j.SetByPath("sequence", easyjson.NewJSON(dl.Sequence))
+	j.SetByPath("time", easyjson.NewJSON(dl.Time))
+	j.SetByPath("typename", easyjson.NewJSON(dl.Typename))
+	j.SetByPath("id", easyjson.NewJSON(dl.ID))
+	j.SetByPath("caller_typename", easyjson.NewJSON(dl.CallerTypename))
+	j.SetByPath("caller_id", easyjson.NewJSON(dl.CallerID))
+	if dl.Payload != nil {
+		j.SetByPath("payload", *dl.Payload)
+	}
+	if dl.Options != nil {
+		j.SetByPath("options", *dl.Options)
+	}
+	j.SetByPath("reason", easyjson.NewJSON(dl.Reason))
+	j.SetByPath("error", easyjson.NewJSON(dl.Error))
+	j.SetByPath("stack", easyjson.NewJSON(dl.Stack))
+	j.SetByPath("attempts", easyjson.NewJSON(dl.Attempts))
+	return j
+}
+
+func deadLetterFromData(sequence uint64, msgData []byte) (DeadLetter, bool) {
+	data, ok := easyjson.JSONFromBytes(msgData)
+	if !ok {
+		return DeadLetter{}, false
+	}
+	dl := DeadLetter{
+		Sequence:       sequence,
+		Time:           int64(data.GetByPath("time").AsNumericDefault(0)),
+		Typename:       data.GetByPath("typename").AsStringDefault(""),
+		ID:             data.GetByPath("id").AsStringDefault(""),
+		CallerTypename: data.GetByPath("caller_typename").AsStringDefault(""),
+		CallerID:       data.GetByPath("caller_id").AsStringDefault(""),
+		Reason:         data.GetByPath("reason").AsStringDefault(DeadLetterReasonPanic),
+		Error:          data.GetByPath("error").AsStringDefault(""),
+		Stack:          data.GetByPath("stack").AsStringDefault(""),
+		Attempts:       int(data.GetByPath("attempts").AsNumericDefault(0)),
+	}
+	if data.PathExists("payload") {
+		dl.Payload = data.GetByPath("payload").GetPtr()
+	}
+	if data.PathExists("options") {
+		dl.Options = data.GetByPath("options").GetPtr()
+	}
+	return dl, true
+}
+
+func (r *Runtime) deadLetterFilterSubject(filter DeadLetterFilter) string {
+	prefix := r.namespacedSubject(DeadLetterSubjectPrefix)
+	switch {
+	case len(filter.Typename) == 0:
+		return prefix + ".>"
+	case len(filter.ID) == 0:
+		return prefix + "." + filter.Typename + ".*"
+	default:
+		return prefix + "." + filter.Typename + "." + filter.ID
+	}
+}
+
+func (f DeadLetterFilter) matches(dl DeadLetter) bool {
+	return (len(f.Typename) == 0 || dl.Typename == f.Typename) && (len(f.ID) == 0 || dl.ID == f.ID)
+}
+
+// Calls f for the filter's dead letters in the stream order until f returns false or the limit is reached
+func (r *Runtime) readDeadLetters(filter DeadLetterFilter, f func(dl DeadLetter) bool) error {
+	_, js := r.messaging()
+	info, err := js.StreamInfo(r.config.deadLetterStreamName)
+	if err != nil {
+		return err
+	}
+	if info.State.Msgs == 0 {
+		return nil
+	}
+
+	opts := []nats.SubOpt{nats.OrderedConsumer(), nats.BindStream(r.config.deadLetterStreamName)}
+	if filter.FromSequence > 0 {
+		opts = append(opts, nats.StartSequence(filter.FromSequence))
+	} else {
+		opts = append(opts, nats.DeliverAll())
+	}
+	sub, err := js.SubscribeSync(r.deadLetterFilterSubject(filter), opts...)
+	if err != nil {
+		return err
+	}
+	defer func() { system.MsgOnErrorReturn(sub.Unsubscribe()) }()
+
+	read := 0
+	for filter.Limit <= 0 || read < filter.Limit {
+		msg, err := sub.NextMsg(DeadLetterReadTimeout)
+		if err == nats.ErrTimeout {
+			return nil // No more dead letters of the filter
+		}
+		if err != nil {
+			return err
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return err
+		}
+		if dl, ok := deadLetterFromData(meta.Sequence.Stream, msg.Data); ok && filter.matches(dl) {
+			read++
+			if !f(dl) {
+				return nil
+			}
+		}
+		if meta.NumPending == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// ListDeadLetters returns the filter's dead letters in the stream order
+func (r *Runtime) ListDeadLetters(filter DeadLetterFilter) ([]DeadLetter, error) {
+	letters := []DeadLetter{}
+	err := r.readDeadLetters(filter, func(dl DeadLetter) bool {
+		letters = append(letters, dl)
+		return true
+	})
+	return letters, err
+}
+
+// ReplayDeadLetters signals the filter's dead letters again and deletes them, returns the number replayed
+func (r *Runtime) ReplayDeadLetters(filter DeadLetterFilter) (int, error) {
+	letters, err := r.ListDeadLetters(filter)
+	if err != nil {
+		return 0, err
+	}
+	_, js := r.messaging()
+	for i, dl := range letters {
+		if err := r.signal(sfPlugins.JetstreamGlobalSignal, dl.CallerTypename, dl.CallerID, dl.Typename, dl.ID, dl.Payload, dl.Options); err != nil {
+			return i, fmt.Errorf("replay of dead letter %d: %w", dl.Sequence, err)
+		}
+		if err := js.DeleteMsg(r.config.deadLetterStreamName, dl.Sequence); err != nil {
+			lg.Log(lg.WarnLevel, "Replayed dead letter was not deleted", "sequence", dl.Sequence, "error", err)
+		}
+	}
+	return len(letters), nil
+}
+
+// PurgeDeadLetters deletes the dead letters of the filter's typename and id, FromSequence and Limit are ignored
+func (r *Runtime) PurgeDeadLetters(filter DeadLetterFilter) error {
+	_, js := r.messaging()
+	if len(filter.Typename) == 0 {
+		return js.PurgeStream(r.config.deadLetterStreamName)
+	}
+	return js.PurgeStream(r.config.deadLetterStreamName, &nats.StreamPurgeRequest{Subject: r.deadLetterFilterSubject(filter)})
+}
+
+// RegisterDeadLettersFunctionType serves the dead letter operations by DeadLettersTypename
+func RegisterDeadLettersFunctionType(runtime *Runtime) {
+	NewFunctionType(runtime, DeadLettersTypename, func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		deadLettersFunction(runtime, contextProcessor)
+	}, *NewFunctionTypeConfig().SetServiceState(true))
+}
+
+func deadLettersFunction(r *Runtime, contextProcessor *sfPlugins.StatefunContextProcessor) {
+	if contextProcessor.Reply == nil {
+		return // Nobody to return the result to
+	}
+	reply := func(status string, result easyjson.JSON) {
+		j := easyjson.NewJSONObject()
+		j.SetByPath("status", easyjson.NewJSON(status))
+		j.SetByPath("result", result)
+		contextProcessor.Reply.With(&j)
+	}
+
+	payload := contextProcessor.Payload
+	filter := DeadLetterFilter{
+		Typename:     payload.GetByPath("typename").AsStringDefault(""),
+		ID:           payload.GetByPath("id").AsStringDefault(""),
+		FromSequence: uint64(payload.GetByPath("from_sequence").AsNumericDefault(0)),
+		Limit:        int(payload.GetByPath("limit").AsNumericDefault(0)),
+	}
+	switch op := strings.ToLower(payload.GetByPath("op").AsStringDefault("list")); op {
+	case "list":
+		letters, err := r.ListDeadLetters(filter)
+		if err != nil {
+			reply("failed", easyjson.NewJSON(err.Error()))
+			return
+		}
+		result := easyjson.NewJSONArray()
+		for _, dl := range letters {
+			result.AddToArray(dl.toJSON())
+		}
+		reply("ok", result)
+	case "replay":
+		replayed, err := r.ReplayDeadLetters(filter)
+		if err != nil {
+			reply("failed", easyjson.NewJSON(err.Error()))
+			return
+		}
+		reply("ok", easyjson.NewJSON(replayed))
+	case "purge":
+		if err := r.PurgeDeadLetters(filter); err != nil {
+			reply("failed", easyjson.NewJSON(err.Error()))
+			return
+		}
+		reply("ok", easyjson.NewJSONNull())
+	default:
+		reply("failed", easyjson.NewJSON(fmt.Sprintf("error: unknown dead letters op %q", op)))
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	DebugCaptureSubjectPrefix = "debug.capture"
+)
+
+type debugCaptureSample struct {
+	time          int64
+	caller        sfPlugins.StatefunAddress
+	payload       *easyjson.JSON
+	options       *easyjson.JSON
+	functionCtxIn *easyjson.JSON
+	objectCtxIn   *easyjson.JSON
+}
+
+func (ft *FunctionType) debugCaptureNeeded(id string) bool {
+	if _, ok := ft.config.debugSamplingIDs[id]; ok {
+		return true
+	}
+	if ft.config.debugSamplingRate <= 0 {
+		return false
+	}
+	return rand.Float64() < ft.config.debugSamplingRate
+}
+
+// Recorded options carry the invocation's random seed and time, so replaying the sample reproduces them
+func (ft *FunctionType) debugCaptureBegin(id string, contextProcessor *sfPlugins.StatefunContextProcessor, randSeed int64, now time.Time) *debugCaptureSample {
+	if !ft.debugCaptureNeeded(id) {
+		return nil
+	}
+	options := contextProcessor.Options.Clone()
+	options.SetByPath(RandSeedOption, easyjson.NewJSON(randSeed))
+	options.SetByPath(NowOption, easyjson.NewJSON(now.Format(time.RFC3339Nano)))
+	return &debugCaptureSample{
+		time:          system.GetCurrentTimeNs(),
+		caller:        contextProcessor.Caller,
+		payload:       contextProcessor.Payload.Clone().GetPtr(),
+		options:       &options,
+		functionCtxIn: ft.getContext(ft.functionContextKey(id)),
+		objectCtxIn:   ft.getContext(ft.objectContextKey(id)),
+	}
+}
+
+// reply - nil if the function was signaled
+func (ft *FunctionType) debugCaptureEnd(id string, sample *debugCaptureSample, executionTime time.Duration, reply *easyjson.JSON) {
+	if sample == nil {
+		return
+	}
+
+	data := easyjson.NewJSONObject()
+	data.SetByPath("time", easyjson.NewJSON(sample.time))
+	data.SetByPath("typename", easyjson.NewJSON(ft.name))
+	data.SetByPath("id", easyjson.NewJSON(id))
+	data.SetByPath("caller_typename", easyjson.NewJSON(sample.caller.Typename))
+	data.SetByPath("caller_id", easyjson.NewJSON(sample.caller.ID))
+	data.SetByPath("payload", *sample.payload)
+	data.SetByPath("options", *sample.options)
+	data.SetByPath("function_context_before", *sample.functionCtxIn)
+	data.SetByPath("function_context_after", *ft.getContext(ft.functionContextKey(id)))
+	data.SetByPath("object_context_before", *sample.objectCtxIn)
+	data.SetByPath("object_context_after", *ft.getContext(ft.objectContextKey(id)))
+	data.SetByPath("execution_time_us", easyjson.NewJSON(executionTime.Microseconds()))
+	data.SetByPath("requested", easyjson.NewJSON(reply != nil))
+	if reply != nil {
+		data.SetByPath("reply", *reply)
+	}
+
+	nc, _ := ft.runtime.messaging()
+	system.MsgOnErrorReturn(nc.Publish(fmt.Sprintf("%s.%s.%s", ft.runtime.namespacedSubject(DebugCaptureSubjectPrefix), ft.name, id), data.ToBytes()))
+}
+
+func (r *Runtime) createDebugCaptureStreamIfNeeded(js nats.JetStreamContext, existingStreams []string) error {
+	captureNeeded := false
+	for _, ft := range r.registeredFunctionTypes {
+		if ft.config.debugSamplingRate > 0 || len(ft.config.debugSamplingIDs) > 0 {
+			captureNeeded = true
+			break
+		}
+	}
+	if !captureNeeded {
+		return nil
+	}
+
+	streamConfig := &nats.StreamConfig{
+		Name:     r.config.debugCaptureStreamName,
+		Subjects: []string{r.namespacedSubject(DebugCaptureSubjectPrefix) + ".>"},
+		MaxAge:   time.Duration(r.config.debugCaptureTTLSec) * time.Second,
+	}
+	for _, name := range existingStreams {
+		if name == streamConfig.Name {
+			_, err := js.UpdateStream(streamConfig)
+			return err
+		}
+	}
+	_, err := js.AddStream(streamConfig)
+	return err
+}
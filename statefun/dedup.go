@@ -0,0 +1,91 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Deduplication drops signals already handled by the typename's id with the same idempotency key within the window
+(FunctionTypeConfig.SetDeduplication), so redelivered or resent signals do not double-apply non-idempotent handlers.
+The key is taken from the message header or from the message options:
+
+	Foliage-Idempotency-Key: <key>   - NATS header of the signal
+	"__idempotency_key": "<key>"     - option of the signal
+
+A key is recorded durably after the handler returned without a panic, so a signal interrupted by a crash is handled
+again. Requests are not deduplicated. Records older than the window are swept periodically.
+*/
+
+const (
+	IdempotencyKeyHeader = "Foliage-Idempotency-Key"
+	IdempotencyKeyOption = "__idempotency_key"
+	DedupKeyPrefix       = "__dedup"
+
+	dedupSweepInterval = time.Minute
+)
+
+func dedupKey(typename string, id string, idempotencyKey string) string {
+	return DedupKeyPrefix + "." + system.GetHashStr(typename) + "." + system.GetHashStr(id+"."+idempotencyKey)
+}
+
+// Returns the cache key recording the signal's idempotency key, empty if the signal is not deduplicated
+func (ft *FunctionType) dedupKeyOf(id string, msg FunctionTypeMsg, options *easyjson.JSON) string {
+	if ft.config.dedupWindowSec <= 0 || msg.RequestCallback != nil || options == nil {
+		return ""
+	}
+	idempotencyKey, ok := options.GetByPath(IdempotencyKeyOption).AsString()
+	if !ok || len(idempotencyKey) == 0 {
+		return ""
+	}
+	return dedupKey(ft.contextTypename(), id, idempotencyKey)
+}
+
+func (ft *FunctionType) isDuplicate(key string) bool {
+	record, err := ft.runtime.cacheStore.GetValueAsJSON(key)
+	if err != nil {
+		return false
+	}
+	seenAt := int64(record.GetByPath("seen_at").AsNumericDefault(0))
+	return system.GetCurrentTimeNs()-seenAt < int64(ft.config.dedupWindowSec)*int64(time.Second)
+}
+
+func (ft *FunctionType) recordHandled(key string) {
+	record := easyjson.NewJSONObjectWithKeyValue("seen_at", easyjson.NewJSON(system.GetCurrentTimeNs()))
+	system.MsgOnErrorReturn(ft.runtime.systemCache().SetValueDurable(key, record.ToBytes()))
+}
+
+func (r *Runtime) runDedupSweeper() {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("runtime-dedupSweeper")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime-dedupSweeper")
+	for {
+		select {
+		case <-r.stopped:
+			return
+		case <-time.After(dedupSweepInterval):
+		}
+		now := system.GetCurrentTimeNs()
+		swept := 0
+		for _, ft := range r.registeredFunctionTypes {
+			if ft.config.dedupWindowSec <= 0 {
+				continue
+			}
+			for _, key := range r.cacheStore.GetKeysByPattern(DedupKeyPrefix + "." + system.GetHashStr(ft.contextTypename()) + ".*") {
+				record, err := r.cacheStore.GetValueAsJSON(key)
+				if err != nil || now-int64(record.GetByPath("seen_at").AsNumericDefault(0)) >= int64(ft.config.dedupWindowSec)*int64(time.Second) {
+					r.systemCache().DeleteValue(key, true, -1, "")
+					swept++
+				}
+			}
+		}
+		if swept > 0 {
+			lg.Logf(lg.TraceLevel, "Swept %d expired idempotency keys\n", swept)
+		}
+	}
+}
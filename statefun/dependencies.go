@@ -0,0 +1,169 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Dependencies keep a function type from accepting traffic before the typenames it calls are served
+(FunctionTypeConfig.SetDependencies). Start subscribes function types without dependencies first, a function type
+with dependencies is subscribed once all of them are ready, until then its signals wait in JetStream. A dependency is
+ready when it is:
+
+	local  - registered in the runtime and subscribed by its Start
+	remote - the JetStream consumer of its signals has a subscriber (a push consumer is bound or a pull one is fetched)
+
+Unmet dependencies are checked every DependencyCheckInterval, logged every DependencyReportInterval and reported by
+Runtime.UnmetDependencies and the "dependencies" health check, so a stuck boot shows what it waits for.
+Start fails on a dependency cycle among the runtime's function types.
+*/
+
+const (
+	DependencyCheckInterval  = 1 * time.Second
+	DependencyReportInterval = 30 * time.Second
+)
+
+// Function type depending on others subscribes to its sources once they are ready
+func (ft *FunctionType) hasDependencies() bool {
+	return len(ft.config.dependencies) > 0
+}
+
+func (r *Runtime) dependencyReady(typename string) bool {
+	typename = r.resolveAlias(typename)
+	r.sourcesMutex.Lock()
+	ft, ok := r.registeredFunctionTypes[typename]
+	started := ok && ft.sourcesStarted
+	r.sourcesMutex.Unlock()
+	if started {
+		return true
+	}
+
+	_, js := r.messaging()
+	if js == nil {
+		return false
+	}
+	streamName := streamNameOf(r.config.signalSubjectTemplate.pattern(typename))
+	consumerName := strings.ReplaceAll(typename, ".", "")
+	if info, err := js.ConsumerInfo(streamName, consumerName); err == nil && info.PushBound {
+		return true
+	}
+	if info, err := js.ConsumerInfo(streamName, consumerName+"-pull"); err == nil && info.NumWaiting > 0 {
+		return true
+	}
+	return false
+}
+
+func (r *Runtime) unmetDependencies(ft *FunctionType) []string {
+	unmet := []string{}
+	for _, dependency := range ft.config.dependencies {
+		if !r.dependencyReady(dependency) {
+			unmet = append(unmet, dependency)
+		}
+	}
+	return unmet
+}
+
+// UnmetDependencies returns the unmet dependencies of the function types not subscribed yet because of them
+func (r *Runtime) UnmetDependencies() map[string][]string {
+	waiting := []*FunctionType{}
+	r.sourcesMutex.Lock()
+	for _, ft := range r.registeredFunctionTypes {
+		if ft.hasDependencies() && !ft.sourcesStarted && r.servesFunctionType(ft) {
+			waiting = append(waiting, ft)
+		}
+	}
+	r.sourcesMutex.Unlock()
+
+	unmet := map[string][]string{}
+	for _, ft := range waiting {
+		if dependencies := r.unmetDependencies(ft); len(dependencies) > 0 {
+			unmet[ft.name] = dependencies
+		}
+	}
+	return unmet
+}
+
+// Returns an error if function types of the runtime depend on each other in a cycle
+func (r *Runtime) checkDependencyCycles() error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	var visit func(typename string, path []string) error
+	visit = func(typename string, path []string) error {
+		ft, ok := r.registeredFunctionTypes[typename]
+		if !ok {
+			return nil // Remote one
+		}
+		switch state[typename] {
+		case visiting:
+			return fmt.Errorf("error: function type dependency cycle %s", strings.Join(append(path, typename), " -> "))
+		case visited:
+			return nil
+		}
+		state[typename] = visiting
+		path = append(path, typename)
+		for _, dependency := range ft.config.dependencies {
+			if err := visit(r.resolveAlias(dependency), path); err != nil {
+				return err
+			}
+		}
+		state[typename] = visited
+		return nil
+	}
+
+	typenames := make([]string, 0, len(r.registeredFunctionTypes))
+	for typename := range r.registeredFunctionTypes {
+		typenames = append(typenames, typename)
+	}
+	sort.Strings(typenames)
+	for _, typename := range typenames {
+		if err := visit(typename, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subscribes the function type once its dependencies are ready
+func (r *Runtime) startSourcesAfterDependencies(ft *FunctionType) {
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("runtime-dependencies")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime-dependencies")
+		lastReport := time.Now()
+		for {
+			unmet := r.unmetDependencies(ft)
+			if len(unmet) == 0 {
+				break
+			}
+			if time.Since(lastReport) >= DependencyReportInterval {
+				lg.Log(lg.WarnLevel, "Function type waits for its dependencies", "typename", ft.name, "unmet", strings.Join(unmet, ","))
+				lastReport = time.Now()
+			}
+			select {
+			case <-r.stopped:
+				return
+			case <-time.After(DependencyCheckInterval):
+			}
+		}
+
+		r.sourcesMutex.Lock()
+		defer r.sourcesMutex.Unlock()
+		if r.stopping.Load() {
+			return
+		}
+		ft.startSources()
+		ft.sourcesStarted = true
+		lg.Log(lg.TraceLevel, "Function type dependencies are ready, subscribed", "typename", ft.name)
+	}()
+}
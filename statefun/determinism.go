@@ -0,0 +1,52 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"math/rand"
+	"time"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Handlers take randomness and time from StatefunContextProcessor.Rand and Now to be reproducible: the random source
+is seeded per invocation and the time is frozen for it. Both are taken from the message options if set, so an
+invocation is replayed exactly by sending the same message with them (debug captures record both):
+
+	"__rand_seed": <integer>   - seed of Rand, a random one if absent
+	"__now": "<RFC 3339 time>" - time returned by Now (nanoseconds precision), the invocation start if absent
+
+Generated seeds fit into 53 bits, so they survive JSON numbers.
+*/
+
+const (
+	RandSeedOption = "__rand_seed"
+	NowOption      = "__now"
+)
+
+// SetupRandAndNow sets Rand and Now of the context processor from its options, returns the seed and the time used
+func SetupRandAndNow(contextProcessor *sfPlugins.StatefunContextProcessor) (int64, time.Time) {
+	seed, now := rand.Int63()>>10, time.Unix(0, system.GetCurrentTimeNs())
+	if options := contextProcessor.Options; options != nil {
+		if v, ok := options.GetByPath(RandSeedOption).AsNumeric(); ok {
+			seed = int64(v)
+		}
+		if s, ok := options.GetByPath(NowOption).AsString(); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				now = t
+			}
+		}
+	}
+
+	var random *rand.Rand // Created on the first use
+	contextProcessor.Rand = func() *rand.Rand {
+		if random == nil {
+			random = rand.New(rand.NewSource(seed))
+		}
+		return random
+	}
+	contextProcessor.Now = func() time.Time { return now }
+	return seed, now
+}
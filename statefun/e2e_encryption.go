@@ -0,0 +1,246 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/foliagecp/easyjson"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+End-to-end encryption of payloads travelling over NATS between function types declared as peers of each other
+(FunctionTypeConfig.SetE2EEncryptedPeers). Every typename pair has its own AES-256-GCM data key, data keys are
+stored in KV wrapped (encrypted) with the master key only the peer services hold (RuntimeConfig.SetE2EMasterKey),
+so neither the NATS server nor the KV see any plaintext. Rotation adds a new data key version, old versions are
+kept to decrypt messages still in flight.
+
+Encrypted payload replaces the original one:
+
+	{"__e2e": {"kid": "<pair hash>.<version>", "data": "<base64 nonce + ciphertext>"}}
+
+Requests' replies are encrypted the same way.
+*/
+
+const (
+	E2EKeysKeyPrefix = "__e2e_keys"
+	e2ePayloadField  = "__e2e"
+)
+
+var (
+	e2eMasterKeyError        = errors.New("error: e2e master key must be 32 bytes long")
+	e2ePlaintextPayloadError = errors.New("error: plaintext payload from an e2e encrypted peer")
+	e2eMalformedPayloadError = errors.New("error: malformed e2e encrypted payload")
+)
+
+func e2ePairHash(typenameA string, typenameB string) string {
+	pair := []string{typenameA, typenameB}
+	slices.Sort(pair)
+	return system.GetHashStr(pair[0] + "|" + pair[1])
+}
+
+// Payloads from typename to peer must be encrypted
+func (r *Runtime) e2eRequired(typename string, peer string) bool {
+	if ft, ok := r.registeredFunctionTypes[typename]; ok {
+		_, required := ft.config.e2eEncryptedPeers[peer]
+		return required
+	}
+	return false
+}
+
+func (r *Runtime) validateE2EConfig() error {
+	for _, ft := range r.registeredFunctionTypes {
+		if len(ft.config.e2eEncryptedPeers) > 0 && len(r.config.e2eMasterKey) != 32 {
+			return e2eMasterKeyError
+		}
+	}
+	return nil
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func aesGCMSeal(key []byte, plaintext []byte, aad []byte) ([]byte, error) {
+	gcm, err := aesGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func aesGCMOpen(key []byte, sealed []byte, aad []byte) ([]byte, error) {
+	gcm, err := aesGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, e2eMalformedPayloadError
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+// Returns the data key by its id, unwrapping it with the master key
+func (r *Runtime) e2eKeyByID(kid string) ([]byte, error) {
+	if key, ok := r.e2eKeys.Load(kid); ok {
+		return key.([]byte), nil
+	}
+	wrapped, err := r.cacheStore.GetValue(E2EKeysKeyPrefix + "." + kid)
+	if err != nil {
+		return nil, err
+	}
+	key, err := aesGCMOpen(r.config.e2eMasterKey, wrapped, []byte(kid))
+	if err != nil {
+		return nil, err
+	}
+	r.e2eKeys.Store(kid, key)
+	return key, nil
+}
+
+func (r *Runtime) e2eCurrentKeyVersion(pairHash string) int {
+	if v, err := r.cacheStore.GetValue(E2EKeysKeyPrefix + "." + pairHash + ".current"); err == nil {
+		if version, err := strconv.Atoi(string(v)); err == nil {
+			return version
+		}
+	}
+	return 0
+}
+
+// Generates a new data key version for the pair under a global mutex, onlyIfNone - keeps the existing key if any
+func (r *Runtime) e2eNewKey(pairHash string, onlyIfNone bool) error {
+	lockKey := E2EKeysKeyPrefix + "-" + pairHash + "-lock"
+	revID, err := KeyMutexLock(r, lockKey, false)
+	if err != nil {
+		return err
+	}
+	defer func() { system.MsgOnErrorReturn(KeyMutexUnlock(r, lockKey, revID)) }()
+
+	version := r.e2eCurrentKeyVersion(pairHash)
+	if onlyIfNone && version > 0 {
+		return nil
+	}
+	version++
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	kid := fmt.Sprintf("%s.%d", pairHash, version)
+	wrapped, err := aesGCMSeal(r.config.e2eMasterKey, key, []byte(kid))
+	if err != nil {
+		return err
+	}
+	if err := r.systemCache().SetValueDurable(E2EKeysKeyPrefix+"."+kid, wrapped); err != nil {
+		return err
+	}
+	return r.systemCache().SetValueDurable(E2EKeysKeyPrefix+"."+pairHash+".current", []byte(strconv.Itoa(version)))
+}
+
+// RotateE2EKey makes a new data key current for the typename pair, messages encrypted with older keys stay readable
+func (r *Runtime) RotateE2EKey(typenameA string, typenameB string) error {
+	return r.e2eNewKey(e2ePairHash(typenameA, typenameB), false)
+}
+
+func (r *Runtime) e2eEncrypt(from string, to string, payload *easyjson.JSON) (*easyjson.JSON, error) {
+	if payload == nil {
+		payload = easyjson.NewJSONObject().GetPtr()
+	}
+	pairHash := e2ePairHash(from, to)
+	version := r.e2eCurrentKeyVersion(pairHash)
+	if version == 0 {
+		if err := r.e2eNewKey(pairHash, true); err != nil {
+			return nil, err
+		}
+		version = r.e2eCurrentKeyVersion(pairHash)
+	}
+	kid := fmt.Sprintf("%s.%d", pairHash, version)
+	key, err := r.e2eKeyByID(kid)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := aesGCMSeal(key, payload.ToBytes(), []byte(from+">"+to))
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := easyjson.NewJSONObject()
+	encrypted.SetByPath(e2ePayloadField+".kid", easyjson.NewJSON(kid))
+	encrypted.SetByPath(e2ePayloadField+".data", easyjson.NewJSON(base64.StdEncoding.EncodeToString(sealed)))
+	return &encrypted, nil
+}
+
+func isE2EEncrypted(payload *easyjson.JSON) bool {
+	return payload != nil && payload.PathExists(e2ePayloadField)
+}
+
+func (r *Runtime) e2eDecrypt(from string, to string, payload *easyjson.JSON) (*easyjson.JSON, error) {
+	kid, ok1 := payload.GetByPath(e2ePayloadField + ".kid").AsString()
+	data, ok2 := payload.GetByPath(e2ePayloadField + ".data").AsString()
+	if !ok1 || !ok2 || !strings.HasPrefix(kid, e2ePairHash(from, to)+".") {
+		return nil, e2eMalformedPayloadError
+	}
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	key, err := r.e2eKeyByID(kid)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aesGCMOpen(key, sealed, []byte(from+">"+to))
+	if err != nil {
+		return nil, err
+	}
+	decrypted, ok := easyjson.JSONFromBytes(plaintext)
+	if !ok {
+		return nil, e2eMalformedPayloadError
+	}
+	return &decrypted, nil
+}
+
+// Decrypts the payload received by typename from caller, refuses plaintext from peers which must encrypt
+func (r *Runtime) e2eReceive(caller string, typename string, payload *easyjson.JSON) (*easyjson.JSON, error) {
+	if isE2EEncrypted(payload) {
+		return r.e2eDecrypt(caller, typename, payload)
+	}
+	if r.e2eRequired(typename, caller) {
+		return nil, e2ePlaintextPayloadError
+	}
+	return payload, nil
+}
+
+// Serializes the reply of the function type to the caller, encrypted if they are peers
+func (ft *FunctionType) e2eReplyBytes(caller string, reply *easyjson.JSON) []byte {
+	encrypted, err := ft.runtime.e2eSend(ft.name, caller, reply)
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Cannot encrypt reply of %s to %s: %s\n", ft.name, caller, err)
+		return []byte{}
+	}
+	return encrypted.ToBytes()
+}
+
+// Encrypts the payload sent by typename to target if they are peers
+func (r *Runtime) e2eSend(typename string, target string, payload *easyjson.JSON) (*easyjson.JSON, error) {
+	if r.e2eRequired(typename, target) {
+		return r.e2eEncrypt(typename, target, payload)
+	}
+	return payload, nil
+}
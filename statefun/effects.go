@@ -0,0 +1,117 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"errors"
+
+	"github.com/foliagecp/easyjson"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Effect log keeps a record for every external side effect (HTTP call, email, etc.) of a stateful function:
+the record is durably written as "pending" before the effect is executed and as "done" after it succeeded,
+so a redelivered message skips effects which were already executed. Records left "pending" by a crash are
+resolved on runtime start by the function type's EffectRecoveryHandler.
+*/
+
+const (
+	EffectLogKeyPrefix = "__effects"
+
+	effectStatusPending = "pending"
+	effectStatusDone    = "done"
+)
+
+var (
+	effectPendingError = errors.New("error: effect is pending and was not resolved by recovery")
+)
+
+type PendingEffect struct {
+	Typename  string
+	ID        string
+	EffectID  string
+	StartedAt int64 // ns
+}
+
+// Decides whether a pending effect found on runtime start was actually executed (e.g. by checking the external system).
+// true - effect is marked done and will be skipped, false - effect record is removed and the effect will be executed again on redelivery
+type EffectRecoveryHandler func(effect PendingEffect) (executed bool)
+
+func effectLogKey(typename string, id string, effectID string) string {
+	return EffectLogKeyPrefix + "." + system.GetHashStr(typename+"."+id+"."+effectID)
+}
+
+func effectRecord(typename string, id string, effectID string, status string, startedAt int64) *easyjson.JSON {
+	record := easyjson.NewJSONObject()
+	record.SetByPath("typename", easyjson.NewJSON(typename))
+	record.SetByPath("id", easyjson.NewJSON(id))
+	record.SetByPath("effect_id", easyjson.NewJSON(effectID))
+	record.SetByPath("status", easyjson.NewJSON(status))
+	record.SetByPath("started_at", easyjson.NewJSON(startedAt))
+	return &record
+}
+
+// Executes effect only if effect with the same effectID was not executed by this typename's id before
+func (ft *FunctionType) runEffectOnce(id string, effectID string, effect func() error) error {
+	key := effectLogKey(ft.name, id, effectID)
+	if record, err := ft.runtime.cacheStore.GetValueAsJSON(key); err == nil {
+		switch record.GetByPath("status").AsStringDefault("") {
+		case effectStatusDone:
+			lg.Log(lg.TraceLevel, "Effect is already done, skipping", "effect", effectID, "typename", ft.name, "id", id)
+			return nil
+		case effectStatusPending:
+			return effectPendingError
+		}
+	}
+
+	startedAt := system.GetCurrentTimeNs()
+	if err := ft.runtime.systemCache().SetValueDurable(key, effectRecord(ft.name, id, effectID, effectStatusPending, startedAt).ToBytes()); err != nil {
+		return err
+	}
+
+	if err := effect(); err != nil {
+		// Effect failed, its execution can be safely retried
+		ft.runtime.systemCache().DeleteValue(key, true, -1, "")
+		return err
+	}
+
+	return ft.runtime.systemCache().SetValueDurable(key, effectRecord(ft.name, id, effectID, effectStatusDone, startedAt).ToBytes())
+}
+
+// Resolves pending effects left after the previous run, removes done records older than effect log record lifetime
+func (r *Runtime) recoverEffectLog() {
+	now := system.GetCurrentTimeNs()
+	for _, key := range r.cacheStore.GetKeysByPattern(EffectLogKeyPrefix + ".*") {
+		record, err := r.cacheStore.GetValueAsJSON(key)
+		if err != nil {
+			continue
+		}
+		effect := PendingEffect{
+			Typename:  record.GetByPath("typename").AsStringDefault(""),
+			ID:        record.GetByPath("id").AsStringDefault(""),
+			EffectID:  record.GetByPath("effect_id").AsStringDefault(""),
+			StartedAt: int64(record.GetByPath("started_at").AsNumericDefault(0)),
+		}
+
+		switch record.GetByPath("status").AsStringDefault("") {
+		case effectStatusDone:
+			if now-effect.StartedAt > int64(r.config.effectLogRecordLifetimeSec)*1000000000 {
+				r.systemCache().DeleteValue(key, true, -1, "")
+			}
+		case effectStatusPending:
+			executed := true
+			if ft, ok := r.registeredFunctionTypes[effect.Typename]; ok && ft.config.effectRecoveryHandler != nil {
+				executed = ft.config.effectRecoveryHandler(effect)
+			} else {
+				lg.Log(lg.WarnLevel, "Effect was interrupted and has no recovery handler, considering it done", "effect", effect.EffectID, "typename", effect.Typename, "id", effect.ID)
+			}
+			if executed {
+				system.MsgOnErrorReturn(r.systemCache().SetValueDurable(key, effectRecord(effect.Typename, effect.ID, effect.EffectID, effectStatusDone, effect.StartedAt).ToBytes()))
+			} else {
+				r.systemCache().DeleteValue(key, true, -1, "")
+			}
+		}
+	}
+}
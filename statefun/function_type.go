@@ -3,6 +3,7 @@
 package statefun
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"sync"
@@ -10,10 +11,12 @@ import (
 	"time"
 
 	lg "github.com/foliagecp/sdk/statefun/logger"
-	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
 
+	"github.com/foliagecp/sdk/statefun/cache"
 	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
 	"github.com/foliagecp/sdk/statefun/system"
 )
@@ -26,19 +29,35 @@ type FunctionType struct {
 	subject                 string
 	config                  FunctionTypeConfig
 	logicHandler            FunctionLogicHandler
+	interceptors            []Interceptor
+	handler                 FunctionLogicHandler // logicHandler wrapped by interceptors
+	ingressTransformation   *compiledIngressTransformation
 	idKeyMutex              system.KeyMutex
 	idHandlersChannel       sync.Map
 	idHandlersLastMsgTime   sync.Map
+	idHandlersDone          sync.Map // id -> chan closed when the id's handler routine exits, per-id ordering only
 	executor                *sfPlugins.TypenameExecutorPlugin
+	executorFile            string // Set by SetExecutorFile, reread by empty source reloads
 	instancesControlChannel chan struct{}
 	resourceMutex           sync.Mutex
+
+	childTasksControlChannel chan struct{}
+	workersControlChannel    chan struct{}
+	workersWaiting           priorityWaiting
+	slo                      sloState
+	handledCount             atomic.Uint64
+	failedCount              atomic.Uint64
+	microService             micro.Service
+	subscriptions            []*nats.Subscription
+	sourcesStarted           bool
+	msgAckChannel            chan *nats.Msg
 }
 
 func NewFunctionType(runtime *Runtime, name string, logicHandler FunctionLogicHandler, config FunctionTypeConfig) *FunctionType {
 	ft := &FunctionType{
 		runtime:                 runtime,
 		name:                    name,
-		subject:                 name + ".*",
+		subject:                 runtime.config.signalSubjectTemplate.pattern(name),
 		logicHandler:            logicHandler,
 		idKeyMutex:              system.NewKeyMutex(),
 		config:                  config,
@@ -47,6 +66,12 @@ func NewFunctionType(runtime *Runtime, name string, logicHandler FunctionLogicHa
 	if config.maxIdHandlers > 0 {
 		ft.instancesControlChannel = make(chan struct{}, config.maxIdHandlers)
 	}
+	if config.maxChildTasks > 0 {
+		ft.childTasksControlChannel = make(chan struct{}, config.maxChildTasks)
+	}
+	if config.maxParallelHandlers > 0 {
+		ft.workersControlChannel = make(chan struct{}, config.maxParallelHandlers)
+	}
 	runtime.registeredFunctionTypes[ft.name] = ft
 	return ft
 }
@@ -55,6 +80,7 @@ func NewFunctionType(runtime *Runtime, name string, logicHandler FunctionLogicHa
 
 func (ft *FunctionType) SetExecutor(alias string, content string, constructor func(alias string, source string) sfPlugins.StatefunExecutor) error {
 	ft.executor = sfPlugins.NewTypenameExecutor(alias, content, constructor)
+	ft.executor.EnablePool(ft.config.executorPoolSize)
 	return nil
 }
 
@@ -99,7 +125,11 @@ func (ft *FunctionType) sendMsg(id string, msg FunctionTypeMsg) {
 
 		msgChannel = make(chan FunctionTypeMsg, ft.config.msgChannelSize)
 
-		go ft.idHandlerRoutine(id, msgChannel)
+		if ft.config.orderedPerID {
+			ft.startOrderedIDHandlerRoutine(id, msgChannel)
+		} else {
+			go ft.idHandlerRoutine(id, msgChannel)
+		}
 		ft.idHandlersChannel.Store(id, msgChannel)
 		if ft.executor != nil {
 			ft.executor.AddForID(id)
@@ -131,19 +161,48 @@ func (ft *FunctionType) sendMsg(id string, msg FunctionTypeMsg) {
 func (ft *FunctionType) idHandlerRoutine(id string, msgChannel chan FunctionTypeMsg) {
 	system.GlobalPrometrics.GetRoutinesCounter().Started("functiontype-idHandlerRoutine")
 	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("functiontype-idHandlerRoutine")
+	ft.migrateLegacyContexts(id)
 	typenameIDContextProcessor := sfPlugins.StatefunContextProcessor{
 		GlobalCache:        ft.runtime.cacheStore,
-		GetFunctionContext: func() *easyjson.JSON { return ft.getContext(ft.name + "." + id) },
-		SetFunctionContext: func(context *easyjson.JSON) { ft.setContext(ft.name+"."+id, context) },
-		GetObjectContext:   func() *easyjson.JSON { return ft.getContext(id) },
-		SetObjectContext:   func(context *easyjson.JSON) { ft.setContext(id, context) },
-		Self:               sfPlugins.StatefunAddress{Typename: ft.name, ID: id},
+		GetFunctionContext: func() *easyjson.JSON { return ft.getContext(ft.functionContextKey(id)) },
+		SetFunctionContext: func(context *easyjson.JSON) { ft.setContext(ft.functionContextKey(id), context) },
+		GetObjectContext:   func() *easyjson.JSON { return ft.getContext(ft.objectContextKey(id)) },
+		SetObjectContext:   func(context *easyjson.JSON) { ft.setContext(ft.objectContextKey(id), context) },
+		GetObjectContextWithRevision: func() (*easyjson.JSON, uint64) {
+			return getContextWithRevision(ft.runtime.cacheStore, ft.objectContextKey(id))
+		},
+		SetObjectContextIfRevision: func(context *easyjson.JSON, revision uint64) (uint64, error) {
+			return setContextIfRevision(ft.runtime.cacheStore, ft.objectContextKey(id), context, revision)
+		},
+		Self: sfPlugins.StatefunAddress{Typename: ft.name, ID: id},
 		Signal: func(signalProvider sfPlugins.SignalProvider, targetTypename string, targetID string, j *easyjson.JSON, o *easyjson.JSON) error {
 			return ft.runtime.signal(signalProvider, ft.name, id, targetTypename, targetID, j, o)
 		},
 		Request: func(requestProvider sfPlugins.RequestProvider, targetTypename string, targetID string, j *easyjson.JSON, o *easyjson.JSON) (*easyjson.JSON, error) {
 			return ft.runtime.request(requestProvider, ft.name, id, targetTypename, targetID, j, o)
 		},
+		Broadcast: func(signalProvider sfPlugins.SignalProvider, targetTypename string, targetIDs []string, j *easyjson.JSON, o *easyjson.JSON) error {
+			return ft.runtime.broadcast(signalProvider, ft.name, id, targetTypename, targetIDs, j, o)
+		},
+		Go: func(task func(ctx context.Context)) error {
+			return ft.goChildTask(id, task)
+		},
+		Effect: func(effectID string, effect func() error) error {
+			return ft.runEffectOnce(id, effectID, effect)
+		},
+		SaveCheckpoint: func(name string, data []byte) error {
+			return ft.saveCheckpoint(id, name, data)
+		},
+		LoadCheckpoint: func(name string) ([]byte, error) {
+			return ft.loadCheckpoint(id, name)
+		},
+		ScheduleSignal: func(timerID string, at time.Time, provider sfPlugins.SignalProvider, targetTypename string, targetID string, j *easyjson.JSON, o *easyjson.JSON) error {
+			return ft.scheduleSignal(id, timerID, at, provider, targetTypename, targetID, j, o)
+		},
+		CancelTimer: func(timerID string) {
+			ft.cancelTimer(id, timerID)
+		},
+		Nats: ft.newNatsFacade(),
 		// To be assigned later:
 		// Call: ...
 		// Payload: ...
@@ -151,14 +210,55 @@ func (ft *FunctionType) idHandlerRoutine(id string, msgChannel chan FunctionType
 		// Caller: ...
 	}
 
+	idRateLimiter := newIDRateLimiter(ft.config.idRateLimitPerSec, ft.config.idRateLimitBurst)
 	for msg := range msgChannel {
-		ft.handleMsgForID(id, msg, &typenameIDContextProcessor)
+		ft.runtime.handlersBusy.Add(1)
+		if idRateLimiter == nil {
+			ft.handleMsgForIDOnWorker(id, msg, &typenameIDContextProcessor)
+		} else {
+			for _, m := range ft.applyIDRateLimit(id, idRateLimiter, msg, msgChannel) {
+				ft.handleMsgForIDOnWorker(id, m, &typenameIDContextProcessor)
+			}
+		}
+		ft.runtime.handlersBusy.Add(-1)
 	}
 	if ft.instancesControlChannel != nil {
 		<-ft.instancesControlChannel
 	}
 }
 
+// Acks a message whose payload cannot be handled, requests get the "failed" reply
+func (ft *FunctionType) refuseMsg(id string, msg FunctionTypeMsg, kind string, err error) {
+	lg.Log(lg.ErrorLevel, "Refusing message", "typename", ft.name, "id", id, "error", err)
+	if msg.AckCallback != nil {
+		msg.AckCallback(true) // Redelivery won't make the payload valid
+	}
+	if msg.RequestCallback != nil {
+		reply := easyjson.NewJSONObject()
+		reply.SetByPath("status", easyjson.NewJSON("failed"))
+		reply.SetByPath("result", easyjson.NewJSON(err.Error()))
+		msg.RequestCallback(&reply)
+	}
+	ft.runtime.recordError(ft.name, id, kind, err.Error())
+	ft.handledCount.Add(1)
+	ft.failedCount.Add(1)
+	ft.recordSLO(0, true)
+}
+
+// Waits for a free worker of the typename's pool if the pool is limited
+func (ft *FunctionType) handleMsgForIDOnWorker(id string, msg FunctionTypeMsg, typenameIDContextProcessor *sfPlugins.StatefunContextProcessor) {
+	unlock, ok := ft.lockOrderedID(id, msg)
+	if !ok {
+		return
+	}
+	defer unlock()
+	if ft.workersControlChannel != nil {
+		ft.acquireWorker(msg)
+		defer func() { <-ft.workersControlChannel }()
+	}
+	ft.handleMsgForID(id, msg, typenameIDContextProcessor)
+}
+
 func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameIDContextProcessor *sfPlugins.StatefunContextProcessor) {
 	/*var lockRevisionID uint64 = 0
 
@@ -191,27 +291,47 @@ func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameI
 			cancelReplyIfExists()
 			replyDataChannel <- data // Put new value
 		}
+		ft.prepareReply(&msg, typenameIDContextProcessor.Reply, replyDataChannel)
 	}
 
 	typenameIDContextProcessor.Payload = msg.Payload
 	if typenameIDContextProcessor.Payload == nil {
 		typenameIDContextProcessor.Payload = easyjson.NewJSONObject().GetPtr()
 	}
+	payload, err := ft.transformPayload(typenameIDContextProcessor.Payload, msg.Caller)
+	if err != nil {
+		ft.refuseMsg(id, msg, "ingress_transformation", err)
+		return
+	}
+	typenameIDContextProcessor.Payload = payload
+	if err := ft.checkPayloadSchema(id, typenameIDContextProcessor.Payload); err != nil {
+		ft.refuseMsg(id, msg, "payload_schema", err)
+		return
+	}
 	ft.resourceMutex.Lock()
 	typenameIDContextProcessor.Options = ft.config.options.Clone().GetPtr()
 	ft.resourceMutex.Unlock()
 	if msg.Options != nil {
 		typenameIDContextProcessor.Options.DeepMerge(*msg.Options)
 	}
+	dedupKey := ft.dedupKeyOf(id, msg, typenameIDContextProcessor.Options)
+	if len(dedupKey) > 0 && ft.isDuplicate(dedupKey) {
+		lg.Log(lg.TraceLevel, "Dropping duplicate signal", "typename", ft.name, "id", id)
+		if msg.AckCallback != nil {
+			msg.AckCallback(true)
+		}
+		return
+	}
+	randSeed, now := SetupRandAndNow(typenameIDContextProcessor)
 	typenameIDContextProcessor.Caller = *msg.Caller
 
 	typenameIDContextProcessor.ObjectMutexLock = func(errorOnLocked bool) error {
 		lockId := fmt.Sprintf("%s-lock", id)
 		revId, err := KeyMutexLock(ft.runtime, lockId, errorOnLocked)
 		if err == nil {
-			objCtx := ft.getContext(lockId)
+			objCtx := ft.getContext(ft.objectContextKey(lockId))
 			objCtx.SetByPath("__lock_rev_id", easyjson.NewJSON(revId))
-			ft.setContext(lockId, objCtx)
+			ft.setContext(ft.objectContextKey(lockId), objCtx)
 			return nil
 		}
 		return err
@@ -219,7 +339,7 @@ func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameI
 	typenameIDContextProcessor.ObjectMutexUnlock = func() error {
 		lockId := fmt.Sprintf("%s-lock", id)
 
-		objCtx := ft.getContext(lockId)
+		objCtx := ft.getContext(ft.objectContextKey(lockId))
 		v, ok := objCtx.GetByPath("__lock_rev_id").AsNumeric()
 		if !ok {
 			return fmt.Errorf("object:%s was not locked", lockId)
@@ -230,37 +350,74 @@ func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameI
 		if err != nil {
 			return err
 		}
-		ft.runtime.cacheStore.DeleteValue(lockId, true, -1, "")
+		ft.runtime.cacheStore.DeleteValue(ft.objectContextKey(lockId), true, -1, "")
 		return nil
 	}
 
+	if ft.config.jsonPathMetrics {
+		typenameIDContextProcessor.JSONPathMetrics = sfPlugins.NewJSONPathMetrics()
+	}
+
+	debugSample := ft.debugCaptureBegin(id, typenameIDContextProcessor, randSeed, now)
 	start := time.Now()
 
 	// Calling typename handler function --------------------
+	var executor sfPlugins.StatefunExecutor
+	releaseExecutor := func() {}
 	if ft.executor != nil {
-		ft.logicHandler(ft.executor.GetForID(id), typenameIDContextProcessor)
-	} else {
-		ft.logicHandler(nil, typenameIDContextProcessor)
+		executor, releaseExecutor = ft.executor.AcquireForID(id)
+	}
+	panicErr := ft.callHandlerWithPanicRecovery(id, executor, typenameIDContextProcessor)
+	releaseExecutor()
+	if panicErr != nil && msg.RequestCallback != nil {
+		reply := easyjson.NewJSONObject()
+		reply.SetByPath("status", easyjson.NewJSON("failed"))
+		reply.SetByPath("result", easyjson.NewJSON(panicErr.Error()))
+		typenameIDContextProcessor.Reply.With(&reply)
 	}
 	// -------------------------------------------------------
+	var debugReply *easyjson.JSON = nil
+	if debugSample != nil && msg.RequestCallback != nil {
+		select { // Peeking the reply, the channel is buffered for a single value
+		case debugReply = <-replyDataChannel:
+			replyDataChannel <- debugReply
+		default:
+		}
+	}
+	ft.debugCaptureEnd(id, debugSample, time.Since(start), debugReply)
+	ft.reportJSONPathMetrics(id, typenameIDContextProcessor.JSONPathMetrics)
 
+	executionTime := time.Since(start)
+	ft.runtime.metrics.observeLatency(ft.name, executionTime)
 	measureName := fmt.Sprintf("%s_execution_time", strings.ReplaceAll(ft.name, ".", ""))
-	if gaugeVec, err := system.GlobalPrometrics.EnsureGaugeVecSimple(measureName, "", []string{"id"}); err == nil {
-		gaugeVec.With(prometheus.Labels{"id": id}).Set(float64(time.Since(start).Microseconds()))
-	}
+	system.Metrics().SetGauge(measureName, "", map[string]string{"id": id}, float64(executionTime.Microseconds()))
 
+	if len(dedupKey) > 0 && panicErr == nil {
+		ft.recordHandled(dedupKey)
+	}
 	if msg.AckCallback != nil {
 		msg.AckCallback(true)
 	}
+	failed := panicErr != nil
 	if msg.RequestCallback != nil {
 		var replyData *easyjson.JSON = nil
 		select {
 		case replyData = <-replyDataChannel:
 		case <-time.After(time.Duration(ft.runtime.config.requestTimeoutSec) * time.Second):
+			replyData = easyjson.NewJSONObject().GetPtr()
 			replyData.SetByPath("status", easyjson.NewJSON("timeout"))
 		}
 		msg.RequestCallback(replyData)
+		if replyData != nil {
+			status, _ := replyData.GetByPath("status").AsString()
+			failed = status == "failed" || status == "timeout"
+		}
 	}
+	ft.handledCount.Add(1)
+	if failed {
+		ft.failedCount.Add(1)
+	}
+	ft.recordSLO(executionTime, failed)
 
 	/*if !ft.config.balanceNeeded { // Use context mutex lock if function type is not typename balanced
 		system.MsgOnErrorReturn(ContextMutexUnlock(ft, id, lockRevisionID))
@@ -307,6 +464,40 @@ func (ft *FunctionType) gc(typenameIDLifetimeMs int) (garbageCollected int, hand
 	return
 }
 
+// Cache key of the id's function context, the id is a single token whatever it holds if the cache's codec allows
+func (ft *FunctionType) functionContextKey(id string) string {
+	return ft.contextTypename() + "." + ft.runtime.cacheStore.IDToken(id)
+}
+
+// Cache key of the id's object context
+func (ft *FunctionType) objectContextKey(id string) string {
+	return ft.runtime.cacheStore.IDToken(id)
+}
+
+// Contexts of ids holding "." or "\" were stored under the id as is (split into several tokens) before ids became
+// single tokens with a key codec set, they are moved to their current keys when the id's handler starts
+func (ft *FunctionType) migrateLegacyContexts(id string) {
+	if ft.objectContextKey(id) == id {
+		return
+	}
+	ft.migrateLegacyContext(ft.contextTypename()+"."+id, ft.functionContextKey(id))
+	ft.migrateLegacyContext(id, ft.objectContextKey(id))
+}
+
+func (ft *FunctionType) migrateLegacyContext(legacyKey string, key string) {
+	cacheStore := ft.runtime.cacheStore
+	if _, err := cacheStore.GetValue(key); err == nil {
+		return // Already moved or written anew
+	}
+	value, err := cacheStore.GetValue(legacyKey)
+	if err != nil {
+		return
+	}
+	cacheStore.SetValue(key, value, true, -1, "")
+	cacheStore.DeleteValue(legacyKey, true, -1, "")
+	lg.Logf(lg.InfoLevel, "Context moved from legacy key=%s to key=%s\n", legacyKey, key)
+}
+
 func (ft *FunctionType) getContext(keyValueID string) *easyjson.JSON {
 	if j, err := ft.runtime.cacheStore.GetValueAsJSON(keyValueID); err == nil {
 		return j
@@ -315,6 +506,25 @@ func (ft *FunctionType) getContext(keyValueID string) *easyjson.JSON {
 	return &j
 }
 
+// Context with the KV revision of its key, an empty one if it does not exist
+func getContextWithRevision(cacheStore *cache.Store, keyValueID string) (*easyjson.JSON, uint64) {
+	value, revision, err := cacheStore.GetValueWithKVRevision(keyValueID)
+	if err == nil {
+		if j, ok := easyjson.JSONFromBytes(value); ok {
+			return &j, revision
+		}
+	}
+	return easyjson.NewJSONObject().GetPtr(), revision
+}
+
+func setContextIfRevision(cacheStore *cache.Store, keyValueID string, context *easyjson.JSON, revision uint64) (uint64, error) {
+	var value []byte
+	if context != nil {
+		value = context.ToBytes()
+	}
+	return cacheStore.SetValueIfKVRevision(keyValueID, value, revision)
+}
+
 func (ft *FunctionType) setContext(keyValueID string, context *easyjson.JSON) {
 	if context == nil {
 		ft.runtime.cacheStore.SetValue(keyValueID, nil, true, -1, "")
@@ -323,6 +533,7 @@ func (ft *FunctionType) setContext(keyValueID string, context *easyjson.JSON) {
 	}
 }
 
-func (ft *FunctionType) getStreamName() string {
-	return fmt.Sprintf("%s_stream", system.GetHashStr(ft.subject))
+// Each signal subject of a function type has its own stream
+func streamNameOf(subject string) string {
+	return fmt.Sprintf("%s_stream", system.GetHashStr(subject))
 }
@@ -12,6 +12,8 @@ const (
 	MutexLifetimeSec         = 120
 	MultipleInstancesAllowed = false
 	MaxIdHandlers            = 20
+	DebugSamplingRate        = 0.0
+	MaxChildTasks            = 20
 )
 
 type FunctionTypeConfig struct {
@@ -20,11 +22,45 @@ type FunctionTypeConfig struct {
 	msgAckChannelSize int
 	balanceNeeded     bool
 	//balanced                 bool
-	serviceActive            bool
-	mutexLifeTimeSec         int
-	options                  *easyjson.JSON
-	multipleInstancesAllowed bool
-	maxIdHandlers            int
+	serviceActive             bool
+	mutexLifeTimeSec          int
+	options                   *easyjson.JSON
+	multipleInstancesAllowed  bool
+	maxIdHandlers             int
+	debugSamplingRate         float64
+	debugSamplingIDs          map[string]struct{}
+	idRateLimitPerSec         float64
+	idRateLimitBurst          int
+	idRateLimitPolicy         IDRateLimitOverflowPolicy
+	maxChildTasks             int
+	effectRecoveryHandler     EffectRecoveryHandler
+	jsonPathMetrics           bool
+	jsonPathWarnOps           int
+	microServiceActive        bool
+	microServiceVersion       string
+	microServiceDescription   string
+	microServiceMetadata      map[string]string
+	microServiceRequestSchema string
+	microServiceReplySchema   string
+	payloadSchema             *easyjson.JSON
+	payloadSchemaVersion      int
+	payloadSchemaStrict       bool
+	e2eEncryptedPeers         map[string]struct{}
+	maxParallelHandlers       int
+	pullConsumerMaxPending    int
+	slo                       *SLO
+	panicRetries              int
+	poisonMessagePolicy       PoisonMessagePolicy
+	ingressTransformation     *IngressTransformation
+	natsPublishSubjects       []string
+	natsReadStreams           []string
+	dedupWindowSec            int
+	priorityLanes             bool
+	lowLaneMaxPending         int
+	dependencies              []string
+	orderedPerID              bool
+	maxDeliveries             int
+	executorPoolSize          int
 }
 
 func NewFunctionTypeConfig() *FunctionTypeConfig {
@@ -37,6 +73,10 @@ func NewFunctionTypeConfig() *FunctionTypeConfig {
 		options:                  easyjson.NewJSONObject().GetPtr(),
 		multipleInstancesAllowed: MultipleInstancesAllowed,
 		maxIdHandlers:            MaxIdHandlers,
+		debugSamplingRate:        DebugSamplingRate,
+		debugSamplingIDs:         map[string]struct{}{},
+		maxChildTasks:            MaxChildTasks,
+		microServiceVersion:      MicroServiceVersion,
 	}
 }
 
@@ -86,3 +126,163 @@ func (ftc *FunctionTypeConfig) SetMaxIdHandlers(maxIdHandlers int) *FunctionType
 	ftc.maxIdHandlers = maxIdHandlers
 	return ftc
 }
+
+// Share of invocations (0.0 - none, 1.0 - all) whose payload and contexts are captured to the debug stream
+func (ftc *FunctionTypeConfig) SetDebugSamplingRate(debugSamplingRate float64) *FunctionTypeConfig {
+	ftc.debugSamplingRate = debugSamplingRate
+	return ftc
+}
+
+// All invocations for these ids are captured to the debug stream regardless of the sampling rate
+func (ftc *FunctionTypeConfig) SetDebugSamplingIDs(ids ...string) *FunctionTypeConfig {
+	ftc.debugSamplingIDs = map[string]struct{}{}
+	for _, id := range ids {
+		ftc.debugSamplingIDs[id] = struct{}{}
+	}
+	return ftc
+}
+
+// Limits the rate of messages handled for each id of the typename, ratePerSec <= 0 disables the limit
+func (ftc *FunctionTypeConfig) SetIDRateLimit(ratePerSec float64, burst int, policy IDRateLimitOverflowPolicy) *FunctionTypeConfig {
+	ftc.idRateLimitPerSec = ratePerSec
+	ftc.idRateLimitBurst = burst
+	ftc.idRateLimitPolicy = policy
+	return ftc
+}
+
+// Limits child tasks started via StatefunContextProcessor.Go running at once for the typename, <= 0 - no limit
+func (ftc *FunctionTypeConfig) SetMaxChildTasks(maxChildTasks int) *FunctionTypeConfig {
+	ftc.maxChildTasks = maxChildTasks
+	return ftc
+}
+
+// Resolves effects of the typename left pending by a crash, called on runtime start before messages are handled
+func (ftc *FunctionTypeConfig) SetEffectRecoveryHandler(effectRecoveryHandler EffectRecoveryHandler) *FunctionTypeConfig {
+	ftc.effectRecoveryHandler = effectRecoveryHandler
+	return ftc
+}
+
+// Enables JSONPathMetrics in the context processor, invocations doing more than warnOps path operations
+// on a single document are logged (warnOps <= 0 - never)
+func (ftc *FunctionTypeConfig) SetJSONPathMetrics(enabled bool, warnOps int) *FunctionTypeConfig {
+	ftc.jsonPathMetrics = enabled
+	ftc.jsonPathWarnOps = warnOps
+	return ftc
+}
+
+// Serves requests of an active service (see SetServiceState) as a NATS micro service, version must be SemVer
+func (ftc *FunctionTypeConfig) SetMicroService(active bool, version string, description string, metadata map[string]string) *FunctionTypeConfig {
+	ftc.microServiceActive = active
+	ftc.microServiceVersion = version
+	ftc.microServiceDescription = description
+	ftc.microServiceMetadata = metadata
+	return ftc
+}
+
+// Request and reply schemas (e.g. JSON Schema documents) published in the micro service endpoint metadata
+func (ftc *FunctionTypeConfig) SetMicroServiceSchema(requestSchema string, replySchema string) *FunctionTypeConfig {
+	ftc.microServiceRequestSchema = requestSchema
+	ftc.microServiceReplySchema = replySchema
+	return ftc
+}
+
+// Registers the payload schema version of the typename in the schema registry on runtime start,
+// strict - refuse messages whose payload does not match the schema instead of logging them. A nil schema clears it
+func (ftc *FunctionTypeConfig) SetPayloadSchema(version int, schema *easyjson.JSON, strict bool) *FunctionTypeConfig {
+	ftc.payloadSchemaVersion = version
+	ftc.payloadSchema = nil
+	if schema != nil {
+		ftc.payloadSchema = schema.Clone().GetPtr()
+	}
+	ftc.payloadSchemaStrict = strict
+	return ftc
+}
+
+// Payloads exchanged over NATS with these typenames are end-to-end encrypted, plaintext ones from them are refused.
+// Peers must declare each other and share the runtime E2E master key
+func (ftc *FunctionTypeConfig) SetE2EEncryptedPeers(typenames ...string) *FunctionTypeConfig {
+	ftc.e2eEncryptedPeers = map[string]struct{}{}
+	for _, typename := range typenames {
+		ftc.e2eEncryptedPeers[typename] = struct{}{}
+	}
+	return ftc
+}
+
+// Limits messages of the typename handled at once across all its ids to a pool of maxParallelHandlers workers,
+// so a hot typename cannot take all the runtime's CPU; <= 0 - no limit
+func (ftc *FunctionTypeConfig) SetMaxParallelHandlers(maxParallelHandlers int) *FunctionTypeConfig {
+	ftc.maxParallelHandlers = maxParallelHandlers
+	return ftc
+}
+
+// Signals are pulled from JetStream only while fewer than maxPending of them are handled or wait for a handler,
+// a saturated runtime leaves the rest to other runtimes; <= 0 - signals are pushed as they come
+func (ftc *FunctionTypeConfig) SetPullConsumer(maxPending int) *FunctionTypeConfig {
+	ftc.pullConsumerMaxPending = maxPending
+	return ftc
+}
+
+// Evaluates the typename's latency and error rate objectives, breaches are alerted as RuntimeConfig sets up
+func (ftc *FunctionTypeConfig) SetSLO(slo SLO) *FunctionTypeConfig {
+	ftc.slo = &slo
+	return ftc
+}
+
+// A handler panicking is called again up to retries times, then the message is handled as the policy says
+func (ftc *FunctionTypeConfig) SetPanicRecovery(retries int, policy PoisonMessagePolicy) *FunctionTypeConfig {
+	ftc.panicRetries = retries
+	ftc.poisonMessagePolicy = policy
+	return ftc
+}
+
+// Reshapes incoming payloads before the schema check and the handler, expressions are compiled on runtime start
+func (ftc *FunctionTypeConfig) SetIngressTransformation(transformation IngressTransformation) *FunctionTypeConfig {
+	ftc.ingressTransformation = &transformation
+	return ftc
+}
+
+// Subject patterns handlers may publish to and streams they may read through StatefunContextProcessor.Nats
+func (ftc *FunctionTypeConfig) SetNatsAccess(publishSubjects []string, readStreams []string) *FunctionTypeConfig {
+	ftc.natsPublishSubjects = publishSubjects
+	ftc.natsReadStreams = readStreams
+	return ftc
+}
+
+// Drops signals with an idempotency key already handled by the id within the window (see dedup.go), 0 - disabled
+func (ftc *FunctionTypeConfig) SetDeduplication(windowSec int) *FunctionTypeConfig {
+	ftc.dedupWindowSec = windowSec
+	return ftc
+}
+
+// High and low priority lanes of signals next to the normal one (see priority_lanes.go),
+// lowLaneMaxPending > 0 bounds low signals pending at once
+func (ftc *FunctionTypeConfig) SetPriorityLanes(enabled bool, lowLaneMaxPending int) *FunctionTypeConfig {
+	ftc.priorityLanes = enabled
+	ftc.lowLaneMaxPending = lowLaneMaxPending
+	return ftc
+}
+
+// Typenames the function type calls, its sources are subscribed once they are served (see dependencies.go)
+func (ftc *FunctionTypeConfig) SetDependencies(typenames ...string) *FunctionTypeConfig {
+	ftc.dependencies = typenames
+	return ftc
+}
+
+// Guarantees messages of the same id are handled serially across routines and runtimes (see ordered_ids.go)
+func (ftc *FunctionTypeConfig) SetOrderedPerID(enabled bool) *FunctionTypeConfig {
+	ftc.orderedPerID = enabled
+	return ftc
+}
+
+// A signal delivered more than maxDeliveries times is dead lettered instead of being handled (see dead_letter.go),
+// 0 - unlimited
+func (ftc *FunctionTypeConfig) SetMaxDeliveries(maxDeliveries int) *FunctionTypeConfig {
+	ftc.maxDeliveries = maxDeliveries
+	return ftc
+}
+
+// Ids share a pool of executors (see SetExecutor) with poolSize warm ones instead of building one per id, 0 - no pool
+func (ftc *FunctionTypeConfig) SetExecutorPool(poolSize int) *FunctionTypeConfig {
+	ftc.executorPoolSize = poolSize
+	return ftc
+}
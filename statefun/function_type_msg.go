@@ -19,4 +19,6 @@ type FunctionTypeMsg struct {
 	RefusalCallback RefusalCallbackAction
 	RequestCallback RequestCallbackAction
 	AckCallback     SignalCallbackAction
+	ReplyStream     bool                  // Requester accepts partial replies
+	StreamCallback  RequestCallbackAction // Sends a partial reply, nil if the requester does not accept them
 }
@@ -0,0 +1,168 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Function versions let new handler logic roll out gradually: a version of a typename is registered as a typename with
+the ":<version>" suffix, e.g. functions.app.foo:v2, and messages sent to the unversioned typename are routed to its
+versions by the typename's VersionRouting:
+
+	VersionRouting{
+		Weights: map[string]int{"": 90, "v2": 10}, // Version -> share of messages, "" - the unversioned typename itself
+		PinByID: true,                             // Share is taken by the id's hash, an id stays on one version
+	}
+
+Without PinByID each message picks the version at random, messages of one id may then be handled by different
+versions at the same time. Messages sent to a versioned typename are not routed. Versions of a typename share the
+function context of the unversioned typename, so state survives the upgrade.
+Routings set with RuntimeConfig.SetVersionRouting are defaults of the runtime, the ones set with
+Runtime.SetVersionRouting are kept in KV and apply to every runtime of the cluster until deleted.
+*/
+
+const (
+	VersionRoutingKeyPrefix = "__versions"
+	typenameVersionSplitter = ":"
+)
+
+type VersionRouting struct {
+	Weights map[string]int `json:"weights"`
+	PinByID bool           `json:"pin_by_id"`
+}
+
+type versionRoute struct {
+	updateTime int64
+	routing    *VersionRouting
+	versions   []string // Versions with positive weights, sorted
+	total      int
+}
+
+// Returns the unversioned typename and the version, empty if the typename has none
+func splitTypenameVersion(typename string) (string, string) {
+	if i := strings.LastIndex(typename, typenameVersionSplitter); i > strings.LastIndex(typename, ".") {
+		return typename[:i], typename[i+1:]
+	}
+	return typename, ""
+}
+
+func versionedTypename(typename string, version string) string {
+	if len(version) == 0 {
+		return typename
+	}
+	return typename + typenameVersionSplitter + version
+}
+
+func versionRoutingKey(typename string) string {
+	return VersionRoutingKeyPrefix + "." + system.GetHashStr(typename)
+}
+
+func newVersionRoute(routing *VersionRouting, updateTime int64) *versionRoute {
+	route := &versionRoute{updateTime: updateTime, routing: routing}
+	for version, weight := range routing.Weights {
+		if weight > 0 {
+			route.versions = append(route.versions, version)
+			route.total += weight
+		}
+	}
+	sort.Strings(route.versions)
+	return route
+}
+
+// SetVersionRouting sets the routing of the unversioned typename for all runtimes of the cluster, nil deletes it
+func (r *Runtime) SetVersionRouting(typename string, routing *VersionRouting) error {
+	if r.cacheStore == nil {
+		return fmt.Errorf("error: runtime is not started")
+	}
+	if _, version := splitTypenameVersion(typename); len(version) > 0 {
+		return fmt.Errorf("error: %s is a versioned typename", typename)
+	}
+	if routing == nil {
+		r.systemCache().DeleteValue(versionRoutingKey(typename), true, -1, "")
+		return nil
+	}
+	data, err := json.Marshal(routing)
+	if err != nil {
+		return err
+	}
+	return r.systemCache().SetValueDurable(versionRoutingKey(typename), data)
+}
+
+// Returns the routing of the typename, the one from KV overrides the runtime's default
+func (r *Runtime) versionRouteOf(typename string) *versionRoute {
+	key := versionRoutingKey(typename)
+	var updateTime int64
+	if r.cacheStore != nil {
+		updateTime = r.cacheStore.GetValueUpdateTime(key)
+	}
+	if value, ok := r.versionRoutes.Load(typename); ok && value.(*versionRoute).updateTime == updateTime {
+		return value.(*versionRoute)
+	}
+
+	route := &versionRoute{updateTime: updateTime}
+	if routing := r.kvVersionRouting(typename); routing != nil {
+		route = newVersionRoute(routing, updateTime)
+	} else if routing, ok := r.config.versionRoutings[typename]; ok {
+		route = newVersionRoute(routing, updateTime)
+	}
+	r.versionRoutes.Store(typename, route)
+	return route
+}
+
+func (r *Runtime) kvVersionRouting(typename string) *VersionRouting {
+	if r.cacheStore == nil {
+		return nil
+	}
+	data, err := r.cacheStore.GetValue(versionRoutingKey(typename))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	routing := &VersionRouting{}
+	if err := json.Unmarshal(data, routing); err != nil {
+		lg.Logf(lg.ErrorLevel, "Version routing of %s is invalid: %s\n", typename, err)
+		return nil
+	}
+	return routing
+}
+
+// Returns the typename the message to the typename and the id goes to
+func (r *Runtime) routeVersion(typename string, id string) string {
+	if _, version := splitTypenameVersion(typename); len(version) > 0 {
+		return typename
+	}
+	route := r.versionRouteOf(typename)
+	if route.total == 0 {
+		return typename
+	}
+
+	var bucket int
+	if route.routing.PinByID {
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		bucket = int(h.Sum32() % uint32(route.total))
+	} else {
+		bucket = rand.Intn(route.total)
+	}
+	for _, version := range route.versions {
+		if bucket -= route.routing.Weights[version]; bucket < 0 {
+			return versionedTypename(typename, version)
+		}
+	}
+	return typename
+}
+
+// Name function contexts are kept under, shared by versions of the typename
+func (ft *FunctionType) contextTypename() string {
+	typename, _ := splitTypenameVersion(ft.name)
+	return typename
+}
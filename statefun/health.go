@@ -0,0 +1,133 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Runtime.Health reports the state of the runtime's dependencies for liveness and readiness probes:
+
+	nats         - the primary NATS connection is connected
+	messaging    - the connection messages go through (the fallback one after a failover, see nats_failover.go)
+	kv           - the KV bucket answers
+	cache        - the cache store is created and loaded
+	started      - Start subscribed the function types and Shutdown was not called
+	dependencies - function types waiting for their dependencies are subscribed (see dependencies.go)
+
+The runtime is live while its NATS connection is not closed (a dropped connection is being reconnected),
+it is ready when all the checks pass. With RuntimeConfig.SetHealthProbes the runtime serves them over HTTP from
+NewRuntime on, so a starting runtime is live and not ready yet:
+
+	GET /healthz - 200 if live, 503 otherwise
+	GET /readyz  - 200 if ready, 503 otherwise
+
+both with the Health as a JSON body, and "GET /capabilities" with the runtime's Capabilities (see capabilities.go).
+*/
+
+const (
+	healthProbesShutdownTimeout = 5 * time.Second
+)
+
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type Health struct {
+	Live          bool          `json:"live"`
+	Ready         bool          `json:"ready"`
+	Checks        []HealthCheck `json:"checks"`
+	FunctionTypes []string      `json:"function_types"` // Registered ones served by the runtime's role
+}
+
+func (r *Runtime) Health() Health {
+	health := Health{Live: r.nc != nil && !r.nc.IsClosed(), Ready: true}
+	check := func(name string, ok bool, errorMsg string) {
+		health.Checks = append(health.Checks, HealthCheck{Name: name, OK: ok, Error: errorMsg})
+		health.Ready = health.Ready && ok
+	}
+
+	check("nats", r.nc != nil && r.nc.IsConnected(), "")
+	msgNC, _ := r.messaging()
+	check("messaging", msgNC != nil && msgNC.IsConnected(), "")
+	if r.kv == nil {
+		check("kv", false, "")
+	} else if _, err := r.kv.Status(); err != nil {
+		check("kv", false, err.Error())
+	} else {
+		check("kv", true, "")
+	}
+	check("cache", r.cacheStore != nil, "")
+	check("started", r.started.Load() && !r.stopping.Load(), "")
+	if unmet := r.UnmetDependencies(); len(unmet) > 0 {
+		typenames := make([]string, 0, len(unmet))
+		for typename, dependencies := range unmet {
+			typenames = append(typenames, typename+" <- "+strings.Join(dependencies, ","))
+		}
+		sort.Strings(typenames)
+		check("dependencies", false, strings.Join(typenames, "; "))
+	} else {
+		check("dependencies", true, "")
+	}
+
+	for name, ft := range r.registeredFunctionTypes {
+		if r.servesFunctionType(ft) {
+			health.FunctionTypes = append(health.FunctionTypes, name)
+		}
+	}
+	sort.Strings(health.FunctionTypes)
+	health.Ready = health.Ready && health.Live
+	return health
+}
+
+func (r *Runtime) startHealthProbes() {
+	if len(r.config.healthProbesAddress) == 0 {
+		return
+	}
+	probe := func(passed func(health Health) bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			health := r.Health()
+			w.Header().Set("Content-Type", "application/json")
+			if !passed(health) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			system.MsgOnErrorReturn(json.NewEncoder(w).Encode(health))
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", probe(func(health Health) bool { return health.Live }))
+	mux.HandleFunc("/readyz", probe(func(health Health) bool { return health.Ready }))
+	mux.HandleFunc("/capabilities", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		system.MsgOnErrorReturn(json.NewEncoder(w).Encode(r.Capabilities()))
+	})
+
+	r.healthServer = &http.Server{Addr: r.config.healthProbesAddress, Handler: mux}
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("runtime-healthProbes")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime-healthProbes")
+		if err := r.healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			lg.Log(lg.ErrorLevel, "Health probes server failed", "address", r.config.healthProbesAddress, "error", err)
+		}
+	}()
+}
+
+func (r *Runtime) stopHealthProbes() {
+	if r.healthServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthProbesShutdownTimeout)
+	defer cancel()
+	system.MsgOnErrorReturn(r.healthServer.Shutdown(ctx))
+}
@@ -1,16 +1,24 @@
 package statefun
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/foliagecp/easyjson"
 
+	sdkErrors "github.com/foliagecp/sdk/errors"
 	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
-	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
 )
 
-func buildNatsData(callerTypename string, callerID string, payload *easyjson.JSON, options *easyjson.JSON) []byte {
+var (
+	// Returned (wrapped) by requests not replied in time, check with errors.Is
+	RequestTimeoutError = sdkErrors.New(sdkErrors.ErrTimeout, "error: request timed out")
+)
+
+func buildNatsData(callerTypename string, callerID string, payload *easyjson.JSON, options *easyjson.JSON, replyStream bool) []byte {
 	data := easyjson.NewJSONObject()
 	data.SetByPath("caller_typename", easyjson.NewJSON(callerTypename))
 	data.SetByPath("caller_id", easyjson.NewJSON(callerID))
@@ -20,17 +28,20 @@ func buildNatsData(callerTypename string, callerID string, payload *easyjson.JSO
 	if options != nil {
 		data.SetByPath("options", *options)
 	}
+	if replyStream {
+		data.SetByPath("reply_stream", easyjson.NewJSON(true))
+	}
 	return data.ToBytes()
 }
 
 func (r *Runtime) signal(signalProvider sfPlugins.SignalProvider, callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) error {
+	targetTypename = r.routeVersion(r.resolveAlias(targetTypename), targetID)
 	jetstreamGlobalSignal := func() error {
-		go func() {
-			system.GlobalPrometrics.GetRoutinesCounter().Started("ingress-jetstreamGlobalSignal-gofunc")
-			defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("ingress-jetstreamGlobalSignal-gofunc")
-			system.MsgOnErrorReturn(r.nc.Publish(fmt.Sprintf("%s.%s", targetTypename, targetID), buildNatsData(callerTypename, callerID, payload, options)))
-		}()
-		return nil
+		payload, err := r.e2eSend(callerTypename, targetTypename, payload)
+		if err != nil {
+			return err
+		}
+		return r.publishSignal(r.prioritySignalSubject(targetTypename, targetID, options), buildNatsData(callerTypename, callerID, payload, options, false))
 	}
 
 	switch signalProvider {
@@ -46,29 +57,55 @@ func (r *Runtime) Signal(signalProvider sfPlugins.SignalProvider, typename strin
 }
 
 func (r *Runtime) request(requestProvider sfPlugins.RequestProvider, callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
+	return r.requestCtx(context.Background(), requestProvider, callerTypename, callerID, targetTypename, targetID, payload, options)
+}
+
+// Requests with the runtime's request timeout if ctx has no deadline
+func (r *Runtime) requestCtx(ctx context.Context, requestProvider sfPlugins.RequestProvider, callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(r.config.requestTimeoutSec)*time.Second)
+		defer cancel()
+	}
+	targetTypename = r.routeVersion(r.resolveAlias(targetTypename), targetID)
+	timeoutError := func() error {
+		return fmt.Errorf("%w: function typename \"%s\" with id \"%s\"", RequestTimeoutError, targetTypename, targetID)
+	}
+
 	natsCoreGlobalRequest := func() (*easyjson.JSON, error) {
-		resp, err := r.nc.Request(
-			fmt.Sprintf("service.%s.%s", targetTypename, targetID),
-			buildNatsData(callerTypename, callerID, payload, options),
-			time.Duration(r.config.requestTimeoutSec)*time.Second,
+		payload, err := r.e2eSend(callerTypename, targetTypename, payload)
+		if err != nil {
+			return nil, err
+		}
+		nc, _ := r.messaging()
+		resp, err := nc.RequestWithContext(
+			ctx,
+			r.nodeRequestSubject(targetTypename, targetID, options),
+			buildNatsData(callerTypename, callerID, payload, options, false),
 		)
 		if err == nil {
 			if j, ok := easyjson.JSONFromBytes(resp.Data); ok {
-				return &j, nil
+				return r.e2eReceive(targetTypename, callerTypename, &j)
 			}
 			return nil, fmt.Errorf("response from function typename \"%s\" with id \"%s\" is not a json", targetTypename, targetID)
 		}
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) {
+			return nil, timeoutError()
+		}
 		return nil, err
 	}
 
 	goLangLocalRequest := func() (*easyjson.JSON, error) {
+		if node := nodeOf(options); len(node) > 0 && node != r.config.nodeID {
+			return nil, fmt.Errorf("callFunctionGolangSync cannot request function with the typename %s on node %s, not the local one", targetTypename, node)
+		}
 		if targetFT, ok := r.registeredFunctionTypes[targetTypename]; ok {
 			// TODO: localGolangServiceActive ???
 			/*if !targetFT.config.serviceActive {
 				return nil, fmt.Errorf("callFunctionGolangSync cannot request function with the typename %s, not running as a service", callerTypename)
 			}*/
 
-			resultJSONChannel := make(chan *easyjson.JSON)
+			resultJSONChannel := make(chan *easyjson.JSON, 1) // Target's reply must not block if the caller is gone
 
 			// Do not send original data, prevents same data concurrent access from different functions
 			var payloadCopy *easyjson.JSON = nil
@@ -101,8 +138,11 @@ func (r *Runtime) request(requestProvider sfPlugins.RequestProvider, callerTypen
 					return resultJSON, nil
 				}
 				return nil, fmt.Errorf("target function typename \"%s\" with id \"%s\" resufes to handle request", targetTypename, targetID)
-			case <-time.After(time.Duration(r.config.requestTimeoutSec) * time.Second):
-				return nil, fmt.Errorf("timeout occured while requesting function typename \"%s\" with id \"%s\"", targetTypename, targetID)
+			case <-ctx.Done():
+				if ctx.Err() == context.DeadlineExceeded {
+					return nil, timeoutError()
+				}
+				return nil, ctx.Err()
 			}
 		} else {
 			return nil, fmt.Errorf("callFunctionGolangSync cannot request function with the typename %s, not registered", callerTypename)
@@ -122,3 +162,9 @@ func (r *Runtime) request(requestProvider sfPlugins.RequestProvider, callerTypen
 func (r *Runtime) Request(requestProvider sfPlugins.RequestProvider, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
 	return r.request(requestProvider, "ingress", "go", typename, id, payload, options)
 }
+
+// RequestCtx is Request cancelled with ctx, ctx's deadline replaces the runtime's request timeout;
+// a request not replied in time fails with RequestTimeoutError
+func (r *Runtime) RequestCtx(ctx context.Context, requestProvider sfPlugins.RequestProvider, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
+	return r.requestCtx(ctx, requestProvider, "ingress", "go", typename, id, payload, options)
+}
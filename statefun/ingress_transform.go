@@ -0,0 +1,111 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/foliagecp/easyjson"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+/*
+Ingress transformation reshapes payloads of legacy producers into the typename's expected schema before the schema
+check and the handler (FunctionTypeConfig.SetIngressTransformation). Expressions are gval expressions over
+
+	payload - the incoming payload
+	caller  - {"typename": ..., "id": ...}
+
+e.g. transformation of {"temp": 21.5, "dev": "a1"} into {"temperature": {"value": 21.5}, "device_id": "a1"}:
+
+	IngressTransformation{
+		When:   `payload.temp != nil`,
+		Fields: map[string]string{"temperature.value": `payload.temp`, "device_id": `payload.dev`},
+	}
+
+A payload the expressions fail on is refused as if it did not match the schema.
+*/
+
+type IngressTransformation struct {
+	When         string            // Transformation applies only to payloads the expression is true for, empty - to all
+	Fields       map[string]string // Path in the resulting payload -> expression of its value
+	KeepUnmapped bool              // Result is the incoming payload with the fields set, otherwise only the fields
+}
+
+type compiledIngressTransformation struct {
+	when         gval.Evaluable
+	fields       map[string]gval.Evaluable
+	keepUnmapped bool
+}
+
+var ingressTransformationLanguage = gval.Full()
+
+func compileIngressTransformation(t *IngressTransformation) (*compiledIngressTransformation, error) {
+	compiled := &compiledIngressTransformation{fields: map[string]gval.Evaluable{}, keepUnmapped: t.KeepUnmapped}
+	var err error
+	if len(t.When) > 0 {
+		if compiled.when, err = ingressTransformationLanguage.NewEvaluable(t.When); err != nil {
+			return nil, fmt.Errorf("error: ingress transformation condition %q: %s", t.When, err)
+		}
+	}
+	for path, expression := range t.Fields {
+		if compiled.fields[path], err = ingressTransformationLanguage.NewEvaluable(expression); err != nil {
+			return nil, fmt.Errorf("error: ingress transformation of %s %q: %s", path, expression, err)
+		}
+	}
+	return compiled, nil
+}
+
+// Compiles ingress transformations of all function types, fails on an invalid expression
+func (r *Runtime) compileIngressTransformations() (err error) {
+	for _, ft := range r.registeredFunctionTypes {
+		if ft.config.ingressTransformation == nil {
+			continue
+		}
+		if ft.ingressTransformation, err = compileIngressTransformation(ft.config.ingressTransformation); err != nil {
+			return fmt.Errorf("%s: %s", ft.name, err)
+		}
+	}
+	return nil
+}
+
+// Returns the payload transformed by the typename's ingress transformation
+func (ft *FunctionType) transformPayload(payload *easyjson.JSON, caller *sfPlugins.StatefunAddress) (*easyjson.JSON, error) {
+	t := ft.ingressTransformation
+	if t == nil {
+		return payload, nil
+	}
+	var payloadValue interface{}
+	if err := json.Unmarshal(payload.ToBytes(), &payloadValue); err != nil {
+		return nil, err
+	}
+	vars := map[string]interface{}{"payload": payloadValue, "caller": map[string]interface{}{}}
+	if caller != nil {
+		vars["caller"] = map[string]interface{}{"typename": caller.Typename, "id": caller.ID}
+	}
+
+	ctx := context.Background()
+	if t.when != nil {
+		if apply, err := t.when.EvalBool(ctx, vars); err != nil {
+			return nil, fmt.Errorf("error: ingress transformation condition: %s", err)
+		} else if !apply {
+			return payload, nil
+		}
+	}
+	result := easyjson.NewJSONObject()
+	if t.keepUnmapped {
+		result = payload.Clone()
+	}
+	for path, field := range t.fields {
+		value, err := field(ctx, vars)
+		if err != nil {
+			return nil, fmt.Errorf("error: ingress transformation of %s: %s", path, err)
+		}
+		result.SetByPath(path, easyjson.NewJSON(value))
+	}
+	return &result, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+/*
+Interceptors wrap function logic handlers with cross-cutting behaviour (logging, metrics, auth, payload validation)
+instead of repeating it in every handler. Runtime interceptors wrap every function type, function type interceptors
+are inside them, the first added is the outermost:
+
+	runtime.Use(logging, metrics)
+	ft.Use(auth)
+
+	logging -> metrics -> auth -> handler
+
+An interceptor not calling next skips the rest of the chain and the handler. Chains are built on runtime start.
+*/
+
+// Interceptor returns the handler wrapping next
+type Interceptor func(next FunctionLogicHandler) FunctionLogicHandler
+
+// Use adds interceptors applied to all function types of the runtime, must be called before Start
+func (r *Runtime) Use(interceptors ...Interceptor) *Runtime {
+	r.interceptors = append(r.interceptors, interceptors...)
+	return r
+}
+
+// Use adds interceptors applied to the function type inside the runtime's ones, must be called before Start
+func (ft *FunctionType) Use(interceptors ...Interceptor) *FunctionType {
+	ft.interceptors = append(ft.interceptors, interceptors...)
+	return ft
+}
+
+func (ft *FunctionType) buildHandler() {
+	handler := ft.logicHandler
+	for i := len(ft.interceptors) - 1; i >= 0; i-- {
+		handler = ft.interceptors[i](handler)
+	}
+	for i := len(ft.runtime.interceptors) - 1; i >= 0; i-- {
+		handler = ft.runtime.interceptors[i](handler)
+	}
+	ft.handler = handler
+}
+
+func (ft *FunctionType) callHandler(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+	if ft.handler == nil {
+		ft.buildHandler()
+	}
+	ft.handler(executor, contextProcessor)
+}
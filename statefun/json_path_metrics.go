@@ -0,0 +1,26 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Publishes path operations of a single invocation and logs documents which are worth splitting or indexing
+func (ft *FunctionType) reportJSONPathMetrics(id string, metrics *sfPlugins.JSONPathMetrics) {
+	if metrics == nil {
+		return
+	}
+	for document, stats := range metrics.Documents() {
+		ops := stats.Gets + stats.Sets
+		labels := map[string]string{"typename": ft.name, "document": document}
+		system.Metrics().ObserveHistogram("json_path_ops", "JSON path operations per invocation", prometheus.ExponentialBuckets(1, 4, 8), labels, float64(ops))
+		system.Metrics().ObserveHistogram("json_path_time", "JSON path operations time per invocation, us", prometheus.ExponentialBuckets(10, 4, 8), labels, float64(stats.Duration.Microseconds()))
+		if ft.config.jsonPathWarnOps > 0 && ops > ft.config.jsonPathWarnOps {
+			lg.Log(lg.WarnLevel, "Too many path operations on a document, consider splitting or indexing it", "typename", ft.name, "id", id, "document", document, "ops", ops, "gets", stats.Gets, "sets", stats.Sets, "duration", stats.Duration.String())
+		}
+	}
+}
@@ -3,8 +3,6 @@
 package statefun
 
 import (
-	"errors"
-	"fmt"
 	"strings"
 	"sync"
 	"time"
@@ -13,6 +11,7 @@ import (
 
 	rt "runtime"
 
+	sdkErrors "github.com/foliagecp/sdk/errors"
 	"github.com/foliagecp/sdk/statefun/system"
 	"github.com/nats-io/nats.go"
 )
@@ -20,7 +19,7 @@ import (
 var (
 	//keyValueMutexOperationMutex sync.Mutex
 	kwWatchMutex     sync.Mutex
-	mutexLockedError = errors.New("error: mutex is locked")
+	mutexLockedError = sdkErrors.New(sdkErrors.ErrConflict, "error: mutex is locked")
 )
 
 // errorOnLocked - if mutex is already locked, exit with error (do not wait for unlocking)
@@ -113,7 +112,7 @@ func KeyMutexLock(runtime *Runtime, key string, errorOnLocked bool) (uint64, err
 			}
 			return revId, err
 		} else if lockTime+int64(runtime.config.kvMutexLifeTimeSec)*int64(time.Second) < now { // Mutex was locked by someone else and its lock is too old
-			le.Logf(lg.WarnLevel, "Context mutex for key=%s is too old, will be unlocked!\n", key)
+			le.Log(lg.WarnLevel, "Context mutex is too old, will be unlocked", "key", key)
 			mutexResetLockNeeded = true
 			//keyValueMutexOperationMutex.Unlock()
 			continue
@@ -138,7 +137,7 @@ func KeyMutexLockUpdate(runtime *Runtime, key string, lockRevisionID uint64) (ui
 		return 0, err
 	}
 	if entry.Revision() != lockRevisionID {
-		le.Logf(lg.WarnLevel, "Context mutex for key=%s with revision=%d was violated, new revision=%d!\n", key, lockRevisionID, entry.Revision())
+		le.Log(lg.WarnLevel, "Context mutex was violated", "key", key, "revision", lockRevisionID, "new_revision", entry.Revision())
 	}
 	lockTime := system.BytesToInt64(entry.Value())
 	if lockTime != 0 {
@@ -149,7 +148,7 @@ func KeyMutexLockUpdate(runtime *Runtime, key string, lockRevisionID uint64) (ui
 		le.Logf(lg.TraceLevel, "============== Updated %s\n", keyMutex)
 		return revId, nil
 	} else {
-		return 0, fmt.Errorf("Context mutex for key=%s was already unlocked", key)
+		return 0, sdkErrors.Newf(sdkErrors.ErrConflict, "Context mutex for key=%s was already unlocked", key)
 	}
 }
 
@@ -166,7 +165,7 @@ func KeyMutexUnlock(runtime *Runtime, key string, lockRevisionID uint64) error {
 		return err
 	}
 	if entry.Revision() != lockRevisionID {
-		le.Logf(lg.WarnLevel, "Context mutex for key=%s with revision=%d was violated, new revision=%d!\n", key, lockRevisionID, entry.Revision())
+		le.Log(lg.WarnLevel, "Context mutex was violated", "key", key, "revision", lockRevisionID, "new_revision", entry.Revision())
 	}
 	lockTime := system.BytesToInt64(entry.Value())
 	if lockTime != 0 {
@@ -175,18 +174,18 @@ func KeyMutexUnlock(runtime *Runtime, key string, lockRevisionID uint64) error {
 			return err
 		}
 	} else {
-		le.Logf(lg.WarnLevel, "Context mutex for key=%s was already unlocked!\n", key)
+		le.Log(lg.WarnLevel, "Context mutex was already unlocked", "key", key)
 	}
 	le.Logf(lg.TraceLevel, "============== Unlocked %s\n", keyMutex)
 	return nil // Successfully unlocked
 }
 
 func ContextMutexLock(ft *FunctionType, id string, errorOnLocked bool) (uint64, error) {
-	return KeyMutexLock(ft.runtime, ft.name+"."+id, errorOnLocked)
+	return KeyMutexLock(ft.runtime, ft.contextTypename()+"."+id, errorOnLocked)
 }
 
 func ContextMutexUnlock(ft *FunctionType, id string, lockRevisionID uint64) error {
-	return KeyMutexUnlock(ft.runtime, ft.name+"."+id, lockRevisionID)
+	return KeyMutexUnlock(ft.runtime, ft.contextTypename()+"."+id, lockRevisionID)
 }
 
 func FunctionTypeMutexLock(ft *FunctionType, errorOnLocked bool) (uint64, error) {
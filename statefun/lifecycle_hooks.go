@@ -0,0 +1,168 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Lifecycle hooks let applications follow the runtime's state, e.g. pause their workers while NATS is unreachable
+and re-warm caches after a reconnect. Hooks are registered on the runtime before Start and run in the
+registration order:
+
+	OnBeforeStart    - at the beginning of Start, an error aborts Start
+	OnAfterStart     - after Start subscribed the function types, in background as Start's onAfterStart is
+	OnBeforeShutdown - at the beginning of Shutdown, before subscriptions are drained, with Shutdown's ctx
+	OnStop           - at the end of Shutdown, when the runtime is stopped
+	OnDisconnect     - the primary NATS connection is lost, with the error (nil if the server closed it)
+	OnReconnect      - the primary NATS connection is restored
+
+Connection hooks run in background, a hook panicking is logged and does not affect the runtime or other hooks.
+*/
+
+type lifecycleHooks struct {
+	mutex          sync.RWMutex
+	beforeStart    []func(runtime *Runtime) error
+	afterStart     []func(runtime *Runtime) error
+	beforeShutdown []func(runtime *Runtime, ctx context.Context)
+	stop           []func(runtime *Runtime)
+	disconnect     []func(runtime *Runtime, err error)
+	reconnect      []func(runtime *Runtime)
+}
+
+func (r *Runtime) OnBeforeStart(hook func(runtime *Runtime) error) {
+	r.hooks.mutex.Lock()
+	defer r.hooks.mutex.Unlock()
+	r.hooks.beforeStart = append(r.hooks.beforeStart, hook)
+}
+
+func (r *Runtime) OnAfterStart(hook func(runtime *Runtime) error) {
+	r.hooks.mutex.Lock()
+	defer r.hooks.mutex.Unlock()
+	r.hooks.afterStart = append(r.hooks.afterStart, hook)
+}
+
+func (r *Runtime) OnBeforeShutdown(hook func(runtime *Runtime, ctx context.Context)) {
+	r.hooks.mutex.Lock()
+	defer r.hooks.mutex.Unlock()
+	r.hooks.beforeShutdown = append(r.hooks.beforeShutdown, hook)
+}
+
+func (r *Runtime) OnStop(hook func(runtime *Runtime)) {
+	r.hooks.mutex.Lock()
+	defer r.hooks.mutex.Unlock()
+	r.hooks.stop = append(r.hooks.stop, hook)
+}
+
+func (r *Runtime) OnDisconnect(hook func(runtime *Runtime, err error)) {
+	r.hooks.mutex.Lock()
+	defer r.hooks.mutex.Unlock()
+	r.hooks.disconnect = append(r.hooks.disconnect, hook)
+}
+
+func (r *Runtime) OnReconnect(hook func(runtime *Runtime)) {
+	r.hooks.mutex.Lock()
+	defer r.hooks.mutex.Unlock()
+	r.hooks.reconnect = append(r.hooks.reconnect, hook)
+}
+
+// Runs the hook recovering its panic, returns the hook's error
+func runHook(name string, hook func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			lg.Log(lg.ErrorLevel, "Lifecycle hook panicked", "hook", name, "panic", p)
+		}
+	}()
+	return hook()
+}
+
+func (r *Runtime) runBeforeStartHooks() error {
+	r.hooks.mutex.RLock()
+	hooks := r.hooks.beforeStart
+	r.hooks.mutex.RUnlock()
+	for _, hook := range hooks {
+		if err := runHook("before_start", func() error { return hook(r) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Runtime) runAfterStartHooks(onAfterStart func(runtime *Runtime) error) {
+	r.hooks.mutex.RLock()
+	hooks := append([]func(runtime *Runtime) error{}, r.hooks.afterStart...)
+	r.hooks.mutex.RUnlock()
+	if onAfterStart != nil {
+		hooks = append([]func(runtime *Runtime) error{onAfterStart}, hooks...)
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("runtime_onAfterStart")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime_onAfterStart")
+		for _, hook := range hooks {
+			system.MsgOnErrorReturn(runHook("after_start", func() error { return hook(r) }))
+		}
+	}()
+}
+
+func (r *Runtime) runBeforeShutdownHooks(ctx context.Context) {
+	r.hooks.mutex.RLock()
+	hooks := r.hooks.beforeShutdown
+	r.hooks.mutex.RUnlock()
+	for _, hook := range hooks {
+		system.MsgOnErrorReturn(runHook("before_shutdown", func() error { hook(r, ctx); return nil }))
+	}
+}
+
+func (r *Runtime) runStopHooks() {
+	r.hooks.mutex.RLock()
+	hooks := r.hooks.stop
+	r.hooks.mutex.RUnlock()
+	for _, hook := range hooks {
+		system.MsgOnErrorReturn(runHook("stop", func() error { hook(r); return nil }))
+	}
+}
+
+// NATS options dispatching the primary connection's events to the hooks
+func (r *Runtime) natsLifecycleOptions() []nats.Option {
+	return []nats.Option{
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			r.hooks.mutex.RLock()
+			hooks := r.hooks.disconnect
+			r.hooks.mutex.RUnlock()
+			if len(hooks) == 0 || r.stopping.Load() {
+				return
+			}
+			go func() {
+				for _, hook := range hooks {
+					system.MsgOnErrorReturn(runHook("disconnect", func() error { hook(r, err); return nil }))
+				}
+			}()
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			if r.config.natsFailoverMode == NatsFailoverAll && len(r.config.natsFallbackURLs) > 0 {
+				go r.onNatsReconnected(nc)
+			}
+			r.hooks.mutex.RLock()
+			hooks := r.hooks.reconnect
+			r.hooks.mutex.RUnlock()
+			if len(hooks) == 0 {
+				return
+			}
+			go func() {
+				for _, hook := range hooks {
+					system.MsgOnErrorReturn(runHook("reconnect", func() error { hook(r); return nil }))
+				}
+			}()
+		}),
+	}
+}
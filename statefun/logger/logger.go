@@ -3,11 +3,30 @@ package logger
 import (
 	"fmt"
 	"io"
+	"os"
 	"runtime"
+	"strings"
+	"sync"
 
 	logrus "github.com/sirupsen/logrus"
 )
 
+/*
+Logs of the sdk go to a pluggable Logger (SetLogger), logrus by default. Besides the printf-like Logf and Logln,
+records may carry structured fields as alternating keys and values like in log/slog:
+
+	lg.Log(lg.ErrorLevel, "Refusing message", "typename", typename, "id", id, "error", err)
+
+Every record gets the "module" field - the package it was logged from relative to the sdk, e.g. "statefun/cache",
+(the full package path outside of the sdk) and the "caller" one if SetReportCaller is on. The level of a module
+(SetModuleLevel) overrides the output level for the module and its subpackages, the longest module wins.
+A *slog.Logger is plugged in as
+
+	lg.SetLogger(lg.LoggerFunc(func(ll lg.LogLevel, msg string, args ...interface{}) {
+		logger.Log(context.Background(), slog.Level(lg.SlogLevel(ll)), msg, args...)
+	}))
+*/
+
 type LogLevel = logrus.Level
 
 const (
@@ -27,18 +46,110 @@ const (
 	DebugLevel
 	// TraceLevel level. Designates finer-grained informational events than the Debug.
 	TraceLevel
+
+	sdkModulePrefix = "github.com/foliagecp/sdk/"
 )
 
+// Logger receives records of enabled levels, args are alternating keys and values of structured fields
+type Logger interface {
+	Log(ll LogLevel, msg string, args ...interface{})
+}
+
+type LoggerFunc func(ll LogLevel, msg string, args ...interface{})
+
+func (f LoggerFunc) Log(ll LogLevel, msg string, args ...interface{}) {
+	f(ll, msg, args...)
+}
+
+// SlogLevel returns the log/slog level (slog.Level is an int) of the level
+func SlogLevel(ll LogLevel) int {
+	switch ll {
+	case PanicLevel, FatalLevel, ErrorLevel:
+		return 8
+	case WarnLevel:
+		return 4
+	case InfoLevel:
+		return 0
+	case DebugLevel:
+		return -4
+	default:
+		return -8
+	}
+}
+
+// Passes records to logrus with their fields, logrus itself does not filter them
+type logrusLogger struct{}
+
+func (logrusLogger) Log(ll LogLevel, msg string, args ...interface{}) {
+	logrus.WithFields(argsToFields(args)).Log(ll, msg)
+}
+
+func argsToFields(args []interface{}) logrus.Fields {
+	fields := logrus.Fields{}
+	for i := 0; i < len(args); i += 2 {
+		key := fmt.Sprint(args[i])
+		if i+1 == len(args) {
+			fields["!BADKEY"] = args[i]
+			break
+		}
+		if err, ok := args[i+1].(error); ok {
+			fields[key] = err.Error()
+		} else {
+			fields[key] = args[i+1]
+		}
+	}
+	return fields
+}
+
 var (
 	reportCaller bool = false
+
+	loggerMutex  sync.RWMutex
+	logger       Logger   = logrusLogger{}
+	outputLevel  LogLevel = InfoLevel
+	moduleLevels          = map[string]LogLevel{}
+
+	modulesByPC sync.Map // uintptr -> string
 )
 
+func init() {
+	logrus.SetLevel(TraceLevel)
+}
+
 func SetOutput(out io.Writer) {
 	logrus.SetOutput(out)
 }
 
+// Formats records of the default logger as JSON lines
+func SetJSONOutput(enabled bool) {
+	if enabled {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	}
+}
+
 func SetOutputLevel(ll LogLevel) {
-	logrus.SetLevel(ll)
+	loggerMutex.Lock()
+	defer loggerMutex.Unlock()
+	outputLevel = ll
+}
+
+// Level of the module and its subpackages, e.g. "statefun/cache" or "embedded/graph"
+func SetModuleLevel(module string, ll LogLevel) {
+	loggerMutex.Lock()
+	defer loggerMutex.Unlock()
+	moduleLevels[module] = ll
+}
+
+// nil restores the default logrus logger
+func SetLogger(l Logger) {
+	loggerMutex.Lock()
+	defer loggerMutex.Unlock()
+	if l == nil {
+		l = logrusLogger{}
+	}
+	logger = l
 }
 
 func SetReportCaller(include bool) {
@@ -46,37 +157,86 @@ func SetReportCaller(include bool) {
 	reportCaller = include
 }
 
+// Enabled reports whether records of the level from the module are logged
+func Enabled(module string, ll LogLevel) bool {
+	loggerMutex.RLock()
+	defer loggerMutex.RUnlock()
+	level, longest := outputLevel, -1
+	for m, l := range moduleLevels {
+		if len(m) > longest && (module == m || strings.HasPrefix(module, m+"/")) {
+			level, longest = l, len(m)
+		}
+	}
+	return ll <= level
+}
+
+// Package of the function with the program counter, relative to the sdk
+func moduleOf(pc uintptr) string {
+	if module, ok := modulesByPC.Load(pc); ok {
+		return module.(string)
+	}
+	module := ""
+	if f := runtime.FuncForPC(pc); f != nil {
+		name := f.Name() // e.g. github.com/foliagecp/sdk/statefun/cache.(*Store).GetValue
+		slash := strings.LastIndex(name, "/")
+		if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+			name = name[:slash+1+dot]
+		}
+		module = strings.TrimPrefix(name, sdkModulePrefix)
+	}
+	modulesByPC.Store(pc, module)
+	return module
+}
+
 func GetCustomLogEntry(pc uintptr, file string, line int, ok bool) LogEntry {
-	var le *logrus.Entry
+	le := LogEntry{module: moduleOf(pc)}
 	if reportCaller {
-		le = logrus.WithField("caller", fmt.Sprintf("%s:%d", file, line))
-	} else {
-		le = logrus.NewEntry(logrus.StandardLogger())
+		le.caller = fmt.Sprintf("%s:%d", file, line)
 	}
-	return LogEntry{le}
+	return le
 }
 
 type LogEntry struct {
-	logrusLogEntry *logrus.Entry
+	module string
+	caller string
 }
 
-func (le *LogEntry) Logln(ll LogLevel, args ...interface{}) {
+// Log logs the message with structured fields, args are alternating keys and values
+func (le *LogEntry) Log(ll LogLevel, msg string, args ...interface{}) {
+	if ll > FatalLevel && !Enabled(le.module, ll) {
+		return
+	}
+	fields := make([]interface{}, 0, len(args)+4)
+	fields = append(fields, args...)
+	fields = append(fields, "module", le.module)
+	if len(le.caller) > 0 {
+		fields = append(fields, "caller", le.caller)
+	}
+	msg = strings.TrimSuffix(msg, "\n")
+
+	loggerMutex.RLock()
+	l := logger
+	loggerMutex.RUnlock()
+	l.Log(ll, msg, fields...)
+
 	switch ll {
 	case PanicLevel:
-		le.logrusLogEntry.Panicln(args...)
+		panic(msg)
 	case FatalLevel:
-		le.logrusLogEntry.Fatalln(args...)
-	case ErrorLevel:
-		le.logrusLogEntry.Errorln(args...)
-	case WarnLevel:
-		le.logrusLogEntry.Warnln(args...)
-	case InfoLevel:
-		le.logrusLogEntry.Infoln(args...)
-	case DebugLevel:
-		le.logrusLogEntry.Debugln(args...)
-	case TraceLevel:
-		le.logrusLogEntry.Traceln(args...)
+		os.Exit(1)
+	}
+}
+
+func Log(ll LogLevel, msg string, args ...interface{}) {
+	le := GetCustomLogEntry(runtime.Caller(1))
+	le.Log(ll, msg, args...)
+}
+
+func (le *LogEntry) Logln(ll LogLevel, args ...interface{}) {
+	if ll > FatalLevel && !Enabled(le.module, ll) {
+		return
 	}
+	le.Log(ll, fmt.Sprintln(args...))
 }
 
 func Logln(ll LogLevel, args ...interface{}) {
@@ -85,22 +245,10 @@ func Logln(ll LogLevel, args ...interface{}) {
 }
 
 func (le *LogEntry) Logf(ll LogLevel, format string, args ...interface{}) {
-	switch ll {
-	case PanicLevel:
-		le.logrusLogEntry.Panicf(format, args...)
-	case FatalLevel:
-		le.logrusLogEntry.Fatalf(format, args...)
-	case ErrorLevel:
-		le.logrusLogEntry.Errorf(format, args...)
-	case WarnLevel:
-		le.logrusLogEntry.Warnf(format, args...)
-	case InfoLevel:
-		le.logrusLogEntry.Infof(format, args...)
-	case DebugLevel:
-		le.logrusLogEntry.Debugf(format, args...)
-	case TraceLevel:
-		le.logrusLogEntry.Tracef(format, args...)
+	if ll > FatalLevel && !Enabled(le.module, ll) {
+		return
 	}
+	le.Log(ll, fmt.Sprintf(format, args...))
 }
 
 func Logf(ll LogLevel, format string, args ...interface{}) {
@@ -0,0 +1,154 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+)
+
+/*
+Namespaces isolate tenants sharing a NATS cluster (RuntimeConfig.SetNamespace). A namespaced runtime has:
+
+	subjects      - "<namespace>." prepended to the signal and request templates (legacy ones of the compatibility
+	                mode too), priority lanes, debug capture and dead letter subjects, so stream and consumer names
+	                derived from them differ too
+	buckets       - "<namespace>_" prepended to the KV bucket, the checkpoint object store bucket and the debug
+	                capture and dead letter stream names
+	cache         - "<namespace>_" prepended to the cache store's kvStorePrefix and id (cache.Config.Namespaced)
+
+so runtimes of different namespaces neither see each other's messages nor share state. NATS accounts or user
+permissions on "<namespace>.>" (see SubscribeSubjectsPermissions) enforce the isolation on the server side.
+Namespaces runs a runtime per namespace in one process, function types are registered in each runtime:
+
+	namespaces, err := statefun.NewNamespaces(*config, "tenant-a", "tenant-b")
+	namespaces.Each(func(namespace string, runtime *statefun.Runtime) error {
+		crud.RegisterAllFunctionTypes(runtime)
+		return nil
+	})
+	err = namespaces.Start(cacheConfig, nil)
+*/
+
+var (
+	subjectTokenRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+func namespacedSubject(namespace string, subject string) string {
+	if len(namespace) == 0 {
+		return subject
+	}
+	return namespace + "." + subject
+}
+
+func namespacedName(namespace string, name string) string {
+	if len(namespace) == 0 {
+		return name
+	}
+	return namespace + "_" + name
+}
+
+// Moves the config's subjects and buckets into its namespace
+func (ro *RuntimeConfig) applyNamespace() error {
+	if len(ro.namespace) == 0 {
+		return nil
+	}
+	if !subjectTokenRegexp.MatchString(ro.namespace) {
+		return fmt.Errorf("error: invalid namespace %q, only letters, digits, \"_\" and \"-\" are allowed", ro.namespace)
+	}
+	ro.signalSubjectTemplate = subjectTemplate(namespacedSubject(ro.namespace, string(ro.signalSubjectTemplate)))
+	ro.requestSubjectTemplate = subjectTemplate(namespacedSubject(ro.namespace, string(ro.requestSubjectTemplate)))
+	ro.keyValueStoreBucketName = namespacedName(ro.namespace, ro.keyValueStoreBucketName)
+	ro.checkpointObjectStoreBucket = namespacedName(ro.namespace, ro.checkpointObjectStoreBucket)
+	ro.debugCaptureStreamName = namespacedName(ro.namespace, ro.debugCaptureStreamName)
+	ro.deadLetterStreamName = namespacedName(ro.namespace, ro.deadLetterStreamName)
+	return nil
+}
+
+// Namespace the runtime runs in, empty if none
+func (r *Runtime) Namespace() string {
+	return r.config.namespace
+}
+
+func (r *Runtime) namespacedSubject(subject string) string {
+	return namespacedSubject(r.config.namespace, subject)
+}
+
+// Legacy templates of the subject compatibility mode moved into the runtime's namespace
+func (r *Runtime) legacyTemplates() (subjectTemplate, subjectTemplate) {
+	return subjectTemplate(r.namespacedSubject(SignalSubjectTemplate)), subjectTemplate(r.namespacedSubject(RequestSubjectTemplate))
+}
+
+// Namespaces is a set of runtimes of different namespaces in one process
+type Namespaces struct {
+	namespaces []string
+	runtimes   map[string]*Runtime
+}
+
+// NewNamespaces creates a runtime per namespace with the config
+func NewNamespaces(config RuntimeConfig, namespaces ...string) (*Namespaces, error) {
+	n := &Namespaces{runtimes: map[string]*Runtime{}}
+	for _, namespace := range namespaces {
+		if _, ok := n.runtimes[namespace]; ok || len(namespace) == 0 {
+			n.shutdownCreated()
+			return nil, fmt.Errorf("error: namespace %q is empty or duplicated", namespace)
+		}
+		namespaceConfig := config
+		namespaceConfig.namespace = namespace
+		runtime, err := NewRuntime(namespaceConfig)
+		if err != nil {
+			n.shutdownCreated()
+			return nil, fmt.Errorf("error: namespace %s runtime: %w", namespace, err)
+		}
+		n.namespaces = append(n.namespaces, namespace)
+		n.runtimes[namespace] = runtime
+	}
+	return n, nil
+}
+
+func (n *Namespaces) shutdownCreated() {
+	for _, runtime := range n.runtimes {
+		_ = runtime.Shutdown(context.Background())
+	}
+}
+
+// Runtime returns the namespace's runtime, nil if there is none
+func (n *Namespaces) Runtime(namespace string) *Runtime {
+	return n.runtimes[namespace]
+}
+
+// Each calls f for every namespace in the creation order, stops on the first error
+func (n *Namespaces) Each(f func(namespace string, runtime *Runtime) error) error {
+	for _, namespace := range n.namespaces {
+		if err := f(namespace, n.runtimes[namespace]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start starts all the runtimes on the cache config (namespaced per runtime), blocks as Runtime.Start does
+// until one of them returns
+func (n *Namespaces) Start(cacheConfig *cache.Config, onAfterStart func(runtime *Runtime) error) error {
+	done := make(chan error, len(n.namespaces))
+	for _, namespace := range n.namespaces {
+		runtime := n.runtimes[namespace]
+		go func() {
+			done <- runtime.Start(cacheConfig, onAfterStart)
+		}()
+	}
+	return <-done
+}
+
+// Shutdown shuts all the runtimes down, returns the first error
+func (n *Namespaces) Shutdown(ctx context.Context) error {
+	var firstErr error
+	for _, namespace := range n.namespaces {
+		if err := n.runtimes[namespace].Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
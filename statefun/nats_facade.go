@@ -0,0 +1,120 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+
+	sdkErrors "github.com/foliagecp/sdk/errors"
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+/*
+NATS facade gives handlers of a typename restricted access to NATS for integrations instead of their own connections
+(StatefunContextProcessor.Nats): publishing to subjects and reading streams approved for the typename with
+FunctionTypeConfig.SetNatsAccess, subject patterns are NATS-like ("*" - one token, ">" - the rest).
+Subjects and streams of the runtime itself are never allowed, even if approved by a pattern: subjects of function
+types, requests, inboxes, debug captures, dead letters, the JetStream/KV/object store/system API, and KV or object
+store streams. Messages go through the current messaging connection (see nats_failover.go).
+*/
+
+var (
+	natsFacadeDeniedSubjects = []string{"_INBOX.>", "$JS.>", "$KV.>", "$O.>", "$SYS.>", "$SRV.>", DebugCaptureSubjectPrefix + ".>", DeadLetterSubjectPrefix + ".>"}
+	natsFacadeDeniedStreams  = []string{"KV_", "OBJ_"}
+)
+
+func (ft *FunctionType) newNatsFacade() *sfPlugins.NatsFacade {
+	return &sfPlugins.NatsFacade{
+		Publish: func(subject string, data []byte, header map[string][]string) error {
+			if err := ft.natsPublishAllowed(subject); err != nil {
+				return err
+			}
+			nc, _ := ft.runtime.messaging()
+			return nc.PublishMsg(&nats.Msg{Subject: subject, Data: data, Header: header})
+		},
+		PublishJetStream: func(subject string, data []byte, header map[string][]string) (uint64, error) {
+			if err := ft.natsPublishAllowed(subject); err != nil {
+				return 0, err
+			}
+			_, js := ft.runtime.messaging()
+			ack, err := js.PublishMsg(&nats.Msg{Subject: subject, Data: data, Header: header})
+			if err != nil {
+				return 0, err
+			}
+			return ack.Sequence, nil
+		},
+		GetStreamMsg: func(stream string, sequence uint64) (*sfPlugins.NatsStreamMsg, error) {
+			if err := ft.natsReadAllowed(stream); err != nil {
+				return nil, err
+			}
+			_, js := ft.runtime.messaging()
+			return natsStreamMsg(js.GetMsg(stream, sequence))
+		},
+		GetLastStreamMsg: func(stream string, subject string) (*sfPlugins.NatsStreamMsg, error) {
+			if err := ft.natsReadAllowed(stream); err != nil {
+				return nil, err
+			}
+			_, js := ft.runtime.messaging()
+			return natsStreamMsg(js.GetLastMsg(stream, subject))
+		},
+	}
+}
+
+func (ft *FunctionType) natsPublishAllowed(subject string) error {
+	if len(subject) == 0 || strings.ContainsAny(subject, "*> \t") {
+		return fmt.Errorf("error: invalid subject %q", subject)
+	}
+	denied := append([]string{}, natsFacadeDeniedSubjects...)
+	denied = append(denied, ft.runtime.namespacedSubject(DebugCaptureSubjectPrefix)+".>", ft.runtime.namespacedSubject(DeadLetterSubjectPrefix)+".>")
+	denied = append(denied, ft.runtime.namespacedSubject(CapabilitiesSubject), ft.runtime.namespacedSubject(CapabilitiesSubject)+".>")
+	denied = append(denied, ft.runtime.namespacedSubject(PluginReloadSubject))
+	_, legacyRequest := ft.runtime.legacyTemplates()
+	for _, t := range []subjectTemplate{ft.runtime.config.requestSubjectTemplate, legacyRequest} {
+		if reserved := t.reservedPattern(); len(reserved) > 0 {
+			denied = append(denied, reserved)
+		}
+	}
+	for _, registered := range ft.runtime.registeredFunctionTypes {
+		for _, source := range registered.signalSources() {
+			denied = append(denied, source.subject)
+		}
+		denied = append(denied, registered.requestSubjects()...)
+		denied = append(denied, registered.nodeRequestSubjects()...)
+	}
+	for _, pattern := range denied {
+		if cache.KeyMatchesPattern(subject, pattern) {
+			return sdkErrors.Newf(sdkErrors.ErrUnauthorized, "error: subject %s is reserved by the runtime", subject)
+		}
+	}
+	for _, pattern := range ft.config.natsPublishSubjects {
+		if cache.KeyMatchesPattern(subject, pattern) {
+			return nil
+		}
+	}
+	return sdkErrors.Newf(sdkErrors.ErrUnauthorized, "error: publishing to %s is not approved for %s", subject, ft.name)
+}
+
+func (ft *FunctionType) natsReadAllowed(stream string) error {
+	for _, prefix := range natsFacadeDeniedStreams {
+		if strings.HasPrefix(stream, prefix) {
+			return sdkErrors.Newf(sdkErrors.ErrUnauthorized, "error: stream %s is reserved by the runtime", stream)
+		}
+	}
+	for _, approved := range ft.config.natsReadStreams {
+		if stream == approved {
+			return nil
+		}
+	}
+	return sdkErrors.Newf(sdkErrors.ErrUnauthorized, "error: reading stream %s is not approved for %s", stream, ft.name)
+}
+
+func natsStreamMsg(msg *nats.RawStreamMsg, err error) (*sfPlugins.NatsStreamMsg, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &sfPlugins.NatsStreamMsg{Subject: msg.Subject, Sequence: msg.Sequence, Header: msg.Header, Data: msg.Data, Time: msg.Time}, nil
+}
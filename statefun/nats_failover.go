@@ -0,0 +1,210 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+NATS failover moves the runtime to fallback servers (RuntimeConfig.SetNatsFallbackURLs), e.g. a DR cluster:
+
+	NatsFailoverAll - one connection to the primary and the fallback servers, tried in this order. If the primary
+		servers are lost the connection moves to the fallback ones with KV and messaging at once. Reconnecting
+		to another cluster recreates streams, consumers and subscriptions there, the fallback cluster must have
+		the KV bucket (e.g. as a replica).
+	NatsFailoverMessagingOnly - KV stays on the primary connection, signals and requests move to a separate
+		connection to the fallback servers once the primary failed the configured health checks in a row, and
+		move back after the primary passed as many.
+
+Moved messaging recreates function streams, consumers, request subscriptions and micro services on the new
+connection, messages taken from the old one are still acked through it.
+*/
+
+type NatsFailoverMode int
+
+const (
+	NatsFailoverAll NatsFailoverMode = iota
+	NatsFailoverMessagingOnly
+
+	NatsHealthCheckIntervalMs = 1000
+	NatsHealthCheckFailures   = 3
+)
+
+// Connects to the primary servers, in NatsFailoverAll mode with the fallback ones after them
+func (r *Runtime) connectNats() (err error) {
+	url := r.config.natsURL
+	options := r.natsLifecycleOptions() // Its reconnect handler moves subscriptions in NatsFailoverAll mode too
+	if len(r.config.natsFallbackURLs) > 0 {
+		options = append(options, nats.MaxReconnects(-1), nats.DontRandomize())
+		if r.config.natsFailoverMode == NatsFailoverAll {
+			url = strings.Join(append([]string{url}, r.config.natsFallbackURLs...), ",")
+		}
+	}
+	if r.nc, err = nats.Connect(url, options...); err != nil {
+		return
+	}
+	if r.js, err = r.nc.JetStream(nats.PublishAsyncMaxPending(256)); err != nil {
+		return
+	}
+	r.msgNC, r.msgJS = r.nc, r.js
+	r.natsCluster = natsClusterOf(r.nc)
+	return
+}
+
+// Cluster name, the server id for servers not in a cluster
+func natsClusterOf(nc *nats.Conn) string {
+	if name := nc.ConnectedClusterName(); len(name) > 0 {
+		return name
+	}
+	return nc.ConnectedServerId()
+}
+
+// Connection signals and requests go through
+func (r *Runtime) messaging() (*nats.Conn, nats.JetStreamContext) {
+	r.messagingMutex.RLock()
+	defer r.messagingMutex.RUnlock()
+	return r.msgNC, r.msgJS
+}
+
+// Creates streams of function types and optional streams on the connection if they do not exist
+func (r *Runtime) ensureStreams(js nats.JetStreamContext) {
+	/* Each stream contains a single subject (topic).
+	 * Differently named stream with overlapping subjects cannot exist!
+	 */
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var existingStreams []string
+	for info := range js.StreamsInfo(nats.Context(ctx)) {
+		existingStreams = append(existingStreams, info.Config.Name)
+	}
+	for _, functionType := range r.registeredFunctionTypes {
+		for _, source := range functionType.signalSources() {
+			if !slices.Contains(existingStreams, streamNameOf(source.subject)) {
+				_, err := js.AddStream(&nats.StreamConfig{
+					Name:     streamNameOf(source.subject),
+					Subjects: []string{source.subject},
+				})
+				system.MsgOnErrorReturn(err)
+			}
+		}
+	}
+	system.MsgOnErrorReturn(r.createDebugCaptureStreamIfNeeded(js, existingStreams))
+	system.MsgOnErrorReturn(r.createDeadLetterStreamIfNeeded(js, existingStreams))
+}
+
+func (r *Runtime) onNatsReconnected(nc *nats.Conn) {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("runtime-onNatsReconnected")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime-onNatsReconnected")
+	cluster := natsClusterOf(nc)
+	lg.Logf(lg.WarnLevel, "Reconnected to NATS %s (cluster %q)\n", nc.ConnectedUrlRedacted(), cluster)
+
+	r.messagingMutex.Lock()
+	moved := cluster != r.natsCluster
+	r.natsCluster = cluster
+	r.messagingMutex.Unlock()
+	if moved {
+		r.resubscribe()
+	}
+}
+
+func (r *Runtime) runNatsHealthCheck() {
+	if len(r.config.natsFallbackURLs) == 0 || r.config.natsFailoverMode != NatsFailoverMessagingOnly {
+		return
+	}
+	system.GlobalPrometrics.GetRoutinesCounter().Started("runtime-natsHealthCheck")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime-natsHealthCheck")
+
+	interval := time.Duration(r.config.natsHealthCheckIntervalMs) * time.Millisecond
+	onFallback := false
+	checksInRow := 0 // Failed ones on the primary, passed ones on the fallback
+	for {
+		select {
+		case <-r.stopped:
+			return
+		case <-time.After(interval):
+		}
+		healthy := r.nc.IsConnected() && r.nc.FlushTimeout(interval) == nil
+		if healthy == onFallback {
+			checksInRow++
+		} else {
+			checksInRow = 0
+		}
+		if checksInRow < r.config.natsHealthCheckFailures {
+			continue
+		}
+		checksInRow = 0
+
+		if !onFallback {
+			lg.Logf(lg.WarnLevel, "Primary NATS failed %d health checks, moving messaging to the fallback\n", r.config.natsHealthCheckFailures)
+			if err := r.switchMessagingToFallback(); err != nil {
+				lg.Logf(lg.ErrorLevel, "Moving messaging to the fallback NATS failed: %s\n", err)
+				continue
+			}
+		} else {
+			lg.Logf(lg.InfoLevel, "Primary NATS is healthy again, moving messaging back\n")
+			r.messagingMutex.Lock()
+			r.msgNC, r.msgJS = r.nc, r.js
+			r.messagingMutex.Unlock()
+		}
+		onFallback = !onFallback
+		r.resubscribe()
+	}
+}
+
+// The fallback connection is made on the first failover and kept open after moving back
+func (r *Runtime) switchMessagingToFallback() error {
+	r.messagingMutex.RLock()
+	nc, js := r.fallbackNC, r.fallbackJS
+	r.messagingMutex.RUnlock()
+	if nc == nil {
+		var err error
+		if nc, err = nats.Connect(strings.Join(r.config.natsFallbackURLs, ","), nats.MaxReconnects(-1), nats.DontRandomize()); err != nil {
+			return err
+		}
+		if js, err = nc.JetStream(nats.PublishAsyncMaxPending(256)); err != nil {
+			nc.Close()
+			return err
+		}
+	}
+	r.messagingMutex.Lock()
+	r.fallbackNC, r.fallbackJS = nc, js
+	r.msgNC, r.msgJS = nc, js
+	r.messagingMutex.Unlock()
+	return nil
+}
+
+// Recreates streams and sources of the started function types on the current messaging connection
+func (r *Runtime) resubscribe() {
+	r.sourcesMutex.Lock()
+	defer r.sourcesMutex.Unlock()
+	if r.stopping.Load() {
+		return
+	}
+	_, js := r.messaging()
+	r.ensureStreams(js)
+	for _, ft := range r.registeredFunctionTypes {
+		if !ft.sourcesStarted {
+			continue
+		}
+		for _, sub := range ft.subscriptions {
+			if err := sub.Drain(); err != nil {
+				system.MsgOnErrorReturn(sub.Unsubscribe())
+			}
+		}
+		ft.subscriptions = nil
+		if ft.microService != nil {
+			system.MsgOnErrorReturn(ft.microService.Stop())
+			ft.microService = nil
+		}
+		ft.startSources()
+	}
+}
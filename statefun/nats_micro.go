@@ -0,0 +1,97 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"strings"
+
+	"github.com/foliagecp/easyjson"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+
+	"github.com/nats-io/nats.go/micro"
+)
+
+const (
+	MicroServiceVersion = "1.0.0"
+)
+
+// Serves typename's requests as a NATS micro service instead of a raw subscription, so standard NATS tooling
+// (nats micro ls/info/stats) can discover and observe it. Requests are load balanced between runtime instances
+func AddRequestSourceNatsMicro(ft *FunctionType) error {
+	serviceName := strings.NewReplacer(".", "_", "*", "_", ">", "_").Replace(ft.name)
+
+	metadata := map[string]string{}
+	for k, v := range ft.config.microServiceMetadata {
+		metadata[k] = v
+	}
+	metadata["typename"] = ft.name
+
+	endpointMetadata := map[string]string{}
+	if len(ft.config.microServiceRequestSchema) > 0 {
+		endpointMetadata["request_schema"] = ft.config.microServiceRequestSchema
+	}
+	if len(ft.config.microServiceReplySchema) > 0 {
+		endpointMetadata["reply_schema"] = ft.config.microServiceReplySchema
+	}
+
+	subjects := ft.requestSubjects()
+	handler := micro.HandlerFunc(func(req micro.Request) { system.MsgOnErrorReturn(handleMicroRequest(ft, req)) })
+	nc, _ := ft.runtime.messaging()
+	service, err := micro.AddService(nc, micro.Config{
+		Name:        serviceName,
+		Version:     ft.config.microServiceVersion,
+		Description: ft.config.microServiceDescription,
+		Metadata:    metadata,
+		Endpoint: &micro.EndpointConfig{
+			Subject:  subjects[0],
+			Handler:  handler,
+			Metadata: endpointMetadata,
+		},
+	})
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Invalid micro service for function type %s: %s\n", ft.name, err)
+		return err
+	}
+	ft.microService = service
+	for _, legacy := range subjects[1:] { // Compatibility mode
+		if err := service.AddEndpoint("legacy", handler, micro.WithEndpointSubject(legacy), micro.WithEndpointMetadata(endpointMetadata)); err != nil {
+			lg.Logf(lg.ErrorLevel, "Invalid legacy micro service endpoint for function type %s: %s\n", ft.name, err)
+			return err
+		}
+	}
+	for _, node := range ft.nodeRequestSubjects() {
+		if err := service.AddEndpoint("node", handler, micro.WithEndpointSubject(node), micro.WithEndpointMetadata(endpointMetadata)); err != nil {
+			lg.Logf(lg.ErrorLevel, "Invalid node micro service endpoint for function type %s: %s\n", ft.name, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func handleMicroRequest(ft *FunctionType, req micro.Request) error {
+	id, functionMsg, err := natsDataToFunctionMsg(ft, req.Subject(), req.Data())
+	if err != nil {
+		system.MsgOnErrorReturn(req.Error("400", err.Error(), nil))
+		return err
+	}
+
+	functionMsg.RequestCallback = func(data *easyjson.JSON) {
+		system.MsgOnErrorReturn(req.Respond(ft.e2eReplyBytes(functionMsg.Caller.Typename, data)))
+	}
+	functionMsg.RefusalCallback = func() {
+		// Counted as an error in the service stats
+		system.MsgOnErrorReturn(req.Error("503", "request refused", nil))
+	}
+	if functionMsg.ReplyStream {
+		nextChunkHeader := chunkHeaders()
+		functionMsg.StreamCallback = func(data *easyjson.JSON) {
+			system.MsgOnErrorReturn(req.Respond(ft.e2eReplyBytes(functionMsg.Caller.Typename, data), micro.WithHeaders(micro.Headers(nextChunkHeader()))))
+		}
+	}
+
+	ft.sendMsg(id, functionMsg)
+
+	return nil
+}
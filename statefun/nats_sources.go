@@ -3,6 +3,7 @@ package statefun
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	lg "github.com/foliagecp/sdk/statefun/logger"
@@ -14,38 +15,76 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
+const (
+	pullConsumerFetchWait = 1 * time.Second
+)
+
+// Subscribes the function type to its signals and requests on the runtime's messaging connection
+func (ft *FunctionType) startSources() {
+	if ft.config.pullConsumerMaxPending > 0 {
+		system.MsgOnErrorReturn(AddSignalSourceJetstreamQueuePullConsumer(ft))
+	} else {
+		system.MsgOnErrorReturn(AddSignalSourceJetstreamQueuePushConsumer(ft))
+	}
+	if ft.config.serviceActive {
+		if ft.config.microServiceActive {
+			system.MsgOnErrorReturn(AddRequestSourceNatsMicro(ft))
+		} else {
+			system.MsgOnErrorReturn(AddRequestSourceNatsCore(ft))
+		}
+	}
+}
+
 func AddRequestSourceNatsCore(ft *FunctionType) error {
-	_, err := ft.runtime.nc.Subscribe(fmt.Sprintf("service.%s", ft.subject), func(msg *nats.Msg) {
-		system.MsgOnErrorReturn(handleNatsMsg(ft, msg, true, nil))
-	})
+	nc, _ := ft.runtime.messaging()
+	for _, subject := range append(ft.requestSubjects(), ft.nodeRequestSubjects()...) {
+		sub, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+			system.MsgOnErrorReturn(handleNatsMsg(ft, msg, true, nil, nil))
+		})
 
-	if err != nil {
-		lg.Logf(lg.ErrorLevel, "Invalid request reply subscription for function type %s: %s\n", ft.name, err)
-		return err
+		if err != nil {
+			lg.Log(lg.ErrorLevel, "Invalid request reply subscription", "typename", ft.name, "subject", subject, "error", err)
+			return err
+		}
+		ft.subscriptions = append(ft.subscriptions, sub)
 	}
 
 	return nil
 }
 
 func AddSignalSourceJetstreamQueuePushConsumer(ft *FunctionType) error {
-	consumerName := strings.ReplaceAll(ft.name, ".", "")
+	for _, source := range ft.signalSources() {
+		if err := addSignalSourceJetstreamQueuePushConsumer(ft, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Each signal source has its own stream and consumer
+func addSignalSourceJetstreamQueuePushConsumer(ft *FunctionType, source signalSource) error {
+	_, js := ft.runtime.messaging()
+	subject := source.subject
+	streamName := streamNameOf(subject)
+	consumerName := strings.ReplaceAll(ft.name, ".", "") + source.suffix
 	consumerGroup := consumerName + "-group"
 	lg.Logf(lg.TraceLevel, "Handling function type %s\n", ft.name)
 
 	// Create stream consumer if does not exist ---------------------
 	consumerExists := false
-	for info := range ft.runtime.js.Consumers(ft.getStreamName(), nats.MaxWait(10*time.Second)) {
+	for info := range js.Consumers(streamName, nats.MaxWait(10*time.Second)) {
 		if info.Name == consumerName {
 			consumerExists = true
 		}
 	}
 	if !consumerExists {
-		_, err := ft.runtime.js.AddConsumer(ft.getStreamName(), &nats.ConsumerConfig{
+		_, err := js.AddConsumer(streamName, &nats.ConsumerConfig{
 			Name:           consumerName,
 			Durable:        consumerName,
 			DeliverSubject: consumerName,
 			DeliverGroup:   consumerGroup,
-			FilterSubject:  ft.subject,
+			FilterSubject:  subject,
+			MaxAckPending:  source.maxPending,
 			AckPolicy:      nats.AckExplicitPolicy,
 			AckWait:        time.Duration(ft.config.msgAckWaitMs) * time.Millisecond, // AckWait should be long due to async message Ack
 		})
@@ -53,79 +92,167 @@ func AddSignalSourceJetstreamQueuePushConsumer(ft *FunctionType) error {
 	}
 	// --------------------------------------------------------------
 
-	// For auto message acking msg ----------------------------------
-	msgAcker := func(msgAckChannel chan *nats.Msg) {
-		system.GlobalPrometrics.GetRoutinesCounter().Started("AddSignalSourceJetstreamQueuePushConsumer-msgAcker")
-		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("AddSignalSourceJetstreamQueuePushConsumer-msgAcker")
-		for msg := range msgAckChannel {
-			system.MsgOnErrorReturn(msg.Ack())
-		}
-	}
-	msgAckChannel := make(chan *nats.Msg, ft.config.msgAckChannelSize)
-	go msgAcker(msgAckChannel)
-	// --------------------------------------------------------------
+	msgAckChannel := startMsgAcker(ft)
 
-	_, err := ft.runtime.js.QueueSubscribe(
-		ft.subject,
+	sub, err := js.QueueSubscribe(
+		subject,
 		consumerGroup,
 		func(msg *nats.Msg) {
-			system.MsgOnErrorReturn(handleNatsMsg(ft, msg, false, msgAckChannel))
+			system.MsgOnErrorReturn(handleNatsMsg(ft, msg, false, msgAckChannel, nil))
 		},
-		nats.Bind(ft.getStreamName(), consumerName),
+		nats.Bind(streamName, consumerName),
 		nats.ManualAck(),
 	)
 	if err != nil {
-		lg.Logf(lg.ErrorLevel, "Invalid signal subscription for function type %s: %s\n", ft.name, err)
+		lg.Log(lg.ErrorLevel, "Invalid signal subscription", "typename", ft.name, "subject", subject, "error", err)
 		return err
 	}
+	ft.subscriptions = append(ft.subscriptions, sub)
 	return nil
 }
 
-func handleNatsMsg(ft *FunctionType, msg *nats.Msg, requestReply bool, msgAckChannel chan *nats.Msg) (err error) {
-	tokens := strings.Split(msg.Subject, ".")
-	id := tokens[len(tokens)-1]
+// Signals are pulled in batches of free pending slots, each slot is freed once its signal is acked or refused
+func AddSignalSourceJetstreamQueuePullConsumer(ft *FunctionType) error {
+	for _, source := range ft.signalSources() {
+		if err := addSignalSourceJetstreamQueuePullConsumer(ft, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	data, ok := easyjson.JSONFromBytes(msg.Data)
-	if !ok {
-		system.MsgOnErrorReturn(msg.Ack())
-		return fmt.Errorf("nats.Msg for function %s with id=%s is not a JSON\n", ft.name, id)
+func addSignalSourceJetstreamQueuePullConsumer(ft *FunctionType, source signalSource) error {
+	_, js := ft.runtime.messaging()
+	subject := source.subject
+	streamName := streamNameOf(subject)
+	consumerName := strings.ReplaceAll(ft.name, ".", "") + "-pull" + source.suffix
+	maxPending := ft.config.pullConsumerMaxPending
+	if source.maxPending > 0 && source.maxPending < maxPending {
+		maxPending = source.maxPending
 	}
+	lg.Logf(lg.TraceLevel, "Handling function type %s with pull consumer\n", ft.name)
 
-	var payload *easyjson.JSON
-	if data.GetByPath("payload").IsObject() {
-		j := data.GetByPath("payload")
-		payload = &j
-	} else {
-		j := easyjson.NewJSONObject()
-		payload = &j
+	// Create stream consumer if does not exist ---------------------
+	consumerExists := false
+	for info := range js.Consumers(streamName, nats.MaxWait(10*time.Second)) {
+		if info.Name == consumerName {
+			consumerExists = true
+		}
+	}
+	if !consumerExists {
+		_, err := js.AddConsumer(streamName, &nats.ConsumerConfig{
+			Name:          consumerName,
+			Durable:       consumerName,
+			FilterSubject: subject,
+			AckPolicy:     nats.AckExplicitPolicy,
+			AckWait:       time.Duration(ft.config.msgAckWaitMs) * time.Millisecond,
+		})
+		system.MsgOnErrorReturn(err)
 	}
+	// --------------------------------------------------------------
 
-	var msgOptions *easyjson.JSON
-	if data.GetByPath("options").IsObject() {
-		msgOptions = data.GetByPath("options").GetPtr()
+	msgAckChannel := startMsgAcker(ft)
+
+	sub, err := js.PullSubscribe(subject, consumerName, nats.Bind(streamName, consumerName), nats.ManualAck())
+	if err != nil {
+		lg.Log(lg.ErrorLevel, "Invalid signal pull subscription", "typename", ft.name, "subject", subject, "error", err)
+		return err
+	}
+	ft.subscriptions = append(ft.subscriptions, sub)
+
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("AddSignalSourceJetstreamQueuePullConsumer-fetcher")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("AddSignalSourceJetstreamQueuePullConsumer-fetcher")
+
+		pendingSlots := make(chan struct{}, maxPending)
+		for sub.IsValid() {
+			// Waiting for at least one free slot, taking all the free ones
+			pendingSlots <- struct{}{}
+			batch := 1
+		freeSlots:
+			for batch < maxPending {
+				select {
+				case pendingSlots <- struct{}{}:
+					batch++
+				default:
+					break freeSlots
+				}
+			}
+
+			msgs, err := sub.Fetch(batch, nats.MaxWait(pullConsumerFetchWait))
+			for i := len(msgs); i < batch; i++ {
+				<-pendingSlots
+			}
+			if err != nil && err != nats.ErrTimeout && sub.IsValid() {
+				lg.Log(lg.ErrorLevel, "Signal pull failed", "typename", ft.name, "subject", subject, "error", err)
+				time.Sleep(pullConsumerFetchWait)
+			}
+			for _, msg := range msgs {
+				system.MsgOnErrorReturn(handleNatsMsg(ft, msg, false, msgAckChannel, func() { <-pendingSlots }))
+			}
+		}
+	}()
+	return nil
+}
+
+// For auto message acking msg, returns the channel signals to be acked are sent to,
+// the acker is started once and serves sources recreated later
+func startMsgAcker(ft *FunctionType) chan *nats.Msg {
+	if ft.msgAckChannel != nil {
+		return ft.msgAckChannel
+	}
+	msgAckChannel := make(chan *nats.Msg, ft.config.msgAckChannelSize)
+	ft.msgAckChannel = msgAckChannel
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("AddSignalSourceJetstreamQueuePushConsumer-msgAcker")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("AddSignalSourceJetstreamQueuePushConsumer-msgAcker")
+		for msg := range msgAckChannel {
+			system.MsgOnErrorReturn(msg.Ack())
+		}
+	}()
+	return msgAckChannel
+}
+
+// done (if not nil) is called once the message is acked or refused
+func handleNatsMsg(ft *FunctionType, msg *nats.Msg, requestReply bool, msgAckChannel chan *nats.Msg, done func()) (err error) {
+	if done != nil {
+		var doneOnce sync.Once
+		d := done
+		done = func() { doneOnce.Do(d) }
 	} else {
-		msgOptions = easyjson.NewJSONObject().GetPtr()
+		done = func() {}
 	}
 
-	caller := sfPlugins.StatefunAddress{}
-	if data.GetByPath("caller_typename").IsString() && data.GetByPath("caller_id").IsString() {
-		caller.Typename, _ = data.GetByPath("caller_typename").AsString()
-		caller.ID, _ = data.GetByPath("caller_id").AsString()
+	id, functionMsg, err := natsDataToFunctionMsg(ft, msg.Subject, msg.Data)
+	if err != nil {
+		system.MsgOnErrorReturn(msg.Ack())
+		done()
+		return err
 	}
 
-	// Create function message ------------------------
-	functionMsg := FunctionTypeMsg{
-		Caller:  &caller,
-		Payload: payload,
-		Options: msgOptions,
+	if !requestReply && ft.deadLetterIfUndeliverable(msg, id, functionMsg) {
+		system.MsgOnErrorReturn(msg.Ack())
+		done()
+		return nil
 	}
+
+	if idempotencyKey := msg.Header.Get(IdempotencyKeyHeader); len(idempotencyKey) > 0 {
+		functionMsg.Options.SetByPath(IdempotencyKeyOption, easyjson.NewJSON(idempotencyKey))
+	}
+
 	if requestReply {
 		functionMsg.RequestCallback = func(data *easyjson.JSON) {
-			system.MsgOnErrorReturn(msg.Respond(data.ToBytes()))
+			system.MsgOnErrorReturn(msg.Respond(ft.e2eReplyBytes(functionMsg.Caller.Typename, data)))
 		}
 		functionMsg.RefusalCallback = func() {
 			system.MsgOnErrorReturn(msg.Respond([]byte{}))
 		}
+		if functionMsg.ReplyStream {
+			nextChunkHeader := chunkHeaders()
+			functionMsg.StreamCallback = func(data *easyjson.JSON) {
+				system.MsgOnErrorReturn(msg.RespondMsg(&nats.Msg{Header: nextChunkHeader(), Data: ft.e2eReplyBytes(functionMsg.Caller.Typename, data)}))
+			}
+		}
 	} else {
 		functionMsg.AckCallback = func(ack bool) {
 			if ack {
@@ -135,14 +262,62 @@ func handleNatsMsg(ft *FunctionType, msg *nats.Msg, requestReply bool, msgAckCha
 			} else {
 				system.MsgOnErrorReturn(msg.Nak())
 			}
+			done()
 		}
 		functionMsg.RefusalCallback = func() {
 			system.MsgOnErrorReturn(msg.Nak())
+			done()
 		}
 	}
-	// ------------------------------------------------
 
 	ft.sendMsg(id, functionMsg)
 
 	return
 }
+
+// Parses message data into a function message without callbacks, id is taken from the subject by its template
+func natsDataToFunctionMsg(ft *FunctionType, subject string, msgData []byte) (string, FunctionTypeMsg, error) {
+	id, err := ft.idFromSubject(subject)
+	if err != nil {
+		return id, FunctionTypeMsg{}, err
+	}
+
+	data, ok := easyjson.JSONFromBytes(msgData)
+	if !ok {
+		return id, FunctionTypeMsg{}, fmt.Errorf("nats.Msg for function %s with id=%s is not a JSON\n", ft.name, id)
+	}
+
+	var payload *easyjson.JSON
+	if data.GetByPath("payload").IsObject() {
+		j := data.GetByPath("payload")
+		payload = &j
+	} else {
+		j := easyjson.NewJSONObject()
+		payload = &j
+	}
+
+	var msgOptions *easyjson.JSON
+	if data.GetByPath("options").IsObject() {
+		msgOptions = data.GetByPath("options").GetPtr()
+	} else {
+		msgOptions = easyjson.NewJSONObject().GetPtr()
+	}
+
+	caller := sfPlugins.StatefunAddress{}
+	if data.GetByPath("caller_typename").IsString() && data.GetByPath("caller_id").IsString() {
+		caller.Typename, _ = data.GetByPath("caller_typename").AsString()
+		caller.ID, _ = data.GetByPath("caller_id").AsString()
+	}
+
+	payload, err = ft.runtime.e2eReceive(caller.Typename, ft.name, payload)
+	if err != nil {
+		return id, FunctionTypeMsg{}, fmt.Errorf("payload for function %s with id=%s from %s: %s", ft.name, id, caller.Typename, err)
+	}
+
+	return id, FunctionTypeMsg{
+		Caller:      &caller,
+		Payload:     payload,
+		Options:     msgOptions,
+		ReplyStream: data.GetByPath("reply_stream").AsBoolDefault(false),
+	}, nil
+}
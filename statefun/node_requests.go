@@ -0,0 +1,83 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Node requests address a specific runtime instance instead of any runtime serving the typename, e.g. for admin
+operations like dumping the node's local cache stats or draining it. Every runtime has a node id
+(RuntimeConfig.SetNodeID, a unique one is generated if not set, see Runtime.NodeID) and serves the requests of its
+function types also on:
+
+	node.<node id>.<request subject>
+
+A request is sent to the node with the option:
+
+	"__node": "<node id>"
+
+it fails with RequestTimeoutError if the node is gone or does not serve the typename. A golang local request with the
+option succeeds only if the node is the local runtime.
+*/
+
+const (
+	NodeOption               = "__node"
+	NodeRequestSubjectPrefix = "node"
+)
+
+// Generates the node id if not set
+func (ro *RuntimeConfig) applyNodeID() error {
+	if len(ro.nodeID) == 0 {
+		ro.nodeID = system.GetUniqueStrID()
+		return nil
+	}
+	if !subjectTokenRegexp.MatchString(ro.nodeID) {
+		return fmt.Errorf("error: invalid node id %q, only letters, digits, \"_\" and \"-\" are allowed", ro.nodeID)
+	}
+	return nil
+}
+
+// NodeID of the runtime requests with the NodeOption are addressed to
+func (r *Runtime) NodeID() string {
+	return r.config.nodeID
+}
+
+func nodeSubject(namespace string, nodeID string, subject string) string {
+	return namespacedSubject(namespace, NodeRequestSubjectPrefix+"."+nodeID+"."+subject)
+}
+
+// Subject without the node prefix of the runtime
+func (r *Runtime) trimNodePrefix(subject string) string {
+	return strings.TrimPrefix(subject, nodeSubject(r.config.namespace, r.config.nodeID, ""))
+}
+
+func nodeOf(options *easyjson.JSON) string {
+	if options == nil {
+		return ""
+	}
+	return options.GetByPath(NodeOption).AsStringDefault("")
+}
+
+// Subject the request is sent to with respect to its node
+func (r *Runtime) nodeRequestSubject(typename string, id string, options *easyjson.JSON) string {
+	if node := nodeOf(options); len(node) > 0 {
+		return nodeSubject(r.config.namespace, node, r.requestSubject(typename, id))
+	}
+	return r.requestSubject(typename, id)
+}
+
+// Request subject patterns of the function type addressed to the runtime's node
+func (ft *FunctionType) nodeRequestSubjects() []string {
+	subjects := []string{}
+	for _, subject := range ft.requestSubjects() {
+		subjects = append(subjects, nodeSubject(ft.runtime.config.namespace, ft.runtime.config.nodeID, subject))
+	}
+	return subjects
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Per-id ordering guarantees that messages of the same (typename, id) are handled serially while different ids run in
+parallel (FunctionTypeConfig.SetOrderedPerID). Without it serial handling holds for an id handler routine only:
+
+  - a routine garbage collected while its handler still runs (the handler took longer than the id's lifetime)
+    keeps handling its queued messages while a new message starts a new routine for the same id
+  - runtimes sharing the typename's queue consumers handle messages of the same id at once
+
+With the option a new routine of an id waits for the previous one to finish, and if the typename may run in
+multiple instances every message is handled under the id's KV context mutex (ContextMutexLock), so a runtime handling
+a message of the id waits for the one handling another. The KV mutex costs two KV round trips per message and is held
+no longer than kvMutexLifeTimeSec, handlers must finish in it. Signals are still handled in delivery order, which is not
+the sending order after redeliveries.
+*/
+
+// Starts the id's handler routine after the previous one of the id exits
+func (ft *FunctionType) startOrderedIDHandlerRoutine(id string, msgChannel chan FunctionTypeMsg) {
+	done := make(chan struct{})
+	var previous chan struct{}
+	if v, ok := ft.idHandlersDone.Load(id); ok {
+		previous = v.(chan struct{})
+	}
+	ft.idHandlersDone.Store(id, done)
+
+	go func() {
+		if previous != nil {
+			<-previous
+		}
+		ft.idHandlerRoutine(id, msgChannel)
+		close(done)
+
+		ft.idKeyMutex.Lock(id)
+		if v, ok := ft.idHandlersDone.Load(id); ok && v.(chan struct{}) == done {
+			ft.idHandlersDone.Delete(id)
+		}
+		ft.idKeyMutex.Unlock(id)
+	}()
+}
+
+// Messages of an id are handled under its KV context mutex
+func (ft *FunctionType) clusterOrderedPerID() bool {
+	return ft.config.orderedPerID && ft.config.multipleInstancesAllowed
+}
+
+// Locks the id's KV context mutex if needed, returns the unlock; refuses the message if locking failed
+func (ft *FunctionType) lockOrderedID(id string, msg FunctionTypeMsg) (unlock func(), ok bool) {
+	if !ft.clusterOrderedPerID() {
+		return func() {}, true
+	}
+	revisionID, err := ContextMutexLock(ft, id, false)
+	if err != nil {
+		lg.Log(lg.ErrorLevel, "Ordered id context mutex lock failed", "typename", ft.name, "id", id, "error", err)
+		if msg.RefusalCallback != nil {
+			msg.RefusalCallback()
+		}
+		return nil, false
+	}
+	return func() { system.MsgOnErrorReturn(ContextMutexUnlock(ft, id, revisionID)) }, true
+}
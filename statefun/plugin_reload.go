@@ -0,0 +1,234 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Executor plugins (JS, WASM, Python) of a typename are reloaded without restarting the runtime. The source is built
+once to check it, keeping the current one on failures, then every id gets its own executor built from the new source
+on its next message, so ids stay isolated from each other. Reloading:
+
+	ft.SetExecutorFile("counter.js", true, sfPluginJS.StatefunExecutorPluginJSContructor) // Reloaded on the file's changes
+	err := ft.ReloadExecutor(newSource)                                                  // This runtime only
+	results, err := runtime.ReloadPlugin("functions.app.counter", newSource, time.Second)  // All the namespace's runtimes
+
+or by the PluginReloadTypename function type (RegisterPluginReloadFunctionType) for operators:
+
+	{"typename": ..., "source": ...}
+
+replying {"status": "ok" | "failed", "result": [{"node_id": ..., "result": "ok" | error}]}. Runtimes reload on the
+plugin.reload core NATS subject, an empty source rereads the file set by SetExecutorFile. A source replaced over NATS
+runs on the host (a Python script does not even need a sandbox escape), so the subject is served only with
+RuntimeConfig.SetPluginReload and only for its typenames; with its token requests without it are refused:
+
+	NewRuntimeConfig().SetPluginReload(os.Getenv("PLUGIN_RELOAD_TOKEN"), "functions.app.counter")
+
+Executors of the replaced source are closed on reload (isolates disposed, Python processes stopped once unused).
+*/
+
+const (
+	PluginReloadTypename      = "functions.system.plugin.reload"
+	PluginReloadSubject       = "plugin.reload"
+	PluginReloadTimeout       = 2 * time.Second
+	ExecutorFileWatchInterval = 2 * time.Second
+)
+
+type pluginReloadRequest struct {
+	Typename string `json:"typename"`
+	Source   string `json:"source,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+type pluginReloadReply struct {
+	NodeID string `json:"node_id"`
+	Result string `json:"result"`
+}
+
+// ReloadExecutor replaces the typename's executor source, an empty one rereads the file set by SetExecutorFile
+func (ft *FunctionType) ReloadExecutor(source string) error {
+	if ft.executor == nil {
+		return fmt.Errorf("error: function type %s has no executor", ft.name)
+	}
+	if len(source) == 0 {
+		if len(ft.executorFile) == 0 {
+			return fmt.Errorf("error: function type %s has no executor file to reload", ft.name)
+		}
+		content, err := os.ReadFile(ft.executorFile)
+		if err != nil {
+			return err
+		}
+		source = string(content)
+	}
+	if err := ft.executor.Reload(source); err != nil {
+		return err
+	}
+	lg.Log(lg.InfoLevel, "Executor reloaded", "typename", ft.name)
+	return nil
+}
+
+// SetExecutorFile sets the executor with the file's source, a watched file reloads it on changes until shutdown
+func (ft *FunctionType) SetExecutorFile(path string, watch bool, constructor func(alias string, source string) sfPlugins.StatefunExecutor) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	ft.executorFile = path
+	if err := ft.SetExecutor(path, string(content), constructor); err != nil {
+		return err
+	}
+	if watch {
+		go ft.watchExecutorFile(path, info.ModTime())
+	}
+	return nil
+}
+
+func (ft *FunctionType) watchExecutorFile(path string, modTime time.Time) {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("executor-file-watch")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("executor-file-watch")
+	ticker := time.NewTicker(ExecutorFileWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ft.runtime.stopped:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil || info.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = info.ModTime()
+			if err := ft.ReloadExecutor(""); err != nil {
+				lg.Log(lg.ErrorLevel, "Executor file changed but was not reloaded", "typename", ft.name, "file", path, "error", err)
+			}
+		}
+	}
+}
+
+// Subscribes the plugin reload subject on the primary connection if reloads are enabled, drained with it on shutdown
+func (r *Runtime) servePluginReload() error {
+	if len(r.config.pluginReloadTypenames) == 0 {
+		return nil
+	}
+	_, err := r.nc.Subscribe(r.namespacedSubject(PluginReloadSubject), func(msg *nats.Msg) {
+		var request pluginReloadRequest
+		if err := json.Unmarshal(msg.Data, &request); err != nil {
+			lg.Log(lg.WarnLevel, "Malformed plugin reload request", "error", err)
+			return
+		}
+		ft, ok := r.registeredFunctionTypes[request.Typename]
+		if !ok || ft.executor == nil {
+			return // Not this runtime's plugin
+		}
+		reply := pluginReloadReply{NodeID: r.config.nodeID, Result: "ok"}
+		if !r.config.pluginReloadTypenames[request.Typename] {
+			reply.Result = fmt.Sprintf("error: reload of %s is not allowed", request.Typename)
+		} else if len(r.config.pluginReloadToken) > 0 && subtle.ConstantTimeCompare([]byte(request.Token), []byte(r.config.pluginReloadToken)) != 1 {
+			lg.Log(lg.WarnLevel, "Plugin reload request with an invalid token refused", "typename", request.Typename)
+			reply.Result = fmt.Sprintf("error: reload of %s is not authorized", request.Typename)
+		} else if err := ft.ReloadExecutor(request.Source); err != nil {
+			reply.Result = err.Error()
+		}
+		data, _ := json.Marshal(reply)
+		system.MsgOnErrorReturn(msg.Respond(data))
+	})
+	return err
+}
+
+// ReloadPlugin reloads the typename's executor on the namespace's runtimes replying within the timeout, this one too;
+// returns the results by node ids, "ok" or an error
+func (r *Runtime) ReloadPlugin(typename string, source string, timeout time.Duration) (map[string]string, error) {
+	data, err := json.Marshal(pluginReloadRequest{Typename: typename, Source: source, Token: r.config.pluginReloadToken})
+	if err != nil {
+		return nil, err
+	}
+	inbox := r.nc.NewRespInbox()
+	sub, err := r.nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { system.MsgOnErrorReturn(sub.Unsubscribe()) }()
+	if err := r.nc.PublishRequest(r.namespacedSubject(PluginReloadSubject), inbox, data); err != nil {
+		return nil, err
+	}
+
+	results := map[string]string{}
+	deadline := time.Now().Add(timeout)
+	for {
+		msg, err := sub.NextMsg(time.Until(deadline))
+		if err != nil {
+			break // Timed out
+		}
+		var reply pluginReloadReply
+		if err := json.Unmarshal(msg.Data, &reply); err != nil {
+			lg.Log(lg.WarnLevel, "Malformed plugin reload reply", "error", err)
+			continue
+		}
+		results[reply.NodeID] = reply.Result
+	}
+	return results, nil
+}
+
+// RegisterPluginReloadFunctionType serves plugin reloads by PluginReloadTypename
+func RegisterPluginReloadFunctionType(runtime *Runtime) {
+	NewFunctionType(runtime, PluginReloadTypename, func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		pluginReloadFunction(runtime, contextProcessor)
+	}, *NewFunctionTypeConfig().SetServiceState(true))
+}
+
+func pluginReloadFunction(r *Runtime, contextProcessor *sfPlugins.StatefunContextProcessor) {
+	typename := contextProcessor.Payload.GetByPath("typename").AsStringDefault(contextProcessor.Self.ID)
+	source := contextProcessor.Payload.GetByPath("source").AsStringDefault("")
+
+	status := "ok"
+	result := easyjson.NewJSONArray()
+	results, err := r.ReloadPlugin(typename, source, PluginReloadTimeout)
+	if err != nil {
+		status = "failed"
+		result = easyjson.NewJSON(err.Error())
+	} else {
+		if len(results) == 0 {
+			status = "failed"
+		}
+		nodes := make([]string, 0, len(results))
+		for node := range results {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		for _, node := range nodes {
+			if results[node] != "ok" {
+				status = "failed"
+			}
+			nodeResult := easyjson.NewJSONObject()
+			nodeResult.SetByPath("node_id", easyjson.NewJSON(node))
+			nodeResult.SetByPath("result", easyjson.NewJSON(results[node]))
+			result.AddToArray(nodeResult)
+		}
+	}
+	lg.Log(lg.InfoLevel, "Plugin reload requested", "typename", typename, "status", status)
+
+	if contextProcessor.Reply != nil {
+		reply := easyjson.NewJSONObject()
+		reply.SetByPath("status", easyjson.NewJSON(status))
+		reply.SetByPath("result", result)
+		contextProcessor.Reply.With(&reply)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 NJWS Inc.
+
+package js
+
+import (
+	"sync"
+
+	"github.com/foliagecp/sdk/statefun/system"
+	v8 "rogchap.com/v8go"
+)
+
+// V8 code cache shared by all executors of the process and keyed by the script's content hash:
+// an unbound script belongs to a single isolate, but its code cache lets any other isolate skip the compilation
+var compiledScriptsCache sync.Map
+
+func compileUnboundScriptCached(vw *v8.Isolate, source string, alias string) (*v8.UnboundScript, error) {
+	hash := system.GetHashStr(source)
+
+	if v, ok := compiledScriptsCache.Load(hash); ok {
+		cachedData := &v8.CompilerCachedData{Bytes: v.([]byte)} // Rejected is set per compilation, do not share the struct
+		script, err := vw.CompileUnboundScript(source, alias, v8.CompileOptions{CachedData: cachedData})
+		if err != nil || !cachedData.Rejected {
+			return script, err
+		}
+		// Cache was produced by an incompatible V8 build or flags, compiling from scratch and replacing it
+	}
+
+	script, err := vw.CompileUnboundScript(source, alias, v8.CompileOptions{Mode: v8.CompileModeEager})
+	if err != nil {
+		return nil, err
+	}
+	compiledScriptsCache.Store(hash, script.CreateCodeCache().Bytes)
+	return script, nil
+}
+
+// ResetCompiledScriptsCache drops all code caches, executors created afterwards compile their scripts from scratch
+func ResetCompiledScriptsCache() {
+	compiledScriptsCache.Range(func(key, _ any) bool {
+		compiledScriptsCache.Delete(key)
+		return true
+	})
+}
@@ -17,16 +17,28 @@ type StatefunExecutorPluginJS struct {
 	copiledScript *v8.UnboundScript
 	buildError    error
 
+	alias  string
+	source string
+	limits Limits
+	run    *limitedRun // Of the current Run, nil if no limits
+
 	contextProcessor *sfPlugins.StatefunContextProcessor
 }
 
 func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.StatefunExecutor {
-	sfejs := &StatefunExecutorPluginJS{}
+	sfejs := &StatefunExecutorPluginJS{alias: alias, source: source}
+	sfejs.build()
+	return sfejs
+}
+
+// Builds the isolate with the script, again after a limit was exceeded
+func (sfejs *StatefunExecutorPluginJS) build() {
+	alias, source := sfejs.alias, sfejs.source
 
 	sfejs.vw = v8.NewIsolate() // creates a new JavaScript VM
 
 	// () -> string
-	statefunGetSelfTypenane := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	statefunGetSelfTypenane := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//lg.Logf("statefun_getSelfTypename: %v\n", info.Args()) // when the JS function is called this Go callback will execute
 		if len(info.Args()) != 0 {
 			lg.Logf(lg.ErrorLevel, "statefun_getSelfTypename requires no arguments but got %d\n", len(info.Args()))
@@ -37,7 +49,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 		return v // you can return a value back to the JS caller if required
 	})
 	// () -> string
-	statefunGetSelfID := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	statefunGetSelfID := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//lg.Logf("statefun_getSelfId: %v\n", info.Args())
 		if len(info.Args()) != 0 {
 			lg.Logf(lg.ErrorLevel, "statefun_getSelfId requires no arguments but got %d\n", len(info.Args()))
@@ -48,7 +60,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 		return v
 	})
 	// () -> string
-	statefunGetCallerTypenane := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	statefunGetCallerTypenane := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//lg.Logf("statefun_getCallerTypename: %v\n", info.Args()) // when the JS function is called this Go callback will execute
 		if len(info.Args()) != 0 {
 			lg.Logf(lg.ErrorLevel, "statefun_getCallerTypename requires no arguments but got %d\n", len(info.Args()))
@@ -59,7 +71,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 		return v // you can return a value back to the JS caller if required
 	})
 	// () -> string
-	statefunGetCallerID := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	statefunGetCallerID := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//lg.Logf("statefun_getCallerId: %v\n", info.Args())
 		if len(info.Args()) != 0 {
 			lg.Logf(lg.ErrorLevel, "statefun_getCallerId requires no arguments but got %d\n", len(info.Args()))
@@ -70,7 +82,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 		return v
 	})
 	// () -> string
-	statefunGetFunctionContext := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	statefunGetFunctionContext := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//lg.Logf("statefun_getFunctionContext: %v\n", info.Args())
 		if len(info.Args()) != 0 {
 			lg.Logf(lg.ErrorLevel, "statefun_getFunctionContext requires no arguments but got %d\n", len(info.Args()))
@@ -81,7 +93,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 		return v
 	})
 	// (string) -> int
-	statefunSetFunctionContext := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	statefunSetFunctionContext := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//lg.Logf("statefun_setFunctionContext: %v\n", info.Args())
 		if len(info.Args()) != 1 {
 			lg.Logf(lg.ErrorLevel, "statefun_setFunctionContext requires 1 argument but got %d\n", len(info.Args()))
@@ -104,7 +116,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 		return v
 	})
 	// (string) -> int
-	statefunSetRequestReplyData := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	statefunSetRequestReplyData := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//lg.Logf("statefun_setRequestReplyData: %v\n", info.Args())
 		if len(info.Args()) != 1 {
 			lg.Logf(lg.ErrorLevel, "statefun_setRequestReplyData requires 1 argument but got %d\n", len(info.Args()))
@@ -130,7 +142,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 		return v
 	})
 	// () -> string
-	statefunGetObjectContext := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	statefunGetObjectContext := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//lg.Logf("statefun_getObjectContext: %v\n", info.Args())
 		if len(info.Args()) != 0 {
 			lg.Logf(lg.ErrorLevel, "statefun_getObjectContext requires no arguments but got %d\n", len(info.Args()))
@@ -141,7 +153,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 		return v
 	})
 	// (string) -> int
-	statefunSetObjectContext := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	statefunSetObjectContext := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//lg.Logf("statefun_setObjectContext: %v\n", info.Args())
 		if len(info.Args()) != 1 {
 			lg.Logf(lg.ErrorLevel, "statefun_setObjectContext requires 1 argument but got %d\n", len(info.Args()))
@@ -164,7 +176,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 		return v
 	})
 	// () -> string
-	statefunGetPayload := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	statefunGetPayload := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//lg.Logf("statefun_getPayload: %v", info.Args())
 		if len(info.Args()) != 0 {
 			lg.Logf(lg.ErrorLevel, "statefun_getPayload requires no arguments but got %d\n", len(info.Args()))
@@ -175,7 +187,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 		return v
 	})
 	// () -> string
-	statefunGetOptions := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	statefunGetOptions := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//lg.Logf("statefun_getOptions: %v", info.Args())
 		if len(info.Args()) != 0 {
 			lg.Logf(lg.ErrorLevel, "statefun_getOptions requires no arguments but got %d\n", len(info.Args()))
@@ -186,7 +198,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 		return v
 	})
 	// (int, string, string, string, string) -> int
-	statefunSignal := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	statefunSignal := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//lg.Logf("statefun_signal: %v\n", info.Args())
 		if len(info.Args()) != 5 {
 			lg.Logf(lg.ErrorLevel, "statefun_signal requires 5 argument but got %d\n", len(info.Args()))
@@ -223,7 +235,7 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 		return v
 	})
 	// (int, string, string, string, string) -> int|string
-	statefunRequest := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	statefunRequest := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		//lg.Logf("statefun_request: %v\n", info.Args())
 		if len(info.Args()) != 5 {
 			lg.Logf(lg.ErrorLevel, "statefun_request requires 5 argument but got %d\n", len(info.Args()))
@@ -263,8 +275,117 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 		v, _ := v8.NewValue(sfejs.vw, int32(2))
 		return v
 	})
+	// (string) -> string|int
+	statefunCacheGetValue := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
+		if len(info.Args()) != 1 {
+			lg.Logf(lg.ErrorLevel, "statefun_cacheGetValue requires 1 argument but got %d\n", len(info.Args()))
+			v, _ := v8.NewValue(sfejs.vw, int32(1))
+			return v
+		}
+		if !info.Args()[0].IsString() {
+			v, _ := v8.NewValue(sfejs.vw, int32(2))
+			return v
+		}
+		value, err := sfejs.contextProcessor.GlobalCache.GetValue(info.Args()[0].String())
+		if err != nil {
+			v, _ := v8.NewValue(sfejs.vw, int32(3))
+			return v
+		}
+		v, _ := v8.NewValue(sfejs.vw, string(value))
+		return v
+	})
+	// (string, string, bool) -> int
+	statefunCacheSetValue := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
+		if len(info.Args()) != 3 {
+			lg.Logf(lg.ErrorLevel, "statefun_cacheSetValue requires 3 arguments but got %d\n", len(info.Args()))
+			v, _ := v8.NewValue(sfejs.vw, int32(1))
+			return v
+		}
+		if !info.Args()[0].IsString() || !info.Args()[1].IsString() || !info.Args()[2].IsBoolean() {
+			v, _ := v8.NewValue(sfejs.vw, int32(2))
+			return v
+		}
+		if err := sfejs.contextProcessor.GlobalCache.SetValueWithError(info.Args()[0].String(), []byte(info.Args()[1].String()), info.Args()[2].Boolean(), -1, ""); err != nil {
+			lg.Logf(lg.ErrorLevel, "statefun_cacheSetValue failed: %s\n", err)
+			v, _ := v8.NewValue(sfejs.vw, int32(3))
+			return v
+		}
+		v, _ := v8.NewValue(sfejs.vw, int32(0))
+		return v
+	})
+	// (string, bool) -> int
+	statefunCacheDeleteValue := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
+		if len(info.Args()) != 2 {
+			lg.Logf(lg.ErrorLevel, "statefun_cacheDeleteValue requires 2 arguments but got %d\n", len(info.Args()))
+			v, _ := v8.NewValue(sfejs.vw, int32(1))
+			return v
+		}
+		if !info.Args()[0].IsString() || !info.Args()[1].IsBoolean() {
+			v, _ := v8.NewValue(sfejs.vw, int32(2))
+			return v
+		}
+		sfejs.contextProcessor.GlobalCache.DeleteValue(info.Args()[0].String(), info.Args()[1].Boolean(), -1, "")
+		v, _ := v8.NewValue(sfejs.vw, int32(0))
+		return v
+	})
+	// (string) -> string|int
+	statefunCacheGetKeysByPattern := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
+		if len(info.Args()) != 1 {
+			lg.Logf(lg.ErrorLevel, "statefun_cacheGetKeysByPattern requires 1 argument but got %d\n", len(info.Args()))
+			v, _ := v8.NewValue(sfejs.vw, int32(1))
+			return v
+		}
+		if !info.Args()[0].IsString() {
+			v, _ := v8.NewValue(sfejs.vw, int32(2))
+			return v
+		}
+		keys := sfejs.contextProcessor.GlobalCache.GetKeysByPattern(info.Args()[0].String())
+		v, _ := v8.NewValue(sfejs.vw, easyjson.JSONFromArray(keys).ToString())
+		return v
+	})
+	// (int, string, string, string, string) -> int
+	statefunBroadcast := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
+		if len(info.Args()) != 5 {
+			lg.Logf(lg.ErrorLevel, "statefun_broadcast requires 5 argument but got %d\n", len(info.Args()))
+			v, _ := v8.NewValue(sfejs.vw, int32(1))
+			return v
+		}
+		if !info.Args()[0].IsInt32() || !info.Args()[1].IsString() || !info.Args()[2].IsString() || !info.Args()[3].IsString() || !info.Args()[4].IsString() {
+			v, _ := v8.NewValue(sfejs.vw, int32(2))
+			return v
+		}
+		idsJSON, ok := easyjson.JSONFromString(info.Args()[2].String())
+		ids, idsOk := idsJSON.AsArrayString()
+		if !ok || !idsOk {
+			lg.Logf(lg.ErrorLevel, "statefun_broadcast ids is not a JSON array of strings: %s\n", info.Args()[2].String())
+			v, _ := v8.NewValue(sfejs.vw, int32(3))
+			return v
+		}
+		j, ok := easyjson.JSONFromString(info.Args()[3].String())
+		if !ok {
+			lg.Logf(lg.ErrorLevel, "statefun_broadcast payload is not a JSON: %s\n", info.Args()[3].String())
+			v, _ := v8.NewValue(sfejs.vw, int32(3))
+			return v
+		}
+		var options *easyjson.JSON = nil
+		if len(info.Args()[4].String()) > 0 {
+			if o, ok := easyjson.JSONFromString(info.Args()[4].String()); ok {
+				options = &o
+			} else {
+				lg.Logf(lg.ErrorLevel, "statefun_broadcast options is not empty and not a JSON: %s\n", info.Args()[4].String())
+				v, _ := v8.NewValue(sfejs.vw, int32(4))
+				return v
+			}
+		}
+		if err := sfejs.contextProcessor.Broadcast(sfPlugins.SignalProvider(info.Args()[0].Int32()), info.Args()[1].String(), ids, &j, options); err != nil {
+			v, _ := v8.NewValue(sfejs.vw, int32(5))
+			return v
+		}
+		v, _ := v8.NewValue(sfejs.vw, int32(0))
+		return v
+	})
 	// (string)
-	print := v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+	print := sfejs.newFunctionTemplate(func(info *v8.FunctionCallbackInfo) *v8.Value {
 		lg.Logf(lg.InfoLevel, "%s: %v\n", alias, info.Args())
 		return nil
 	})
@@ -285,20 +406,37 @@ func StatefunExecutorPluginJSContructor(alias string, source string) sfPlugins.S
 
 	system.MsgOnErrorReturn(global.Set("statefun_signal", statefunSignal))
 	system.MsgOnErrorReturn(global.Set("statefun_request", statefunRequest))
-	system.MsgOnErrorReturn(global.Set("print", print))
+	system.MsgOnErrorReturn(global.Set("statefun_broadcast", statefunBroadcast))
 
-	sfejs.vmContect = v8.NewContext(sfejs.vw, global)                                                         // new context within the VM
-	sfejs.copiledScript, sfejs.buildError = sfejs.vw.CompileUnboundScript(source, alias, v8.CompileOptions{}) // compile script to get cached data
+	system.MsgOnErrorReturn(global.Set("statefun_cacheGetValue", statefunCacheGetValue))
+	system.MsgOnErrorReturn(global.Set("statefun_cacheSetValue", statefunCacheSetValue))
+	system.MsgOnErrorReturn(global.Set("statefun_cacheDeleteValue", statefunCacheDeleteValue))
+	system.MsgOnErrorReturn(global.Set("statefun_cacheGetKeysByPattern", statefunCacheGetKeysByPattern))
+	system.MsgOnErrorReturn(global.Set("print", print))
 
-	return sfejs
+	sfejs.vmContect = v8.NewContext(sfejs.vw, global)                                           // new context within the VM
+	sfejs.copiledScript, sfejs.buildError = compileUnboundScriptCached(sfejs.vw, source, alias) // compile script reusing code cache of the same source
 }
 
 func (sfejs *StatefunExecutorPluginJS) Run(contextProcessor *sfPlugins.StatefunContextProcessor) error {
 	sfejs.contextProcessor = contextProcessor
-	_, err := sfejs.copiledScript.Run(sfejs.vmContect)
-	return err
+	if sfejs.limits.unlimited() {
+		_, err := sfejs.copiledScript.Run(sfejs.vmContect)
+		return err
+	}
+	return sfejs.runLimited()
 }
 
 func (sfejs *StatefunExecutorPluginJS) BuildError() error {
 	return sfejs.buildError
 }
+
+// Close disposes the isolate
+func (sfejs *StatefunExecutorPluginJS) Close() {
+	if sfejs.vw == nil {
+		return
+	}
+	sfejs.vmContect.Close()
+	sfejs.vw.Dispose()
+	sfejs.vw, sfejs.vmContect, sfejs.copiledScript = nil, nil, nil
+}
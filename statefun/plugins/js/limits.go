@@ -0,0 +1,156 @@
+// Copyright 2023 NJWS Inc.
+
+package js
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	sdkErrors "github.com/foliagecp/sdk/errors"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+	v8 "rogchap.com/v8go"
+)
+
+/*
+Limits stop runaway scripts so one bad script cannot stall its typename:
+
+	ft.SetExecutor("counter.js", source, sfPluginJS.StatefunExecutorPluginJSContructorWithLimits(sfPluginJS.Limits{
+		Timeout:      100 * time.Millisecond,
+		MaxHeapBytes: 64 << 20,
+	}))
+
+A run exceeding a limit is terminated and fails with *LimitError (timeout ones match sdk errors.ErrTimeout), the
+id's isolate is built again so nothing of the terminated run is left for the next message. The deadline is enforced
+from another thread, the heap is checked on the script's own one (V8 does not allow inspecting a running isolate
+elsewhere) on every statefun_* call and after the run, so scripts allocating without calls are stopped by the
+deadline. Zero limits are unlimited.
+*/
+
+const (
+	LimitTimeout = "timeout"
+	LimitHeap    = "heap"
+)
+
+// Limits of a script's every run
+type Limits struct {
+	Timeout      time.Duration
+	MaxHeapBytes uint64
+}
+
+func (l Limits) unlimited() bool {
+	return l.Timeout <= 0 && l.MaxHeapBytes == 0
+}
+
+// LimitError is returned by Run of a script terminated for exceeding a limit
+type LimitError struct {
+	Alias     string
+	Limit     string // LimitTimeout or LimitHeap
+	Elapsed   time.Duration
+	HeapBytes uint64 // Used when the heap limit was exceeded
+}
+
+func (e *LimitError) Error() string {
+	if e.Limit == LimitHeap {
+		return fmt.Sprintf("error: js script %s exceeded its heap limit: %d bytes used", e.Alias, e.HeapBytes)
+	}
+	return fmt.Sprintf("error: js script %s exceeded its timeout: terminated after %s", e.Alias, e.Elapsed)
+}
+
+func (e *LimitError) Is(target error) bool {
+	return e.Limit == LimitTimeout && target == sdkErrors.ErrTimeout
+}
+
+type limitedRun struct {
+	mutex    sync.Mutex
+	finished bool
+	exceeded *LimitError
+	started  time.Time
+}
+
+// StatefunExecutorPluginJSContructorWithLimits returns the JS executor constructor running scripts within the limits
+func StatefunExecutorPluginJSContructorWithLimits(limits Limits) sfPlugins.StatefunExecutorConstructor {
+	return func(alias string, source string) sfPlugins.StatefunExecutor {
+		sfejs := &StatefunExecutorPluginJS{alias: alias, source: source, limits: limits}
+		sfejs.build()
+		return sfejs
+	}
+}
+
+// Terminates the run once for the limit unless it has finished
+func (sfejs *StatefunExecutorPluginJS) terminate(run *limitedRun, exceeded *LimitError) {
+	run.mutex.Lock()
+	defer run.mutex.Unlock()
+	if run.finished || run.exceeded != nil {
+		return
+	}
+	exceeded.Elapsed = time.Since(run.started)
+	run.exceeded = exceeded
+	sfejs.vw.TerminateExecution()
+}
+
+// Checks the heap limit on the script's thread, terminates the run if exceeded
+func (sfejs *StatefunExecutorPluginJS) heapExceeded() bool {
+	run := sfejs.run
+	if run == nil || sfejs.limits.MaxHeapBytes == 0 {
+		return false
+	}
+	used := sfejs.vw.GetHeapStatistics().UsedHeapSize
+	if used <= sfejs.limits.MaxHeapBytes {
+		return false
+	}
+	sfejs.terminate(run, &LimitError{Alias: sfejs.alias, Limit: LimitHeap, HeapBytes: used})
+	return true
+}
+
+// newFunctionTemplate creates the template of a statefun_* function checking the heap limit before the call
+func (sfejs *StatefunExecutorPluginJS) newFunctionTemplate(callback v8.FunctionCallback) *v8.FunctionTemplate {
+	return v8.NewFunctionTemplate(sfejs.vw, func(info *v8.FunctionCallbackInfo) *v8.Value {
+		if sfejs.heapExceeded() {
+			return nil
+		}
+		return callback(info)
+	})
+}
+
+func (sfejs *StatefunExecutorPluginJS) runLimited() error {
+	run := &limitedRun{started: time.Now()}
+	sfejs.run = run
+	defer func() { sfejs.run = nil }()
+
+	done := make(chan struct{})
+	if sfejs.limits.Timeout > 0 {
+		go func() {
+			system.GlobalPrometrics.GetRoutinesCounter().Started("js-executor-deadline")
+			defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("js-executor-deadline")
+			timer := time.NewTimer(sfejs.limits.Timeout)
+			defer timer.Stop()
+			select {
+			case <-done:
+			case <-timer.C:
+				sfejs.terminate(run, &LimitError{Alias: sfejs.alias, Limit: LimitTimeout})
+			}
+		}()
+	}
+
+	_, err := sfejs.copiledScript.Run(sfejs.vmContect)
+	if err == nil {
+		sfejs.heapExceeded()
+	}
+	close(done)
+
+	run.mutex.Lock()
+	run.finished = true
+	exceeded := run.exceeded
+	run.mutex.Unlock()
+
+	if exceeded == nil {
+		return err
+	}
+	lg.Log(lg.WarnLevel, "JS script exceeded its limit, isolate is rebuilt", "alias", sfejs.alias, "limit", exceeded.Limit, "elapsed", exceeded.Elapsed)
+	sfejs.Close()
+	sfejs.build()
+	return exceeded
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 NJWS Inc.
+
+package plugins
+
+import (
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+)
+
+// JSONPathDocumentStats holds path operations counters for a single wrapped document
+type JSONPathDocumentStats struct {
+	Gets     int
+	Sets     int
+	Duration time.Duration
+}
+
+// JSONPathMetrics collects path operations of documents wrapped during a single function invocation
+type JSONPathMetrics struct {
+	mutex     sync.Mutex
+	documents map[string]*JSONPathDocumentStats
+}
+
+func NewJSONPathMetrics() *JSONPathMetrics {
+	return &JSONPathMetrics{documents: map[string]*JSONPathDocumentStats{}}
+}
+
+// Wrap returns an instrumented view on j, operations are accounted under the document name.
+// Safe to call on nil metrics: the returned wrapper just proxies calls without accounting
+func (m *JSONPathMetrics) Wrap(document string, j *easyjson.JSON) *InstrumentedJSON {
+	return &InstrumentedJSON{j: j, metrics: m, document: document}
+}
+
+// Documents returns a copy of collected stats by document name
+func (m *JSONPathMetrics) Documents() map[string]JSONPathDocumentStats {
+	result := map[string]JSONPathDocumentStats{}
+	if m == nil {
+		return result
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for name, stats := range m.documents {
+		result[name] = *stats
+	}
+	return result
+}
+
+func (m *JSONPathMetrics) account(document string, set bool, start time.Time) {
+	if m == nil {
+		return
+	}
+	d := time.Since(start)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stats, ok := m.documents[document]
+	if !ok {
+		stats = &JSONPathDocumentStats{}
+		m.documents[document] = stats
+	}
+	if set {
+		stats.Sets++
+	} else {
+		stats.Gets++
+	}
+	stats.Duration += d
+}
+
+type InstrumentedJSON struct {
+	j        *easyjson.JSON
+	metrics  *JSONPathMetrics
+	document string
+}
+
+// JSON returns the wrapped document
+func (ij *InstrumentedJSON) JSON() *easyjson.JSON {
+	return ij.j
+}
+
+func (ij *InstrumentedJSON) GetByPath(p string) easyjson.JSON {
+	defer ij.metrics.account(ij.document, false, time.Now())
+	return ij.j.GetByPath(p)
+}
+
+func (ij *InstrumentedJSON) GetByPathPtr(p string) *easyjson.JSON {
+	defer ij.metrics.account(ij.document, false, time.Now())
+	return ij.j.GetByPathPtr(p)
+}
+
+func (ij *InstrumentedJSON) PathExists(p string) bool {
+	defer ij.metrics.account(ij.document, false, time.Now())
+	return ij.j.PathExists(p)
+}
+
+func (ij *InstrumentedJSON) SetByPath(p string, v easyjson.JSON) bool {
+	defer ij.metrics.account(ij.document, true, time.Now())
+	return ij.j.SetByPath(p, v)
+}
+
+func (ij *InstrumentedJSON) RemoveByPath(p string) bool {
+	defer ij.metrics.account(ij.document, true, time.Now())
+	return ij.j.RemoveByPath(p)
+}
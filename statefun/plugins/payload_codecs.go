@@ -0,0 +1,214 @@
+// Copyright 2023 NJWS Inc.
+
+package plugins
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/foliagecp/easyjson"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Payload codecs let functions exchange binary bodies (protobuf, msgpack, ...) instead of JSON ones, e.g. for
+high-frequency telemetry signals. An encoded body travels in the payload with its content type:
+
+	{"__body": {"content_type": "application/protobuf", "data": "<base64 body>"}}
+
+so it passes everything working on payloads (end-to-end encryption, dead letters, timers) unchanged. A JSON object
+body stays a plain payload. Sending and receiving:
+
+	payload, err := sfPlugins.EncodePayload(sfPlugins.ProtobufContentType, &telemetry)
+	contextProcessor.Signal(sfPlugins.JetstreamGlobalSignal, "functions.app.telemetry", id, payload, nil)
+
+	var telemetry pb.Telemetry
+	err := contextProcessor.DecodePayload(&telemetry) // Any payload: encoded by any registered codec or plain JSON
+
+Content type negotiation for replies: a requester lists the content types it accepts by AcceptOptions, the handler
+replies by ReplyEncoded with the first accepted content type whose codec can encode the reply, JSON otherwise:
+
+	reply, err := contextProcessor.Request(sfPlugins.NatsCoreGlobalRequest, typename, id, &payload, sfPlugins.AcceptOptions(nil, sfPlugins.ProtobufContentType))
+	err = sfPlugins.DecodePayload(reply, &result)
+
+JSON and protobuf codecs are built in, others are added by RegisterPayloadCodec.
+*/
+
+const (
+	JSONContentType     = "application/json"
+	ProtobufContentType = "application/protobuf"
+
+	PayloadBodyField    = "__body"
+	PayloadAcceptOption = "__accept"
+)
+
+// PayloadCodec encodes values to bodies of its content type and back
+type PayloadCodec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                { return JSONContentType }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return ProtobufContentType }
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("error: %T is not a protobuf message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("error: %T is not a protobuf message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+var payloadCodecs sync.Map // content type -> PayloadCodec
+
+func init() {
+	RegisterPayloadCodec(jsonCodec{})
+	RegisterPayloadCodec(protobufCodec{})
+}
+
+// RegisterPayloadCodec adds the codec or replaces the one of its content type
+func RegisterPayloadCodec(codec PayloadCodec) {
+	payloadCodecs.Store(codec.ContentType(), codec)
+}
+
+func PayloadCodecByContentType(contentType string) (PayloadCodec, bool) {
+	if v, ok := payloadCodecs.Load(contentType); ok {
+		return v.(PayloadCodec), true
+	}
+	return nil, false
+}
+
+// PayloadContentTypes returns the content types of the registered codecs, sorted
+func PayloadContentTypes() []string {
+	contentTypes := []string{}
+	payloadCodecs.Range(func(key, value any) bool {
+		contentTypes = append(contentTypes, key.(string))
+		return true
+	})
+	sort.Strings(contentTypes)
+	return contentTypes
+}
+
+// EncodePayload encodes the value to a payload with the content type's codec
+func EncodePayload(contentType string, v any) (*easyjson.JSON, error) {
+	codec, ok := PayloadCodecByContentType(contentType)
+	if !ok {
+		return nil, fmt.Errorf("error: no payload codec for %s", contentType)
+	}
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if contentType == JSONContentType {
+		if j, ok := easyjson.JSONFromBytes(data); ok && j.IsObject() {
+			return &j, nil
+		}
+	}
+	body := easyjson.NewJSONObject()
+	body.SetByPath("content_type", easyjson.NewJSON(contentType))
+	body.SetByPath("data", easyjson.NewJSON(base64.StdEncoding.EncodeToString(data)))
+	return easyjson.NewJSONObjectWithKeyValue(PayloadBodyField, body).GetPtr(), nil
+}
+
+// PayloadContentType returns the content type of the payload's body, JSON for a plain payload
+func PayloadContentType(payload *easyjson.JSON) string {
+	if payload != nil {
+		if contentType, ok := payload.GetByPath(PayloadBodyField + ".content_type").AsString(); ok {
+			return contentType
+		}
+	}
+	return JSONContentType
+}
+
+// DecodePayload decodes the payload's body into the value with the codec of the body's content type
+func DecodePayload(payload *easyjson.JSON, v any) error {
+	if payload == nil {
+		return fmt.Errorf("error: no payload to decode")
+	}
+	contentType := PayloadContentType(payload)
+	codec, ok := PayloadCodecByContentType(contentType)
+	if !ok {
+		return fmt.Errorf("error: no payload codec for %s", contentType)
+	}
+	if !payload.PathExists(PayloadBodyField) {
+		return codec.Unmarshal(payload.ToBytes(), v)
+	}
+	encoded, _ := payload.GetByPath(PayloadBodyField + ".data").AsString()
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("error: malformed %s payload body: %s", contentType, err)
+	}
+	return codec.Unmarshal(data, v)
+}
+
+// AcceptOptions returns a copy of the options with the content types a requester accepts replies in
+func AcceptOptions(options *easyjson.JSON, contentTypes ...string) *easyjson.JSON {
+	result := easyjson.NewJSONObject()
+	if options != nil && options.IsObject() {
+		result = options.Clone()
+	}
+	accept := easyjson.NewJSONArray()
+	for _, contentType := range contentTypes {
+		accept.AddToArray(easyjson.NewJSON(contentType))
+	}
+	result.SetByPath(PayloadAcceptOption, accept)
+	return &result
+}
+
+// AcceptedContentTypes returns the content types listed in the options by AcceptOptions
+func AcceptedContentTypes(options *easyjson.JSON) []string {
+	contentTypes := []string{}
+	if options == nil {
+		return contentTypes
+	}
+	accept := options.GetByPath(PayloadAcceptOption)
+	for i := 0; i < accept.ArraySize(); i++ {
+		if contentType, ok := accept.ArrayElement(i).AsString(); ok {
+			contentTypes = append(contentTypes, contentType)
+		}
+	}
+	return contentTypes
+}
+
+// DecodePayload decodes the message's payload into the value (see DecodePayload)
+func (cp *StatefunContextProcessor) DecodePayload(v any) error {
+	return DecodePayload(cp.Payload, v)
+}
+
+// PayloadContentType returns the content type of the message's payload
+func (cp *StatefunContextProcessor) PayloadContentType() string {
+	return PayloadContentType(cp.Payload)
+}
+
+// ReplyEncoded replies with the value encoded in the first content type accepted by the requester which can encode it
+func (cp *StatefunContextProcessor) ReplyEncoded(v any) error {
+	if cp.Reply == nil {
+		return fmt.Errorf("error: function was signaled, there is no one to reply")
+	}
+	for _, contentType := range append(AcceptedContentTypes(cp.Options), JSONContentType) {
+		if payload, err := EncodePayload(contentType, v); err == nil {
+			cp.Reply.With(payload)
+			return nil
+		}
+	}
+	return fmt.Errorf("error: reply %T cannot be encoded in any accepted content type", v)
+}
@@ -5,7 +5,12 @@
 package plugins
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
 	"sync"
+	"time"
 
 	lg "github.com/foliagecp/sdk/statefun/logger"
 
@@ -35,6 +40,10 @@ const (
 type SyncReply struct {
 	With          func(*easyjson.JSON)
 	CancelDefault func()
+	// Sends a partial reply right away if the caller streams replies, otherwise collects it into the reply array
+	Stream func(*easyjson.JSON)
+	// Sends the final reply without waiting for the handler to return
+	Close func()
 }
 
 type StatefunContextProcessor struct {
@@ -43,21 +52,86 @@ type StatefunContextProcessor struct {
 	SetFunctionContext func(*easyjson.JSON)
 	GetObjectContext   func() *easyjson.JSON
 	SetObjectContext   func(*easyjson.JSON)
-	ObjectMutexLock    func(errorOnLocked bool) error
-	ObjectMutexUnlock  func() error
+	// Optimistic locking of the object context across runtimes: the context with its KV revision, 0 - the context is not
+	// in KV; the context is written to KV only if its revision is still the given one, returns the revision after
+	// the call. On a conflict with another writer the error is of sdk errors.ErrConflict kind, the caller is to re-read
+	// the context and retry; other errors (e.g. the KV backend without conditional writes) are not to be retried
+	GetObjectContextWithRevision func() (*easyjson.JSON, uint64)
+	SetObjectContextIfRevision   func(context *easyjson.JSON, revision uint64) (uint64, error)
+	ObjectMutexLock              func(errorOnLocked bool) error
+	ObjectMutexUnlock            func() error
 	// TODO: DownstreamSignal(<function type>, <links filters>, <payload>, <options>)
 	Signal  func(SignalProvider, string, string, *easyjson.JSON, *easyjson.JSON) error
 	Request func(RequestProvider, string, string, *easyjson.JSON, *easyjson.JSON) (*easyjson.JSON, error)
+	// Signals every id of the typename with the same payload, publishing all signals at once
+	Broadcast func(provider SignalProvider, typename string, ids []string, payload *easyjson.JSON, options *easyjson.JSON) error
+	// Runs a background task supervised by the runtime instead of a raw goroutine: the task's context is cancelled
+	// on runtime stop, panics are recovered, returns error if typename's child tasks limit is reached
+	Go func(task func(ctx context.Context)) error
+	// Executes an external side effect at most once per effectID for this id even if the message is redelivered:
+	// the intent is durably recorded before execution and marked done after it, failed effects can be retried
+	Effect func(effectID string, effect func() error) error
+	// Persists large derived in-memory state of this id (e.g. a parsed model) under the name to restore it after
+	// restarts instead of recomputing, LoadCheckpoint returns nil data without error if nothing was saved
+	SaveCheckpoint func(name string, data []byte) error
+	LoadCheckpoint func(name string) ([]byte, error)
+	// Schedules a signal from this id to be sent at the given time, persisted so it survives restarts and delivered
+	// at least once; timerID is unique within this id, scheduling it again replaces the timer
+	ScheduleSignal func(timerID string, at time.Time, provider SignalProvider, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) error
+	// Cancels the timer scheduled by this id if it has not fired yet
+	CancelTimer func(timerID string)
+	// Random source seeded per invocation (not safe for concurrent use) and the invocation's time frozen for it,
+	// both reproducible by message options (see statefun.SetupRandAndNow)
+	Rand func() *rand.Rand
+	Now  func() time.Time
+	// Restricted NATS access for integrations, only to subjects and streams approved for the typename
+	Nats    *NatsFacade
 	Self    StatefunAddress
 	Caller  StatefunAddress
 	Payload *easyjson.JSON
 	Options *easyjson.JSON
-	Reply   *SyncReply // when requested in function: nil - function was signaled, !nil - function was requested
+	// Wrap contexts with JSONPathMetrics.Wrap to account path operations per invocation, nil if disabled for the typename
+	JSONPathMetrics *JSONPathMetrics
+	Reply           *SyncReply // when requested in function: nil - function was signaled, !nil - function was requested
+}
+
+// Publishes to subjects and reads streams approved for the typename (see statefun.FunctionTypeConfig.SetNatsAccess)
+type NatsFacade struct {
+	Publish          func(subject string, data []byte, header map[string][]string) error
+	PublishJetStream func(subject string, data []byte, header map[string][]string) (sequence uint64, err error)
+	GetStreamMsg     func(stream string, sequence uint64) (*NatsStreamMsg, error)
+	GetLastStreamMsg func(stream string, subject string) (*NatsStreamMsg, error)
+}
+
+type NatsStreamMsg struct {
+	Subject  string
+	Sequence uint64
+	Header   map[string][]string
+	Data     []byte
+	Time     time.Time
+}
+
+// ScheduleSignalAfter schedules a signal to be sent after the delay (see ScheduleSignal)
+func (cp *StatefunContextProcessor) ScheduleSignalAfter(timerID string, delay time.Duration, provider SignalProvider, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) error {
+	return cp.ScheduleSignal(timerID, time.Now().Add(delay), provider, typename, id, payload, options)
+}
+
+// BroadcastByPattern broadcasts to ids which are the last tokens of cache keys matching the pattern, e.g. ids of
+// vertex's children by "<vertex id>.out.body.>" (see Broadcast)
+func (cp *StatefunContextProcessor) BroadcastByPattern(provider SignalProvider, typename string, keyPattern string, payload *easyjson.JSON, options *easyjson.JSON) error {
+	keys := cp.GlobalCache.GetKeysByPattern(keyPattern)
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, key[strings.LastIndex(key, ".")+1:])
+	}
+	return cp.Broadcast(provider, typename, ids, payload, options)
 }
 
 type StatefunExecutor interface {
 	Run(contextProcessor *StatefunContextProcessor) error
 	BuildError() error
+	// Close releases the executor's resources (isolates, instances, processes), it is not run afterwards
+	Close()
 }
 
 type StatefunExecutorConstructor func(alias string, source string) StatefunExecutor
@@ -65,8 +139,40 @@ type StatefunExecutorConstructor func(alias string, source string) StatefunExecu
 type TypenameExecutorPlugin struct {
 	alias                      string
 	source                     string
-	idExecutors                sync.Map
+	revision                   uint64 // Of the source, incremented by Reload
+	sourceMutex                sync.RWMutex
+	idExecutors                sync.Map // id -> *idExecutor
 	executorContructorFunction StatefunExecutorConstructor
+	pool                       *executorPool // Executors shared by ids if set, see EnablePool
+}
+
+type executorPool struct {
+	size  int
+	idle  chan *idExecutor
+	slots chan struct{} // One per executor of the pool, idle or busy
+}
+
+type idExecutor struct {
+	executor StatefunExecutor
+	revision uint64
+	mutex    sync.Mutex // Held by the call running the executor, so the executor is closed between calls
+	closed   bool
+}
+
+// Closes the executor once its current call, if any, is over
+func (e *idExecutor) close() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !e.closed && e.executor != nil {
+		e.executor.Close()
+	}
+	e.closed = true
+}
+
+// Closes the pool's executor freeing its slot
+func (p *executorPool) drop(e *idExecutor) {
+	e.close()
+	<-p.slots
 }
 
 func NewTypenameExecutor(alias string, source string, executorContructorFunction StatefunExecutorConstructor) *TypenameExecutorPlugin {
@@ -74,22 +180,176 @@ func NewTypenameExecutor(alias string, source string, executorContructorFunction
 	return &tnex
 }
 
-func (tnex *TypenameExecutorPlugin) AddForID(id string) {
+func (tnex *TypenameExecutorPlugin) newIDExecutor(id string) *idExecutor {
+	tnex.sourceMutex.RLock()
+	source, revision := tnex.source, tnex.revision
+	tnex.sourceMutex.RUnlock()
+
 	if tnex.executorContructorFunction == nil {
 		lg.Logf(lg.ErrorLevel, "Cannot create new StatefunExecutor for id=%s: missing newExecutor function\n", id)
-		tnex.idExecutors.Store(id, nil)
-	} else {
-		lg.Logf(lg.TraceLevel, "______________ Created StatefunExecutor for id=%s\n", id)
-		executor := tnex.executorContructorFunction(tnex.alias, tnex.source)
-		tnex.idExecutors.Store(id, executor)
+		return &idExecutor{revision: revision}
+	}
+	lg.Logf(lg.TraceLevel, "______________ Created StatefunExecutor for id=%s\n", id)
+	return &idExecutor{executor: tnex.executorContructorFunction(tnex.alias, source), revision: revision}
+}
+
+func (tnex *TypenameExecutorPlugin) AddForID(id string) {
+	if tnex.pool != nil {
+		return // Ids take executors from the pool
+	}
+	previous, loaded := tnex.idExecutors.Load(id)
+	tnex.idExecutors.Store(id, tnex.newIDExecutor(id))
+	if loaded {
+		previous.(*idExecutor).close()
+	}
+}
+
+func (tnex *TypenameExecutorPlugin) stale(e *idExecutor) bool {
+	tnex.sourceMutex.RLock()
+	defer tnex.sourceMutex.RUnlock()
+	return e.revision != tnex.revision
+}
+
+// Fills the pool's idle executors up to its size
+func (tnex *TypenameExecutorPlugin) warmPool() {
+	for len(tnex.pool.idle) < tnex.pool.size {
+		select {
+		case tnex.pool.slots <- struct{}{}:
+		default:
+			return // All the executors are built
+		}
+		e := tnex.newIDExecutor("pool")
+		select {
+		case tnex.pool.idle <- e:
+		default:
+			tnex.pool.drop(e) // Filled by releases meanwhile
+			return
+		}
+	}
+}
+
+// EnablePool makes ids share executors of a pool with size idle ones built in advance instead of building one per id
+// on its first message, a script's global state is shared by ids then. While all are busy up to size more executors
+// are built, further calls wait for a release. Must be called before messages are handled.
+func (tnex *TypenameExecutorPlugin) EnablePool(size int) {
+	if size <= 0 {
+		return
+	}
+	tnex.pool = &executorPool{size: size, idle: make(chan *idExecutor, size), slots: make(chan struct{}, 2*size)}
+	tnex.warmPool()
+}
+
+// AcquireForID returns an executor for a single call on the id and the function to call after it
+func (tnex *TypenameExecutorPlugin) AcquireForID(id string) (StatefunExecutor, func()) {
+	if tnex.pool == nil {
+		e := tnex.getForID(id)
+		if e == nil {
+			return nil, func() {}
+		}
+		e.mutex.Lock()
+		if e.closed { // Removed meanwhile, a temporary one serves the call
+			e.mutex.Unlock()
+			e = tnex.newIDExecutor(id)
+			return e.executor, e.close
+		}
+		return e.executor, e.mutex.Unlock
+	}
+	var e *idExecutor
+	select {
+	case e = <-tnex.pool.idle:
+	default:
+		select { // All are busy
+		case e = <-tnex.pool.idle:
+		case tnex.pool.slots <- struct{}{}:
+			e = tnex.newIDExecutor(id)
+		}
+	}
+	if tnex.stale(e) {
+		e.close()
+		e = tnex.newIDExecutor(id) // Takes the slot of the stale one
+	}
+	return e.executor, func() {
+		if tnex.stale(e) {
+			tnex.pool.drop(e) // Reloaded meanwhile
+			return
+		}
+		select {
+		case tnex.pool.idle <- e:
+		default:
+			tnex.pool.drop(e) // Pool is full
+		}
 	}
 }
 
 func (tnex *TypenameExecutorPlugin) RemoveForID(id string) {
-	tnex.idExecutors.Delete(id)
+	if value, ok := tnex.idExecutors.LoadAndDelete(id); ok {
+		value.(*idExecutor).close()
+	}
 }
 
+// GetForID returns the id's executor, rebuilt from the current source if it was reloaded since the executor was built
 func (tnex *TypenameExecutorPlugin) GetForID(id string) StatefunExecutor {
-	value, _ := tnex.idExecutors.Load(id)
-	return value.(StatefunExecutor)
+	if e := tnex.getForID(id); e != nil {
+		return e.executor
+	}
+	return nil
+}
+
+func (tnex *TypenameExecutorPlugin) getForID(id string) *idExecutor {
+	value, ok := tnex.idExecutors.Load(id)
+	if !ok {
+		return nil
+	}
+	e := value.(*idExecutor)
+	if tnex.stale(e) {
+		stale := e
+		e = tnex.newIDExecutor(id)
+		tnex.idExecutors.Store(id, e)
+		stale.close()
+	}
+	return e
+}
+
+// Reload replaces the source if an executor builds from it, every id gets its own executor of it on its next message.
+// Executors of the old source are closed once their current calls are over
+func (tnex *TypenameExecutorPlugin) Reload(source string) error {
+	if tnex.executorContructorFunction == nil {
+		return fmt.Errorf("error: %s: missing newExecutor function", tnex.alias)
+	}
+	probe := tnex.executorContructorFunction(tnex.alias, source)
+	err := probe.BuildError()
+	probe.Close()
+	if err != nil {
+		return err
+	}
+	tnex.sourceMutex.Lock()
+	tnex.source = source
+	tnex.revision++
+	tnex.sourceMutex.Unlock()
+
+	tnex.idExecutors.Range(func(_, value interface{}) bool {
+		if e := value.(*idExecutor); tnex.stale(e) {
+			e.close() // Replaced on the id's next message
+		}
+		return true
+	})
+	if tnex.pool != nil {
+		for drained := false; !drained; {
+			select {
+			case e := <-tnex.pool.idle:
+				tnex.pool.drop(e)
+			default:
+				drained = true
+			}
+		}
+		tnex.warmPool()
+	}
+	return nil
+}
+
+// Source returns the current source and its revision
+func (tnex *TypenameExecutorPlugin) Source() (string, uint64) {
+	tnex.sourceMutex.RLock()
+	defer tnex.sourceMutex.RUnlock()
+	return tnex.source, tnex.revision
 }
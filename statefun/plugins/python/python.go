@@ -0,0 +1,345 @@
+// Copyright 2023 NJWS Inc.
+
+package python
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+
+	"github.com/foliagecp/easyjson"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Python executor runs statefun scripts in Python, e.g. graph enrichment functions of data-science users, while the Go
+runtime keeps the orchestration:
+
+	content, err := os.ReadFile("enrich.py")
+	ft.SetExecutor("enrich.py", string(content), sfPluginPython.StatefunExecutorPluginPythonContructor)
+
+A script is run by a sidecar interpreter process (PythonInterpreter, a runner script is passed to it) speaking
+JSON lines over its stdin and stdout, no cgo or libpython is needed. The script has the same functions as the JS
+executor's ones (statefun_getPayload, statefun_setObjectContext, statefun_signal, statefun_request, print, ...) and
+is executed with fresh globals for every message:
+
+	import json
+	context = json.loads(statefun_getFunctionContext())
+	context["counter"] = context.get("counter", 0) + 1
+	statefun_setFunctionContext(json.dumps(context))
+
+One process serves all the ids of the scripts with the same content, one message at a time, and is stopped once all
+its executors are closed. A process exited or broken is started again on the next message; a script failing to
+compile is the executor's build error.
+*/
+
+// PythonInterpreter is the interpreter the sidecar processes are started with
+var PythonInterpreter = "python3"
+
+//go:embed runner.py
+var runnerScript string
+
+type StatefunExecutorPluginPython struct {
+	process    *pythonProcess
+	buildError error
+}
+
+type protocolMsg struct {
+	Type   string `json:"type"`
+	Alias  string `json:"alias,omitempty"`
+	Source string `json:"source,omitempty"`
+	Fn     string `json:"fn,omitempty"`
+	Args   []any  `json:"args,omitempty"`
+	Value  any    `json:"value"` // Zero statuses are values too
+	Error  string `json:"error,omitempty"`
+}
+
+type pythonProcess struct {
+	mutex  sync.Mutex
+	alias  string
+	source string
+	hash   string
+	refs   int // Executors using the process, guarded by processesMutex
+
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+var (
+	processes      = map[string]*pythonProcess{} // Source hash -> process
+	processesMutex sync.Mutex
+)
+
+func StatefunExecutorPluginPythonContructor(alias string, source string) sfPlugins.StatefunExecutor {
+	sfepy := &StatefunExecutorPluginPython{}
+
+	hash := system.GetHashStr(source)
+	processesMutex.Lock()
+	p, ok := processes[hash]
+	if !ok {
+		p = &pythonProcess{alias: alias, source: source, hash: hash}
+		processes[hash] = p
+	}
+	p.refs++
+	processesMutex.Unlock()
+	sfepy.process = p
+
+	sfepy.process.mutex.Lock()
+	defer sfepy.process.mutex.Unlock()
+	sfepy.buildError = sfepy.process.startIfNeeded()
+	return sfepy
+}
+
+func (sfepy *StatefunExecutorPluginPython) Run(contextProcessor *sfPlugins.StatefunContextProcessor) error {
+	sfepy.process.mutex.Lock()
+	defer sfepy.process.mutex.Unlock()
+	if err := sfepy.process.startIfNeeded(); err != nil {
+		return err
+	}
+	err := sfepy.process.run(contextProcessor)
+	if err != nil && !isScriptError(err) {
+		sfepy.process.stop() // Protocol is broken, starting a new process on the next message
+	}
+	return err
+}
+
+func (sfepy *StatefunExecutorPluginPython) BuildError() error {
+	return sfepy.buildError
+}
+
+// Close releases the executor's process, the process is stopped with its last executor
+func (sfepy *StatefunExecutorPluginPython) Close() {
+	processesMutex.Lock()
+	defer processesMutex.Unlock()
+	p := sfepy.process
+	if p == nil {
+		return
+	}
+	sfepy.process = nil
+	if p.refs--; p.refs > 0 {
+		return
+	}
+	delete(processes, p.hash)
+	p.mutex.Lock()
+	p.stop()
+	p.mutex.Unlock()
+}
+
+// StopPythonProcesses stops all the sidecar processes, executors start them again on their next messages
+func StopPythonProcesses() {
+	processesMutex.Lock()
+	defer processesMutex.Unlock()
+	for _, p := range processes {
+		p.mutex.Lock()
+		p.stop()
+		p.mutex.Unlock()
+	}
+}
+
+type scriptError struct {
+	alias     string
+	traceback string
+}
+
+func (e *scriptError) Error() string {
+	return fmt.Sprintf("error: %s: %s", e.alias, e.traceback)
+}
+
+func isScriptError(err error) bool {
+	_, ok := err.(*scriptError)
+	return ok
+}
+
+func (p *pythonProcess) startIfNeeded() error {
+	if p.cmd != nil {
+		return nil
+	}
+	cmd := exec.Command(PythonInterpreter, "-u", "-c", runnerScript)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error: %s: python interpreter %s did not start: %w", p.alias, PythonInterpreter, err)
+	}
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("python-executor-stderr")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("python-executor-stderr")
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			lg.Logf(lg.InfoLevel, "%s: %s\n", p.alias, scanner.Text())
+		}
+	}()
+
+	p.cmd, p.stdin = cmd, stdin
+	p.encoder, p.decoder = json.NewEncoder(stdin), json.NewDecoder(stdout)
+
+	loaded := protocolMsg{}
+	if err := p.encoder.Encode(protocolMsg{Type: "load", Alias: p.alias, Source: p.source}); err == nil {
+		err = p.decoder.Decode(&loaded)
+	}
+	if err != nil || loaded.Type != "loaded" {
+		p.stop()
+		return fmt.Errorf("error: %s: python runner did not load the script: %v", p.alias, err)
+	}
+	if len(loaded.Error) > 0 {
+		p.stop()
+		return &scriptError{alias: p.alias, traceback: loaded.Error}
+	}
+	return nil
+}
+
+func (p *pythonProcess) stop() {
+	if p.cmd == nil {
+		return
+	}
+	system.MsgOnErrorReturn(p.stdin.Close())
+	if p.cmd.Process != nil {
+		system.MsgOnErrorReturn(p.cmd.Process.Kill())
+	}
+	_ = p.cmd.Wait() // Killed
+	p.cmd, p.stdin, p.encoder, p.decoder = nil, nil, nil, nil
+}
+
+func (p *pythonProcess) run(contextProcessor *sfPlugins.StatefunContextProcessor) error {
+	if err := p.encoder.Encode(protocolMsg{Type: "run"}); err != nil {
+		return err
+	}
+	for {
+		msg := protocolMsg{}
+		if err := p.decoder.Decode(&msg); err != nil {
+			return fmt.Errorf("error: %s: python runner failed: %w", p.alias, err)
+		}
+		switch msg.Type {
+		case "call":
+			if err := p.encoder.Encode(protocolMsg{Type: "result", Value: p.call(contextProcessor, msg.Fn, msg.Args)}); err != nil {
+				return err
+			}
+		case "done":
+			if len(msg.Error) > 0 {
+				return &scriptError{alias: p.alias, traceback: msg.Error}
+			}
+			return nil
+		default:
+			return fmt.Errorf("error: %s: unexpected python runner message %s", p.alias, msg.Type)
+		}
+	}
+}
+
+func stringArgs(args []any, from int, count int) ([]string, bool) {
+	if len(args) != from+count {
+		return nil, false
+	}
+	result := make([]string, count)
+	for i := 0; i < count; i++ {
+		s, ok := args[from+i].(string)
+		if !ok {
+			return nil, false
+		}
+		result[i] = s
+	}
+	return result, true
+}
+
+// Calls the host function, returns values and statuses of the JS executor's one
+func (p *pythonProcess) call(cp *sfPlugins.StatefunContextProcessor, fn string, args []any) any {
+	switch fn {
+	case "statefun_getSelfTypename":
+		return cp.Self.Typename
+	case "statefun_getSelfId":
+		return cp.Self.ID
+	case "statefun_getCallerTypename":
+		return cp.Caller.Typename
+	case "statefun_getCallerId":
+		return cp.Caller.ID
+	case "statefun_getFunctionContext":
+		return cp.GetFunctionContext().ToString()
+	case "statefun_getObjectContext":
+		return cp.GetObjectContext().ToString()
+	case "statefun_getPayload":
+		return cp.Payload.ToString()
+	case "statefun_getOptions":
+		return cp.Options.ToString()
+	case "statefun_setFunctionContext", "statefun_setObjectContext", "statefun_setRequestReplyData":
+		s, ok := stringArgs(args, 0, 1)
+		if !ok {
+			return 2
+		}
+		if fn == "statefun_setRequestReplyData" && cp.Reply == nil {
+			return 3
+		}
+		j, ok := easyjson.JSONFromString(s[0])
+		if !ok {
+			if fn == "statefun_setRequestReplyData" {
+				return 4
+			}
+			return 3
+		}
+		switch fn {
+		case "statefun_setFunctionContext":
+			cp.SetFunctionContext(&j)
+		case "statefun_setObjectContext":
+			cp.SetObjectContext(&j)
+		default:
+			cp.Reply.With(&j)
+		}
+		return 0
+	case "statefun_signal", "statefun_request":
+		if len(args) != 5 {
+			lg.Logf(lg.ErrorLevel, "%s requires 5 argument but got %d\n", fn, len(args))
+			return 1
+		}
+		provider, ok := args[0].(float64)
+		s, sok := stringArgs(args, 1, 4)
+		if !ok || !sok {
+			return 2
+		}
+		payload, ok := easyjson.JSONFromString(s[2])
+		if !ok {
+			lg.Logf(lg.ErrorLevel, "%s payload is not a JSON: %s\n", fn, s[2])
+			return 3
+		}
+		var options *easyjson.JSON = nil
+		if len(s[3]) > 0 {
+			o, ok := easyjson.JSONFromString(s[3])
+			if !ok {
+				lg.Logf(lg.ErrorLevel, "%s options is not empty and not a JSON: %s\n", fn, s[3])
+				return 4
+			}
+			options = &o
+		}
+		if fn == "statefun_signal" {
+			system.MsgOnErrorReturn(cp.Signal(sfPlugins.SignalProvider(int(provider)), s[0], s[1], &payload, options))
+			return 0
+		}
+		reply, err := cp.Request(sfPlugins.RequestProvider(int(provider)), s[0], s[1], &payload, options)
+		if err != nil {
+			return 5
+		}
+		return reply.ToString()
+	case "print":
+		if s, ok := stringArgs(args, 0, 1); ok {
+			lg.Logf(lg.InfoLevel, "%s: %s\n", p.alias, s[0])
+		}
+		return nil
+	}
+	lg.Logf(lg.ErrorLevel, "%s: unknown host function %s\n", p.alias, fn)
+	return nil
+}
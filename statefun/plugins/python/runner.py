@@ -0,0 +1,81 @@
+# Copyright 2023 NJWS Inc.
+
+# Runs statefun scripts for the Go runtime's Python executor: messages are JSON lines, host -> runner on stdin,
+# runner -> host on stdout. The script is loaded once and executed for every "run" with fresh globals, calling the
+# host's functions in between. Anything else written to stdout goes to stderr not to break the protocol.
+
+import builtins
+import json
+import sys
+import traceback
+
+_protocol_out = sys.stdout
+sys.stdout = sys.stderr
+
+HOST_FUNCTIONS = [
+    "statefun_getSelfTypename",
+    "statefun_getSelfId",
+    "statefun_getCallerTypename",
+    "statefun_getCallerId",
+    "statefun_getFunctionContext",
+    "statefun_getObjectContext",
+    "statefun_getPayload",
+    "statefun_getOptions",
+    "statefun_setFunctionContext",
+    "statefun_setObjectContext",
+    "statefun_setRequestReplyData",
+    "statefun_signal",
+    "statefun_request",
+]
+
+
+def _send(msg):
+    _protocol_out.write(json.dumps(msg) + "\n")
+    _protocol_out.flush()
+
+
+def _receive():
+    line = sys.stdin.readline()
+    if not line:
+        sys.exit(0)  # Host closed the pipe
+    return json.loads(line)
+
+
+def _call(fn, *args):
+    _send({"type": "call", "fn": fn, "args": list(args)})
+    return _receive().get("value")
+
+
+def _host_function(fn):
+    return lambda *args: _call(fn, *args)
+
+
+def _globals():
+    g = {"__name__": "__statefun__", "__builtins__": builtins}
+    for fn in HOST_FUNCTIONS:
+        g[fn] = _host_function(fn)
+    g["print"] = lambda *args: _call("print", " ".join(str(a) for a in args))
+    return g
+
+
+def main():
+    load = _receive()
+    try:
+        code = compile(load["source"], load["alias"], "exec")
+    except Exception:
+        _send({"type": "loaded", "error": traceback.format_exc()})
+        return
+    _send({"type": "loaded"})
+
+    while True:
+        msg = _receive()
+        if msg.get("type") != "run":
+            continue
+        try:
+            exec(code, _globals())
+            _send({"type": "done"})
+        except Exception:
+            _send({"type": "done", "error": traceback.format_exc()})
+
+
+main()
@@ -0,0 +1,303 @@
+// Copyright 2023 NJWS Inc.
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	sdkErrors "github.com/foliagecp/sdk/errors"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Remote executor proxies statefun invocations to an external gRPC service, so heavyweight handlers (ML inference,
+legacy services) live outside the runtime process while still signaling, requesting and accessing contexts:
+
+	ft.SetExecutor("inference", "dns:///inference:50051", sfPluginRemote.StatefunExecutorPluginRemoteContructor)
+
+The source is the service's gRPC target, executors of a constructor share one connection per target. The service
+implements RemoteFunction.Invoke of remote.proto, a bidirectional stream of google.protobuf.Struct frames per
+invocation, so no code generation is needed on either side:
+
+	runtime -> {"type": "invoke", "self": {"typename", "id"}, "caller": {"typename", "id"}, "payload": {...}, "options": {...}}
+	service -> {"type": "call", "fn": "statefun_getObjectContext", "args": [...]}  // Any number of calls
+	runtime -> {"type": "result", "value": ...}
+	service -> {"type": "done", "reply": {...}, "error": "..."}                   // reply and error are optional
+
+Calls are those of the JS executor with JSON values instead of JSON strings: statefun_getFunctionContext,
+statefun_getObjectContext, statefun_setFunctionContext(context), statefun_setObjectContext(context),
+statefun_setRequestReplyData(reply), statefun_signal(provider, typename, id, payload, options) and
+statefun_request(provider, typename, id, payload, options) returning the reply or a status. Connections are
+plaintext by default, Options set credentials and an invocation timeout (failing with sdk errors.ErrTimeout).
+*/
+
+const (
+	InvokeMethod = "/foliage.statefun.remote.v1.RemoteFunction/Invoke"
+)
+
+// Options of remote invocations
+type Options struct {
+	Timeout     time.Duration     // Of an invocation, 0 - no timeout
+	DialOptions []grpc.DialOption // Insecure credentials if empty
+}
+
+type StatefunExecutorPluginRemote struct {
+	alias      string
+	target     string
+	options    Options
+	conn       *grpc.ClientConn
+	buildError error
+}
+
+// Connections are shared by executors dialing the same target with the same dial options
+type connectionKey struct {
+	target string
+	dialer uint64 // 0 - default dial options, constructor's own otherwise
+}
+
+var (
+	connections      = map[connectionKey]*grpc.ClientConn{}
+	connectionsMutex sync.Mutex
+	lastDialer       atomic.Uint64
+
+	invokeStreamDesc = &grpc.StreamDesc{StreamName: "Invoke", ServerStreams: true, ClientStreams: true}
+)
+
+func StatefunExecutorPluginRemoteContructor(alias string, source string) sfPlugins.StatefunExecutor {
+	return newExecutor(alias, source, Options{}, 0)
+}
+
+// StatefunExecutorPluginRemoteContructorWithOptions returns the remote executor constructor with the options.
+// Dial options cannot be compared, so executors of the constructor do not share connections with other constructors
+func StatefunExecutorPluginRemoteContructorWithOptions(options Options) sfPlugins.StatefunExecutorConstructor {
+	var dialer uint64 = 0
+	if len(options.DialOptions) > 0 {
+		dialer = lastDialer.Add(1)
+	}
+	return func(alias string, source string) sfPlugins.StatefunExecutor {
+		return newExecutor(alias, source, options, dialer)
+	}
+}
+
+func newExecutor(alias string, target string, options Options, dialer uint64) *StatefunExecutorPluginRemote {
+	sferemote := &StatefunExecutorPluginRemote{alias: alias, target: target, options: options}
+	sferemote.conn, sferemote.buildError = connection(connectionKey{target: target, dialer: dialer}, options)
+	return sferemote
+}
+
+// Returns the shared connection, dialed lazily by gRPC
+func connection(key connectionKey, options Options) (*grpc.ClientConn, error) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	if conn, ok := connections[key]; ok {
+		return conn, nil
+	}
+	dialOptions := options.DialOptions
+	if len(dialOptions) == 0 {
+		dialOptions = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	conn, err := grpc.Dial(key.target, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	connections[key] = conn
+	return conn, nil
+}
+
+// CloseConnections closes the shared connections, executors created afterwards dial again
+func CloseConnections() {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	for key, conn := range connections {
+		system.MsgOnErrorReturn(conn.Close())
+		delete(connections, key)
+	}
+}
+
+func (sferemote *StatefunExecutorPluginRemote) BuildError() error {
+	return sferemote.buildError
+}
+
+// Close does nothing, connections are shared and closed by CloseConnections
+func (sferemote *StatefunExecutorPluginRemote) Close() {}
+
+func (sferemote *StatefunExecutorPluginRemote) Run(contextProcessor *sfPlugins.StatefunContextProcessor) error {
+	if sferemote.buildError != nil {
+		return sferemote.buildError
+	}
+	// Canceled on return whatever the outcome is, releasing the stream not read to its end
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if sferemote.options.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), sferemote.options.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	err := sferemote.invoke(ctx, contextProcessor)
+	if status.Code(err) == codes.DeadlineExceeded {
+		return sdkErrors.Wrap(sdkErrors.ErrTimeout, fmt.Errorf("error: remote function %s timed out: %w", sferemote.alias, err))
+	}
+	return err
+}
+
+func (sferemote *StatefunExecutorPluginRemote) invoke(ctx context.Context, cp *sfPlugins.StatefunContextProcessor) error {
+	stream, err := sferemote.conn.NewStream(ctx, invokeStreamDesc, InvokeMethod)
+	if err != nil {
+		return err
+	}
+
+	invoke := easyjson.NewJSONObject()
+	invoke.SetByPath("type", easyjson.NewJSON("invoke"))
+	invoke.SetByPath("self", addressJSON(cp.Self))
+	invoke.SetByPath("caller", addressJSON(cp.Caller))
+	invoke.SetByPath("payload", orNull(cp.Payload))
+	invoke.SetByPath("options", orNull(cp.Options))
+	if err := send(stream, invoke); err != nil {
+		return err
+	}
+
+	for {
+		frame, err := receive(stream)
+		if err == io.EOF {
+			return fmt.Errorf("error: remote function %s closed the stream before done", sferemote.alias)
+		}
+		if err != nil {
+			return err
+		}
+		switch frame.GetByPath("type").AsStringDefault("") {
+		case "call":
+			result := easyjson.NewJSONObject()
+			result.SetByPath("type", easyjson.NewJSON("result"))
+			result.SetByPath("value", sferemote.call(cp, frame.GetByPath("fn").AsStringDefault(""), frame.GetByPath("args")))
+			if err := send(stream, result); err != nil {
+				return err
+			}
+		case "done":
+			system.MsgOnErrorReturn(stream.CloseSend())
+			if frame.PathExists("reply") && cp.Reply != nil {
+				cp.Reply.With(frame.GetByPath("reply").GetPtr())
+			}
+			if msg := frame.GetByPath("error").AsStringDefault(""); len(msg) > 0 {
+				return fmt.Errorf("error: remote function %s: %s", sferemote.alias, msg)
+			}
+			return nil
+		default:
+			return fmt.Errorf("error: remote function %s sent an unexpected frame %s", sferemote.alias, frame.ToString())
+		}
+	}
+}
+
+func addressJSON(address sfPlugins.StatefunAddress) easyjson.JSON {
+	j := easyjson.NewJSONObject()
+	j.SetByPath("typename", easyjson.NewJSON(address.Typename))
+	j.SetByPath("id", easyjson.NewJSON(address.ID))
+	return j
+}
+
+func orNull(j *easyjson.JSON) easyjson.JSON {
+	if j == nil {
+		return easyjson.NewJSONNull()
+	}
+	return *j
+}
+
+func send(stream grpc.ClientStream, frame easyjson.JSON) error {
+	s := &structpb.Struct{}
+	if err := protojson.Unmarshal(frame.ToBytes(), s); err != nil {
+		return err
+	}
+	return stream.SendMsg(s)
+}
+
+func receive(stream grpc.ClientStream) (easyjson.JSON, error) {
+	s := &structpb.Struct{}
+	if err := stream.RecvMsg(s); err != nil {
+		return easyjson.NewJSONNull(), err
+	}
+	data, err := protojson.Marshal(s)
+	if err != nil {
+		return easyjson.NewJSONNull(), err
+	}
+	frame, ok := easyjson.JSONFromBytes(data)
+	if !ok {
+		return easyjson.NewJSONNull(), errors.New("error: malformed remote function frame")
+	}
+	return frame, nil
+}
+
+// Calls the host function, returns values and statuses of the JS executor's one
+func (sferemote *StatefunExecutorPluginRemote) call(cp *sfPlugins.StatefunContextProcessor, fn string, args easyjson.JSON) easyjson.JSON {
+	status := func(code int) easyjson.JSON { return easyjson.NewJSON(code) }
+	switch fn {
+	case "statefun_getFunctionContext":
+		return orNull(cp.GetFunctionContext())
+	case "statefun_getObjectContext":
+		return orNull(cp.GetObjectContext())
+	case "statefun_setFunctionContext", "statefun_setObjectContext", "statefun_setRequestReplyData":
+		if args.ArraySize() != 1 {
+			return status(1)
+		}
+		value := args.ArrayElement(0)
+		switch fn {
+		case "statefun_setFunctionContext":
+			cp.SetFunctionContext(&value)
+		case "statefun_setObjectContext":
+			cp.SetObjectContext(&value)
+		default:
+			if cp.Reply == nil {
+				return status(3)
+			}
+			cp.Reply.With(&value)
+		}
+		return status(0)
+	case "statefun_signal", "statefun_request":
+		if args.ArraySize() != 5 {
+			lg.Logf(lg.ErrorLevel, "%s requires 5 argument but got %d\n", fn, args.ArraySize())
+			return status(1)
+		}
+		provider, ok := args.ArrayElement(0).AsNumeric()
+		typename, tok := args.ArrayElement(1).AsString()
+		id, iok := args.ArrayElement(2).AsString()
+		if !ok || !tok || !iok {
+			return status(2)
+		}
+		payload := args.ArrayElement(3)
+		if !payload.IsObject() {
+			lg.Logf(lg.ErrorLevel, "%s payload is not a JSON object: %s\n", fn, payload.ToString())
+			return status(3)
+		}
+		var options *easyjson.JSON = nil
+		if o := args.ArrayElement(4); !o.IsNull() {
+			options = &o
+		}
+		if fn == "statefun_signal" {
+			system.MsgOnErrorReturn(cp.Signal(sfPlugins.SignalProvider(int(provider)), typename, id, &payload, options))
+			return status(0)
+		}
+		reply, err := cp.Request(sfPlugins.RequestProvider(int(provider)), typename, id, &payload, options)
+		if err != nil {
+			return status(5)
+		}
+		return orNull(reply)
+	}
+	lg.Logf(lg.ErrorLevel, "%s: unknown host function %s\n", sferemote.alias, fn)
+	return easyjson.NewJSONNull()
+}
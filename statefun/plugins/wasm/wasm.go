@@ -0,0 +1,325 @@
+// Copyright 2023 NJWS Inc.
+
+package wasm
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+WebAssembly executor runs handlers compiled to WASM (Rust, TinyGo, AssemblyScript, ...) by wazero, without cgo:
+
+	content, err := os.ReadFile("handler.wasm")
+	ft.SetExecutor("handler.wasm", string(content), sfPluginWASM.StatefunExecutorPluginWASMContructor)
+
+Setting the executor again replaces the module for the typename's ids created afterwards. A module exports its linear
+memory as "memory", "statefun_alloc(size i32) -> i32" returning a buffer the host writes strings to, and
+"statefun_run()" called for every message. It imports the same functions as the JS executor from the "statefun"
+module, strings are passed as (ptr, len) pairs and returned packed to i64 as ptr << 32 | len:
+
+	statefun_getSelfTypename() -> i64, statefun_getSelfId() -> i64, statefun_getCallerTypename() -> i64,
+	statefun_getCallerId() -> i64, statefun_getFunctionContext() -> i64, statefun_getObjectContext() -> i64,
+	statefun_getPayload() -> i64, statefun_getOptions() -> i64
+	statefun_setFunctionContext(ptr, len) -> i32, statefun_setObjectContext(ptr, len) -> i32,
+	statefun_setRequestReplyData(ptr, len) -> i32
+	statefun_signal(provider, typename ptr, len, id ptr, len, payload ptr, len, options ptr, len) -> i32
+	statefun_request(provider, typename ptr, len, id ptr, len, payload ptr, len, options ptr, len) -> i64
+	print(ptr, len)
+
+Statuses are those of the JS executor, 0 - ok; a failed request returns its status with a zero ptr. WASI is
+available for the languages' runtimes, a reactor's "_initialize" is called once per instance. A module is compiled
+once per process and content, every id of the typename gets its own instance.
+*/
+
+type StatefunExecutorPluginWASM struct {
+	alias      string
+	module     api.Module
+	run        api.Function
+	alloc      api.Function
+	buildError error
+
+	contextProcessor *sfPlugins.StatefunContextProcessor
+}
+
+type executorContextKey struct{}
+
+var (
+	wasmRuntime     wazero.Runtime
+	wasmRuntimeErr  error
+	wasmRuntimeOnce sync.Once
+
+	compiledModules sync.Map // Content hash -> wazero.CompiledModule
+)
+
+func StatefunExecutorPluginWASMContructor(alias string, source string) sfPlugins.StatefunExecutor {
+	sfewasm := &StatefunExecutorPluginWASM{alias: alias}
+	ctx := context.Background()
+
+	compiled, err := compileModuleCached(ctx, source)
+	if err != nil {
+		sfewasm.buildError = fmt.Errorf("error: %s: %w", alias, err)
+		return sfewasm
+	}
+	sfewasm.module, err = wasmRuntime.InstantiateModule(ctx, compiled, wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		sfewasm.buildError = fmt.Errorf("error: %s: %w", alias, err)
+		return sfewasm
+	}
+	runtime.SetFinalizer(sfewasm, func(e *StatefunExecutorPluginWASM) {
+		system.MsgOnErrorReturn(e.module.Close(context.Background()))
+	})
+
+	sfewasm.run = sfewasm.module.ExportedFunction("statefun_run")
+	sfewasm.alloc = sfewasm.module.ExportedFunction("statefun_alloc")
+	if sfewasm.run == nil || sfewasm.alloc == nil || sfewasm.module.Memory() == nil {
+		sfewasm.buildError = fmt.Errorf("error: %s: module must export memory, statefun_alloc and statefun_run", alias)
+	}
+	return sfewasm
+}
+
+func (sfewasm *StatefunExecutorPluginWASM) Run(contextProcessor *sfPlugins.StatefunContextProcessor) error {
+	if sfewasm.buildError != nil {
+		return sfewasm.buildError
+	}
+	sfewasm.contextProcessor = contextProcessor
+	_, err := sfewasm.run.Call(context.WithValue(context.Background(), executorContextKey{}, sfewasm))
+	return err
+}
+
+func (sfewasm *StatefunExecutorPluginWASM) BuildError() error {
+	return sfewasm.buildError
+}
+
+// Close closes the module's instance, the compiled module stays cached
+func (sfewasm *StatefunExecutorPluginWASM) Close() {
+	if sfewasm.module == nil {
+		return
+	}
+	runtime.SetFinalizer(sfewasm, nil)
+	system.MsgOnErrorReturn(sfewasm.module.Close(context.Background()))
+	sfewasm.module, sfewasm.run, sfewasm.alloc = nil, nil, nil
+}
+
+func compileModuleCached(ctx context.Context, source string) (wazero.CompiledModule, error) {
+	wasmRuntimeOnce.Do(func() {
+		wasmRuntime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCompilationCache(wazero.NewCompilationCache()))
+		wasi_snapshot_preview1.MustInstantiate(ctx, wasmRuntime)
+		wasmRuntimeErr = instantiateHostModule(ctx, wasmRuntime)
+	})
+	if wasmRuntimeErr != nil {
+		return nil, wasmRuntimeErr
+	}
+
+	hash := system.GetHashStr(source)
+	if v, ok := compiledModules.Load(hash); ok {
+		return v.(wazero.CompiledModule), nil
+	}
+	compiled, err := wasmRuntime.CompileModule(ctx, []byte(source))
+	if err != nil {
+		return nil, err
+	}
+	if v, loaded := compiledModules.LoadOrStore(hash, compiled); loaded {
+		system.MsgOnErrorReturn(compiled.Close(ctx))
+		return v.(wazero.CompiledModule), nil
+	}
+	return compiled, nil
+}
+
+// ResetCompiledModulesCache drops all compiled modules, executors created afterwards compile their modules again
+func ResetCompiledModulesCache() {
+	compiledModules.Range(func(key, _ any) bool {
+		compiledModules.Delete(key) // Closing is left to the runtime, instances of the module may still run
+		return true
+	})
+}
+
+func executorOf(ctx context.Context) *StatefunExecutorPluginWASM {
+	e, _ := ctx.Value(executorContextKey{}).(*StatefunExecutorPluginWASM)
+	return e
+}
+
+func readString(m api.Module, ptr uint32, size uint32) (string, bool) {
+	if size == 0 {
+		return "", true
+	}
+	data, ok := m.Memory().Read(ptr, size)
+	if !ok {
+		return "", false
+	}
+	return string(data), true
+}
+
+// Writes the string to a buffer of the guest, returns it packed, 0 on failures
+func (sfewasm *StatefunExecutorPluginWASM) writeString(ctx context.Context, s string) uint64 {
+	results, err := sfewasm.alloc.Call(ctx, uint64(len(s)))
+	if err != nil || len(results) != 1 {
+		lg.Logf(lg.ErrorLevel, "statefun_alloc failed: %v\n", err)
+		return 0
+	}
+	ptr := uint32(results[0])
+	if !sfewasm.module.Memory().Write(ptr, []byte(s)) {
+		lg.Logf(lg.ErrorLevel, "statefun_alloc returned a buffer out of memory: %d\n", ptr)
+		return 0
+	}
+	return uint64(ptr)<<32 | uint64(len(s))
+}
+
+func readJSON(m api.Module, ptr uint32, size uint32) (*easyjson.JSON, bool) {
+	s, ok := readString(m, ptr, size)
+	if !ok {
+		return nil, false
+	}
+	j, ok := easyjson.JSONFromString(s)
+	return &j, ok
+}
+
+// Reads optional JSON options, empty string - no options
+func readOptions(m api.Module, ptr uint32, size uint32) (*easyjson.JSON, bool) {
+	if size == 0 {
+		return nil, true
+	}
+	return readJSON(m, ptr, size)
+}
+
+func instantiateHostModule(ctx context.Context, r wazero.Runtime) error {
+	getter := func(get func(cp *sfPlugins.StatefunContextProcessor) string) func(ctx context.Context, m api.Module) uint64 {
+		return func(ctx context.Context, m api.Module) uint64 {
+			e := executorOf(ctx)
+			if e == nil {
+				return 0
+			}
+			return e.writeString(ctx, get(e.contextProcessor))
+		}
+	}
+	// (string) -> int
+	setter := func(set func(cp *sfPlugins.StatefunContextProcessor, j *easyjson.JSON) int32) func(ctx context.Context, m api.Module, ptr uint32, size uint32) int32 {
+		return func(ctx context.Context, m api.Module, ptr uint32, size uint32) int32 {
+			e := executorOf(ctx)
+			if e == nil {
+				return 1
+			}
+			j, ok := readJSON(m, ptr, size)
+			if !ok {
+				return 3
+			}
+			return set(e.contextProcessor, j)
+		}
+	}
+
+	b := r.NewHostModuleBuilder("statefun")
+	for name, get := range map[string]func(cp *sfPlugins.StatefunContextProcessor) string{
+		"statefun_getSelfTypename":    func(cp *sfPlugins.StatefunContextProcessor) string { return cp.Self.Typename },
+		"statefun_getSelfId":          func(cp *sfPlugins.StatefunContextProcessor) string { return cp.Self.ID },
+		"statefun_getCallerTypename":  func(cp *sfPlugins.StatefunContextProcessor) string { return cp.Caller.Typename },
+		"statefun_getCallerId":        func(cp *sfPlugins.StatefunContextProcessor) string { return cp.Caller.ID },
+		"statefun_getFunctionContext": func(cp *sfPlugins.StatefunContextProcessor) string { return cp.GetFunctionContext().ToString() },
+		"statefun_getObjectContext":   func(cp *sfPlugins.StatefunContextProcessor) string { return cp.GetObjectContext().ToString() },
+		"statefun_getPayload":         func(cp *sfPlugins.StatefunContextProcessor) string { return cp.Payload.ToString() },
+		"statefun_getOptions":         func(cp *sfPlugins.StatefunContextProcessor) string { return cp.Options.ToString() },
+	} {
+		b.NewFunctionBuilder().WithFunc(getter(get)).Export(name)
+	}
+
+	b.NewFunctionBuilder().WithFunc(setter(func(cp *sfPlugins.StatefunContextProcessor, j *easyjson.JSON) int32 {
+		cp.SetFunctionContext(j)
+		return 0
+	})).Export("statefun_setFunctionContext")
+	b.NewFunctionBuilder().WithFunc(setter(func(cp *sfPlugins.StatefunContextProcessor, j *easyjson.JSON) int32 {
+		cp.SetObjectContext(j)
+		return 0
+	})).Export("statefun_setObjectContext")
+	// (string) -> int
+	b.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, ptr uint32, size uint32) int32 {
+		e := executorOf(ctx)
+		if e == nil {
+			return 1
+		}
+		if e.contextProcessor.Reply == nil {
+			return 3
+		}
+		j, ok := readJSON(m, ptr, size)
+		if !ok {
+			return 4
+		}
+		e.contextProcessor.Reply.With(j)
+		return 0
+	}).Export("statefun_setRequestReplyData")
+
+	// (int, string, string, string, string) -> int
+	b.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, provider int32, typenamePtr, typenameLen, idPtr, idLen, payloadPtr, payloadLen, optionsPtr, optionsLen uint32) int32 {
+		e := executorOf(ctx)
+		if e == nil {
+			return 1
+		}
+		typename, ok1 := readString(m, typenamePtr, typenameLen)
+		id, ok2 := readString(m, idPtr, idLen)
+		if !ok1 || !ok2 {
+			return 2
+		}
+		payload, ok := readJSON(m, payloadPtr, payloadLen)
+		if !ok {
+			lg.Logf(lg.ErrorLevel, "statefun_signal payload is not a JSON\n")
+			return 3
+		}
+		options, ok := readOptions(m, optionsPtr, optionsLen)
+		if !ok {
+			lg.Logf(lg.ErrorLevel, "statefun_signal options is not empty and not a JSON\n")
+			return 4
+		}
+		system.MsgOnErrorReturn(e.contextProcessor.Signal(sfPlugins.SignalProvider(provider), typename, id, payload, options))
+		return 0
+	}).Export("statefun_signal")
+
+	// (int, string, string, string, string) -> string|int
+	b.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, provider int32, typenamePtr, typenameLen, idPtr, idLen, payloadPtr, payloadLen, optionsPtr, optionsLen uint32) uint64 {
+		e := executorOf(ctx)
+		if e == nil {
+			return 1
+		}
+		typename, ok1 := readString(m, typenamePtr, typenameLen)
+		id, ok2 := readString(m, idPtr, idLen)
+		if !ok1 || !ok2 {
+			return 2
+		}
+		payload, ok := readJSON(m, payloadPtr, payloadLen)
+		if !ok {
+			lg.Logf(lg.ErrorLevel, "statefun_request payload is not a JSON\n")
+			return 3
+		}
+		options, ok := readOptions(m, optionsPtr, optionsLen)
+		if !ok {
+			lg.Logf(lg.ErrorLevel, "statefun_request options is not empty and not a JSON\n")
+			return 4
+		}
+		reply, err := e.contextProcessor.Request(sfPlugins.RequestProvider(provider), typename, id, payload, options)
+		if err != nil {
+			return 5
+		}
+		return e.writeString(ctx, reply.ToString())
+	}).Export("statefun_request")
+
+	// (string)
+	b.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, ptr uint32, size uint32) {
+		alias := ""
+		if e := executorOf(ctx); e != nil {
+			alias = e.alias
+		}
+		s, _ := readString(m, ptr, size)
+		lg.Logf(lg.InfoLevel, "%s: %s\n", alias, s)
+	}).Export("print")
+
+	_, err := b.Instantiate(ctx)
+	return err
+}
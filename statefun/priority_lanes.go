@@ -0,0 +1,149 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+)
+
+/*
+Priority lanes keep interactive traffic of a typename from waiting behind bulk signals, e.g. graph rebuilds
+(FunctionTypeConfig.SetPriorityLanes). A signal is sent to a lane with the priority option:
+
+	"__priority": "high" | "normal" | "low"
+
+High and low signals have their own subjects, streams and consumers next to the typename's usual (normal) ones:
+
+	priority.high.<signal subject>
+	priority.low.<signal subject>
+
+so JetStream delivers them independently of the normal lane's backlog, the low lane may be bounded to a number
+of signals pending at once. When the typename's workers are limited (SetMaxParallelHandlers) a free worker is given
+to requests and high signals first, then to normal ones, low signals take the rest.
+Signals to typenames without lanes, not registered in the sending runtime or without the option go the normal lane.
+*/
+
+type SignalPriority string
+
+const (
+	PriorityHigh   SignalPriority = "high"
+	PriorityNormal SignalPriority = "normal"
+	PriorityLow    SignalPriority = "low"
+
+	PriorityOption            = "__priority"
+	PriorityLaneSubjectPrefix = "priority"
+
+	priorityYieldInterval = time.Millisecond
+)
+
+var signalPriorities = []SignalPriority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// A subject the function type's signals are consumed from
+type signalSource struct {
+	subject    string
+	suffix     string // Of consumer names
+	maxPending int    // Signals pending at once, 0 - as configured for the typename
+}
+
+func laneSubject(namespace string, priority SignalPriority, subject string) string {
+	return namespacedSubject(namespace, PriorityLaneSubjectPrefix+"."+string(priority)+"."+subject)
+}
+
+// Subject without its lane prefix
+func trimLanePrefix(namespace string, subject string) string {
+	for _, priority := range []SignalPriority{PriorityHigh, PriorityLow} {
+		if prefix := laneSubject(namespace, priority, ""); strings.HasPrefix(subject, prefix) {
+			return strings.TrimPrefix(subject, prefix)
+		}
+	}
+	return subject
+}
+
+func priorityOf(options *easyjson.JSON) SignalPriority {
+	if options == nil {
+		return PriorityNormal
+	}
+	switch priority := SignalPriority(options.GetByPath(PriorityOption).AsStringDefault("")); priority {
+	case PriorityHigh, PriorityLow:
+		return priority
+	default:
+		return PriorityNormal
+	}
+}
+
+// Lanes go after the normal ones, legacy subjects of the compatibility mode have the normal lane only
+func (ft *FunctionType) signalSources() []signalSource {
+	sources := []signalSource{}
+	for i, subject := range ft.signalSubjects() {
+		suffix := ""
+		if i > 0 {
+			suffix = "-legacy"
+		}
+		sources = append(sources, signalSource{subject: subject, suffix: suffix})
+	}
+	if ft.config.priorityLanes {
+		sources = append(sources,
+			signalSource{subject: laneSubject(ft.runtime.config.namespace, PriorityHigh, ft.subject), suffix: "-" + string(PriorityHigh)},
+			signalSource{subject: laneSubject(ft.runtime.config.namespace, PriorityLow, ft.subject), suffix: "-" + string(PriorityLow), maxPending: ft.config.lowLaneMaxPending},
+		)
+	}
+	return sources
+}
+
+// Subject the signal is sent to with respect to its priority
+func (r *Runtime) prioritySignalSubject(typename string, id string, options *easyjson.JSON) string {
+	if priority := priorityOf(options); priority != PriorityNormal {
+		if ft, ok := r.registeredFunctionTypes[typename]; ok && ft.config.priorityLanes {
+			return laneSubject(r.config.namespace, priority, r.config.signalSubjectTemplate.subject(typename, id))
+		}
+	}
+	return r.signalSubject(typename, id)
+}
+
+func (ft *FunctionType) msgPriority(msg FunctionTypeMsg) int {
+	priority := PriorityHigh
+	if msg.RequestCallback == nil {
+		priority = priorityOf(msg.Options)
+	}
+	for i, p := range signalPriorities {
+		if p == priority {
+			return i
+		}
+	}
+	return 1
+}
+
+// Takes a worker of the limited pool, messages of lower priorities yield it while higher ones wait
+func (ft *FunctionType) acquireWorker(msg FunctionTypeMsg) {
+	if !ft.config.priorityLanes {
+		ft.workersControlChannel <- struct{}{}
+		return
+	}
+	priority := ft.msgPriority(msg)
+	ft.workersWaiting[priority].Add(1)
+	defer ft.workersWaiting[priority].Add(-1)
+	for {
+		ft.workersControlChannel <- struct{}{}
+		if !ft.higherPriorityWaiting(priority) {
+			return
+		}
+		<-ft.workersControlChannel
+		time.Sleep(priorityYieldInterval)
+	}
+}
+
+func (ft *FunctionType) higherPriorityWaiting(priority int) bool {
+	for i := 0; i < priority; i++ {
+		if ft.workersWaiting[i].Load() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Workers waiting by priority of their messages
+type priorityWaiting [3]atomic.Int32
@@ -0,0 +1,162 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	sdkErrors "github.com/foliagecp/sdk/errors"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+)
+
+var (
+	idRateLimitExceededError = sdkErrors.New(sdkErrors.ErrThrottled, "error: rate limit of the id is exceeded")
+)
+
+type IDRateLimitOverflowPolicy int
+
+const (
+	// Wait until the limit allows the message to be handled, messages keep piling up in the id's channel
+	IDRateLimitQueue IDRateLimitOverflowPolicy = iota
+	// Drop the message: signals are acked without handling, requests get the "failed" reply
+	IDRateLimitShed
+	// Deep merge all signals waiting in the id's channel into one and handle it when the limit allows
+	IDRateLimitAggregate
+)
+
+// Token bucket, lives within a single id handler routine so needs no locking
+type idRateLimiter struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newIDRateLimiter(rate float64, burst int) *idRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &idRateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (rl *idRateLimiter) refill() {
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+}
+
+func (rl *idRateLimiter) tryTake() bool {
+	rl.refill()
+	if rl.tokens >= 1 {
+		rl.tokens--
+		return true
+	}
+	return false
+}
+
+func (rl *idRateLimiter) waitTake() {
+	for !rl.tryTake() {
+		time.Sleep(time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second)))
+	}
+}
+
+// Returns messages to be handled in order, empty if there is nothing to handle
+func (ft *FunctionType) applyIDRateLimit(id string, rl *idRateLimiter, msg FunctionTypeMsg, msgChannel chan FunctionTypeMsg) []FunctionTypeMsg {
+	if rl.tryTake() {
+		return []FunctionTypeMsg{msg}
+	}
+
+	switch ft.config.idRateLimitPolicy {
+	case IDRateLimitShed:
+		lg.Log(lg.TraceLevel, "Rate limit is exceeded, message is shed", "typename", ft.name, "id", id)
+		if msg.RequestCallback != nil {
+			reply := easyjson.NewJSONObject()
+			reply.SetByPath("status", easyjson.NewJSON("failed"))
+			reply.SetByPath("result", easyjson.NewJSON(idRateLimitExceededError.Error()))
+			msg.RequestCallback(&reply)
+		} else if msg.AckCallback != nil {
+			msg.AckCallback(true)
+		}
+		return []FunctionTypeMsg{}
+	case IDRateLimitAggregate:
+		if msg.RequestCallback == nil { // Requests must be replied one by one, cannot be aggregated
+			aggregated, leftover := aggregateQueuedSignals(msg, msgChannel)
+			rl.waitTake()
+			if leftover == nil {
+				return []FunctionTypeMsg{aggregated}
+			}
+			rl.waitTake()
+			return []FunctionTypeMsg{aggregated, *leftover}
+		}
+	}
+	rl.waitTake()
+	return []FunctionTypeMsg{msg}
+}
+
+// Merges signals waiting in the channel into one, stops at the first request which is returned as leftover.
+// Acking or refusing the merged signal acks or refuses every signal merged into it
+func aggregateQueuedSignals(msg FunctionTypeMsg, msgChannel chan FunctionTypeMsg) (FunctionTypeMsg, *FunctionTypeMsg) {
+	aggregated := msg
+	if msg.Payload != nil {
+		aggregated.Payload = msg.Payload.Clone().GetPtr()
+	} else {
+		aggregated.Payload = easyjson.NewJSONObject().GetPtr()
+	}
+	if msg.Options != nil {
+		aggregated.Options = msg.Options.Clone().GetPtr()
+	}
+	acks := []SignalCallbackAction{msg.AckCallback}
+	refusals := []RefusalCallbackAction{msg.RefusalCallback}
+
+	for {
+		select {
+		case next, ok := <-msgChannel:
+			if !ok {
+				return finalizeAggregatedSignal(aggregated, acks, refusals), nil
+			}
+			if next.RequestCallback != nil {
+				return finalizeAggregatedSignal(aggregated, acks, refusals), &next
+			}
+			if next.Payload != nil {
+				aggregated.Payload.DeepMerge(*next.Payload)
+			}
+			if next.Options != nil {
+				if aggregated.Options == nil {
+					aggregated.Options = easyjson.NewJSONObject().GetPtr()
+				}
+				aggregated.Options.DeepMerge(*next.Options)
+			}
+			aggregated.Caller = next.Caller
+			acks = append(acks, next.AckCallback)
+			refusals = append(refusals, next.RefusalCallback)
+		default:
+			return finalizeAggregatedSignal(aggregated, acks, refusals), nil
+		}
+	}
+}
+
+func finalizeAggregatedSignal(aggregated FunctionTypeMsg, acks []SignalCallbackAction, refusals []RefusalCallbackAction) FunctionTypeMsg {
+	aggregated.AckCallback = func(ack bool) {
+		for _, a := range acks {
+			if a != nil {
+				a(ack)
+			}
+		}
+	}
+	aggregated.RefusalCallback = func() {
+		for _, r := range refusals {
+			if r != nil {
+				r()
+			}
+		}
+	}
+	return aggregated
+}
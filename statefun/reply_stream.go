@@ -0,0 +1,195 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	sdkErrors "github.com/foliagecp/sdk/errors"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+/*
+Streaming replies let a requested function send partial replies (Reply.Stream) before its final one, e.g. results
+of a long graph query as they are found. Requests made with RequestStream mark their data with "reply_stream": true,
+chunks are sent to the reply subject right away with the ReplyChunkHeader header (chunk number starting from 1),
+the final reply is a regular one without the header. Reply.Close sends the final reply without waiting for the
+handler to return, chunks streamed after it are dropped.
+A plain request gets the chunks collected into the JSON array as the reply, unless the handler replies with With.
+*/
+
+const (
+	ReplyChunkHeader = "Foliage-Reply-Chunk"
+)
+
+var (
+	requestRefusedError = sdkErrors.New(sdkErrors.ErrThrottled, "error: request refused")
+)
+
+// Makes the reply of a requested message: reply callback called once, chunks streamed or collected
+func (ft *FunctionType) prepareReply(msg *FunctionTypeMsg, reply *sfPlugins.SyncReply, replyDataChannel chan *easyjson.JSON) {
+	requestCallback := msg.RequestCallback
+	var replyOnce sync.Once
+	msg.RequestCallback = func(data *easyjson.JSON) {
+		replyOnce.Do(func() { requestCallback(data) })
+	}
+
+	var closed atomic.Bool
+	var chunksMutex sync.Mutex
+	chunks := easyjson.NewJSONArray()
+	reply.Stream = func(data *easyjson.JSON) {
+		if closed.Load() || data == nil {
+			return
+		}
+		if msg.StreamCallback != nil {
+			msg.StreamCallback(data)
+			return
+		}
+		chunksMutex.Lock()
+		chunks.AddToArray(*data)
+		collected := chunks.Clone()
+		chunksMutex.Unlock()
+		reply.With(&collected)
+	}
+	reply.Close = func() {
+		if !closed.CompareAndSwap(false, true) {
+			return
+		}
+		var data *easyjson.JSON
+		select {
+		case data = <-replyDataChannel:
+		default:
+			data = easyjson.NewJSONObject().GetPtr()
+		}
+		msg.RequestCallback(data)
+		replyDataChannel <- data // Read again after the handler returns, replying is a no-op then
+	}
+}
+
+// Returns headers of the reply's chunks numbered one by one
+func chunkHeaders() func() nats.Header {
+	var chunk atomic.Int64
+	return func() nats.Header {
+		header := nats.Header{}
+		header.Set(ReplyChunkHeader, strconv.FormatInt(chunk.Add(1), 10))
+		return header
+	}
+}
+
+// RequestStream is RequestCtx receiving partial replies the function streams with onChunk (called sequentially)
+// before returning its final reply
+func (r *Runtime) RequestStream(ctx context.Context, requestProvider sfPlugins.RequestProvider, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON, onChunk func(chunk *easyjson.JSON)) (*easyjson.JSON, error) {
+	return r.requestStream(ctx, requestProvider, "ingress", "go", typename, id, payload, options, onChunk)
+}
+
+func (r *Runtime) requestStream(ctx context.Context, requestProvider sfPlugins.RequestProvider, callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON, onChunk func(chunk *easyjson.JSON)) (*easyjson.JSON, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(r.config.requestTimeoutSec)*time.Second)
+		defer cancel()
+	}
+	targetTypename = r.routeVersion(r.resolveAlias(targetTypename), targetID)
+	timeoutError := func(err error) error {
+		if err == context.DeadlineExceeded || err == nats.ErrTimeout {
+			return fmt.Errorf("%w: function typename \"%s\" with id \"%s\"", RequestTimeoutError, targetTypename, targetID)
+		}
+		return err
+	}
+
+	switch requestProvider {
+	case sfPlugins.NatsCoreGlobalRequest:
+		payload, err := r.e2eSend(callerTypename, targetTypename, payload)
+		if err != nil {
+			return nil, err
+		}
+		nc, _ := r.messaging()
+		inbox := nats.NewInbox()
+		sub, err := nc.SubscribeSync(inbox)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = sub.Unsubscribe() }()
+		if err := nc.PublishRequest(r.nodeRequestSubject(targetTypename, targetID, options), inbox, buildNatsData(callerTypename, callerID, payload, options, true)); err != nil {
+			return nil, err
+		}
+		for {
+			msg, err := sub.NextMsgWithContext(ctx)
+			if err != nil {
+				return nil, timeoutError(err)
+			}
+			if len(msg.Data) == 0 {
+				return nil, fmt.Errorf("%w: function typename \"%s\" with id \"%s\"", requestRefusedError, targetTypename, targetID)
+			}
+			j, ok := easyjson.JSONFromBytes(msg.Data)
+			if !ok {
+				return nil, fmt.Errorf("response from function typename \"%s\" with id \"%s\" is not a json", targetTypename, targetID)
+			}
+			data, err := r.e2eReceive(targetTypename, callerTypename, &j)
+			if err != nil {
+				return nil, err
+			}
+			if len(msg.Header.Get(ReplyChunkHeader)) == 0 {
+				return data, nil
+			}
+			if onChunk != nil {
+				onChunk(data)
+			}
+		}
+	case sfPlugins.GolangLocalRequest:
+		targetFT, ok := r.registeredFunctionTypes[targetTypename]
+		if !ok {
+			return nil, fmt.Errorf("cannot request function with the typename %s, not registered", targetTypename)
+		}
+		resultJSONChannel := make(chan *easyjson.JSON, 1)
+		chunksChannel := make(chan *easyjson.JSON, targetFT.config.msgChannelSize)
+		functionMsg := FunctionTypeMsg{
+			Caller:          &sfPlugins.StatefunAddress{Typename: callerTypename, ID: callerID},
+			RequestCallback: func(data *easyjson.JSON) { resultJSONChannel <- data },
+			RefusalCallback: func() { close(resultJSONChannel) },
+			StreamCallback: func(data *easyjson.JSON) {
+				select {
+				case chunksChannel <- data.Clone().GetPtr():
+				case <-ctx.Done():
+				}
+			},
+		}
+		if payload != nil {
+			functionMsg.Payload = payload.Clone().GetPtr()
+		}
+		if options != nil {
+			functionMsg.Options = options.Clone().GetPtr()
+		}
+		targetFT.sendMsg(targetID, functionMsg)
+
+		for {
+			select {
+			case chunk := <-chunksChannel:
+				if onChunk != nil {
+					onChunk(chunk)
+				}
+			case resultJSON, ok := <-resultJSONChannel:
+				if !ok {
+					return nil, fmt.Errorf("%w: function typename \"%s\" with id \"%s\"", requestRefusedError, targetTypename, targetID)
+				}
+				for len(chunksChannel) > 0 { // Chunks are always sent before the final reply
+					if chunk := <-chunksChannel; onChunk != nil {
+						onChunk(chunk)
+					}
+				}
+				return resultJSON, nil
+			case <-ctx.Done():
+				return nil, timeoutError(ctx.Err())
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown request provider: %d", requestProvider)
+	}
+}
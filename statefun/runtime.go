@@ -7,12 +7,12 @@ package statefun
 import (
 	"context"
 	"fmt"
-	"slices"
+	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	lg "github.com/foliagecp/sdk/statefun/logger"
-	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/foliagecp/sdk/embedded/nats/kv"
 	"github.com/foliagecp/sdk/statefun/cache"
@@ -20,6 +20,10 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
+const (
+	SystemCacheKeysOwner = "statefun" // Owner of the effect log, schema registry, e2e keys and checkpoints in the cache
+)
+
 type Runtime struct {
 	config     RuntimeConfig
 	nc         *nats.Conn
@@ -27,7 +31,43 @@ type Runtime struct {
 	kv         nats.KeyValue
 	cacheStore *cache.Store
 
+	msgNC          *nats.Conn // Messaging connection: nc or fallbackNC
+	msgJS          nats.JetStreamContext
+	fallbackNC     *nats.Conn
+	fallbackJS     nats.JetStreamContext
+	natsCluster    string // The primary connection is connected to
+	messagingMutex sync.RWMutex
+	sourcesMutex   sync.Mutex // Function types' subscriptions are being changed
+
 	registeredFunctionTypes map[string]*FunctionType
+	interceptors            []Interceptor
+	reservedCacheKeys       [][2]string // owner, pattern - reserved in the cache store on start
+	e2eKeys                 sync.Map    // E2E data key id -> unwrapped key
+	checkpointBackend       cache.ArchiveBackend
+	checkpointBackendMutex  sync.Mutex
+	versionRoutes           sync.Map // Unversioned typename -> *versionRoute
+
+	stopped                     chan struct{} // Closed by Shutdown
+	stopping                    atomic.Bool
+	started                     atomic.Bool  // Function types are subscribed by Start
+	handlersBusy                atomic.Int64 // Messages taken by id handlers and not handled yet
+	singleInstanceRevisions     map[string]uint64
+	singleInstanceRevisionsLock sync.Mutex
+
+	childTasksCtx       context.Context
+	childTasksCancel    context.CancelFunc
+	childTasksWaitGroup sync.WaitGroup
+
+	adminServer  *http.Server
+	recentErrors recentErrors
+
+	metrics       *runtimeMetrics // nil if the metrics endpoint is disabled
+	metricsServer *http.Server
+	healthServer  *http.Server
+	hooks         lifecycleHooks
+	signalBuffer  *signalBuffer // nil if signals are not buffered
+
+	registeredCapabilities registeredCapabilities
 
 	gt0  int64 // Global time 0 - time of the very first message receving by any function type
 	glce int64 // Global last call ended - time of last call of last function handling id of any function type
@@ -35,18 +75,32 @@ type Runtime struct {
 }
 
 func NewRuntime(config RuntimeConfig) (r *Runtime, err error) {
+	if err = config.applyNamespace(); err != nil {
+		return
+	}
+	if err = config.applyNodeID(); err != nil {
+		return
+	}
 	r = &Runtime{
 		config:                  config,
 		registeredFunctionTypes: make(map[string]*FunctionType),
+		stopped:                 make(chan struct{}),
+		singleInstanceRevisions: map[string]uint64{},
+	}
+	r.childTasksCtx, r.childTasksCancel = context.WithCancel(context.Background())
+	r.metrics = newRuntimeMetrics(r)
+	r.signalBuffer = newSignalBuffer(r)
+
+	config.applyLogging()
+	if config.metricsBackend != nil {
+		system.GlobalMetrics = config.metricsBackend
 	}
 
-	r.nc, err = nats.Connect(config.natsURL)
-	if err != nil {
+	if err = config.validateSubjectTemplates(); err != nil {
 		return
 	}
 
-	r.js, err = r.nc.JetStream(nats.PublishAsyncMaxPending(256))
-	if err != nil {
+	if err = r.connectNats(); err != nil {
 		return
 	}
 
@@ -74,43 +128,61 @@ func NewRuntime(config RuntimeConfig) (r *Runtime, err error) {
 	}
 	// --------------------------------------------------------------
 
+	if err = r.serveCapabilities(); err != nil {
+		return
+	}
+	if err = r.servePluginReload(); err != nil {
+		return
+	}
+	r.startHealthProbes()
 	return
 }
 
 func (r *Runtime) Start(cacheConfig *cache.Config, onAfterStart func(runtime *Runtime) error) (err error) {
-	// Create streams if does not exist ------------------------------
-	/* Each stream contains a single subject (topic).
-	 * Differently named stream with overlapping subjects cannot exist!
-	 */
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	var existingStreams []string
-	for info := range r.js.StreamsInfo(nats.Context(ctx)) {
-		existingStreams = append(existingStreams, info.Config.Name)
-	}
-	for _, functionType := range r.registeredFunctionTypes {
-		if !slices.Contains(existingStreams, functionType.getStreamName()) {
-			_, err := r.js.AddStream(&nats.StreamConfig{
-				Name:     functionType.getStreamName(),
-				Subjects: []string{functionType.subject},
-			})
-			system.MsgOnErrorReturn(err)
-		}
+	if err := r.runBeforeStartHooks(); err != nil {
+		return err
 	}
+
+	// Create streams if does not exist ------------------------------
+	_, js := r.messaging()
+	r.ensureStreams(js)
 	// --------------------------------------------------------------
 
 	lg.Logln(lg.TraceLevel, "Initializing the cache store...")
+	cacheConfig = cacheConfig.Namespaced(r.config.namespace)
+	if r.config.cacheDistributedInvalidation {
+		cacheConfig.SetInvalidationBus(cache.NewNatsInvalidationBus(r.nc))
+	}
 	r.cacheStore = cache.NewCacheStore(context.Background(), cacheConfig, r.js, r.kv)
+	r.reserveSystemCacheKeys()
 	lg.Logln(lg.TraceLevel, "Cache store inited!")
 
+	r.recoverEffectLog()
+
+	if err := r.validateE2EConfig(); err != nil {
+		return err
+	}
+
+	if err := r.registerPayloadSchemas(); err != nil {
+		return err
+	}
+
+	if err := r.compileIngressTransformations(); err != nil {
+		return err
+	}
+
 	// Functions running in a single instance controller --------------------------------
-	singleInstanceFunctionRevisions := map[string]uint64{}
 	singleInstanceFunctionLocksUpdater := func(sifr map[string]uint64) {
 		system.GlobalPrometrics.GetRoutinesCounter().Started("singleInstanceFunctionLocksUpdater")
 		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("singleInstanceFunctionLocksUpdater")
 		if len(sifr) > 0 {
 			for {
-				time.Sleep(time.Duration(r.config.kvMutexLifeTimeSec) / 2 * time.Second)
+				select {
+				case <-r.stopped:
+					return
+				case <-time.After(time.Duration(r.config.kvMutexLifeTimeSec) / 2 * time.Second):
+				}
+				r.singleInstanceRevisionsLock.Lock()
 				for ftName, revId := range sifr {
 					newRevId, err := KeyMutexLockUpdate(r, system.GetHashStr(ftName), revId)
 					if err != nil {
@@ -119,13 +191,22 @@ func (r *Runtime) Start(cacheConfig *cache.Config, onAfterStart func(runtime *Ru
 						sifr[ftName] = newRevId
 					}
 				}
+				r.singleInstanceRevisionsLock.Unlock()
 			}
 		}
 	}
 	// ----------------------------------------------------------------------------------
 
+	if err := r.checkDependencyCycles(); err != nil {
+		return err
+	}
+
 	// Start function subscriptions ---------------------------------
 	for ftName, ft := range r.registeredFunctionTypes {
+		if !r.servesFunctionType(ft) {
+			lg.Logf(lg.TraceLevel, "Function type %s is not served by the %s runtime role, skipping\n", ft.name, r.config.role)
+			continue
+		}
 		if !ft.config.multipleInstancesAllowed {
 			revId, err := KeyMutexLock(r, system.GetHashStr(ftName), true)
 			if err != nil {
@@ -136,30 +217,64 @@ func (r *Runtime) Start(cacheConfig *cache.Config, onAfterStart func(runtime *Ru
 					return err
 				}
 			}
-			singleInstanceFunctionRevisions[ftName] = revId
+			r.singleInstanceRevisions[ftName] = revId
 		}
 
-		system.MsgOnErrorReturn(AddSignalSourceJetstreamQueuePushConsumer(ft))
-		if ft.config.serviceActive {
-			system.MsgOnErrorReturn(AddRequestSourceNatsCore(ft))
+		ft.buildHandler()
+		if ft.hasDependencies() {
+			r.startSourcesAfterDependencies(ft)
+			continue
 		}
+		r.sourcesMutex.Lock()
+		ft.startSources()
+		ft.sourcesStarted = true
+		r.sourcesMutex.Unlock()
 	}
 	// --------------------------------------------------------------
 
-	go singleInstanceFunctionLocksUpdater(singleInstanceFunctionRevisions)
+	r.started.Store(true)
 
-	if onAfterStart != nil {
-		go func() {
-			system.GlobalPrometrics.GetRoutinesCounter().Started("runtime_onAfterStart")
-			defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime_onAfterStart")
-			system.MsgOnErrorReturn(onAfterStart(r))
-		}()
-	}
+	go singleInstanceFunctionLocksUpdater(r.singleInstanceRevisions)
+	go r.runTimersScheduler()
+	go r.runDedupSweeper()
+	go r.runNatsHealthCheck()
+	r.startAdminUI()
+	r.startMetricsEndpoint()
+
+	r.runAfterStartHooks(onAfterStart)
 	system.MsgOnErrorReturn(r.runGarbageCellector())
 
 	return
 }
 
+// GetCacheStore returns the runtime's cache store, nil until the runtime is started
+func (r *Runtime) GetCacheStore() *cache.Store {
+	return r.cacheStore
+}
+
+// ReserveCacheKeyPattern makes cache keys matching the pattern writable only through GetCacheStore().Reserved(owner)
+func (r *Runtime) ReserveCacheKeyPattern(owner string, pattern string) {
+	if r.cacheStore != nil {
+		r.cacheStore.ReserveKeyPattern(owner, pattern)
+		return
+	}
+	r.reservedCacheKeys = append(r.reservedCacheKeys, [2]string{owner, pattern})
+}
+
+func (r *Runtime) reserveSystemCacheKeys() {
+	for _, prefix := range []string{EffectLogKeyPrefix, SchemaRegistryKeyPrefix, E2EKeysKeyPrefix, CheckpointKeyPrefix, TimerKeyPrefix, VersionRoutingKeyPrefix, DedupKeyPrefix, AliasKeyPrefix} {
+		r.cacheStore.ReserveKeyPattern(SystemCacheKeysOwner, prefix+".>")
+	}
+	for _, reserved := range r.reservedCacheKeys {
+		r.cacheStore.ReserveKeyPattern(reserved[0], reserved[1])
+	}
+}
+
+// Writes cache keys reserved by the runtime itself
+func (r *Runtime) systemCache() *cache.ReservedWriter {
+	return r.cacheStore.Reserved(SystemCacheKeysOwner)
+}
+
 func (r *Runtime) runGarbageCellector() (err error) {
 	for {
 		// Start function subscriptions ---------------------------------
@@ -167,17 +282,11 @@ func (r *Runtime) runGarbageCellector() (err error) {
 		var totalIDHandlersRunning int
 
 		measureName := "stetefun_instances"
-		var gaugeVec *prometheus.GaugeVec
-		var gaugeVecErr error
-		gaugeVec, gaugeVecErr = system.GlobalPrometrics.EnsureGaugeVecSimple(measureName, "Stateful function instances", []string{"typename"})
-
 		for _, ft := range r.registeredFunctionTypes {
 			n1, n2 := ft.gc(r.config.functionTypeIDLifetimeMs)
 			totalIdsGrbageCollected += n1
 			totalIDHandlersRunning += n2
-			if gaugeVec != nil && gaugeVecErr == nil {
-				gaugeVec.With(prometheus.Labels{"typename": ft.name}).Set(float64(n2))
-			}
+			system.Metrics().SetGauge(measureName, "Stateful function instances", map[string]string{"typename": ft.name}, float64(n2))
 		}
 
 		if totalIdsGrbageCollected > 0 && totalIDHandlersRunning == 0 {
@@ -198,7 +307,11 @@ func (r *Runtime) runGarbageCellector() (err error) {
 		}
 		// --------------------------------------------------------------
 
-		time.Sleep(1 * time.Second)
+		select {
+		case <-r.stopped:
+			return nil
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
 
@@ -0,0 +1,148 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Metrics endpoint is a Prometheus scrape endpoint served by the runtime (RuntimeConfig.SetMetricsEndpoint), it exports:
+
+	fg_function_invocations_total{typename}              - handled messages
+	fg_function_failures_total{typename}                 - failed, timed out and refused messages
+	fg_function_error_ratio{typename}                    - failures per invocation since the start
+	fg_function_latency_seconds{typename}                - histogram of handler execution time
+	fg_consumer_pending_messages{typename, consumer}     - JetStream messages not delivered to the consumer yet
+	fg_consumer_ack_pending_messages{typename, consumer} - delivered and not acked ones
+	cache_*{id}                                          - cache store stats (see cache.Store.PrometheusCollector)
+
+together with everything registered in the default Prometheus registry (e.g. system.GlobalPrometrics metrics).
+Error rates over time are rate(fg_function_failures_total[5m]) / rate(fg_function_invocations_total[5m]).
+Consumer lag is read from NATS on every scrape.
+*/
+
+const (
+	MetricsEndpointPath = "/metrics"
+
+	metricsShutdownTimeout = 5 * time.Second
+)
+
+type runtimeMetrics struct {
+	registry *prometheus.Registry
+	latency  *prometheus.HistogramVec
+}
+
+type runtimeCollector struct {
+	r *Runtime
+
+	invocations        *prometheus.Desc
+	failures           *prometheus.Desc
+	errorRatio         *prometheus.Desc
+	consumerPending    *prometheus.Desc
+	consumerAckPending *prometheus.Desc
+}
+
+func newRuntimeMetrics(r *Runtime) *runtimeMetrics {
+	if len(r.config.metricsAddress) == 0 {
+		return nil
+	}
+	m := &runtimeMetrics{
+		registry: prometheus.NewRegistry(),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "fg_function_latency_seconds",
+			Help:    "Function handler execution time",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"typename"}),
+	}
+	m.registry.MustRegister(m.latency, &runtimeCollector{
+		r:                  r,
+		invocations:        prometheus.NewDesc("fg_function_invocations_total", "Messages handled by the function", []string{"typename"}, nil),
+		failures:           prometheus.NewDesc("fg_function_failures_total", "Messages the function failed, timed out or refused", []string{"typename"}, nil),
+		errorRatio:         prometheus.NewDesc("fg_function_error_ratio", "Failures per invocation since the runtime start", []string{"typename"}, nil),
+		consumerPending:    prometheus.NewDesc("fg_consumer_pending_messages", "JetStream messages not delivered to the consumer yet", []string{"typename", "consumer"}, nil),
+		consumerAckPending: prometheus.NewDesc("fg_consumer_ack_pending_messages", "JetStream messages delivered to the consumer and not acked", []string{"typename", "consumer"}, nil),
+	})
+	return m
+}
+
+func (m *runtimeMetrics) observeLatency(typename string, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.latency.With(prometheus.Labels{"typename": typename}).Observe(latency.Seconds())
+}
+
+func (c *runtimeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.invocations
+	ch <- c.failures
+	ch <- c.errorRatio
+	ch <- c.consumerPending
+	ch <- c.consumerAckPending
+}
+
+func (c *runtimeCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, ft := range c.r.registeredFunctionTypes {
+		handled, failed := ft.handledCount.Load(), ft.failedCount.Load()
+		ch <- prometheus.MustNewConstMetric(c.invocations, prometheus.CounterValue, float64(handled), name)
+		ch <- prometheus.MustNewConstMetric(c.failures, prometheus.CounterValue, float64(failed), name)
+		ratio := 0.0
+		if handled > 0 {
+			ratio = float64(failed) / float64(handled)
+		}
+		ch <- prometheus.MustNewConstMetric(c.errorRatio, prometheus.GaugeValue, ratio, name)
+	}
+
+	c.r.sourcesMutex.Lock()
+	defer c.r.sourcesMutex.Unlock()
+	for name, ft := range c.r.registeredFunctionTypes {
+		for _, sub := range ft.subscriptions {
+			info, err := sub.ConsumerInfo()
+			if err != nil {
+				continue // Not a JetStream subscription or the consumer is gone
+			}
+			ch <- prometheus.MustNewConstMetric(c.consumerPending, prometheus.GaugeValue, float64(info.NumPending), name, info.Name)
+			ch <- prometheus.MustNewConstMetric(c.consumerAckPending, prometheus.GaugeValue, float64(info.NumAckPending), name, info.Name)
+		}
+	}
+}
+
+func (r *Runtime) startMetricsEndpoint() {
+	if r.metrics == nil {
+		return
+	}
+	system.MsgOnErrorReturn(r.metrics.registry.Register(r.cacheStore.PrometheusCollector()))
+
+	path := r.config.metricsPath
+	if len(path) == 0 {
+		path = MetricsEndpointPath
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(prometheus.Gatherers{r.metrics.registry, prometheus.DefaultGatherer}, promhttp.HandlerOpts{}))
+
+	r.metricsServer = &http.Server{Addr: r.config.metricsAddress, Handler: mux}
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("runtime-metricsEndpoint")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime-metricsEndpoint")
+		if err := r.metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			lg.Log(lg.ErrorLevel, "Metrics endpoint failed", "address", r.config.metricsAddress, "error", err)
+		}
+	}()
+}
+
+func (r *Runtime) stopMetricsEndpoint() {
+	if r.metricsServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+	defer cancel()
+	system.MsgOnErrorReturn(r.metricsServer.Shutdown(ctx))
+}
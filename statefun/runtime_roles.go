@@ -0,0 +1,89 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Runtime roles split a deployment into independently scaled binaries: control-plane nodes serve only embedded
+system function types (graph CRUD, JPGQL, CMDB transactions, etc.), worker nodes serve only application ones.
+All function types may still be registered on every node, a node subscribes only to those its role allows.
+*/
+
+type RuntimeRole int
+
+const (
+	RuntimeRoleAll RuntimeRole = iota
+	RuntimeRoleControlPlane
+	RuntimeRoleWorker
+)
+
+var (
+	SystemFunctionTypenamePrefixes = []string{"functions.graph.", "functions.cmdb."}
+)
+
+func (role RuntimeRole) String() string {
+	switch role {
+	case RuntimeRoleControlPlane:
+		return "control-plane"
+	case RuntimeRoleWorker:
+		return "worker"
+	default:
+		return "all"
+	}
+}
+
+func ParseRuntimeRole(role string) (RuntimeRole, error) {
+	switch role {
+	case "", "all":
+		return RuntimeRoleAll, nil
+	case "control-plane":
+		return RuntimeRoleControlPlane, nil
+	case "worker":
+		return RuntimeRoleWorker, nil
+	}
+	return RuntimeRoleAll, fmt.Errorf("error: unknown runtime role %s", role)
+}
+
+func (r *Runtime) isSystemFunctionType(ft *FunctionType) bool {
+	for _, prefix := range r.config.systemTypenamePrefixes {
+		if strings.HasPrefix(ft.name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tells whether the node's role allows it to handle the function type
+func (r *Runtime) servesFunctionType(ft *FunctionType) bool {
+	switch r.config.role {
+	case RuntimeRoleControlPlane:
+		return r.isSystemFunctionType(ft)
+	case RuntimeRoleWorker:
+		return !r.isSystemFunctionType(ft)
+	default:
+		return true
+	}
+}
+
+// SubscribeSubjectsPermissions returns the subjects this node's role subscribes to.
+// Use them as the NATS user "subscribe allow" permissions of the node to enforce routing on the server side
+func (r *Runtime) SubscribeSubjectsPermissions() []string {
+	subjects := []string{}
+	for _, ft := range r.registeredFunctionTypes {
+		if !r.servesFunctionType(ft) {
+			continue
+		}
+		for _, source := range ft.signalSources() {
+			subjects = append(subjects, source.subject)
+		}
+		if ft.config.serviceActive {
+			subjects = append(subjects, ft.requestSubjects()...)
+			subjects = append(subjects, ft.nodeRequestSubjects()...)
+		}
+	}
+	return subjects
+}
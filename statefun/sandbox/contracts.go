@@ -0,0 +1,145 @@
+// Copyright 2023 NJWS Inc.
+
+package sandbox
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/foliagecp/sdk/statefun"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+const (
+	ContractFileSuffix = ".contract.json"
+)
+
+// VerifyContract runs the callee's handler with every recorded case, requested cases must reply in the recorded shape
+func VerifyContract(contract *statefun.Contract, handler statefun.FunctionLogicHandler, executor sfPlugins.StatefunExecutor) error {
+	for i, c := range contract.Cases {
+		fixture := Fixture{
+			Typename:  contract.Callee,
+			ID:        "contract",
+			Caller:    sfPlugins.StatefunAddress{Typename: contract.Caller, ID: "contract"},
+			Payload:   c.Payload.Clone().GetPtr(),
+			Options:   c.Options,
+			Requested: c.Requested,
+		}
+		result, err := runRecovered(fixture, handler, executor)
+		if err != nil {
+			return fmt.Errorf("error: %s > %s case %d: %s", contract.Caller, contract.Callee, i, err)
+		}
+		if c.Requested && contract.ReplySchema != nil {
+			if result.Reply == nil {
+				return fmt.Errorf("error: %s > %s case %d: no reply", contract.Caller, contract.Callee, i)
+			}
+			if err := statefun.ValidatePayload(contract.ReplySchema, result.Reply); err != nil {
+				return fmt.Errorf("error: %s > %s case %d reply changed: %s", contract.Caller, contract.Callee, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func runRecovered(fixture Fixture, handler statefun.FunctionLogicHandler, executor sfPlugins.StatefunExecutor) (result *Result, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+	return Run(fixture, handler, executor)
+}
+
+func contractFileName(contract *statefun.Contract) string {
+	return contract.Caller + "__" + contract.Callee + ContractFileSuffix
+}
+
+// GenerateContractTests writes contract files and a Go test running them against the callees' handlers. The test
+// expects the package to declare contractHandlers map[string]statefun.FunctionLogicHandler (callee typename -> handler),
+// contracts of callees missing in it are skipped
+func GenerateContractTests(contracts []*statefun.Contract, contractsDir string, testFileName string, packageName string) error {
+	if err := os.MkdirAll(contractsDir, 0755); err != nil {
+		return err
+	}
+	for _, contract := range contracts {
+		if err := statefun.WriteContractFile(filepath.Join(contractsDir, contractFileName(contract)), contract); err != nil {
+			return err
+		}
+	}
+
+	relativeContractsDir, err := filepath.Rel(filepath.Dir(testFileName), contractsDir)
+	if err != nil {
+		return err
+	}
+	source := strings.NewReplacer("{{package}}", packageName, "{{dir}}", filepath.ToSlash(relativeContractsDir), "{{suffix}}", ContractFileSuffix).Replace(contractTestTemplate)
+	return os.WriteFile(testFileName, []byte(source), 0644)
+}
+
+const contractTestTemplate = `// Code generated by foliage contracts. DO NOT EDIT.
+
+package {{package}}
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/sandbox"
+)
+
+func TestContracts(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("{{dir}}", "*{{suffix}}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		contract, err := statefun.ReadContractFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler, ok := contractHandlers[contract.Callee]
+		if !ok {
+			t.Logf("no handler for %s, skipping contract %s", contract.Callee, file)
+			continue
+		}
+		t.Run(contract.Caller+">"+contract.Callee, func(t *testing.T) {
+			if err := sandbox.VerifyContract(contract, handler, nil); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+`
+
+func contractsCommand(args []string) error {
+	fs := flag.NewFlagSet("contracts", flag.ContinueOnError)
+	capturesFile := fs.String("captures", "", "debug capture samples JSON lines file")
+	contractsDir := fs.String("out", "contracts", "directory for contract files")
+	testFileName := fs.String("test", "contracts_test.go", "generated test file")
+	packageName := fs.String("package", "main", "package of the generated test")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*capturesFile) == 0 {
+		return errors.New("error: --captures is required")
+	}
+	f, err := os.Open(*capturesFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	samples, err := statefun.ReadDebugCaptures(f)
+	if err != nil {
+		return err
+	}
+	contracts := statefun.ContractsFromCaptures(samples)
+	if err := GenerateContractTests(contracts, *contractsDir, *testFileName, *packageName); err != nil {
+		return err
+	}
+	fmt.Printf("%d contracts generated from %d samples\n", len(contracts), len(samples))
+	return nil
+}
@@ -0,0 +1,440 @@
+// Copyright 2023 NJWS Inc.
+
+// Foliage statefun sandbox package.
+// Runs a single stateful function handler in-process against fixture data, without NATS
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+/*
+Sandbox executes one handler call with an in-memory cache prefilled with the fixture's contexts. Signals and requests
+the handler makes are recorded instead of being sent (a broadcast - as signals to each id), requests are answered with
+empty objects. Result contains the contexts after the call, recorded calls and the reply for requested calls:
+
+	{
+		"function_context": {...},
+		"object_context": {...},
+		"signals": [{"provider": 0, "typename": "...", "id": "...", "payload": {...}, "options": {...}}],
+		"requests": [...],
+		"effects": ["<effect id>", ...],
+		"timers": [{"timer_id": "...", "at": <ns>, "provider": 0, "typename": "...", "id": "...", ...}],
+		"publishes": [{"subject": "...", "data": "...", "jetstream": false}],
+		"reply": {...},
+		"reply_chunks": [{...}, ...]
+	}
+*/
+
+var (
+	noStreamsError = errors.New("error: no NATS streams in the sandbox")
+)
+
+// Fixture describes the call to run
+type Fixture struct {
+	Typename        string
+	ID              string
+	Caller          sfPlugins.StatefunAddress
+	Payload         *easyjson.JSON
+	Options         *easyjson.JSON
+	FunctionContext *easyjson.JSON
+	ObjectContext   *easyjson.JSON
+	Requested       bool // Handler is called as requested and may reply
+}
+
+// Call is a signal or a request made by the handler
+type Call struct {
+	Provider int
+	Typename string
+	ID       string
+	Payload  *easyjson.JSON
+	Options  *easyjson.JSON
+}
+
+type Result struct {
+	FunctionContext *easyjson.JSON
+	ObjectContext   *easyjson.JSON
+	Signals         []Call
+	Requests        []Call
+	Effects         []string
+	Timers          []Timer   // Scheduled and not cancelled
+	Publishes       []Publish // Made through the NATS facade, stream reads fail in the sandbox
+	Reply           *easyjson.JSON
+	ReplyChunks     []*easyjson.JSON // Streamed with Reply.Stream
+}
+
+// Timer is a signal scheduled by the handler
+type Timer struct {
+	TimerID string
+	At      int64 // ns
+	Call
+}
+
+// Publish is a message the handler published through the NATS facade
+type Publish struct {
+	Subject   string
+	Data      []byte
+	JetStream bool
+}
+
+func (c Call) toJSON() easyjson.JSON {
+	j := easyjson.NewJSONObject()
+	j.SetByPath("provider", easyjson.NewJSON(c.Provider))
+	j.SetByPath("typename", easyjson.NewJSON(c.Typename))
+	j.SetByPath("id", easyjson.NewJSON(c.ID))
+	if c.Payload != nil {
+		j.SetByPath("payload", *c.Payload)
+	}
+	if c.Options != nil {
+		j.SetByPath("options", *c.Options)
+	}
+	return j
+}
+
+// ToJSON returns the result in the format described above
+func (r *Result) ToJSON() *easyjson.JSON {
+	j := easyjson.NewJSONObject()
+	j.SetByPath("function_context", *r.FunctionContext)
+	j.SetByPath("object_context", *r.ObjectContext)
+	for _, field := range []struct {
+		name  string
+		calls []Call
+	}{{"signals", r.Signals}, {"requests", r.Requests}} {
+		calls := easyjson.NewJSONArray()
+		for _, c := range field.calls {
+			calls.AddToArray(c.toJSON())
+		}
+		j.SetByPath(field.name, calls)
+	}
+	j.SetByPath("effects", easyjson.JSONFromArray(r.Effects))
+	timers := easyjson.NewJSONArray()
+	for _, t := range r.Timers {
+		timer := t.toJSON()
+		timer.SetByPath("timer_id", easyjson.NewJSON(t.TimerID))
+		timer.SetByPath("at", easyjson.NewJSON(t.At))
+		timers.AddToArray(timer)
+	}
+	j.SetByPath("timers", timers)
+	publishes := easyjson.NewJSONArray()
+	for _, p := range r.Publishes {
+		publish := easyjson.NewJSONObjectWithKeyValue("subject", easyjson.NewJSON(p.Subject))
+		publish.SetByPath("data", easyjson.NewJSON(string(p.Data)))
+		publish.SetByPath("jetstream", easyjson.NewJSON(p.JetStream))
+		publishes.AddToArray(publish)
+	}
+	j.SetByPath("publishes", publishes)
+	if r.Reply != nil {
+		j.SetByPath("reply", *r.Reply)
+	}
+	if len(r.ReplyChunks) > 0 {
+		chunks := easyjson.NewJSONArray()
+		for _, c := range r.ReplyChunks {
+			chunks.AddToArray(*c)
+		}
+		j.SetByPath("reply_chunks", chunks)
+	}
+	return &j
+}
+
+func jsonOrEmptyObject(j *easyjson.JSON) *easyjson.JSON {
+	if j == nil {
+		return easyjson.NewJSONObject().GetPtr()
+	}
+	return j
+}
+
+// Run calls the handler once with the fixture, executor is passed to the handler as it is (may be nil)
+func Run(fixture Fixture, handler statefun.FunctionLogicHandler, executor sfPlugins.StatefunExecutor) (*Result, error) {
+	if handler == nil {
+		return nil, errors.New("error: no handler to run")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cacheStore := cache.NewCacheStoreWithBackend(ctx, cache.NewCacheConfig("sandbox"), cache.NewMemoryKVBackend())
+	defer cacheStore.Destroy()
+
+	functionContextKey := fixture.Typename + "." + cacheStore.IDToken(fixture.ID)
+	objectContextKey := cacheStore.IDToken(fixture.ID)
+	getContext := func(key string) *easyjson.JSON {
+		if j, err := cacheStore.GetValueAsJSON(key); err == nil {
+			return j
+		}
+		return easyjson.NewJSONObject().GetPtr()
+	}
+	setContext := func(key string, context *easyjson.JSON) {
+		if context == nil {
+			cacheStore.SetValue(key, nil, true, -1, "")
+		} else {
+			cacheStore.SetValue(key, context.ToBytes(), true, -1, "")
+		}
+	}
+	setContext(functionContextKey, jsonOrEmptyObject(fixture.FunctionContext))
+	setContext(objectContextKey, jsonOrEmptyObject(fixture.ObjectContext))
+
+	result := &Result{Signals: []Call{}, Requests: []Call{}, Effects: []string{}, Timers: []Timer{}, Publishes: []Publish{}}
+	var resultMutex sync.Mutex
+	cancelTimer := func(timerID string) { // Under resultMutex
+		for i, t := range result.Timers {
+			if t.TimerID == timerID {
+				result.Timers = append(result.Timers[:i], result.Timers[i+1:]...)
+				return
+			}
+		}
+	}
+	var tasks sync.WaitGroup
+	checkpoints := map[string][]byte{}
+
+	contextProcessor := &sfPlugins.StatefunContextProcessor{
+		GlobalCache:        cacheStore,
+		GetFunctionContext: func() *easyjson.JSON { return getContext(functionContextKey) },
+		SetFunctionContext: func(context *easyjson.JSON) { setContext(functionContextKey, context) },
+		GetObjectContext:   func() *easyjson.JSON { return getContext(objectContextKey) },
+		SetObjectContext:   func(context *easyjson.JSON) { setContext(objectContextKey, context) },
+		GetObjectContextWithRevision: func() (*easyjson.JSON, uint64) {
+			value, revision, err := cacheStore.GetValueWithKVRevision(objectContextKey)
+			if err == nil {
+				if j, ok := easyjson.JSONFromBytes(value); ok {
+					return &j, revision
+				}
+			}
+			return easyjson.NewJSONObject().GetPtr(), revision
+		},
+		SetObjectContextIfRevision: func(context *easyjson.JSON, revision uint64) (uint64, error) {
+			var value []byte
+			if context != nil {
+				value = context.ToBytes()
+			}
+			return cacheStore.SetValueIfKVRevision(objectContextKey, value, revision)
+		},
+		ObjectMutexLock:   func(errorOnLocked bool) error { return nil },
+		ObjectMutexUnlock: func() error { return nil },
+		Signal: func(provider sfPlugins.SignalProvider, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) error {
+			resultMutex.Lock()
+			defer resultMutex.Unlock()
+			result.Signals = append(result.Signals, Call{Provider: int(provider), Typename: typename, ID: id, Payload: payload, Options: options})
+			return nil
+		},
+		Broadcast: func(provider sfPlugins.SignalProvider, typename string, ids []string, payload *easyjson.JSON, options *easyjson.JSON) error {
+			resultMutex.Lock()
+			defer resultMutex.Unlock()
+			for _, id := range ids {
+				result.Signals = append(result.Signals, Call{Provider: int(provider), Typename: typename, ID: id, Payload: payload, Options: options})
+			}
+			return nil
+		},
+		Request: func(provider sfPlugins.RequestProvider, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) (*easyjson.JSON, error) {
+			resultMutex.Lock()
+			defer resultMutex.Unlock()
+			result.Requests = append(result.Requests, Call{Provider: int(provider), Typename: typename, ID: id, Payload: payload, Options: options})
+			return easyjson.NewJSONObject().GetPtr(), nil
+		},
+		Go: func(task func(ctx context.Context)) error {
+			tasks.Add(1)
+			go func() {
+				defer tasks.Done()
+				task(ctx)
+			}()
+			return nil
+		},
+		Effect: func(effectID string, effect func() error) error {
+			resultMutex.Lock()
+			result.Effects = append(result.Effects, effectID)
+			resultMutex.Unlock()
+			return effect()
+		},
+		SaveCheckpoint: func(name string, data []byte) error {
+			resultMutex.Lock()
+			defer resultMutex.Unlock()
+			checkpoints[name] = data
+			return nil
+		},
+		LoadCheckpoint: func(name string) ([]byte, error) {
+			resultMutex.Lock()
+			defer resultMutex.Unlock()
+			return checkpoints[name], nil
+		},
+		ScheduleSignal: func(timerID string, at time.Time, provider sfPlugins.SignalProvider, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) error {
+			resultMutex.Lock()
+			defer resultMutex.Unlock()
+			cancelTimer(timerID)
+			result.Timers = append(result.Timers, Timer{TimerID: timerID, At: at.UnixNano(), Call: Call{Provider: int(provider), Typename: typename, ID: id, Payload: payload, Options: options}})
+			return nil
+		},
+		CancelTimer: func(timerID string) {
+			resultMutex.Lock()
+			defer resultMutex.Unlock()
+			cancelTimer(timerID)
+		},
+		Nats: &sfPlugins.NatsFacade{
+			Publish: func(subject string, data []byte, header map[string][]string) error {
+				resultMutex.Lock()
+				defer resultMutex.Unlock()
+				result.Publishes = append(result.Publishes, Publish{Subject: subject, Data: data})
+				return nil
+			},
+			PublishJetStream: func(subject string, data []byte, header map[string][]string) (uint64, error) {
+				resultMutex.Lock()
+				defer resultMutex.Unlock()
+				result.Publishes = append(result.Publishes, Publish{Subject: subject, Data: data, JetStream: true})
+				return uint64(len(result.Publishes)), nil
+			},
+			GetStreamMsg: func(stream string, sequence uint64) (*sfPlugins.NatsStreamMsg, error) {
+				return nil, noStreamsError
+			},
+			GetLastStreamMsg: func(stream string, subject string) (*sfPlugins.NatsStreamMsg, error) {
+				return nil, noStreamsError
+			},
+		},
+		Self:    sfPlugins.StatefunAddress{Typename: fixture.Typename, ID: fixture.ID},
+		Caller:  fixture.Caller,
+		Payload: jsonOrEmptyObject(fixture.Payload),
+		Options: jsonOrEmptyObject(fixture.Options),
+	}
+	if fixture.Requested {
+		contextProcessor.Reply = &sfPlugins.SyncReply{
+			With:          func(data *easyjson.JSON) { result.Reply = data },
+			CancelDefault: func() { result.Reply = nil },
+			Stream: func(data *easyjson.JSON) {
+				resultMutex.Lock()
+				defer resultMutex.Unlock()
+				result.ReplyChunks = append(result.ReplyChunks, data)
+			},
+			Close: func() {},
+		}
+		result.Reply = easyjson.NewJSONObject().GetPtr()
+	}
+
+	statefun.SetupRandAndNow(contextProcessor) // Fixture options set the seed and the time to reproduce a capture
+	handler(executor, contextProcessor)
+	tasks.Wait()
+
+	result.FunctionContext = getContext(functionContextKey)
+	result.ObjectContext = getContext(objectContextKey)
+	return result, nil
+}
+
+// RunExecutor is the handler running the executor as it is, used for typenames without Go handlers
+func RunExecutor(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+	if executor == nil {
+		return
+	}
+	if err := executor.BuildError(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if err := executor.Run(contextProcessor); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// CLI --------------------------------------------------------------------------------------------
+
+func readJSONFile(fileName string) (*easyjson.JSON, error) {
+	if len(fileName) == 0 {
+		return nil, nil
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	j, ok := easyjson.JSONFromBytes(data)
+	if !ok {
+		return nil, fmt.Errorf("error: %s is not a valid JSON", fileName)
+	}
+	return &j, nil
+}
+
+/*
+Main implements the sandbox command line, application binaries pass their Go handlers to run them locally:
+
+	<binary> run --typename X [--id ID] [--payload file.json] [--context file.json] [--object-context file.json]
+	             [--options file.json] [--caller-typename T --caller-id ID] [--request] [--js file.js]
+
+	<binary> contracts --captures samples.jsonl [--out contracts] [--test contracts_test.go] [--package main]
+
+--js runs the script with the executor built by executorConstructor, the typename's Go handler (if any) gets the
+executor, otherwise the executor is run as it is. Result is printed to stdout, the exit code is 1 on failures.
+contracts generates contract files and their test (see GenerateContractTests) from recorded debug capture samples.
+*/
+func Main(handlers map[string]statefun.FunctionLogicHandler, executorConstructor sfPlugins.StatefunExecutorConstructor) {
+	if err := runCommand(os.Args[1:], handlers, executorConstructor); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func runCommand(args []string, handlers map[string]statefun.FunctionLogicHandler, executorConstructor sfPlugins.StatefunExecutorConstructor) error {
+	if len(args) > 0 && args[0] == "contracts" {
+		return contractsCommand(args[1:])
+	}
+	if len(args) == 0 || args[0] != "run" {
+		return errors.New("usage: run --typename X [--id ID] [--payload file.json] [--context file.json] [--object-context file.json] [--options file.json] [--caller-typename T --caller-id ID] [--request] [--js file.js]\n" +
+			"       contracts --captures samples.jsonl [--out contracts] [--test contracts_test.go] [--package main]")
+	}
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	typename := fs.String("typename", "", "function typename")
+	id := fs.String("id", "sandbox", "function id")
+	payloadFile := fs.String("payload", "", "payload JSON file")
+	contextFile := fs.String("context", "", "function context JSON file")
+	objectContextFile := fs.String("object-context", "", "object context JSON file")
+	optionsFile := fs.String("options", "", "options JSON file")
+	callerTypename := fs.String("caller-typename", "", "caller typename")
+	callerID := fs.String("caller-id", "", "caller id")
+	requested := fs.Bool("request", false, "call as requested, prints the reply")
+	jsFile := fs.String("js", "", "JS executor script")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if len(*typename) == 0 {
+		return errors.New("error: --typename is required")
+	}
+
+	fixture := Fixture{Typename: *typename, ID: *id, Caller: sfPlugins.StatefunAddress{Typename: *callerTypename, ID: *callerID}, Requested: *requested}
+	var err error
+	for _, f := range []struct {
+		fileName string
+		target   **easyjson.JSON
+	}{{*payloadFile, &fixture.Payload}, {*contextFile, &fixture.FunctionContext}, {*objectContextFile, &fixture.ObjectContext}, {*optionsFile, &fixture.Options}} {
+		if *f.target, err = readJSONFile(f.fileName); err != nil {
+			return err
+		}
+	}
+
+	handler := handlers[*typename]
+	var executor sfPlugins.StatefunExecutor
+	if len(*jsFile) > 0 {
+		if executorConstructor == nil {
+			return errors.New("error: no executor constructor for --js")
+		}
+		source, err := os.ReadFile(*jsFile)
+		if err != nil {
+			return err
+		}
+		executor = executorConstructor(*jsFile, string(source))
+		if handler == nil {
+			handler = RunExecutor
+		}
+	}
+	if handler == nil {
+		return fmt.Errorf("error: no handler for typename %s", *typename)
+	}
+
+	result, err := Run(fixture, handler, executor)
+	if err != nil {
+		return err
+	}
+	fmt.Println(result.ToJSON().ToString())
+	return nil
+}
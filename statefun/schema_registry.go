@@ -0,0 +1,228 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/foliagecp/easyjson"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Schema registry keeps payload schemas of function types per version in KV. Schemas are a subset of JSON Schema:
+
+	{
+		"type": "object",                // "object" | "array" | "string" | "number" | "boolean" | "null", absent - any
+		"properties": {"<name>": {...}}, // for objects
+		"required": ["<name>", ...],     // for objects
+		"items": {...}                   // for arrays
+	}
+
+A new version registered for a typename must accept every payload the previous version accepts: it may add optional
+properties, but must not add required ones nor change types of the existing ones. Runtime start fails otherwise.
+In strict mode payloads not matching the typename's schema are refused, otherwise they are only logged.
+*/
+
+const (
+	SchemaRegistryKeyPrefix = "__schemas"
+)
+
+func schemaRegistryKeyPrefix(typename string) string {
+	return SchemaRegistryKeyPrefix + "." + system.GetHashStr(typename)
+}
+
+// GetPayloadSchema returns the registered payload schema of the typename, version < 0 - the latest one
+func (r *Runtime) GetPayloadSchema(typename string, version int) (*easyjson.JSON, int, error) {
+	if version < 0 {
+		versions := r.payloadSchemaVersions(typename)
+		if len(versions) == 0 {
+			return nil, -1, fmt.Errorf("error: no payload schema registered for %s", typename)
+		}
+		version = versions[len(versions)-1]
+	}
+	schema, err := r.cacheStore.GetValueAsJSON(fmt.Sprintf("%s.%d", schemaRegistryKeyPrefix(typename), version))
+	return schema, version, err
+}
+
+// Returns registered versions sorted ascending
+func (r *Runtime) payloadSchemaVersions(typename string) []int {
+	prefix := schemaRegistryKeyPrefix(typename)
+	versions := []int{}
+	for _, key := range r.cacheStore.GetKeysByPattern(prefix + ".*") {
+		if v, err := strconv.Atoi(key[len(prefix)+1:]); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// Registers payload schemas of all function types, fails on a schema incompatible with the previous version
+func (r *Runtime) registerPayloadSchemas() error {
+	for _, ft := range r.registeredFunctionTypes {
+		if ft.config.payloadSchema == nil {
+			continue
+		}
+		version := ft.config.payloadSchemaVersion
+		key := fmt.Sprintf("%s.%d", schemaRegistryKeyPrefix(ft.name), version)
+
+		if existing, err := r.cacheStore.GetValueAsJSON(key); err == nil {
+			if !bytes.Equal(existing.ToBytes(), ft.config.payloadSchema.ToBytes()) {
+				return fmt.Errorf("error: payload schema version %d of %s is already registered and differs", version, ft.name)
+			}
+			continue
+		}
+
+		previous := -1
+		for _, v := range r.payloadSchemaVersions(ft.name) {
+			if v < version {
+				previous = v
+			}
+		}
+		if previous >= 0 {
+			previousSchema, _, err := r.GetPayloadSchema(ft.name, previous)
+			if err != nil {
+				return err
+			}
+			if err := PayloadSchemaCompatible(previousSchema, ft.config.payloadSchema); err != nil {
+				return fmt.Errorf("error: payload schema version %d of %s is incompatible with version %d: %s", version, ft.name, previous, err)
+			}
+		}
+
+		if err := r.systemCache().SetValueDurable(key, ft.config.payloadSchema.ToBytes()); err != nil {
+			return err
+		}
+		lg.Logf(lg.TraceLevel, "Registered payload schema version %d of %s\n", version, ft.name)
+	}
+	return nil
+}
+
+// Checks the payload of a received message, returns an error if the message must be refused
+func (ft *FunctionType) checkPayloadSchema(id string, payload *easyjson.JSON) error {
+	if ft.config.payloadSchema == nil {
+		return nil
+	}
+	err := ValidatePayload(ft.config.payloadSchema, payload)
+	if err != nil && !ft.config.payloadSchemaStrict {
+		lg.Log(lg.WarnLevel, "Payload does not match schema", "typename", ft.name, "id", id, "schema_version", ft.config.payloadSchemaVersion, "error", err)
+		return nil
+	}
+	return err
+}
+
+// ValidatePayload checks the payload against the schema
+func ValidatePayload(schema *easyjson.JSON, payload *easyjson.JSON) error {
+	return validateBySchema(schema, payload, "$")
+}
+
+func jsonTypeName(j *easyjson.JSON) string {
+	switch {
+	case j.IsObject():
+		return "object"
+	case j.IsArray():
+		return "array"
+	case j.IsString():
+		return "string"
+	case j.IsNumeric():
+		return "number"
+	case j.IsBool():
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+func validateBySchema(schema *easyjson.JSON, value *easyjson.JSON, path string) error {
+	if expected, ok := schema.GetByPath("type").AsString(); ok {
+		if actual := jsonTypeName(value); actual != expected {
+			return fmt.Errorf("%s: expected %s, got %s", path, expected, actual)
+		}
+	}
+
+	if value.IsObject() {
+		if required, ok := schema.GetByPath("required").AsArrayString(); ok {
+			for _, name := range required {
+				if !value.PathExists(name) {
+					return fmt.Errorf("%s: required property %s is missing", path, name)
+				}
+			}
+		}
+		properties := schema.GetByPath("properties")
+		for _, name := range properties.ObjectKeys() {
+			if value.PathExists(name) {
+				propertySchema := properties.GetByPath(name)
+				propertyValue := value.GetByPath(name)
+				if err := validateBySchema(&propertySchema, &propertyValue, path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if value.IsArray() && schema.PathExists("items") {
+		items := schema.GetByPath("items")
+		for i := 0; i < value.ArraySize(); i++ {
+			element := value.ArrayElement(i)
+			if err := validateBySchema(&items, &element, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PayloadSchemaCompatible checks that every payload valid for previous schema is valid for next one
+func PayloadSchemaCompatible(previous *easyjson.JSON, next *easyjson.JSON) error {
+	return schemasCompatible(previous, next, "$")
+}
+
+func schemasCompatible(previous *easyjson.JSON, next *easyjson.JSON, path string) error {
+	nextType, nextTyped := next.GetByPath("type").AsString()
+	previousType, previousTyped := previous.GetByPath("type").AsString()
+	if nextTyped && (!previousTyped || previousType != nextType) {
+		return fmt.Errorf("%s: type changed from %q to %q", path, previousType, nextType)
+	}
+
+	previousRequired := map[string]bool{}
+	if required, ok := previous.GetByPath("required").AsArrayString(); ok {
+		for _, name := range required {
+			previousRequired[name] = true
+		}
+	}
+	if required, ok := next.GetByPath("required").AsArrayString(); ok {
+		for _, name := range required {
+			if !previousRequired[name] {
+				return fmt.Errorf("%s: property %s became required", path, name)
+			}
+		}
+	}
+
+	previousProperties := previous.GetByPath("properties")
+	nextProperties := next.GetByPath("properties")
+	for _, name := range nextProperties.ObjectKeys() {
+		if previousProperties.PathExists(name) {
+			p := previousProperties.GetByPath(name)
+			n := nextProperties.GetByPath(name)
+			if err := schemasCompatible(&p, &n, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if next.PathExists("items") {
+		if !previous.PathExists("items") {
+			return fmt.Errorf("%s: array items became restricted", path)
+		}
+		p := previous.GetByPath("items")
+		n := next.GetByPath("items")
+		if err := schemasCompatible(&p, &n, path+"[]"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
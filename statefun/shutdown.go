@@ -0,0 +1,141 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+	"github.com/nats-io/nats.go"
+)
+
+/*
+Shutdown stops the runtime in order, so a restart loses nothing buffered in memory:
+
+ 1. NATS subscriptions and micro services are drained: no new messages are accepted, delivered ones are dispatched
+ 2. id handlers finish the messages already queued to them, signals' acks are sent
+ 3. child tasks are cancelled and waited for
+ 4. the cache is flushed to KV and destroyed, single instance function type locks are released
+ 5. the NATS connection is drained and closed
+
+Messages not acked by then are redelivered by JetStream to other runtimes after their ack wait.
+*/
+
+const (
+	shutdownPollInterval = 10 * time.Millisecond
+)
+
+var (
+	runtimeStoppedError = errors.New("error: runtime is already shut down")
+)
+
+// Shutdown gracefully stops the runtime started by Start, returns ctx error if the drain did not finish in time
+func (r *Runtime) Shutdown(ctx context.Context) error {
+	if !r.stopping.CompareAndSwap(false, true) {
+		return runtimeStoppedError
+	}
+	defer close(r.stopped)
+	lg.Logln(lg.TraceLevel, "Shutting down the runtime...")
+	r.runBeforeShutdownHooks(ctx)
+
+	r.stopAdminUI()
+	r.stopMetricsEndpoint()
+	r.sourcesMutex.Lock()
+	for _, ft := range r.registeredFunctionTypes {
+		for _, sub := range ft.subscriptions {
+			system.MsgOnErrorReturn(sub.Drain())
+		}
+		if ft.microService != nil {
+			system.MsgOnErrorReturn(ft.microService.Stop())
+		}
+	}
+	r.sourcesMutex.Unlock()
+	err := r.waitUntil(ctx, func() bool {
+		for _, ft := range r.registeredFunctionTypes {
+			for _, sub := range ft.subscriptions {
+				if sub.IsValid() {
+					return false
+				}
+			}
+		}
+		return true
+	})
+
+	if err == nil {
+		err = r.waitUntil(ctx, r.drained)
+	}
+	if e := r.StopChildTasks(ctx); err == nil {
+		err = e
+	}
+
+	if r.cacheStore != nil {
+		if e := r.cacheStore.Flush(ctx); err == nil {
+			err = e
+		}
+		r.cacheStore.Destroy()
+	}
+
+	r.singleInstanceRevisionsLock.Lock()
+	for ftName, revID := range r.singleInstanceRevisions {
+		system.MsgOnErrorReturn(KeyMutexUnlock(r, system.GetHashStr(ftName), revID))
+	}
+	r.singleInstanceRevisions = map[string]uint64{}
+	r.singleInstanceRevisionsLock.Unlock()
+
+	r.messagingMutex.RLock()
+	connections := []*nats.Conn{r.fallbackNC, r.nc}
+	r.messagingMutex.RUnlock()
+	for _, nc := range connections {
+		if nc == nil {
+			continue
+		}
+		if e := nc.Drain(); e != nil && err == nil {
+			err = e
+		}
+		if e := r.waitUntil(ctx, nc.IsClosed); err == nil {
+			err = e
+		}
+	}
+	r.stopHealthProbes()
+	r.runStopHooks()
+	lg.Logln(lg.TraceLevel, "Runtime is shut down")
+	return err
+}
+
+// No messages are queued to or handled by id handlers and all acks are sent
+func (r *Runtime) drained() bool {
+	if r.handlersBusy.Load() > 0 {
+		return false
+	}
+	if r.signalBuffer != nil && r.signalBuffer.depth() > 0 {
+		return false
+	}
+	for _, ft := range r.registeredFunctionTypes {
+		if ft.msgAckChannel != nil && len(ft.msgAckChannel) > 0 {
+			return false
+		}
+		queued := false
+		ft.idHandlersChannel.Range(func(_, value interface{}) bool {
+			queued = len(value.(chan FunctionTypeMsg)) > 0
+			return !queued
+		})
+		if queued {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Runtime) waitUntil(ctx context.Context, condition func() bool) error {
+	for !condition() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(shutdownPollInterval):
+		}
+	}
+	return nil
+}
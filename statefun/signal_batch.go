@@ -0,0 +1,169 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+/*
+Signal batches publish many signals at once for ingestion pipelines emitting tens of thousands of signals per second:
+
+	signals := make([]statefun.Signal, 0, len(updates))
+	for _, u := range updates {
+		signals = append(signals, statefun.Signal{Provider: sfPlugins.JetstreamGlobalSignal, Typename: "functions.graph.api.vertex.update", ID: u.ID, Payload: u.Body})
+	}
+	if err := runtime.SignalBatch(signals); err != nil {
+		var batchErr *statefun.SignalBatchError
+		if errors.As(err, &batchErr) {
+			// batchErr.Failed - indices of the signals to resend
+		}
+	}
+
+Unlike Signal the batch is published with JetStream acks awaited under a single deadline (SignalBatchAckWait, or the
+ctx of SignalBatchCtx) for the whole batch instead of one per signal: publishes are pipelined with up to
+SignalBatchWindow of them awaiting acks. Signals are published in the batch's order, the signal buffer is bypassed.
+SignalBatch returns once every signal is acked or failed, so a nil error means the whole batch is stored.
+*/
+
+const (
+	SignalBatchAckWait = 30 * time.Second
+	SignalBatchWindow  = 256
+)
+
+// Signal is a signal of a batch sent by SignalBatch
+type Signal struct {
+	Provider sfPlugins.SignalProvider
+	Typename string
+	ID       string
+	Payload  *easyjson.JSON
+	Options  *easyjson.JSON
+}
+
+// SignalBatchError is returned by SignalBatch if some of the signals were not published or acked
+type SignalBatchError struct {
+	Total  int
+	Failed []int // Indices of the failed signals in the batch
+	Err    error // First failure
+}
+
+func (e *SignalBatchError) Error() string {
+	return fmt.Sprintf("error: %d of %d batch signals failed: %s", len(e.Failed), e.Total, e.Err)
+}
+
+func (e *SignalBatchError) Unwrap() error {
+	return e.Err
+}
+
+type batchMsg struct {
+	index   int
+	subject string
+	data    []byte
+}
+
+// Builds the messages of the signals, message data is built once per target typename, payload and options
+func (r *Runtime) buildBatchMsgs(callerTypename string, callerID string, signals []Signal) ([]batchMsg, error) {
+	type dataKey struct {
+		typename string
+		payload  *easyjson.JSON
+		options  *easyjson.JSON
+	}
+	msgs := make([]batchMsg, 0, len(signals))
+	dataByKey := map[dataKey][]byte{}
+	for i, signal := range signals {
+		if signal.Provider != sfPlugins.JetstreamGlobalSignal {
+			return nil, fmt.Errorf("unknown signal provider: %d, batch signal %d", signal.Provider, i)
+		}
+		typename := r.routeVersion(r.resolveAlias(signal.Typename), signal.ID)
+		key := dataKey{typename: typename, payload: signal.Payload, options: signal.Options}
+		data, ok := dataByKey[key]
+		if !ok {
+			e2ePayload, err := r.e2eSend(callerTypename, typename, signal.Payload)
+			if err != nil {
+				return nil, err
+			}
+			data = buildNatsData(callerTypename, callerID, e2ePayload, signal.Options, false)
+			dataByKey[key] = data
+		}
+		msgs = append(msgs, batchMsg{index: i, subject: r.prioritySignalSubject(typename, signal.ID, signal.Options), data: data})
+	}
+	return msgs, nil
+}
+
+func (r *Runtime) signalBatch(ctx context.Context, callerTypename string, callerID string, signals []Signal) error {
+	msgs, err := r.buildBatchMsgs(callerTypename, callerID, signals)
+	if err != nil {
+		return err
+	}
+	_, js := r.messaging()
+	if js == nil {
+		return fmt.Errorf("error: runtime is not connected to NATS")
+	}
+
+	batchErr := &SignalBatchError{Total: len(signals), Failed: []int{}}
+	fail := func(index int, err error) {
+		batchErr.Failed = append(batchErr.Failed, index)
+		if batchErr.Err == nil {
+			batchErr.Err = err
+		}
+	}
+
+	type pendingAck struct {
+		index  int
+		future nats.PubAckFuture
+	}
+	pending := make([]pendingAck, 0, SignalBatchWindow)
+	awaitAck := func(p pendingAck) {
+		select {
+		case <-p.future.Ok():
+		case err := <-p.future.Err():
+			fail(p.index, err)
+		case <-ctx.Done():
+			fail(p.index, ctx.Err())
+		}
+	}
+
+	for _, msg := range msgs {
+		if ctx.Err() != nil {
+			fail(msg.index, ctx.Err())
+			continue
+		}
+		if len(pending) >= SignalBatchWindow {
+			awaitAck(pending[0])
+			pending = pending[1:]
+		}
+		future, err := js.PublishAsync(msg.subject, msg.data)
+		if err != nil {
+			fail(msg.index, err)
+			continue
+		}
+		pending = append(pending, pendingAck{index: msg.index, future: future})
+	}
+	for _, p := range pending {
+		awaitAck(p)
+	}
+
+	if len(batchErr.Failed) > 0 {
+		return batchErr
+	}
+	return nil
+}
+
+// SignalBatch publishes the signals awaiting their acks for SignalBatchAckWait, returns *SignalBatchError on failures
+func (r *Runtime) SignalBatch(signals []Signal) error {
+	ctx, cancel := context.WithTimeout(context.Background(), SignalBatchAckWait)
+	defer cancel()
+	return r.signalBatch(ctx, "ingress", "nats", signals)
+}
+
+// SignalBatchCtx publishes the signals awaiting their acks until the ctx is done
+func (r *Runtime) SignalBatchCtx(ctx context.Context, signals []Signal) error {
+	return r.signalBatch(ctx, "ingress", "nats", signals)
+}
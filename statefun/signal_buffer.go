@@ -0,0 +1,158 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	sdkErrors "github.com/foliagecp/sdk/errors"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Signals are published fire-and-forget by default: a failed publish is logged and the signal is lost, a slow NATS
+piles up publishing routines. With RuntimeConfig.SetSignalBuffer signals (Signal, Broadcast, contextProcessor.Signal)
+are queued to a bounded buffer instead and a single routine publishes them in order with JetStream acks:
+
+  - a publish failing or not acked in SignalBufferPublishTimeout is retried with exponential backoff
+    (SignalBufferInitialBackoff doubled up to SignalBufferMaxBackoff), the signal is dropped after maxRetries retries
+  - while the buffer is full sending fails with SignalBufferFullError at once, so a handler neither blocks forever
+    nor loses the signal silently and may retry, slow down or fail itself
+
+Shutdown waits for the buffer to be published. Metrics:
+
+	fg_signal_buffer_depth          - signals queued
+	fg_signal_send_retries_total    - publish retries
+	fg_signal_send_dropped_total    - signals dropped after all the retries
+	fg_signal_buffer_rejected_total - signals rejected by the full buffer
+*/
+
+const (
+	SignalBufferPublishTimeout = 5 * time.Second
+	SignalBufferInitialBackoff = 50 * time.Millisecond
+	SignalBufferMaxBackoff     = 5 * time.Second
+)
+
+var (
+	// Returned by signal sends while the signal buffer is full, check with errors.Is
+	SignalBufferFullError = sdkErrors.New(sdkErrors.ErrThrottled, "error: signal buffer is full")
+)
+
+type bufferedSignal struct {
+	subject string
+	data    []byte
+}
+
+type signalBuffer struct {
+	runtime    *Runtime
+	maxRetries int
+	signals    chan bufferedSignal
+
+	mutex      sync.Mutex
+	publishing bool // The signal taken from the channel is not published yet
+}
+
+// Nil if the buffer is disabled
+func newSignalBuffer(r *Runtime) *signalBuffer {
+	if r.config.signalBufferMaxSize <= 0 {
+		return nil
+	}
+	b := &signalBuffer{
+		runtime:    r,
+		maxRetries: r.config.signalBufferMaxRetries,
+		signals:    make(chan bufferedSignal, r.config.signalBufferMaxSize),
+	}
+	go b.run()
+	return b
+}
+
+func (b *signalBuffer) enqueue(subject string, data []byte) error {
+	select {
+	case b.signals <- bufferedSignal{subject: subject, data: data}:
+		b.reportDepth()
+		return nil
+	default:
+		system.Metrics().AddCounter("fg_signal_buffer_rejected_total", "Signals rejected by the full signal buffer", nil, 1)
+		return SignalBufferFullError
+	}
+}
+
+// Signals queued and being published
+func (b *signalBuffer) depth() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.publishing {
+		return len(b.signals) + 1
+	}
+	return len(b.signals)
+}
+
+func (b *signalBuffer) reportDepth() {
+	system.Metrics().SetGauge("fg_signal_buffer_depth", "Signals queued to the signal buffer", nil, float64(len(b.signals)))
+}
+
+func (b *signalBuffer) run() {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("runtime-signalBuffer")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime-signalBuffer")
+	for {
+		select {
+		case signal := <-b.signals:
+			b.mutex.Lock()
+			b.publishing = true
+			b.mutex.Unlock()
+			b.reportDepth()
+
+			b.publish(signal)
+
+			b.mutex.Lock()
+			b.publishing = false
+			b.mutex.Unlock()
+		case <-b.runtime.stopped:
+			return
+		}
+	}
+}
+
+func (b *signalBuffer) publish(signal bufferedSignal) {
+	backoff := SignalBufferInitialBackoff
+	for retry := 0; ; retry++ {
+		_, js := b.runtime.messaging()
+		_, err := js.Publish(signal.subject, signal.data, nats.AckWait(SignalBufferPublishTimeout))
+		if err == nil {
+			return
+		}
+		if retry >= b.maxRetries {
+			lg.Log(lg.ErrorLevel, "Signal dropped after retries", "subject", signal.subject, "retries", retry, "error", err)
+			system.Metrics().AddCounter("fg_signal_send_dropped_total", "Signals dropped after all the publish retries", nil, 1)
+			return
+		}
+		lg.Log(lg.WarnLevel, "Signal publish failed, retrying", "subject", signal.subject, "backoff", backoff, "error", err)
+		system.Metrics().AddCounter("fg_signal_send_retries_total", "Signal publish retries", nil, 1)
+		select {
+		case <-time.After(backoff):
+		case <-b.runtime.stopped:
+			return
+		}
+		if backoff *= 2; backoff > SignalBufferMaxBackoff {
+			backoff = SignalBufferMaxBackoff
+		}
+	}
+}
+
+// Publishes the signal through the buffer if it is enabled
+func (r *Runtime) publishSignal(subject string, data []byte) error {
+	if r.signalBuffer != nil {
+		return r.signalBuffer.enqueue(subject, data)
+	}
+	go func() {
+		system.GlobalPrometrics.GetRoutinesCounter().Started("ingress-jetstreamGlobalSignal-gofunc")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("ingress-jetstreamGlobalSignal-gofunc")
+		nc, _ := r.messaging()
+		system.MsgOnErrorReturn(nc.Publish(subject, data))
+	}()
+	return nil
+}
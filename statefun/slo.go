@@ -0,0 +1,158 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+SLOs are evaluated per function type over a sliding window made of sloWindowBuckets buckets, each time a bucket
+is completed. An invocation is failed if its request got a "failed" or "timeout" reply status or its payload was
+refused by the schema. A breach and a recovery of each objective are reported once to the alert function
+(RuntimeConfig.SetSLOAlertFunction, signalled with id = typename with dots replaced by "_") and to the webhook
+(RuntimeConfig.SetSLOAlertWebhook, POSTed), the alert:
+
+	{"typename": ..., "objective": "latency" | "error_rate", "state": "breached" | "resolved",
+	 "value": share of slow or failed invocations, "target": allowed share, "invocations": ..., "window_sec": ...}
+*/
+
+const (
+	SLOObjectiveLatency   = "latency"
+	SLOObjectiveErrorRate = "error_rate"
+
+	sloWindowBuckets   = 10
+	sloWebhookTimeout  = 5 * time.Second
+	sloAlertCallerType = "statefun.slo"
+)
+
+type SLO struct {
+	LatencyThreshold   time.Duration // 0 - latency is not checked
+	LatencyObjective   float64       // Share of invocations to be faster than LatencyThreshold, e.g. 0.99
+	ErrorRateObjective float64       // Max share of failed invocations, e.g. 0.01; 0 - error rate is not checked
+	Window             time.Duration
+	MinInvocations     int // Windows with fewer invocations are not evaluated
+}
+
+type sloBucket struct {
+	start  int64
+	total  int
+	slow   int
+	failed int
+}
+
+type sloState struct {
+	mutex    sync.Mutex
+	buckets  [sloWindowBuckets]sloBucket
+	breached map[string]bool
+}
+
+func (ft *FunctionType) recordSLO(latency time.Duration, failed bool) {
+	slo := ft.config.slo
+	if slo == nil || slo.Window <= 0 {
+		return
+	}
+	bucketNs := int64(slo.Window) / sloWindowBuckets
+	if bucketNs <= 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	start := now - now%bucketNs
+
+	ft.slo.mutex.Lock()
+	bucket := &ft.slo.buckets[(start/bucketNs)%sloWindowBuckets]
+	var alerts []*easyjson.JSON
+	if bucket.start != start {
+		alerts = ft.evaluateSLO(slo, now)
+		*bucket = sloBucket{start: start}
+	}
+	bucket.total++
+	if slo.LatencyThreshold > 0 && latency > slo.LatencyThreshold {
+		bucket.slow++
+	}
+	if failed {
+		bucket.failed++
+	}
+	ft.slo.mutex.Unlock()
+
+	for _, alert := range alerts {
+		ft.runtime.sendSLOAlert(ft.name, alert)
+	}
+}
+
+// Must be called with locked mutex, returns alerts for objectives changed their state
+func (ft *FunctionType) evaluateSLO(slo *SLO, now int64) (alerts []*easyjson.JSON) {
+	total, slow, failed := 0, 0, 0
+	for _, b := range ft.slo.buckets {
+		if b.start > now-int64(slo.Window) {
+			total, slow, failed = total+b.total, slow+b.slow, failed+b.failed
+		}
+	}
+	if total == 0 || total < slo.MinInvocations {
+		return nil
+	}
+	if ft.slo.breached == nil {
+		ft.slo.breached = map[string]bool{}
+	}
+
+	check := func(objective string, bad int, allowed float64) {
+		value := float64(bad) / float64(total)
+		breached := value > allowed
+		if breached == ft.slo.breached[objective] {
+			return
+		}
+		ft.slo.breached[objective] = breached
+		state := "resolved"
+		if breached {
+			state = "breached"
+		}
+		alert := easyjson.NewJSONObject()
+		alert.SetByPath("typename", easyjson.NewJSON(ft.name))
+		alert.SetByPath("objective", easyjson.NewJSON(objective))
+		alert.SetByPath("state", easyjson.NewJSON(state))
+		alert.SetByPath("value", easyjson.NewJSON(value))
+		alert.SetByPath("target", easyjson.NewJSON(allowed))
+		alert.SetByPath("invocations", easyjson.NewJSON(total))
+		alert.SetByPath("window_sec", easyjson.NewJSON(slo.Window.Seconds()))
+		alerts = append(alerts, &alert)
+	}
+	if slo.LatencyThreshold > 0 {
+		check(SLOObjectiveLatency, slow, 1-slo.LatencyObjective)
+	}
+	if slo.ErrorRateObjective > 0 {
+		check(SLOObjectiveErrorRate, failed, slo.ErrorRateObjective)
+	}
+	return
+}
+
+func (r *Runtime) sendSLOAlert(typename string, alert *easyjson.JSON) {
+	lg.Logf(lg.WarnLevel, "SLO alert for %s: %s\n", typename, alert.ToString())
+	if state, _ := alert.GetByPath("state").AsString(); state == "breached" {
+		r.recordError(typename, "", "slo", alert.ToString())
+	}
+	if len(r.config.sloAlertFunction) > 0 {
+		system.MsgOnErrorReturn(r.signal(sfPlugins.JetstreamGlobalSignal, sloAlertCallerType, "runtime", r.config.sloAlertFunction, strings.ReplaceAll(typename, ".", "_"), alert, nil))
+	}
+	if len(r.config.sloAlertWebhook) > 0 {
+		go func() {
+			system.GlobalPrometrics.GetRoutinesCounter().Started("sendSLOAlert-webhook")
+			defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("sendSLOAlert-webhook")
+			client := http.Client{Timeout: sloWebhookTimeout}
+			resp, err := client.Post(r.config.sloAlertWebhook, "application/json", bytes.NewReader(alert.ToBytes()))
+			if err != nil {
+				lg.Logf(lg.ErrorLevel, "SLO alert webhook for %s failed: %s\n", typename, err)
+				return
+			}
+			system.MsgOnErrorReturn(resp.Body.Close())
+		}()
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Subject templates define NATS subjects of typenames' signals and requests (RuntimeConfig.SetSubjectTemplates):
+
+	"{typename}.{id}"         - signals, default
+	"service.{typename}.{id}" - requests, default
+
+A template is dot separated tokens, each one is either a literal (no wildcards, spaces or braces), "{typename}"
+or "{id}", both placeholders exactly once. Templates are validated when the runtime is created.
+Subjects of the default templates are the legacy ones, a compatibility mode moves an old deployment to new
+templates without losing messages:
+
+	SubjectCompatibilityOff       - only the configured templates are used
+	SubjectCompatibilityReadBoth  - messages are sent to the configured subjects, both the configured and the legacy
+		ones are consumed (legacy signals from their own streams), e.g. until old runtimes are gone
+	SubjectCompatibilitySendLegacy - as SubjectCompatibilityReadBoth, but messages are sent to the legacy subjects,
+		to run together with old runtimes
+*/
+
+type SubjectCompatibilityMode int
+
+const (
+	SubjectCompatibilityOff SubjectCompatibilityMode = iota
+	SubjectCompatibilityReadBoth
+	SubjectCompatibilitySendLegacy
+
+	SignalSubjectTemplate  = "{typename}.{id}"
+	RequestSubjectTemplate = "service.{typename}.{id}"
+
+	subjectTypenamePlaceholder = "{typename}"
+	subjectIDPlaceholder       = "{id}"
+)
+
+type subjectTemplate string
+
+func (t subjectTemplate) validate() error {
+	typenames, ids := 0, 0
+	for _, token := range strings.Split(string(t), ".") {
+		switch token {
+		case subjectTypenamePlaceholder:
+			typenames++
+		case subjectIDPlaceholder:
+			ids++
+		default:
+			if len(token) == 0 || strings.ContainsAny(token, "*> \t{}") {
+				return fmt.Errorf("error: subject template %q has invalid token %q", t, token)
+			}
+		}
+	}
+	if typenames != 1 || ids != 1 {
+		return fmt.Errorf("error: subject template %q must have %s and %s exactly once", t, subjectTypenamePlaceholder, subjectIDPlaceholder)
+	}
+	return nil
+}
+
+func (t subjectTemplate) subject(typename string, id string) string {
+	return strings.NewReplacer(subjectTypenamePlaceholder, typename, subjectIDPlaceholder, id).Replace(string(t))
+}
+
+// Subject pattern of all ids of the typename
+func (t subjectTemplate) pattern(typename string) string {
+	return t.subject(typename, "*")
+}
+
+// Returns the id if the subject is typename's one
+func (t subjectTemplate) id(typename string, subject string) (string, bool) {
+	patternTokens := strings.Split(t.pattern(typename), ".")
+	tokens := strings.Split(subject, ".")
+	if len(tokens) != len(patternTokens) {
+		return "", false
+	}
+	id, found := "", false
+	for i, token := range patternTokens {
+		if token == "*" && !found {
+			id, found = tokens[i], true
+		} else if token != tokens[i] {
+			return "", false
+		}
+	}
+	return id, found
+}
+
+// Pattern of all subjects with the template's leading literal tokens, empty if the template starts with a placeholder
+func (t subjectTemplate) reservedPattern() string {
+	prefix := strings.SplitN(string(t), "{", 2)[0]
+	if len(prefix) == 0 {
+		return ""
+	}
+	return prefix + ">"
+}
+
+func (ro *RuntimeConfig) validateSubjectTemplates() error {
+	for _, t := range []subjectTemplate{ro.signalSubjectTemplate, ro.requestSubjectTemplate} {
+		if err := t.validate(); err != nil {
+			return err
+		}
+	}
+	if ro.signalSubjectTemplate == ro.requestSubjectTemplate {
+		return fmt.Errorf("error: signal and request subject templates must differ")
+	}
+	return nil
+}
+
+func (r *Runtime) subjectsCompatible() bool {
+	legacySignal, legacyRequest := r.legacyTemplates()
+	return r.config.subjectCompatibility != SubjectCompatibilityOff &&
+		(r.config.signalSubjectTemplate != legacySignal || r.config.requestSubjectTemplate != legacyRequest)
+}
+
+// Subjects signals and requests are sent to
+func (r *Runtime) sendTemplates() (subjectTemplate, subjectTemplate) {
+	if r.subjectsCompatible() && r.config.subjectCompatibility == SubjectCompatibilitySendLegacy {
+		return r.legacyTemplates()
+	}
+	return r.config.signalSubjectTemplate, r.config.requestSubjectTemplate
+}
+
+func (r *Runtime) signalSubject(typename string, id string) string {
+	signal, _ := r.sendTemplates()
+	return signal.subject(typename, id)
+}
+
+func (r *Runtime) requestSubject(typename string, id string) string {
+	_, request := r.sendTemplates()
+	return request.subject(typename, id)
+}
+
+// Signal subject patterns the function type consumes, the configured one first
+func (ft *FunctionType) signalSubjects() []string {
+	subjects := []string{ft.subject}
+	legacySignal, _ := ft.runtime.legacyTemplates()
+	if legacy := legacySignal.pattern(ft.name); ft.runtime.subjectsCompatible() && legacy != ft.subject {
+		subjects = append(subjects, legacy)
+	}
+	return subjects
+}
+
+// Request subject patterns the function type serves, the configured one first
+func (ft *FunctionType) requestSubjects() []string {
+	subjects := []string{ft.runtime.config.requestSubjectTemplate.pattern(ft.name)}
+	_, legacyRequest := ft.runtime.legacyTemplates()
+	if legacy := legacyRequest.pattern(ft.name); ft.runtime.subjectsCompatible() && legacy != subjects[0] {
+		subjects = append(subjects, legacy)
+	}
+	return subjects
+}
+
+// Returns the id of the function type's signal or request subject
+func (ft *FunctionType) idFromSubject(subject string) (string, error) {
+	subject = trimLanePrefix(ft.runtime.config.namespace, ft.runtime.trimNodePrefix(subject))
+	templates := []subjectTemplate{ft.runtime.config.signalSubjectTemplate, ft.runtime.config.requestSubjectTemplate}
+	if ft.runtime.subjectsCompatible() {
+		legacySignal, legacyRequest := ft.runtime.legacyTemplates()
+		templates = append(templates, legacySignal, legacyRequest)
+	}
+	for _, t := range templates {
+		if id, ok := t.id(ft.name, subject); ok {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("error: subject %s is not of function type %s", subject, ft.name)
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 NJWS Inc.
+
+package system
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+Metrics backends abstract the SDK's metrics from Prometheus: SDK packages report through Metrics(), which is
+GlobalMetrics if set (e.g. by statefun.RuntimeConfig.SetMetricsBackend) or GlobalPrometrics otherwise, so
+deployments using StatsD, OTLP or anything else plug their exporter by implementing MetricsBackend:
+
+	system.GlobalMetrics = system.NewStatsDMetrics("127.0.0.1:8125", "foliage")
+
+Metric names are Prometheus-like ("cache_values"), help and buckets are hints backends may ignore.
+Reporting does nothing if there is no backend.
+*/
+
+type MetricsBackend interface {
+	SetGauge(name string, help string, labels map[string]string, value float64)
+	AddGauge(name string, help string, labels map[string]string, delta float64)
+	AddCounter(name string, help string, labels map[string]string, delta float64)
+	ObserveHistogram(name string, help string, buckets []float64, labels map[string]string, value float64)
+}
+
+var (
+	GlobalMetrics MetricsBackend
+)
+
+type noMetrics struct{}
+
+func (noMetrics) SetGauge(string, string, map[string]string, float64)                    {}
+func (noMetrics) AddGauge(string, string, map[string]string, float64)                    {}
+func (noMetrics) AddCounter(string, string, map[string]string, float64)                  {}
+func (noMetrics) ObserveHistogram(string, string, []float64, map[string]string, float64) {}
+
+// Metrics returns the backend metrics are reported to
+func Metrics() MetricsBackend {
+	if GlobalMetrics != nil {
+		return GlobalMetrics
+	}
+	if GlobalPrometrics != nil {
+		return GlobalPrometrics
+	}
+	return noMetrics{}
+}
+
+func sortedLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Prometheus backend -----------------------------------------------------------------------------
+
+func (pm *Prometrics) SetGauge(name string, help string, labels map[string]string, value float64) {
+	if gaugeVec, err := pm.EnsureGaugeVecSimple(name, help, sortedLabelNames(labels)); err == nil {
+		gaugeVec.With(labels).Set(value)
+	}
+}
+
+func (pm *Prometrics) AddGauge(name string, help string, labels map[string]string, delta float64) {
+	if gaugeVec, err := pm.EnsureGaugeVecSimple(name, help, sortedLabelNames(labels)); err == nil {
+		gaugeVec.With(labels).Add(delta)
+	}
+}
+
+func (pm *Prometrics) AddCounter(name string, help string, labels map[string]string, delta float64) {
+	if counterVec, err := pm.EnsureCounterVecSimple(name, help, sortedLabelNames(labels)); err == nil {
+		counterVec.With(labels).Add(delta)
+	}
+}
+
+func (pm *Prometrics) ObserveHistogram(name string, help string, buckets []float64, labels map[string]string, value float64) {
+	if histogramVec, err := pm.EnsureHistogramVecSimple(name, help, buckets, sortedLabelNames(labels)); err == nil {
+		histogramVec.With(labels).Observe(value)
+	}
+}
+
+// ------------------------------------------------------------------------------------------------
+
+// StatsD backend ---------------------------------------------------------------------------------
+
+// StatsDMetrics sends metrics over UDP in the StatsD format with DogStatsD tags ("name:1|g|#label:value"),
+// histograms are sent as "|h", sending errors are ignored
+type StatsDMetrics struct {
+	prefix string
+	mutex  sync.Mutex
+	conn   net.Conn
+}
+
+// NewStatsDMetrics returns the backend sending to the address, prefix - optional, prepended to names with a dot
+func NewStatsDMetrics(address string, prefix string) (*StatsDMetrics, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if len(prefix) > 0 {
+		prefix += "."
+	}
+	return &StatsDMetrics{prefix: prefix, conn: conn}, nil
+}
+
+func (sm *StatsDMetrics) send(name string, value string, kind string, labels map[string]string) {
+	var b strings.Builder
+	b.WriteString(sm.prefix)
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+	for i, label := range sortedLabelNames(labels) {
+		if i == 0 {
+			b.WriteString("|#")
+		} else {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s:%s", label, labels[label])
+	}
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	_, _ = sm.conn.Write([]byte(b.String()))
+}
+
+func formatStatsDValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func (sm *StatsDMetrics) SetGauge(name string, help string, labels map[string]string, value float64) {
+	if value < 0 { // "-N" would be a delta
+		sm.send(name, "0", "g", labels)
+	}
+	sm.send(name, formatStatsDValue(value), "g", labels)
+}
+
+func (sm *StatsDMetrics) AddGauge(name string, help string, labels map[string]string, delta float64) {
+	value := formatStatsDValue(delta)
+	if delta >= 0 {
+		value = "+" + value
+	}
+	sm.send(name, value, "g", labels)
+}
+
+func (sm *StatsDMetrics) AddCounter(name string, help string, labels map[string]string, delta float64) {
+	sm.send(name, formatStatsDValue(delta), "c", labels)
+}
+
+func (sm *StatsDMetrics) ObserveHistogram(name string, help string, buckets []float64, labels map[string]string, value float64) {
+	sm.send(name, formatStatsDValue(value), "h", labels)
+}
+
+func (sm *StatsDMetrics) Close() error {
+	return sm.conn.Close()
+}
+
+// ------------------------------------------------------------------------------------------------
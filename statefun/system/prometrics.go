@@ -119,6 +119,38 @@ func (pm *Prometrics) EnsureGaugeVec(id string, metric *prometheus.GaugeVec) (*p
 
 // ------------------------------------------------------------------------------------------------
 
+// CounterVec -------------------------------------------------------------------------------------
+func (pm *Prometrics) EnsureCounterVecSimple(id string, help string, labelNames []string) (*prometheus.CounterVec, error) {
+	if pm == nil {
+		return nil, PrometricInstanceIsNil
+	}
+	name := strings.ReplaceAll(id, ".", "")
+	metric := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: name,
+		Help: help,
+	}, labelNames)
+	return pm.EnsureCounterVec(id, metric)
+}
+
+func (pm *Prometrics) EnsureCounterVec(id string, metric *prometheus.CounterVec) (*prometheus.CounterVec, error) {
+	if pm == nil {
+		return nil, PrometricInstanceIsNil
+	}
+	pm.metricsMutex.Lock()
+	defer pm.metricsMutex.Unlock()
+	if metricAny, ok := pm.metrics[id]; ok {
+		if metric, ok := metricAny.(*prometheus.CounterVec); ok {
+			return metric, nil
+		} else {
+			return nil, PrometricDifferentTypeExistsForIdError
+		}
+	}
+	pm.metrics[id] = metric
+	return metric, prometheus.Register(*metric)
+}
+
+// ------------------------------------------------------------------------------------------------
+
 // HistogramVec -----------------------------------------------------------------------------------
 func (pm *Prometrics) EnsureHistogramVecSimple(id string, help string, buckets []float64, labelNames []string) (*prometheus.HistogramVec, error) {
 	if pm == nil {
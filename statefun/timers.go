@@ -0,0 +1,110 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Timers are signals scheduled by a function's id to be sent later (StatefunContextProcessor.ScheduleSignal).
+A timer is a KV record, so it survives restarts, and is named by the scheduling typename, id and timer id:
+scheduling the same timer id again replaces the timer.
+
+	__timers.<typename hash>.<id hash>.<timer id hash> = {"at": <ns>, "provider": ..., "typename": ..., "id": ...,
+		"payload": {...}, "options": {...}, "caller_typename": ..., "caller_id": ..., "timer_id": ...}
+
+Every runtime checks timers each TimersPollIntervalMs, a pass is made by one runtime at a time under a KV mutex.
+Due timers are signalled from their scheduler and then deleted, a runtime crashing in between signals the timer
+again after the restart, so timers are delivered at least once.
+*/
+
+const (
+	TimerKeyPrefix = "__timers"
+)
+
+func timerKey(typename string, id string, timerID string) string {
+	return TimerKeyPrefix + "." + system.GetHashStr(typename) + "." + system.GetHashStr(id) + "." + system.GetHashStr(timerID)
+}
+
+func (ft *FunctionType) scheduleSignal(id string, timerID string, at time.Time, provider sfPlugins.SignalProvider, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) error {
+	record := easyjson.NewJSONObject()
+	record.SetByPath("at", easyjson.NewJSON(at.UnixNano()))
+	record.SetByPath("provider", easyjson.NewJSON(int(provider)))
+	record.SetByPath("typename", easyjson.NewJSON(targetTypename))
+	record.SetByPath("id", easyjson.NewJSON(targetID))
+	if payload != nil {
+		record.SetByPath("payload", *payload)
+	}
+	if options != nil {
+		record.SetByPath("options", *options)
+	}
+	record.SetByPath("caller_typename", easyjson.NewJSON(ft.name))
+	record.SetByPath("caller_id", easyjson.NewJSON(id))
+	record.SetByPath("timer_id", easyjson.NewJSON(timerID))
+	return ft.runtime.systemCache().SetValueDurable(timerKey(ft.name, id, timerID), record.ToBytes())
+}
+
+func (ft *FunctionType) cancelTimer(id string, timerID string) {
+	ft.runtime.systemCache().DeleteValue(timerKey(ft.name, id, timerID), true, -1, "")
+}
+
+func (r *Runtime) runTimersScheduler() {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("runtime-timersScheduler")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("runtime-timersScheduler")
+	for {
+		select {
+		case <-r.stopped:
+			return
+		case <-time.After(time.Duration(r.config.timersPollIntervalMs) * time.Millisecond):
+		}
+		if len(r.cacheStore.GetKeysByPattern(TimerKeyPrefix+".*.*.*")) == 0 {
+			continue
+		}
+		lockRevisionID, err := KeyMutexLock(r, TimerKeyPrefix, true)
+		if err != nil {
+			continue // Another runtime is making the pass
+		}
+		r.fireDueTimers()
+		system.MsgOnErrorReturn(KeyMutexUnlock(r, TimerKeyPrefix, lockRevisionID))
+	}
+}
+
+func (r *Runtime) fireDueTimers() {
+	now := system.GetCurrentTimeNs()
+	for _, key := range r.cacheStore.GetKeysByPattern(TimerKeyPrefix + ".*.*.*") {
+		record, err := r.cacheStore.GetValueAsJSON(key)
+		if err != nil {
+			continue
+		}
+		if int64(record.GetByPath("at").AsNumericDefault(0)) > now {
+			continue
+		}
+		callerTypename := record.GetByPath("caller_typename").AsStringDefault("")
+		callerID := record.GetByPath("caller_id").AsStringDefault("")
+		typename := record.GetByPath("typename").AsStringDefault("")
+		id := record.GetByPath("id").AsStringDefault("")
+		var payload, options *easyjson.JSON
+		if record.PathExists("payload") {
+			payload = record.GetByPath("payload").GetPtr()
+		}
+		if record.PathExists("options") {
+			options = record.GetByPath("options").GetPtr()
+		}
+		provider := sfPlugins.SignalProvider(record.GetByPath("provider").AsNumericDefault(0))
+		updatedAt := r.cacheStore.GetValueUpdateTime(key)
+
+		if err := r.signal(provider, callerTypename, callerID, typename, id, payload, options); err != nil {
+			lg.Log(lg.ErrorLevel, "Timer failed to signal, retrying", "timer", record.GetByPath("timer_id").AsStringDefault(""), "caller_typename", callerTypename, "caller_id", callerID, "typename", typename, "id", id, "error", err)
+			continue
+		}
+		if r.cacheStore.GetValueUpdateTime(key) == updatedAt { // Not rescheduled meanwhile
+			r.systemCache().DeleteValue(key, true, -1, "")
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/foliagecp/easyjson"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+/*
+Typed functions decode the payload into the handler's request type with encoding/json, validate it if the type
+implements Validator and encode the returned response as the reply:
+
+	{"status": "ok", "result": <response>}
+	{"status": "failed", "result": "<error>"} - the payload could not be decoded or validated, or the handler failed
+
+The response of a signalled typed function is dropped. TypedRequest requests a typed function and decodes its reply.
+*/
+
+// Validator is implemented by request types checking their values after decoding
+type Validator interface {
+	Validate() error
+}
+
+type TypedHandler[Req any, Resp any] func(request Req, contextProcessor *sfPlugins.StatefunContextProcessor) (Resp, error)
+
+// NewTypedFunction registers the typename with the typed handler
+func NewTypedFunction[Req any, Resp any](runtime *Runtime, name string, handler TypedHandler[Req, Resp], config FunctionTypeConfig) *FunctionType {
+	return NewFunctionType(runtime, name, TypedLogicHandler(handler), config)
+}
+
+// TypedLogicHandler wraps the typed handler into a regular one
+func TypedLogicHandler[Req any, Resp any](handler TypedHandler[Req, Resp]) FunctionLogicHandler {
+	return func(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
+		var request Req
+		response, err := func() (Resp, error) {
+			var empty Resp
+			if err := json.Unmarshal(contextProcessor.Payload.ToBytes(), &request); err != nil {
+				return empty, fmt.Errorf("error: payload does not match the request type: %s", err)
+			}
+			if validator, ok := any(&request).(Validator); ok {
+				if err := validator.Validate(); err != nil {
+					return empty, fmt.Errorf("error: invalid request: %s", err)
+				}
+			}
+			return handler(request, contextProcessor)
+		}()
+
+		if err != nil {
+			lg.Log(lg.ErrorLevel, "Typed function failed", "typename", contextProcessor.Self.Typename, "id", contextProcessor.Self.ID, "error", err)
+		}
+		if contextProcessor.Reply == nil {
+			return
+		}
+		reply := easyjson.NewJSONObject()
+		if err != nil {
+			reply.SetByPath("status", easyjson.NewJSON("failed"))
+			reply.SetByPath("result", easyjson.NewJSON(err.Error()))
+		} else if result, err := typedToJSON(response); err != nil {
+			reply.SetByPath("status", easyjson.NewJSON("failed"))
+			reply.SetByPath("result", easyjson.NewJSON(fmt.Sprintf("error: response cannot be encoded: %s", err)))
+		} else {
+			reply.SetByPath("status", easyjson.NewJSON("ok"))
+			reply.SetByPath("result", result)
+		}
+		contextProcessor.Reply.With(&reply)
+	}
+}
+
+// TypedRequest requests the typed function with the request, returns the decoded response or the function's error
+func TypedRequest[Req any, Resp any](ctx context.Context, runtime *Runtime, requestProvider sfPlugins.RequestProvider, typename string, id string, request Req, options *easyjson.JSON) (Resp, error) {
+	var response Resp
+	payload, err := typedToJSON(request)
+	if err != nil {
+		return response, err
+	}
+	reply, err := runtime.RequestCtx(ctx, requestProvider, typename, id, &payload, options)
+	if err != nil {
+		return response, err
+	}
+	if status, _ := reply.GetByPath("status").AsString(); status != "ok" {
+		return response, fmt.Errorf("error: %s:%s replied with status %q: %s", typename, id, status, reply.GetByPath("result").ToString())
+	}
+	err = json.Unmarshal(reply.GetByPath("result").ToBytes(), &response)
+	return response, err
+}
+
+func typedToJSON(value any) (easyjson.JSON, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return easyjson.NewJSONNull(), err
+	}
+	j, ok := easyjson.JSONFromBytes(data)
+	if !ok {
+		return easyjson.NewJSONNull(), fmt.Errorf("error: %T is not encoded as a JSON", value)
+	}
+	return j, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 NJWS Inc.
+
+package statefun
+
+import (
+	"fmt"
+
+	"github.com/foliagecp/easyjson"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Typename aliases let a typename be renamed without coordinating every producer: signals and requests sent through
+the runtime to an alias go to the typename the alias points to, e.g.
+
+	RuntimeConfig.SetTypenameAlias("functions.app.old", "functions.app.new")
+
+An alias may point to another alias, chains longer than maxAliasChain are treated as loops and not routed.
+Aliases set with RuntimeConfig.SetTypenameAlias are defaults of the runtime, the ones set with
+Runtime.SetTypenameAlias are kept in KV, apply to every runtime of the cluster and override the defaults until deleted.
+Aliasing happens before version routing, messages routed via an alias are counted by the "aliased_messages" metric.
+Messages published by raw NATS clients to the alias subject or already pending in its stream are not routed.
+*/
+
+const (
+	AliasKeyPrefix = "__aliases"
+
+	maxAliasChain = 8
+)
+
+func aliasKey(alias string) string {
+	return AliasKeyPrefix + "." + system.GetHashStr(alias)
+}
+
+// Routes messages sent to the alias to the typename cluster-wide, an empty typename deletes the alias
+func (r *Runtime) SetTypenameAlias(alias string, typename string) error {
+	if r.cacheStore == nil {
+		return fmt.Errorf("error: runtime is not started")
+	}
+	if len(typename) == 0 {
+		r.systemCache().DeleteValue(aliasKey(alias), true, -1, "")
+		return nil
+	}
+	if alias == typename {
+		return fmt.Errorf("error: typename %s cannot be an alias of itself", alias)
+	}
+	if _, ok := r.registeredFunctionTypes[alias]; ok {
+		return fmt.Errorf("error: registered typename %s cannot be an alias", alias)
+	}
+	record := easyjson.NewJSONObjectWithKeyValue("alias", easyjson.NewJSON(alias))
+	record.SetByPath("typename", easyjson.NewJSON(typename))
+	return r.systemCache().SetValueDurable(aliasKey(alias), record.ToBytes())
+}
+
+// Returns aliases and typenames they point to, cluster-wide ones override the runtime's defaults
+func (r *Runtime) TypenameRoutingTable() map[string]string {
+	table := map[string]string{}
+	for alias, typename := range r.config.typenameAliases {
+		table[alias] = typename
+	}
+	if r.cacheStore == nil {
+		return table
+	}
+	for _, key := range r.cacheStore.GetKeysByPattern(AliasKeyPrefix + ".*") {
+		if record, err := r.cacheStore.GetValueAsJSON(key); err == nil {
+			table[record.GetByPath("alias").AsStringDefault("")] = record.GetByPath("typename").AsStringDefault("")
+		}
+	}
+	return table
+}
+
+func (r *Runtime) aliasTarget(alias string) (string, bool) {
+	if r.cacheStore != nil && r.cacheStore.GetValueUpdateTime(aliasKey(alias)) > 0 { // Not looked up in KV on a miss
+		if record, err := r.cacheStore.GetValueAsJSON(aliasKey(alias)); err == nil {
+			if typename, ok := record.GetByPath("typename").AsString(); ok && len(typename) > 0 {
+				return typename, true
+			}
+		}
+	}
+	typename, ok := r.config.typenameAliases[alias]
+	return typename, ok
+}
+
+// Returns the typename messages sent to the typename go to
+func (r *Runtime) resolveAlias(typename string) string {
+	resolved := typename
+	for i := 0; i < maxAliasChain; i++ {
+		target, ok := r.aliasTarget(resolved)
+		if !ok {
+			if resolved != typename {
+				system.Metrics().AddGauge("aliased_messages", "Messages routed via typename aliases", map[string]string{"alias": typename, "typename": resolved}, 1)
+			}
+			return resolved
+		}
+		resolved = target
+	}
+	lg.Log(lg.ErrorLevel, "Alias is a loop or a too long chain, not routed", "typename", typename)
+	return typename
+}
@@ -3,7 +3,10 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/foliagecp/easyjson"
@@ -49,6 +52,8 @@ var (
 	KVMuticesTestDurationSec int = system.GetEnvMustProceed("KV_MUTICES_TEST_DURATION_SEC", 10)
 	// KVMuticesTestWorkers - key/value mutices workers to apply in the test
 	KVMuticesTestWorkers int = system.GetEnvMustProceed("KV_MUTICES_TEST_WORKERS", 4)
+	// RuntimeRole - function types this node serves: all, control-plane (system ones only) or worker (application ones only)
+	RuntimeRole string = system.GetEnvMustProceed("RUNTIME_ROLE", "all")
 )
 
 func MasterFunction(executor sfPlugins.StatefunExecutor, contextProcessor *sfPlugins.StatefunContextProcessor) {
@@ -180,7 +185,12 @@ func Start() {
 		return nil
 	}
 
-	if runtime, err := statefun.NewRuntime(*statefun.NewRuntimeConfigSimple(NatsURL, "basic")); err == nil {
+	role, err := statefun.ParseRuntimeRole(RuntimeRole)
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "%s, serving all function types\n", err)
+	}
+
+	if runtime, err := statefun.NewRuntime(*statefun.NewRuntimeConfigSimple(NatsURL, "basic").SetRole(role)); err == nil {
 		if KVMuticesTest {
 			KVMuticesSimpleTest(runtime, KVMuticesTestDurationSec, KVMuticesTestWorkers, 2, 1)
 		}
@@ -189,6 +199,16 @@ func Start() {
 		if TriggersTest {
 			registerTriggerFunctions(runtime)
 		}
+		go func() {
+			stop := make(chan os.Signal, 1)
+			signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+			<-stop
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := runtime.Shutdown(ctx); err != nil {
+				lg.Logf(lg.ErrorLevel, "Runtime shutdown: %s\n", err)
+			}
+		}()
 		if err := runtime.Start(cache.NewCacheConfig("main_cache"), afterStart); err != nil {
 			lg.Logf(lg.ErrorLevel, "Cannot start due to an error: %s\n", err)
 		}
@@ -31,6 +31,17 @@ statefun_setRequestReplyData(<string of JSON>) -> int(status)
 statefun_signal(<int of signal provider>, <string of typename>, <string of id>, <string with JSON payload>, <string with JSON options>) -> int(status)
 // Synchronously call a stateful function by its typename and id (string)
 statefun_request(<int of request provider>, <string of typename>, <string of id>, <string with JSON payload>, <string with JSON options>) -> string(json)|int(err status)
+// Signal stateful functions of a typename by their ids
+statefun_broadcast(<int of signal provider>, <string of typename>, <string with JSON array of ids>, <string with JSON payload>, <string with JSON options>) -> int(status)
+
+// Get a value from the cache store
+statefun_cacheGetValue(<string of key>) -> string(value)|int(err status)
+// Set a value in the cache store, and in the KV store if updateInKV is true
+statefun_cacheSetValue(<string of key>, <string of value>, <bool of updateInKV>) -> int(status)
+// Delete a value from the cache store, and from the KV store if updateInKV is true
+statefun_cacheDeleteValue(<string of key>, <bool of updateInKV>) -> int(status)
+// Get keys of the cache store matching a pattern
+statefun_cacheGetKeysByPattern(<string of key pattern>) -> string(json array)
 // Print arbitrary values
 print(v1, v2, ...)
 */